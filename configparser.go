@@ -22,6 +22,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/uniqush/goconf/conf"
 	"github.com/uniqush/log"
@@ -143,6 +144,460 @@ func LoadDatabaseConfig(cf *conf.ConfigFile) *db.DatabaseConfig {
 	return c
 }
 
+// LoadPushBackEndConfig returns a representation of the settings for sending and retrying pushes from the [Push] section of uniqush.conf
+func LoadPushBackEndConfig(cf *conf.ConfigFile) *PushBackEndConfig {
+	c := NewPushBackEndConfig()
+
+	getDuration := func(key string, defaultValue time.Duration) time.Duration {
+		value, err := cf.GetString("Push", key)
+		if err != nil || value == "" {
+			return defaultValue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return defaultValue
+		}
+		return d
+	}
+	// Without an initial backoff, retries would be sent in a busy loop which never reaches max_backoff.
+	if backoff := getDuration("init_backoff_time", c.InitBackoff); backoff > 0 {
+		c.InitBackoff = backoff
+	}
+	c.MinBackoff = getDuration("min_backoff", c.MinBackoff)
+	c.MaxBackoff = getDuration("max_backoff", c.MaxBackoff)
+	c.ResponseTimeout = getDuration("response_timeout", c.ResponseTimeout)
+	c.MaxRequestAge = getDuration("max_request_age", c.MaxRequestAge)
+	c.MaxRetryAfter = getDuration("max_retry_after", c.MaxRetryAfter)
+	c.WarmupTTL = getDuration("warmup_ttl", c.WarmupTTL)
+	c.BatchTimeLimit = getDuration("batch_time_limit", c.BatchTimeLimit)
+	if window := getDuration("concurrency_window", c.ConcurrencyWindow); window > 0 {
+		c.ConcurrencyWindow = window
+	}
+	resolutionCacheSize, err := cf.GetInt("Push", "resolution_cache_size")
+	if err == nil && resolutionCacheSize >= 0 {
+		c.ResolutionCacheSize = resolutionCacheSize
+	}
+	c.ResolutionCacheTTL = getDuration("resolution_cache_ttl", c.ResolutionCacheTTL)
+	if ttl := getDuration("receipt_ttl", c.ReceiptTTL); ttl > 0 {
+		c.ReceiptTTL = ttl
+	}
+	maxAwaitedReceipts, err := cf.GetInt("Push", "max_awaited_receipts")
+	if err == nil && maxAwaitedReceipts >= 0 {
+		c.MaxAwaitedReceipts = maxAwaitedReceipts
+	}
+	c.HookTimeout = getDuration("hook_timeout", c.HookTimeout)
+	c.ContentDedupWindow = getDuration("content_dedup_window", c.ContentDedupWindow)
+	c.ErrorLogWindow = getDuration("error_log_window", c.ErrorLogWindow)
+	c.UnsubscribeWindow = getDuration("unsubscribe_window", c.UnsubscribeWindow)
+	unsubscribeThreshold, err := cf.GetInt("Push", "unsubscribe_threshold")
+	if err == nil && unsubscribeThreshold >= 1 {
+		c.UnsubscribeThreshold = unsubscribeThreshold
+	}
+	c.BlacklistWindow = getDuration("blacklist_window", c.BlacklistWindow)
+	c.BlacklistTTL = getDuration("blacklist_ttl", c.BlacklistTTL)
+	blacklistThreshold, err := cf.GetInt("Push", "blacklist_threshold")
+	if err == nil && blacklistThreshold >= 0 {
+		c.BlacklistThreshold = blacklistThreshold
+	}
+	healthRouting, err := cf.GetString("Push", "health_routing")
+	if err == nil {
+		switch mode := strings.ToLower(healthRouting); mode {
+		case HealthRoutingOff, HealthRoutingOrder, HealthRoutingSkip:
+			c.HealthRouting = mode
+		}
+	}
+	healthMinScore, err := cf.GetFloat64("Push", "health_min_score")
+	if err == nil && healthMinScore >= 0 && healthMinScore <= 1 {
+		c.HealthMinScore = healthMinScore
+	}
+	errorRateThreshold, err := cf.GetFloat64("Push", "error_rate_threshold")
+	if err == nil && errorRateThreshold >= 0 && errorRateThreshold < 1 {
+		c.ErrorRateThreshold = errorRateThreshold
+	}
+	c.ErrorRateWindow = getDuration("error_rate_window", c.ErrorRateWindow)
+	errorRateMinPushes, err := cf.GetInt("Push", "error_rate_min_pushes")
+	if err == nil && errorRateMinPushes > 0 {
+		c.ErrorRateMinPushes = errorRateMinPushes
+	}
+	fieldLimits, err := cf.GetString("Push", "field_limits")
+	if err == nil {
+		switch mode := strings.ToLower(fieldLimits); mode {
+		case FieldLimitsOff, FieldLimitsReject, FieldLimitsTruncate, FieldLimitsDrop:
+			c.FieldLimits = mode
+		}
+	}
+	errorLogThreshold, err := cf.GetInt("Push", "error_log_threshold")
+	if err == nil && errorLogThreshold >= 0 {
+		c.ErrorLogThreshold = errorLogThreshold
+	}
+	maxRetries, err := cf.GetInt("Push", "max_retries")
+	if err == nil && maxRetries >= 0 {
+		c.MaxRetries = maxRetries
+	}
+	maxRetryHistory, err := cf.GetInt("Push", "max_retry_history")
+	if err == nil && maxRetryHistory >= 0 {
+		c.MaxRetryHistory = maxRetryHistory
+	}
+	retryCollapseKey, err := cf.GetBool("Push", "retry_collapse_key")
+	if err == nil {
+		c.RetryCollapseKey = retryCollapseKey
+	}
+	maxPendingRetries, err := cf.GetInt("Push", "max_pending_retries")
+	if err == nil && maxPendingRetries >= 0 {
+		c.MaxPendingRetries = maxPendingRetries
+	}
+	retryRate, err := cf.GetFloat64("Push", "retry_rate")
+	if err == nil && retryRate > 0 {
+		c.RetryRate = retryRate
+		c.RetryRateBurst = 1
+	}
+	retryRateBurst, err := cf.GetInt("Push", "retry_rate_burst")
+	if err == nil && retryRateBurst > 0 {
+		c.RetryRateBurst = retryRateBurst
+	}
+	retryOverflow, err := cf.GetString("Push", "retry_overflow")
+	if err == nil {
+		switch mode := strings.ToLower(retryOverflow); mode {
+		case RetryOverflowReject, RetryOverflowDropNewest, RetryOverflowDropOldest:
+			c.RetryOverflow = mode
+		}
+	}
+	maxDevicesPerSubscriber, err := cf.GetInt("Push", "max_devices_per_subscriber")
+	if err == nil && maxDevicesPerSubscriber >= 0 {
+		c.MaxDevicesPerSubscriber = maxDevicesPerSubscriber
+	}
+	maxPausedPushes, err := cf.GetInt("Push", "max_paused_pushes")
+	if err == nil && maxPausedPushes >= 0 {
+		c.MaxPausedPushes = maxPausedPushes
+	}
+	globalRate, err := cf.GetFloat64("Push", "global_rate")
+	if err == nil && globalRate > 0 {
+		c.GlobalRate = globalRate
+		c.GlobalRateBurst = int(globalRate)
+	}
+	globalRateBurst, err := cf.GetInt("Push", "global_rate_burst")
+	if err == nil && globalRateBurst > 0 {
+		c.GlobalRateBurst = globalRateBurst
+	}
+	globalRateMode, err := cf.GetString("Push", "global_rate_mode")
+	if err == nil {
+		c.GlobalRateReject = strings.ToLower(globalRateMode) == "reject"
+	}
+	maxConcurrentPushes, err := cf.GetInt("Push", "max_concurrent_pushes")
+	if err == nil && maxConcurrentPushes >= 0 {
+		c.MaxConcurrentPushes = maxConcurrentPushes
+	}
+	concurrentPushesMode, err := cf.GetString("Push", "concurrent_pushes_mode")
+	if err == nil {
+		c.ConcurrentPushesReject = strings.ToLower(concurrentPushesMode) == "reject"
+	}
+	priorityStarvationLimit, err := cf.GetInt("Push", "priority_starvation_limit")
+	if err == nil && priorityStarvationLimit >= 0 {
+		c.PriorityStarvationLimit = priorityStarvationLimit
+	}
+	memoryLimitMB, err := cf.GetInt("Push", "memory_limit_mb")
+	if err == nil && memoryLimitMB >= 0 {
+		c.MemoryLimit = uint64(memoryLimitMB) << 20
+	}
+	memoryShedPriority, err := cf.GetString("Push", "memory_shed_priority")
+	if err == nil {
+		switch priority := strings.ToLower(memoryShedPriority); priority {
+		case "high", "normal", "low":
+			c.MemoryShedPriority = priority
+		}
+	}
+	memoryPressureMaxRetries, err := cf.GetInt("Push", "memory_pressure_max_retries")
+	if err == nil && memoryPressureMaxRetries >= 0 {
+		c.MemoryPressureMaxRetries = memoryPressureMaxRetries
+	}
+	if interval := getDuration("memory_check_interval", c.MemoryCheckInterval); interval > 0 {
+		c.MemoryCheckInterval = interval
+	}
+	emptySubscribers, err := cf.GetString("Push", "empty_subscribers")
+	if err == nil {
+		c.IgnoreEmptySubscribers = strings.ToLower(emptySubscribers) == "ignore"
+	}
+	duplicateDeliveryPoints, err := cf.GetString("Push", "duplicate_delivery_points")
+	if err == nil {
+		switch mode := strings.ToLower(duplicateDeliveryPoints); mode {
+		case DuplicateDeliveryPointsPushAll, DuplicateDeliveryPointsDedup, DuplicateDeliveryPointsWarn, DuplicateDeliveryPointsHealthiest:
+			c.DuplicateDeliveryPoints = mode
+		}
+	}
+	abortFailureRate, err := cf.GetFloat64("Push", "abort_failure_rate")
+	if err == nil && abortFailureRate >= 0 && abortFailureRate < 1 {
+		c.AbortFailureRate = abortFailureRate
+	}
+	abortMinResults, err := cf.GetInt("Push", "abort_min_results")
+	if err == nil && abortMinResults > 0 {
+		c.AbortMinResults = abortMinResults
+	}
+	broadcastBatchSize, err := cf.GetInt("Push", "broadcast_batch_size")
+	if err == nil && broadcastBatchSize > 0 {
+		c.BroadcastBatchSize = broadcastBatchSize
+	}
+	deliveryPointRate, err := cf.GetFloat64("Push", "delivery_point_rate")
+	if err == nil && deliveryPointRate > 0 {
+		c.DeliveryPointRate = deliveryPointRate
+		c.DeliveryPointRateBurst = 1
+	}
+	deliveryPointRateBurst, err := cf.GetInt("Push", "delivery_point_rate_burst")
+	if err == nil && deliveryPointRateBurst > 0 {
+		c.DeliveryPointRateBurst = deliveryPointRateBurst
+	}
+	debugTiming, err := cf.GetBool("Push", "debug_timing")
+	if err == nil {
+		c.DebugTiming = debugTiming
+	}
+	retryOnPanic, err := cf.GetBool("Push", "retry_on_panic")
+	if err == nil {
+		c.RetryOnPanic = retryOnPanic
+	}
+	retryFailedUpdates, err := cf.GetBool("Push", "retry_failed_updates")
+	if err == nil {
+		c.RetryFailedUpdates = retryFailedUpdates
+	}
+	refreshResult, err := cf.GetString("Push", "refresh_result")
+	if err == nil {
+		c.RefreshReportsFailure = strings.ToLower(refreshResult) == "failure"
+	}
+	shardCount, err := cf.GetInt("Push", "shard_count")
+	if err == nil && shardCount > 1 {
+		shardIndex, err := cf.GetInt("Push", "shard_index")
+		if err == nil && shardIndex >= 0 && shardIndex < shardCount {
+			c.ShardCount = shardCount
+			c.ShardIndex = shardIndex
+		}
+	}
+	serializeSubscribers, err := cf.GetBool("Push", "serialize_subscribers")
+	if err == nil {
+		c.SerializeSubscribers = serializeSubscribers
+	}
+	sortSubscribers, err := cf.GetBool("Push", "sort_subscribers")
+	if err == nil {
+		c.SortSubscribers = sortSubscribers
+	}
+	recordRawResponses, err := cf.GetBool("Push", "record_raw_responses")
+	if err == nil {
+		c.RecordRawResponses = recordRawResponses
+	}
+	c.NotificationDefaults = loadNotificationDefaults(cf, notificationDefaultsSectionPrefix)
+	c.PushServiceTypeDefaults = loadNotificationDefaults(cf, pushServiceTypeDefaultsSectionPrefix)
+	c.RetryWindows = loadRetryWindows(cf)
+	c.PushBatching = loadPushBatching(cf)
+	c.ServiceMaxRetryAfter = loadServiceMaxRetryAfter(cf)
+	c.ProviderFailover = loadProviderFailover(cf)
+	c.PushClasses = loadPushClasses(cf)
+	serializedDeliveryPoints, err := cf.GetString("Push", "serialized_delivery_points")
+	if err == nil {
+		for _, dpName := range strings.Split(serializedDeliveryPoints, ",") {
+			if dpName = strings.TrimSpace(dpName); dpName != "" {
+				if c.SerializedDeliveryPoints == nil {
+					c.SerializedDeliveryPoints = make(map[string]bool)
+				}
+				c.SerializedDeliveryPoints[dpName] = true
+			}
+		}
+	}
+	loopbackServices, err := cf.GetString("Push", "loopback_services")
+	if err == nil {
+		for _, service := range strings.Split(loopbackServices, ",") {
+			if service = strings.ToLower(strings.TrimSpace(service)); service != "" {
+				if c.LoopbackServices == nil {
+					c.LoopbackServices = make(map[string]bool)
+				}
+				c.LoopbackServices[service] = true
+			}
+		}
+	}
+
+	return c
+}
+
+// loadNotificationDefaults returns the default notification fields from each section named with prefix, e.g. [defaults:<service>] or [typedefaults:<pushservicetype>], or nil if there are none.
+// The config file parser lowercases section and option names, so the names after prefix are matched case-insensitively.
+func loadNotificationDefaults(cf *conf.ConfigFile, prefix string) map[string]map[string]string {
+	var result map[string]map[string]string
+	// The options of the default section are included in every section, so they are skipped.
+	inherited := make(map[string]bool)
+	if options, err := cf.GetOptions(conf.DefaultSection); err == nil {
+		for _, option := range options {
+			inherited[option] = true
+		}
+	}
+	for _, section := range cf.GetSections() {
+		if !strings.HasPrefix(section, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(section, prefix)
+		options, err := cf.GetOptions(section)
+		if err != nil || name == "" {
+			continue
+		}
+		fields := make(map[string]string)
+		for _, option := range options {
+			if inherited[option] {
+				continue
+			}
+			if value, err := cf.GetString(section, option); err == nil {
+				fields[option] = value
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]map[string]string)
+		}
+		result[name] = fields
+	}
+	return result
+}
+
+// loadRetryWindows returns the retry window of each service with a [retrywindow:<service>] section containing a valid start and end, or nil if there are none.
+func loadRetryWindows(cf *conf.ConfigFile) map[string]RetryWindow {
+	var result map[string]RetryWindow
+	for _, section := range cf.GetSections() {
+		if !strings.HasPrefix(section, retryWindowSectionPrefix) {
+			continue
+		}
+		service := strings.TrimPrefix(section, retryWindowSectionPrefix)
+		start, err := cf.GetString(section, "start")
+		if err != nil || service == "" {
+			continue
+		}
+		end, err := cf.GetString(section, "end")
+		if err != nil {
+			continue
+		}
+		window, err := parseRetryWindow(start, end)
+		if err != nil {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]RetryWindow)
+		}
+		result[service] = window
+	}
+	return result
+}
+
+// loadPushBatching returns the batching of the pushes of each service with a [batching:<service>] section containing a positive window, or nil if there are none.
+func loadPushBatching(cf *conf.ConfigFile) map[string]PushBatching {
+	var result map[string]PushBatching
+	for _, section := range cf.GetSections() {
+		if !strings.HasPrefix(section, pushBatchingSectionPrefix) {
+			continue
+		}
+		service := strings.TrimPrefix(section, pushBatchingSectionPrefix)
+		value, err := cf.GetString(section, "window")
+		if err != nil || service == "" {
+			continue
+		}
+		window, err := time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			continue
+		}
+		batching := PushBatching{Window: window}
+		if maxSize, err := cf.GetInt(section, "max_size"); err == nil && maxSize > 0 {
+			batching.MaxSize = maxSize
+		}
+		if result == nil {
+			result = make(map[string]PushBatching)
+		}
+		result[service] = batching
+	}
+	return result
+}
+
+// loadServiceMaxRetryAfter returns the max_retry_after of each service with a [retryafter:<service>] section, or nil if there are none.
+func loadServiceMaxRetryAfter(cf *conf.ConfigFile) map[string]time.Duration {
+	var result map[string]time.Duration
+	for _, section := range cf.GetSections() {
+		if !strings.HasPrefix(section, retryAfterSectionPrefix) {
+			continue
+		}
+		service := strings.TrimPrefix(section, retryAfterSectionPrefix)
+		value, err := cf.GetString(section, "max")
+		if err != nil || service == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]time.Duration)
+		}
+		result[service] = d
+	}
+	return result
+}
+
+// loadProviderFailover returns the push service providers of each service with a [failover:<service>] section, or nil if there are none.
+func loadProviderFailover(cf *conf.ConfigFile) map[string][]string {
+	var result map[string][]string
+	for _, section := range cf.GetSections() {
+		if !strings.HasPrefix(section, providerFailoverSectionPrefix) {
+			continue
+		}
+		service := strings.TrimPrefix(section, providerFailoverSectionPrefix)
+		value, err := cf.GetString(section, "providers")
+		if err != nil || service == "" {
+			continue
+		}
+		var providers []string
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				providers = append(providers, name)
+			}
+		}
+		if len(providers) < 2 {
+			continue
+		}
+		if result == nil {
+			result = make(map[string][]string)
+		}
+		result[service] = providers
+	}
+	return result
+}
+
+// loadPushClasses returns the policy of each class of pushes with a [class:<name>] section, or nil if there are none.
+// Class names are case-insensitive, since the config file parser lowercases section names.
+func loadPushClasses(cf *conf.ConfigFile) map[string]*PushClass {
+	var result map[string]*PushClass
+	for _, section := range cf.GetSections() {
+		if !strings.HasPrefix(section, pushClassSectionPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(section, pushClassSectionPrefix)
+		if name == "" {
+			continue
+		}
+		class := &PushClass{RateBurst: 1, LogLevel: log.LOGLEVEL_DEBUG}
+		if rate, err := cf.GetFloat64(section, "rate"); err == nil && rate > 0 {
+			class.Rate = rate
+		}
+		if burst, err := cf.GetInt(section, "rate_burst"); err == nil && burst > 0 {
+			class.RateBurst = burst
+		}
+		if maxRetries, err := cf.GetInt(section, "max_retries"); err == nil && maxRetries > 0 {
+			class.MaxRetries = maxRetries
+		}
+		if loglevel, err := cf.GetString(section, "loglevel"); err == nil {
+			if level, warningMsg := extractLogLevel(loglevel); warningMsg == "" {
+				class.LogLevel = level
+			}
+		}
+		if result == nil {
+			result = make(map[string]*PushClass)
+		}
+		result[name] = class
+	}
+	return result
+}
+
 const (
 	defaultConfigFilePath = "/etc/uniqush/uniqush.conf"
 )
@@ -213,6 +668,33 @@ func LoadRestAddr(c *conf.ConfigFile) (string, error) {
 	return addr, err
 }
 
+// LoadMetrics returns the metrics backend from the [Metrics] section of uniqush.conf, or NullMetrics if none is configured.
+func LoadMetrics(c *conf.ConfigFile) (Metrics, error) {
+	backend, err := c.GetString("Metrics", "backend")
+	if err != nil {
+		return NullMetrics{}, nil
+	}
+	switch strings.ToLower(backend) {
+	case "", "none":
+		return NullMetrics{}, nil
+	case "statsd":
+		addr, err := c.GetString("Metrics", "statsd_addr")
+		if err != nil || addr == "" {
+			addr = "localhost:8125"
+		}
+		prefix, _ := c.GetString("Metrics", "statsd_prefix")
+		metrics, err := NewStatsdMetrics(addr, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return metrics, nil
+	case "prometheus":
+		return NewPrometheusMetrics(nil), nil
+	default:
+		return nil, fmt.Errorf("unknown metrics backend %q: expected none, statsd, or prometheus", backend)
+	}
+}
+
 // Run will load the configuration and start the uniqush-push server and REST API based on that config.
 func Run(conf, version string) error {
 	c, err := OpenConfig(conf)
@@ -221,10 +703,15 @@ func Run(conf, version string) error {
 	}
 	loggers := LoadLoggers(c)
 	dbconf := LoadDatabaseConfig(c)
+	backendConf := LoadPushBackEndConfig(c)
 	addr, err := LoadRestAddr(c)
 	if err != nil {
 		return err
 	}
+	metrics, err := LoadMetrics(c)
+	if err != nil {
+		return err
+	}
 	psm := push.GetPushServiceManager()
 	psm.SetConfigFile(c)
 
@@ -233,7 +720,8 @@ func Run(conf, version string) error {
 		return err
 	}
 
-	backend := NewPushBackEnd(psm, db, loggers)
+	backend := NewPushBackEnd(psm, db, loggers, backendConf)
+	backend.SetMetrics(metrics)
 	rest := NewRestAPI(psm, loggers, version, backend)
 	stopChan := make(chan bool)
 	go rest.signalSetup()
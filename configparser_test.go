@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/db"
@@ -58,3 +59,183 @@ func TestExtractLogLevel(t *testing.T) {
 	testutil.ExpectStringEquals(t, `Unsupported loglevel "blue". Supported values: alert, error, warn/warning, standard/verbose/info, and debug`, warningMsg, "expected a warning message")
 	testutil.ExpectEquals(t, log.LOGLEVEL_INFO, level, "expected INFO level fallback")
 }
+
+func TestLoadPushBackEndConfig(t *testing.T) {
+	c, err := OpenConfig("conf/uniqush-push.conf")
+	if err != nil {
+		t.Fatalf("Unexpected error loading example config: %v", err)
+	}
+	testutil.ExpectEquals(t, *NewPushBackEndConfig(), *LoadPushBackEndConfig(c), "expected defaults when the [Push] settings are commented out")
+
+	c.AddOption("Push", "init_backoff_time", "2s")
+	c.AddOption("Push", "min_backoff", "3s")
+	c.AddOption("Push", "max_backoff", "invalid")
+	backendConf := LoadPushBackEndConfig(c)
+	testutil.ExpectEquals(t, 2*time.Second, backendConf.InitBackoff, "unexpected init_backoff_time")
+	testutil.ExpectEquals(t, 3*time.Second, backendConf.MinBackoff, "unexpected min_backoff")
+	testutil.ExpectEquals(t, 1*time.Minute, backendConf.MaxBackoff, "expected default for invalid max_backoff")
+	testutil.ExpectEquals(t, 3*time.Second, backendConf.retryBackoff(0), "expected min_backoff to be a floor for the first retry")
+	testutil.ExpectEquals(t, 6*time.Second, backendConf.retryBackoff(6*time.Second), "expected retry delays above min_backoff to be unchanged")
+
+	c.AddOption("Push", "init_backoff_time", "0s")
+	testutil.ExpectEquals(t, 5*time.Second, LoadPushBackEndConfig(c).InitBackoff, "expected the default for a zero init_backoff_time")
+	c.AddOption("Push", "init_backoff_time", "500ms")
+	c.AddOption("Push", "min_backoff", "0s")
+	backendConf = LoadPushBackEndConfig(c)
+	testutil.ExpectEquals(t, 500*time.Millisecond, backendConf.InitBackoff, "unexpected init_backoff_time")
+	testutil.ExpectEquals(t, 1*time.Second, backendConf.retryBackoff(1*time.Second), "expected the backoff to keep growing past 1s")
+}
+
+func TestShortInitBackoff(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = 500 * time.Millisecond
+	config.MaxBackoff = 2 * time.Second
+	backend, _, _ := newTestPushBackEnd(config)
+	first := time.Unix(1000, 0)
+	schedule := backend.retrySchedule(push.NewEmptyNotification(), "myservice", first, config.retryBackoff(0), 0, 0, first)
+	// The delays of the later retries are 1s and 2s, after which the next backoff would exceed max_backoff.
+	testutil.ExpectEquals(t, 3, len(schedule), "expected the retries to stop at max_backoff")
+}
+
+func TestLoadNotificationDefaults(t *testing.T) {
+	c, err := OpenConfig("conf/uniqush-push.conf")
+	if err != nil {
+		t.Fatalf("Unexpected error loading example config: %v", err)
+	}
+	c.AddSection("defaults:MyService")
+	c.AddOption("defaults:MyService", "sound", "chime")
+	c.AddSection("defaults:emptyservice")
+	backendConf := LoadPushBackEndConfig(c)
+	testutil.ExpectEquals(t, map[string]map[string]string{"myservice": {"sound": "chime"}}, backendConf.NotificationDefaults, "unexpected notification defaults")
+
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	merged := backendConf.applyNotificationDefaults("MyService", notif)
+	testutil.ExpectEquals(t, map[string]string{"msg": "hello", "sound": "chime"}, merged.Data, "expected the default sound to be added")
+	testutil.ExpectEquals(t, map[string]string{"msg": "hello"}, notif.Data, "expected the original notification to be unchanged")
+
+	notif.Data["sound"] = "bell"
+	merged = backendConf.applyNotificationDefaults("myservice", notif)
+	testutil.ExpectEquals(t, "bell", merged.Data["sound"], "expected the push to override the default")
+}
+
+func TestLoadPushServiceTypeDefaults(t *testing.T) {
+	c, err := OpenConfig("conf/uniqush-push.conf")
+	if err != nil {
+		t.Fatalf("Unexpected error loading example config: %v", err)
+	}
+	c.AddSection("defaults:myservice")
+	c.AddOption("defaults:myservice", "sound", "chime")
+	c.AddSection("typedefaults:APNS")
+	c.AddOption("typedefaults:APNS", "sound", "default")
+	c.AddOption("typedefaults:APNS", "badge", "1")
+	backendConf := LoadPushBackEndConfig(c)
+	testutil.ExpectEquals(t, map[string]map[string]string{"apns": {"sound": "default", "badge": "1"}}, backendConf.PushServiceTypeDefaults, "unexpected push service type defaults")
+
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	merged := backendConf.applyPushServiceTypeDefaults("apns", backendConf.applyNotificationDefaults("myservice", notif))
+	testutil.ExpectEquals(t, map[string]string{"msg": "hello", "sound": "chime", "badge": "1"}, merged.Data, "expected the defaults of the service to override the defaults of the push service type")
+	testutil.ExpectEquals(t, notif, backendConf.applyPushServiceTypeDefaults("fcm", notif), "expected no defaults for other push service types")
+}
+
+func TestLoadRetryWindows(t *testing.T) {
+	c, err := OpenConfig("conf/uniqush-push.conf")
+	if err != nil {
+		t.Fatalf("Unexpected error loading example config: %v", err)
+	}
+	c.AddSection("retrywindow:MyService")
+	c.AddOption("retrywindow:MyService", "start", "22:00")
+	c.AddOption("retrywindow:MyService", "end", "06:30")
+	c.AddSection("retrywindow:invalid")
+	c.AddOption("retrywindow:invalid", "start", "25:00")
+	c.AddOption("retrywindow:invalid", "end", "06:00")
+	backendConf := LoadPushBackEndConfig(c)
+	testutil.ExpectEquals(t, map[string]RetryWindow{"myservice": {Start: 22 * time.Hour, End: 6*time.Hour + 30*time.Minute}}, backendConf.RetryWindows, "unexpected retry windows")
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+	testutil.ExpectEquals(t, 10*time.Hour, backendConf.retryDelay("myservice", time.Hour, now), "expected the retry to wait for the window at 22:00")
+	testutil.ExpectEquals(t, 10*time.Hour, backendConf.retryDelay("myservice", 10*time.Hour, now), "expected a retry at the start of the window to be unchanged")
+	testutil.ExpectEquals(t, 17*time.Hour, backendConf.retryDelay("myservice", 17*time.Hour, now), "expected a retry within the window after midnight to be unchanged")
+	testutil.ExpectEquals(t, 34*time.Hour, backendConf.retryDelay("myservice", 19*time.Hour, now), "expected a retry after the window to wait for the next day's window")
+	testutil.ExpectEquals(t, time.Hour, backendConf.retryDelay("otherservice", time.Hour, now), "expected services without a window to be unaffected")
+}
+
+func TestLoadPushBatching(t *testing.T) {
+	c, err := OpenConfig("conf/uniqush-push.conf")
+	if err != nil {
+		t.Fatalf("Unexpected error loading example config: %v", err)
+	}
+	c.AddSection("batching:MyService")
+	c.AddOption("batching:MyService", "window", "5ms")
+	c.AddOption("batching:MyService", "max_size", "100")
+	c.AddSection("batching:nowindow")
+	c.AddOption("batching:nowindow", "max_size", "100")
+	backendConf := LoadPushBackEndConfig(c)
+	testutil.ExpectEquals(t, map[string]PushBatching{"myservice": {Window: 5 * time.Millisecond, MaxSize: 100}}, backendConf.PushBatching, "unexpected push batching")
+}
+
+func TestLoadMaxRetryAfter(t *testing.T) {
+	c, err := OpenConfig("conf/uniqush-push.conf")
+	if err != nil {
+		t.Fatalf("Unexpected error loading example config: %v", err)
+	}
+	c.AddOption("Push", "max_retry_after", "5m")
+	c.AddSection("retryafter:MyService")
+	c.AddOption("retryafter:MyService", "max", "1h")
+	backendConf := LoadPushBackEndConfig(c)
+	testutil.ExpectEquals(t, 5*time.Minute, backendConf.MaxRetryAfter, "unexpected max_retry_after")
+	testutil.ExpectEquals(t, map[string]time.Duration{"myservice": time.Hour}, backendConf.ServiceMaxRetryAfter, "unexpected max_retry_after of services")
+
+	delay, clamped := backendConf.retryAfter("otherservice", time.Second, 24*time.Hour)
+	testutil.ExpectEquals(t, 5*time.Minute, delay, "expected the requested delay to be clamped")
+	testutil.ExpectEquals(t, true, clamped, "expected the requested delay to be reported as clamped")
+	delay, clamped = backendConf.retryAfter("MyService", time.Second, 30*time.Minute)
+	testutil.ExpectEquals(t, 30*time.Minute, delay, "expected the requested delay to be honored within the service's max")
+	testutil.ExpectEquals(t, false, clamped, "expected the requested delay not to be clamped")
+	delay, _ = backendConf.retryAfter("otherservice", time.Minute, time.Second)
+	testutil.ExpectEquals(t, time.Minute, delay, "expected the backoff to be used when it is longer")
+
+	// With max_retry_after shorter than init_backoff_time, a clamped delay must not undercut the backoff or min_backoff.
+	c.AddOption("Push", "max_retry_after", "2s")
+	c.AddOption("Push", "init_backoff_time", "5s")
+	c.AddOption("Push", "min_backoff", "3s")
+	backendConf = LoadPushBackEndConfig(c)
+	delay, clamped = backendConf.retryAfter("otherservice", backendConf.retryBackoff(0), time.Hour)
+	testutil.ExpectEquals(t, 5*time.Second, delay, "expected the backoff to be used when max_retry_after is shorter")
+	testutil.ExpectEquals(t, true, clamped, "expected the requested delay to be reported as clamped")
+	backendConf.MinBackoff = 10 * time.Second
+	delay, _ = backendConf.retryAfter("otherservice", 5*time.Second, time.Hour)
+	testutil.ExpectEquals(t, 10*time.Second, delay, "expected min_backoff to be a floor")
+}
+
+func TestLoadProviderFailover(t *testing.T) {
+	c, err := OpenConfig("conf/uniqush-push.conf")
+	if err != nil {
+		t.Fatalf("Unexpected error loading example config: %v", err)
+	}
+	c.AddSection("failover:MyService")
+	c.AddOption("failover:MyService", "providers", "apns:primary, apns:backup")
+	c.AddSection("failover:otherservice")
+	c.AddOption("failover:otherservice", "providers", "apns:only")
+	backendConf := LoadPushBackEndConfig(c)
+	expected := map[string][]string{"myservice": {"apns:primary", "apns:backup"}}
+	testutil.ExpectEquals(t, expected, backendConf.ProviderFailover, "expected only services with providers to fail over between")
+}
+
+func TestLoadPushClasses(t *testing.T) {
+	c, err := OpenConfig("conf/uniqush-push.conf")
+	if err != nil {
+		t.Fatalf("Unexpected error loading example config: %v", err)
+	}
+	c.AddSection("class:Marketing")
+	c.AddOption("class:Marketing", "rate", "2.5")
+	c.AddOption("class:Marketing", "max_retries", "1")
+	c.AddOption("class:Marketing", "loglevel", "warn")
+	c.AddSection("class:transactional")
+	backendConf := LoadPushBackEndConfig(c)
+	testutil.ExpectEquals(t, map[string]*PushClass{
+		"marketing":     {Rate: 2.5, RateBurst: 1, MaxRetries: 1, LogLevel: log.LOGLEVEL_WARN},
+		"transactional": {RateBurst: 1, LogLevel: log.LOGLEVEL_DEBUG},
+	}, backendConf.PushClasses, "unexpected push classes")
+}
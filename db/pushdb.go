@@ -89,6 +89,10 @@ type PushDatabase interface {
 
 	GetSubscriptions(services []string, user string, logger log.Logger) ([]map[string]string, error)
 
+	// GetSubscribers returns a page of about count subscribers of service, starting at cursor (0 for the first page), so that every subscriber doesn't have to be loaded at once.
+	// next is 0 after the last page. A subscriber may be returned in more than one page.
+	GetSubscribers(service string, cursor uint64, count int) (subscribers []string, next uint64, err error)
+
 	FlushCache() error
 }
 
@@ -419,6 +423,16 @@ func (f *pushDatabaseOpts) GetSubscriptions(services []string, user string, logg
 	return subs, nil
 }
 
+func (f *pushDatabaseOpts) GetSubscribers(service string, cursor uint64, count int) ([]string, uint64, error) {
+	f.dblock.RLock()
+	defer f.dblock.RUnlock()
+	subs, next, err := f.db.GetSubscribersByService(service, cursor, int64(count))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Could not list subscribers for service %s: %v", service, err)
+	}
+	return subs, next, nil
+}
+
 func (f *pushDatabaseOpts) RebuildServiceSet() error {
 	f.dblock.Lock()
 	defer f.dblock.Unlock()
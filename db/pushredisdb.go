@@ -50,6 +50,7 @@ type redisClient interface {
 	SRem(key string, members ...interface{}) *redis.IntCmd
 	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
 	SMembers(key string) *redis.StringSliceCmd
+	Scan(cursor uint64, match string, count int64) *redis.ScanCmd
 }
 
 type redisMultiClient struct {
@@ -109,6 +110,10 @@ func (mc *redisMultiClient) SMembers(key string) *redis.StringSliceCmd {
 	return mc.slaveClient.SMembers(key)
 }
 
+func (mc *redisMultiClient) Scan(cursor uint64, match string, count int64) *redis.ScanCmd {
+	return mc.slaveClient.Scan(cursor, match, count)
+}
+
 var _ redisClient = &redis.Client{}
 var _ pushRawDatabase = &PushRedisDB{}
 
@@ -480,6 +485,21 @@ func (r *PushRedisDB) RemovePushServiceProviderOfServiceDeliveryPoint(srv, dp st
 }
 
 // GetPushServiceProvidersByService will return a list of the names of push service providers belonging to the given service name
+// GetSubscribersByService returns a page of about count subscribers of srv, starting at cursor (0 for the first page), using SCAN so that large services don't block redis.
+// next is 0 after the last page. As with SCAN, a subscriber may be returned in more than one page.
+func (r *PushRedisDB) GetSubscribersByService(srv string, cursor uint64, count int64) (subs []string, next uint64, err error) {
+	prefix := ServiceSubscriberToDeliveryPointsPrefix + srv + ":"
+	keys, next, err := r.client.Scan(cursor, prefix+"*", count).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("GetSubscribersByService scan failed for %q: %v", srv, err)
+	}
+	subs = make([]string, 0, len(keys))
+	for _, k := range keys {
+		subs = append(subs, strings.TrimPrefix(k, prefix))
+	}
+	return subs, next, nil
+}
+
 func (r *PushRedisDB) GetPushServiceProvidersByService(srv string) ([]string, error) {
 	m, err := r.client.SMembers(ServiceToPushServiceProvidersPrefix + srv).Result()
 	if err != nil {
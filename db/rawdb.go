@@ -77,6 +77,7 @@ type pushRawDatabaseReader interface { // nolint: megacheck
 	GetPushServiceProviderNameByServiceDeliveryPoint(srv, dp string) (string, error)
 
 	GetPushServiceProvidersByService(srv string) ([]string, error)
+	GetSubscribersByService(srv string, cursor uint64, count int64) ([]string, uint64, error)
 }
 
 type pushRawDatabase interface {
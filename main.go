@@ -35,6 +35,7 @@ func installPushServices() {
 	srv.InstallFCM()
 	srv.InstallAPNS()
 	srv.InstallADM()
+	srv.InstallLoopback()
 }
 
 func main() {
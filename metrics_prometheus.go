@@ -0,0 +1,178 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultPrometheusBuckets are the upper bounds (in seconds) of the buckets of the histograms of PrometheusMetrics.
+// They go up to several minutes, since the latency of a push includes the backoffs of its retries.
+var DefaultPrometheusBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// PrometheusMetrics keeps measurements in memory, and serves them in the Prometheus text format to be scraped (at /metrics, see MetricsURL).
+// This implements the format directly, so that uniqush-push doesn't depend on the Prometheus client library.
+type PrometheusMetrics struct {
+	lock     sync.Mutex
+	buckets  []float64
+	families map[string]*prometheusFamily
+}
+
+var _ Metrics = &PrometheusMetrics{}
+var _ http.Handler = &PrometheusMetrics{}
+
+// prometheusFamily contains the series of a metric, by their formatted labels.
+type prometheusFamily struct {
+	histogram bool
+	series    map[string]*prometheusSeries
+}
+
+type prometheusSeries struct {
+	// value is the value of a counter.
+	value float64
+	// counts are the number of observations of a histogram in each bucket (not cumulative), with one more for observations above the last bucket.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheusMetrics returns Metrics for Prometheus, with histograms using buckets (DefaultPrometheusBuckets if buckets is empty), which must be sorted.
+func NewPrometheusMetrics(buckets []float64) *PrometheusMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultPrometheusBuckets
+	}
+	return &PrometheusMetrics{
+		buckets:  buckets,
+		families: make(map[string]*prometheusFamily),
+	}
+}
+
+// getSeries returns the series of name with labels, creating it if needed. This must be called with the lock held.
+func (m *PrometheusMetrics) getSeries(name string, histogram bool, labels map[string]string) *prometheusSeries {
+	family, ok := m.families[name]
+	if !ok {
+		family = &prometheusFamily{histogram: histogram, series: make(map[string]*prometheusSeries)}
+		m.families[name] = family
+	}
+	key := formatPrometheusLabels(labels)
+	series, ok := family.series[key]
+	if !ok {
+		series = new(prometheusSeries)
+		if histogram {
+			series.counts = make([]uint64, len(m.buckets)+1)
+		}
+		family.series[key] = series
+	}
+	return series
+}
+
+// IncCounter adds 1 to a counter.
+func (m *PrometheusMetrics) IncCounter(name string, labels map[string]string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.getSeries(name, false, labels).value++
+}
+
+// ObserveHistogram adds an observation to a histogram.
+func (m *PrometheusMetrics) ObserveHistogram(name string, value float64, labels map[string]string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	series := m.getSeries(name, true, labels)
+	series.counts[sort.SearchFloat64s(m.buckets, value)]++
+	series.sum += value
+	series.count++
+}
+
+// ServeHTTP responds with every measurement in the Prometheus text format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(m.format())
+}
+
+// format returns every measurement in the Prometheus text format, sorted so that the output is stable.
+func (m *PrometheusMetrics) format() []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		family := m.families[name]
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if !family.histogram {
+			fmt.Fprintf(&buf, "# TYPE %s counter\n", name)
+			for _, labels := range keys {
+				fmt.Fprintf(&buf, "%s%s %s\n", name, labels, formatMetricValue(family.series[labels].value))
+			}
+			continue
+		}
+		fmt.Fprintf(&buf, "# TYPE %s histogram\n", name)
+		for _, labels := range keys {
+			series := family.series[labels]
+			var cumulative uint64
+			for i, bound := range m.buckets {
+				cumulative += series.counts[i]
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, withPrometheusLabel(labels, "le", formatMetricValue(bound)), cumulative)
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", name, withPrometheusLabel(labels, "le", "+Inf"), series.count)
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", name, labels, formatMetricValue(series.sum))
+			fmt.Fprintf(&buf, "%s_count%s %d\n", name, labels, series.count)
+		}
+	}
+	return buf.Bytes()
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatPrometheusLabels returns the labels as they are written after the name of a series (e.g. `{code="UNIQUSH_SUCCESS",service="myservice"}`), or "" if there are none.
+func formatPrometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + `="` + prometheusLabelEscaper.Replace(labels[k]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// withPrometheusLabel adds a label to labels formatted by formatPrometheusLabels (e.g. the "le" label of a bucket).
+func withPrometheusLabel(labels string, key string, value string) string {
+	label := key + `="` + value + `"`
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// StatsdMetrics sends measurements to a statsd server over UDP, with labels as tags (the format of DogStatsD, Telegraf, and statsd_exporter).
+// For example, a counter is sent as "uniqush_push_results_total:1|c|#code:UNIQUSH_SUCCESS,service:myservice", and a histogram observation uses the "h" type.
+// Measurements which can't be sent are dropped, since statsd is a best-effort protocol.
+type StatsdMetrics struct {
+	conn   net.Conn
+	prefix string
+}
+
+var _ Metrics = &StatsdMetrics{}
+
+// NewStatsdMetrics returns Metrics which sends measurements to the statsd server at addr (e.g. "localhost:8125"), with prefix (e.g. "uniqush.") added to each name.
+func NewStatsdMetrics(addr string, prefix string) (*StatsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdMetrics{conn: conn, prefix: prefix}, nil
+}
+
+// IncCounter sends a counter increment.
+func (m *StatsdMetrics) IncCounter(name string, labels map[string]string) {
+	m.send(name, "1", "c", labels)
+}
+
+// ObserveHistogram sends a histogram observation.
+func (m *StatsdMetrics) ObserveHistogram(name string, value float64, labels map[string]string) {
+	m.send(name, formatMetricValue(value), "h", labels)
+}
+
+// Close closes the connection to the statsd server.
+func (m *StatsdMetrics) Close() error {
+	return m.conn.Close()
+}
+
+func (m *StatsdMetrics) send(name string, value string, metricType string, labels map[string]string) {
+	// Errors are ignored: the server may be down, and UDP can't tell whether it received anything anyway.
+	m.conn.Write(formatStatsdLine(m.prefix+name, value, metricType, labels))
+}
+
+// formatStatsdLine returns the statsd line for one measurement, with the labels sorted so that each series has a single name.
+func formatStatsdLine(name string, value string, metricType string, labels map[string]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteByte(':')
+	buf.WriteString(value)
+	buf.WriteByte('|')
+	buf.WriteString(metricType)
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			buf.WriteString("|#")
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(k)
+		buf.WriteByte(':')
+		buf.WriteString(labels[k])
+	}
+	return buf.Bytes()
+}
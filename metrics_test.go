@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestStatsdMetrics(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer server.Close()
+	metrics, err := NewStatsdMetrics(server.LocalAddr().String(), "uniqush.")
+	if err != nil {
+		t.Fatalf("Failed to create the statsd client: %v", err)
+	}
+	defer metrics.Close()
+
+	metrics.IncCounter(MetricPushResults, map[string]string{"service": "myservice", "code": UNIQUSH_SUCCESS})
+	metrics.ObserveHistogram(MetricPushLatency, 0.25, nil)
+	buf := make([]byte, 1024)
+	var lines []string
+	for i := 0; i < 2; i++ {
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Failed to read a measurement: %v", err)
+		}
+		lines = append(lines, string(buf[:n]))
+	}
+	expected := []string{
+		"uniqush.uniqush_push_results_total:1|c|#code:UNIQUSH_SUCCESS,service:myservice",
+		"uniqush.uniqush_push_latency_seconds:0.25|h",
+	}
+	testutil.ExpectEquals(t, expected, lines, "unexpected statsd lines")
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics([]float64{0.1, 1})
+	labels := map[string]string{"service": "my\"service"}
+	metrics.ObserveHistogram(MetricPushLatency, 0.05, labels)
+	metrics.ObserveHistogram(MetricPushLatency, 0.5, labels)
+	metrics.ObserveHistogram(MetricPushLatency, 5, labels)
+	metrics.IncCounter(MetricRetries, nil)
+
+	expected := strings.Join([]string{
+		`# TYPE uniqush_push_latency_seconds histogram`,
+		`uniqush_push_latency_seconds_bucket{service="my\"service",le="0.1"} 1`,
+		`uniqush_push_latency_seconds_bucket{service="my\"service",le="1"} 2`,
+		`uniqush_push_latency_seconds_bucket{service="my\"service",le="+Inf"} 3`,
+		`uniqush_push_latency_seconds_sum{service="my\"service"} 5.55`,
+		`uniqush_push_latency_seconds_count{service="my\"service"} 3`,
+		`# TYPE uniqush_retries_total counter`,
+		`uniqush_retries_total 1`,
+		``,
+	}, "\n")
+	testutil.ExpectEquals(t, expected, string(metrics.format()), "unexpected prometheus output")
+}
@@ -19,6 +19,7 @@ package push
 
 import (
 	"fmt"
+	"net"
 	"time"
 )
 
@@ -43,6 +44,7 @@ var _ Error = &BadPushServiceProvider{}
 var _ Error = &UnsubscribeUpdate{}
 var _ Error = &InvalidRegistrationUpdate{}
 var _ Error = &ConnectionError{}
+var _ Error = &PanicError{}
 
 // InfoReport is not an actual error.
 // But it is worthy to be reported to the user.
@@ -95,6 +97,38 @@ type RetryError struct {
 	Destination *DeliveryPoint
 	Content     *Notification
 	Reason      error
+	// Category is why the push is retried (e.g. RetryCategoryTimeout), if the push service type knows. See ReasonCategory.
+	Category string
+}
+
+// These are the categories of the reasons for retrying a push.
+const (
+	// RetryCategoryProvider is an error reported by the push service itself (e.g. a 5xx status, or "Unavailable").
+	RetryCategoryProvider = "provider"
+	// RetryCategoryRateLimited is the push service asking to slow down (e.g. a 429 status).
+	RetryCategoryRateLimited = "rate_limited"
+	// RetryCategoryAuth is an expired credential, which is refreshed before retrying.
+	RetryCategoryAuth = "auth"
+	// RetryCategoryTimeout is a request to the push service which timed out.
+	RetryCategoryTimeout = "timeout"
+	// RetryCategoryConnection is any other network error (e.g. a connection reset, or a failed DNS lookup).
+	RetryCategoryConnection = "connection"
+	// RetryCategoryUnknown is used when the reason can't be categorized.
+	RetryCategoryUnknown = "unknown"
+)
+
+// ReasonCategory returns Category if it is set. Otherwise, it categorizes Reason as a timeout or a connection error, or returns RetryCategoryUnknown.
+func (e *RetryError) ReasonCategory() string {
+	if e.Category != "" {
+		return e.Category
+	}
+	if reason, ok := e.Reason.(net.Error); ok {
+		if reason.Timeout() {
+			return RetryCategoryTimeout
+		}
+		return RetryCategoryConnection
+	}
+	return RetryCategoryUnknown
 }
 
 func (e *RetryError) Error() string {
@@ -125,6 +159,13 @@ func NewRetryError(psp *PushServiceProvider, dp *DeliveryPoint, notif *Notificat
 	}
 }
 
+// NewRetryErrorWithCategory builds a RetryError with no associated reason, for a known category of reason (e.g. RetryCategoryProvider).
+func NewRetryErrorWithCategory(psp *PushServiceProvider, dp *DeliveryPoint, notif *Notification, after time.Duration, category string) *RetryError {
+	err := NewRetryError(psp, dp, notif, after)
+	err.Category = category
+	return err
+}
+
 /*********************/
 
 // PushServiceProviderUpdate is an error object indicating that the push service provider's VolatileData was updated. (E.g. triggered by Update-Client-Auth for GCM/FCM)
@@ -296,3 +337,21 @@ func (e *ConnectionError) Error() string {
 func NewConnectionError(err error) *ConnectionError {
 	return &ConnectionError{Err: err}
 }
+
+/*********************/
+
+// PanicError indicates that a push service type panicked while pushing, so that a bug in one push service type doesn't crash uniqush-push.
+// Destination is nil for the delivery point (if any) which was being pushed to when the panic occurred. The other delivery points were never pushed to.
+type PanicError struct {
+	implementsPushError
+	PushServiceType string
+	Provider        *PushServiceProvider
+	Destination     *DeliveryPoint
+	Content         *Notification
+	Value           interface{}
+	Stack           []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Push service type %s panicked: %v", e.PushServiceType, e.Value)
+}
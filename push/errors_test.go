@@ -0,0 +1,36 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestRetryReasonCategory(t *testing.T) {
+	timeout := &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+	notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+	testutil.ExpectEquals(t, RetryCategoryTimeout, NewRetryErrorWithReason(nil, nil, nil, 0, timeout).ReasonCategory(), "unexpected category for a timeout")
+	testutil.ExpectEquals(t, RetryCategoryConnection, NewRetryErrorWithReason(nil, nil, nil, 0, notFound).ReasonCategory(), "unexpected category for a network error")
+	testutil.ExpectEquals(t, RetryCategoryUnknown, NewRetryErrorWithReason(nil, nil, nil, 0, errors.New("failed")).ReasonCategory(), "unexpected category for another error")
+	testutil.ExpectEquals(t, RetryCategoryUnknown, NewRetryError(nil, nil, nil, 0).ReasonCategory(), "unexpected category without a reason")
+	testutil.ExpectEquals(t, RetryCategoryProvider, NewRetryErrorWithCategory(nil, nil, nil, 0, RetryCategoryProvider).ReasonCategory(), "expected the category to be used")
+}
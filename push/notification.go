@@ -19,8 +19,22 @@ package push
 
 import (
 	"encoding/json"
+	"strings"
 )
 
+// CollapseKey is an optional parameter of /push. If a device is offline, the push service only delivers the latest of the notifications with the same collapse key.
+// This is the collapse_key of GCM/FCM (which only keep 4 distinct collapse keys per device at a time),
+// the apns-collapse-id of APNs (which requires uniqush.http2=1, and is at most 64 bytes), and the consolidationKey of ADM.
+const CollapseKey = "msggroup"
+
+// GroupKey is an optional parameter of /push. Notifications with the same group are grouped together on the device
+// (as the "thread-id" of APNs notifications, and the "tag" of FCM/GCM notifications, which requires uniqush.notification.fcm/gcm).
+const GroupKey = "uniqush.group"
+
+// HeaderPrefix is the prefix of the optional parameters of /push which set a header of the request to the external push service,
+// e.g. uniqush.header.apns-push-type=background. Push service types which don't support a header drop it with a warning.
+const HeaderPrefix = "uniqush.header."
+
 // Notification is an abstraction of the push notification request from a client of uniqush-push.
 type Notification struct {
 	Data map[string]string
@@ -51,3 +65,33 @@ func (n *Notification) Clone() *Notification {
 func (n *Notification) IsEmpty() bool {
 	return len(n.Data) == 0
 }
+
+// Headers returns the headers set with HeaderPrefix, with the lowercase header names as keys.
+func (n *Notification) Headers() map[string]string {
+	var headers map[string]string
+	for k, v := range n.Data {
+		if !strings.HasPrefix(k, HeaderPrefix) {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[strings.ToLower(strings.TrimPrefix(k, HeaderPrefix))] = v
+	}
+	return headers
+}
+
+// WithoutHeaders returns a clone of the notification without the given headers (lowercase header names), or the notification itself if it doesn't set any of them.
+func (n *Notification) WithoutHeaders(names map[string]bool) *Notification {
+	ret := n
+	for k := range n.Data {
+		if !strings.HasPrefix(k, HeaderPrefix) || !names[strings.ToLower(strings.TrimPrefix(k, HeaderPrefix))] {
+			continue
+		}
+		if ret == n {
+			ret = n.Clone()
+		}
+		delete(ret.Data, k)
+	}
+	return ret
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import (
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestNotificationHeaders(t *testing.T) {
+	notif := NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	notif.Data["uniqush.header.APNs-Push-Type"] = "background"
+	notif.Data["uniqush.header.x-custom"] = "1"
+	testutil.ExpectEquals(t, map[string]string{"apns-push-type": "background", "x-custom": "1"}, notif.Headers(), "unexpected headers")
+
+	filtered := notif.WithoutHeaders(map[string]bool{"x-custom": true})
+	testutil.ExpectEquals(t, map[string]string{"apns-push-type": "background"}, filtered.Headers(), "unexpected headers after filtering")
+	testutil.ExpectEquals(t, "hello", filtered.Data["msg"], "expected other fields to be kept")
+	testutil.ExpectEquals(t, 2, len(notif.Headers()), "expected the original notification to be unchanged")
+	if notif.WithoutHeaders(map[string]bool{"apns-id": true}) != notif {
+		t.Error("Expected the notification to be reused when it doesn't set any of the headers")
+	}
+}
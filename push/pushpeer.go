@@ -43,6 +43,9 @@ const (
 	// TODO: Allow clients to specify version ranges?
 	AppVersion = "app_version"
 	Locale     = "locale"
+	// Priority is optional. It is an integer, and a subscriber's delivery points with higher priorities are pushed to first (Missing priorities are 0).
+	// Combined with uniqush.fallback, this can be used to push to a primary device and only fall back to the others if that fails.
+	Priority = "priority"
 )
 
 // PushPeer implements common functionality for pushes. Other structs in this module include this struct.
@@ -187,6 +190,12 @@ func (dp *DeliveryPoint) addVolatileData(kv map[string]string) error {
 		}
 		dp.VolatileData[SubscribeDate] = subscribeDate
 	}
+	if priority, ok := kv[Priority]; ok && len(priority) > 0 {
+		if _, err := strconv.Atoi(priority); err != nil {
+			return fmt.Errorf("Invalid priority %q, expected an integer: %v", priority, err)
+		}
+		dp.VolatileData[Priority] = priority
+	}
 	// Add any volatile fields with no validation
 	for _, field := range []string{DeviceID, OldDeviceID, AppVersion, Locale} {
 		if value, ok := kv[field]; ok && len(value) > 0 {
@@ -196,6 +205,15 @@ func (dp *DeliveryPoint) addVolatileData(kv map[string]string) error {
 	return nil
 }
 
+// PushPriority returns the priority of this delivery point, which determines the order in which a subscriber's delivery points are pushed to.
+func (dp *DeliveryPoint) PushPriority() int {
+	priority, err := strconv.Atoi(dp.VolatileData[Priority])
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
 // PushServiceProvider contains the data needed to send pushes to an external push notifications service provider (certificates, pushservicetype, server address, etc.).
 type PushServiceProvider struct { // nolint: golint
 	PushPeer
@@ -256,6 +274,9 @@ func UnserializeSubscription(data []byte) (map[string]string, error) {
 			if appVersion, ok := volatileData[AppVersion]; ok && len(appVersion) > 0 {
 				sub[AppVersion] = appVersion
 			}
+			if priority, ok := volatileData[Priority]; ok && len(priority) > 0 {
+				sub[Priority] = priority
+			}
 		}
 
 		return sub, nil
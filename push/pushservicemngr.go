@@ -20,6 +20,7 @@ package push
 import (
 	"errors"
 	"fmt"
+	"runtime/debug"
 	"strings"
 	"sync"
 
@@ -183,13 +184,27 @@ func (m *PushServiceManager) BuildDeliveryPointFromBytes(value []byte) (*Deliver
 
 // Push will send a push to each delivery point received over the channel dpQueue, and send success/error responses over resQueue.
 func (m *PushServiceManager) Push(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *Result, notif *Notification) {
+	m.pushWith(psp.pushServiceType, psp, dpQueue, resQueue, notif)
+}
+
+// PushWithType is like Push, but sends the push with the given push service type instead of the push service type of psp (e.g. to send it to a loopback push service type in tests).
+func (m *PushServiceManager) PushWithType(pushServiceType string, psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *Result, notif *Notification) {
+	var pst PushServiceType
+	if t, ok := m.serviceTypes[pushServiceType]; ok && t != nil {
+		pst = t.pst
+	}
+	m.pushWith(pst, psp, dpQueue, resQueue, notif)
+}
+
+func (m *PushServiceManager) pushWith(pst PushServiceType, psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *Result, notif *Notification) {
 	wg := new(sync.WaitGroup)
 
-	if psp.pushServiceType != nil {
+	if pst != nil {
 		wg.Add(1)
 		go func() {
-			psp.pushServiceType.Push(psp, dpQueue, resQueue, notif)
-			wg.Done()
+			defer wg.Done()
+			defer m.recoverPushPanic(psp, dpQueue, resQueue, notif)
+			pst.Push(psp, dpQueue, resQueue, notif)
 		}()
 	} else {
 		r := new(Result)
@@ -204,6 +219,52 @@ func (m *PushServiceManager) Push(psp *PushServiceProvider, dpQueue <-chan *Deli
 	wg.Wait()
 }
 
+// recoverPushPanic turns a panic in the Push method of a push service type into PanicErrors.
+// Each delivery point remaining in dpQueue gets its own PanicError.
+// Some push service types close resQueue with defer, so the errors are sent to the global error report chan if resQueue was already closed.
+func (m *PushServiceManager) recoverPushPanic(psp *PushServiceProvider, dpQueue <-chan *DeliveryPoint, resQueue chan<- *Result, notif *Notification) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	stack := debug.Stack()
+	isOpen := true
+	report := func(dp *DeliveryPoint) {
+		err := &PanicError{
+			PushServiceType: psp.PushServiceName(),
+			Provider:        psp,
+			Destination:     dp,
+			Content:         notif,
+			Value:           value,
+			Stack:           stack,
+		}
+		if isOpen {
+			isOpen = trySendResult(resQueue, &Result{Provider: psp, Destination: dp, Content: notif, Err: err})
+		}
+		if !isOpen && m.errChan != nil {
+			m.errChan <- err
+		}
+	}
+	report(nil)
+	for dp := range dpQueue {
+		report(dp)
+	}
+	if isOpen {
+		close(resQueue)
+	}
+}
+
+// trySendResult sends res to resQueue, and returns false if resQueue was closed.
+func trySendResult(resQueue chan<- *Result, res *Result) (sent bool) {
+	defer func() {
+		if recover() != nil {
+			sent = false
+		}
+	}()
+	resQueue <- res
+	return true
+}
+
 // Preview will return the bytes of the serialized payload that will be sent to an external service for the given uniqush API parameters in 'notif' (adding placeholders where needed).
 func (m *PushServiceManager) Preview(pushServiceType string, notif *Notification) ([]byte, Error) {
 	if pst, ok := m.serviceTypes[pushServiceType]; ok && pst != nil {
@@ -230,6 +291,36 @@ func (m *PushServiceManager) SetConfigFile(c *conf.ConfigFile) {
 	}
 }
 
+// SetDeliveryReceiptChan will set the channel for delivery receipts on each push service type which reports them (see DeliveryReceiptReporter).
+// This must be called after all push service types are registered.
+func (m *PushServiceManager) SetDeliveryReceiptChan(receipts chan<- *DeliveryReceipt) {
+	for _, t := range m.serviceTypes {
+		if reporter, ok := t.pst.(DeliveryReceiptReporter); ok {
+			reporter.SetDeliveryReceiptChan(receipts)
+		}
+	}
+}
+
+// SetRecordRawResponses enables or disables recording the raw responses of external push services on each push service type which supports it (see RawResponseRecorder).
+// This must be called after all push service types are registered.
+func (m *PushServiceManager) SetRecordRawResponses(record bool) {
+	for _, t := range m.serviceTypes {
+		if recorder, ok := t.pst.(RawResponseRecorder); ok {
+			recorder.SetRecordRawResponses(record)
+		}
+	}
+}
+
+// ConnectionPoolStats returns the connection pool stats of the given push service type, if it reports them (see ConnectionPoolStatsReporter).
+func (m *PushServiceManager) ConnectionPoolStats(pushServiceType string) (ConnectionPoolStats, bool) {
+	if pst, ok := m.serviceTypes[pushServiceType]; ok && pst != nil {
+		if reporter, ok := pst.pst.(ConnectionPoolStatsReporter); ok {
+			return reporter.ConnectionPoolStats(), true
+		}
+	}
+	return ConnectionPoolStats{}, false
+}
+
 // Finalize will finalize each of the push service types before shutting down.
 func (m *PushServiceManager) Finalize() {
 	// TODO: Could use a WaitGroup to do this in parallel, but that isn't high priority.
@@ -237,3 +328,37 @@ func (m *PushServiceManager) Finalize() {
 		t.pst.Finalize()
 	}
 }
+
+// FieldLimits returns the maximum length in bytes of the limited keys of notif.Data for the given push service type (see FieldLimiter).
+// It returns nil if the push service type doesn't limit any fields.
+func (m *PushServiceManager) FieldLimits(pushServiceType string, notif *Notification) map[string]int {
+	if pst, ok := m.serviceTypes[pushServiceType]; ok && pst != nil {
+		if limiter, ok := pst.pst.(FieldLimiter); ok {
+			return limiter.FieldLimits(notif)
+		}
+	}
+	return nil
+}
+
+// UnsupportedHeaders returns the lowercase names of the headers set with HeaderPrefix in notif which the given push service type wouldn't forward (see HeaderForwarder).
+func (m *PushServiceManager) UnsupportedHeaders(pushServiceType string, notif *Notification) map[string]bool {
+	headers := notif.Headers()
+	if len(headers) == 0 {
+		return nil
+	}
+	if pst, ok := m.serviceTypes[pushServiceType]; ok && pst != nil {
+		if forwarder, ok := pst.pst.(HeaderForwarder); ok {
+			for _, name := range forwarder.ForwardedHeaders(notif) {
+				delete(headers, name)
+			}
+		}
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	unsupported := make(map[string]bool, len(headers))
+	for name := range headers {
+		unsupported[name] = true
+	}
+	return unsupported
+}
@@ -17,7 +17,13 @@
 
 package push
 
-import "fmt"
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
 
 // Result is an abstraction of the result of a request to push to an external service.
 type Result struct {
@@ -26,6 +32,8 @@ type Result struct {
 	Content     *Notification
 	MsgID       string
 	Err         Error
+	// RawResponse is the response of the external push service to this push, if the push service type records raw responses (see RawResponseRecorder). It is nil otherwise.
+	RawResponse *RawResponse
 }
 
 // IsError returns true if the result of the push attempt was an error.
@@ -88,3 +96,105 @@ type PushServiceType interface { // nolint: golint
 	// Finalize will release any resources (e.g. network connections) used by this push service type. It is called on shutdown
 	Finalize()
 }
+
+// ConnectionPoolStats counts how the pushes of a push service type used its pool of connections to the external push service.
+type ConnectionPoolStats struct {
+	// Reused is the number of requests sent on a connection which was already open.
+	Reused int64
+	// Opened is the number of requests which had to open a new connection.
+	Opened int64
+}
+
+// ConnectionPoolStatsReporter is implemented by the push service types which pool their connections to the external push service.
+type ConnectionPoolStatsReporter interface {
+	// ConnectionPoolStats returns the totals since the push service type was created.
+	ConnectionPoolStats() ConnectionPoolStats
+}
+
+// ConnectionPoolCounter is used by push service types to count connection reuse for ConnectionPoolStats. It is safe for concurrent use.
+type ConnectionPoolCounter struct {
+	reused int64 // accessed atomically
+	opened int64 // accessed atomically
+}
+
+// Record counts one request, which either reused a pooled connection or opened a new one.
+func (c *ConnectionPoolCounter) Record(reused bool) {
+	if reused {
+		atomic.AddInt64(&c.reused, 1)
+	} else {
+		atomic.AddInt64(&c.opened, 1)
+	}
+}
+
+// TraceRequest returns a copy of req which records whether the connection it is sent on was reused, using net/http/httptrace.
+func (c *ConnectionPoolCounter) TraceRequest(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.Record(info.Reused)
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// Stats returns the counts recorded so far.
+func (c *ConnectionPoolCounter) Stats() ConnectionPoolStats {
+	return ConnectionPoolStats{
+		Reused: atomic.LoadInt64(&c.reused),
+		Opened: atomic.LoadInt64(&c.opened),
+	}
+}
+
+// MaxRawResponseBody is the number of bytes of the body of a raw response which are kept. The rest is discarded.
+const MaxRawResponseBody = 4096
+
+// RawResponse is the unparsed response of an external push service to a push, for diagnosing how it handles the pushes.
+type RawResponse struct {
+	StatusCode int
+	// Body is the first MaxRawResponseBody bytes of the response body.
+	Body string
+}
+
+// NewRawResponse returns the RawResponse with the given HTTP status code and body, keeping the first MaxRawResponseBody bytes of the body.
+func NewRawResponse(statusCode int, body []byte) *RawResponse {
+	if len(body) > MaxRawResponseBody {
+		body = body[:MaxRawResponseBody]
+	}
+	return &RawResponse{StatusCode: statusCode, Body: string(body)}
+}
+
+// RawResponseRecorder is implemented by the push service types which can include the raw response of the external push service in the results of their pushes.
+// Recording is off until it is enabled, so that response bodies aren't kept during normal operation.
+type RawResponseRecorder interface {
+	// SetRecordRawResponses enables or disables setting the RawResponse of each Result.
+	SetRecordRawResponses(record bool)
+}
+
+// DeliveryReceipt is an asynchronous report from an external push service that a message it accepted was (or wasn't) delivered to the device.
+type DeliveryReceipt struct {
+	// PushServiceType is the name of the push service type which sent the message (e.g. "apns").
+	PushServiceType string
+	// MsgID is the message id of the successful push result for the message.
+	MsgID string
+	// Err is nil if the message was delivered.
+	Err error
+	// Timestamp is when the external push service delivered the message (or failed to), if it reports that. Otherwise, it is the zero time.
+	Timestamp time.Time
+}
+
+// DeliveryReceiptReporter is implemented by the push service types whose external push service reports deliveries asynchronously.
+type DeliveryReceiptReporter interface {
+	// SetDeliveryReceiptChan sets the channel to send the delivery receipts to.
+	SetDeliveryReceiptChan(receipts chan<- *DeliveryReceipt)
+}
+
+// HeaderForwarder is implemented by the push service types which forward headers set with HeaderPrefix to the external push service.
+type HeaderForwarder interface {
+	// ForwardedHeaders returns the lowercase names of the headers which would be forwarded for notif (e.g. depending on the protocol used for it).
+	ForwardedHeaders(notif *Notification) []string
+}
+
+// FieldLimiter is implemented by the push service types whose external push service limits the length of individual fields of a notification, beyond the size of the whole payload.
+type FieldLimiter interface {
+	// FieldLimits returns the maximum length in bytes of the values of the limited keys of notif.Data (e.g. depending on the protocol used for notif).
+	FieldLimits(notif *Notification) map[string]int
+}
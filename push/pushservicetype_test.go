@@ -0,0 +1,51 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package push
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestConnectionPoolCounterTraceRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	counter := new(ConnectionPoolCounter)
+	client := &http.Client{Transport: &http.Transport{}}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		resp, err := client.Do(counter.TraceRequest(req))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		// The connection is only returned to the pool once the body is read and closed.
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	testutil.ExpectEquals(t, ConnectionPoolStats{Reused: 1, Opened: 1}, counter.Stats(), "expected the second request to reuse the connection")
+}
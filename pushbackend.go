@@ -19,20 +19,107 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/db"
 	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/srv"
 )
 
 // PushBackEnd contains the data structures associated with sending pushes, managing subscriptions, and logging the results.
 type PushBackEnd struct {
+	// pushesStarted and pushesFinished count the calls to the push service manager, to find pushes which never complete (e.g. a push service hangs).
+	// These are first for 64-bit alignment, which sync/atomic needs on 32-bit platforms.
+	pushesStarted  int64
+	pushesFinished int64
+	// backoffWaited is the total time in nanoseconds that finished pushes spent waiting for retries.
+	backoffWaited int64
+	// retriesOverflowed counts the retries which were rejected or dropped because max_pending_retries were already waiting.
+	retriesOverflowed int64
+
 	psm     *push.PushServiceManager
 	db      db.PushDatabase
 	loggers []log.Logger
 	errChan chan push.Error
+	config  *PushBackEndConfig
+	paused  *pausedServices
+	// inFlight contains the pushes which are being sent, for InFlightPushes.
+	inFlight *inFlightPushes
+	// resolver finds the delivery points to push to. This is db unless SetDeliveryPointResolver was called.
+	resolver DeliveryPointResolver
+	// groups expands the groups given to /push into subscribers. This is nil unless SetGroupResolver was called.
+	groups GroupResolver
+	// shard skips the subscribers owned by other instances. This is nil unless subscribers are sharded.
+	shard ShardFilter
+	// delivered tracks recent successful pushes, so that retries don't deliver the same notification twice.
+	delivered *deliveredPushes
+	// globalRateLimiter limits the total number of pushes per second sent to delivery points. This is nil if there is no limit.
+	globalRateLimiter *rateLimiter
+	// classRateLimiters limits the pushes of the classes of pushes (see OptionClass) which have a rate.
+	classRateLimiters map[string]*rateLimiter
+	// deliveryPointRateLimiter limits the number of pushes per second to each delivery point. This is nil if there is no limit.
+	deliveryPointRateLimiter *keyedRateLimiter
+	hooks                    []PushHook
+	retries                  *retryScheduler
+	// retryReasons counts the retries requested by push services, for RetryReasonCounts.
+	retryReasons      *retryReasonCounters
+	deadLetterHandler DeadLetterHandler
+	// batchSummaryHandler is set by SetBatchSummaryHandler.
+	batchSummaryHandler BatchSummaryHandler
+	// metrics receives measurements of pushes. This is NullMetrics unless SetMetrics was called.
+	metrics Metrics
+	// subscriberLocks serializes pushes to each subscriber. This is nil unless serialize_subscribers is enabled.
+	subscriberLocks *subscriberLocks
+	// dpWorkers serializes the pushes to the delivery points of serialized_delivery_points. This is nil unless serialized_delivery_points is set.
+	dpWorkers *deliveryPointWorkers
+	// concurrency tracks the concurrent pushes of each service, for ConcurrencyStats.
+	concurrency *serviceConcurrency
+	// warmed contains the delivery points of subscribers looked up ahead of time by Warmup.
+	warmed *warmedDeliveryPoints
+	// resolved caches the delivery points resolved by recent pushes. This is nil unless resolution_cache_size is set.
+	resolved *resolvedDeliveryPoints
+	// recentContents suppresses duplicate pushes of the same content to a subscriber. This is nil unless content_dedup_window is set.
+	recentContents *recentContents
+	// batcher collects the identical pushes of the services with a [batching:<service>] section into batches.
+	batcher *pushBatcher
+	// cancelled contains the subscribers whose pending pushes were cancelled by CancelForSubscriber.
+	cancelled *cancelledSubscribers
+	// pushSlots limits the number of calls to Push running at once. This is nil if there is no limit.
+	pushSlots *pushSlots
+	// memory measures the memory use compared to memory_limit_mb. This is nil if there is no limit.
+	memory *memoryMonitor
+	// memoryStop is closed by Finalize to stop watchMemory.
+	memoryStop chan struct{}
+	// errorLogSampler limits the logs of identical push errors. This is nil unless error_log_threshold is set.
+	errorLogSampler *errorLogSampler
+	// receiptHandler and awaitedReceipts are set by SetDeliveryReceiptHandler.
+	receiptHandler  DeliveryReceiptHandler
+	awaitedReceipts *awaitedReceipts
+	// unregistered counts the unregistered errors of delivery points. This is nil unless unsubscribe_threshold is more than 1.
+	unregistered *unregisteredDeliveryPoints
+	// blacklist skips the delivery points which keep failing. This is nil unless blacklist_threshold is set.
+	blacklist *blacklistedDeliveryPoints
+	// health scores the delivery points by the outcomes of recent pushes. This is nil unless health_routing is enabled.
+	health *deliveryPointHealth
+	// failover finds the push service providers to try when one fails. This is nil unless providers to fail over between are configured, or SetProviderFailoverResolver was called.
+	failover ProviderFailoverResolver
+	// retryTransformer changes the notification sent by each retry. This is nil unless SetRetryTransformer was called.
+	retryTransformer RetryTransformer
+	// encryptor encrypts the notification sent to each delivery point. This is nil unless SetPayloadEncryptor was called.
+	encryptor PayloadEncryptor
+	// signer signs the notification sent to each delivery point, in its signatureField. This is nil unless SetNotificationSigner was called.
+	signer         NotificationSigner
+	signatureField string
+	// errorRates counts the failed pushes of each service and push service type. This is nil unless error_rate_threshold is set.
+	errorRates *errorRates
+	// errorRateAlerter is notified when an error rate crosses error_rate_threshold. This is nil unless SetErrorRateAlerter was called.
+	errorRateAlerter ErrorRateAlerter
 }
 
 // Finalize will save all subscriptions (and perform other cleanup) as part of the push service shutting down.
@@ -40,29 +127,103 @@ func (backend *PushBackEnd) Finalize() {
 	// TODO: Add an option to prevent calling SAVE in implementations such as redis.
 	// Users may want this if saving is time-consuming or already configured to happen periodically.
 	backend.db.FlushCache()
+	if backend.memoryStop != nil {
+		close(backend.memoryStop)
+	}
 	close(backend.errChan)
 	backend.psm.Finalize()
 }
 
 // NewPushBackEnd creates and sets up the only instance of the push implementation.
-func NewPushBackEnd(psm *push.PushServiceManager, database db.PushDatabase, loggers []log.Logger) *PushBackEnd {
+func NewPushBackEnd(psm *push.PushServiceManager, database db.PushDatabase, loggers []log.Logger, config *PushBackEndConfig) *PushBackEnd {
 	ret := new(PushBackEnd)
 	ret.psm = psm
 	ret.db = database
+	ret.resolver = database
 	ret.loggers = loggers
+	if config == nil {
+		config = NewPushBackEndConfig()
+	}
+	ret.config = config
+	ret.paused = newPausedServices()
+	ret.inFlight = newInFlightPushes()
+	// The entries of requests with pending retries are kept regardless of this ttl.
+	ret.delivered = newDeliveredPushes(2 * config.MaxBackoff)
+	ret.retries = newRetryScheduler(config.MaxPendingRetries, config.RetryOverflow == RetryOverflowDropOldest)
+	if config.RetryRate > 0 {
+		ret.retries.rate = newRateLimiter(config.RetryRate, config.RetryRateBurst)
+	}
+	ret.retryReasons = newRetryReasonCounters()
+	ret.concurrency = newServiceConcurrency(config.ConcurrencyWindow, time.Now())
+	ret.metrics = NullMetrics{}
+	ret.warmed = newWarmedDeliveryPoints(config.WarmupTTL)
+	if config.ResolutionCacheSize > 0 {
+		ret.resolved = newResolvedDeliveryPoints(config.ResolutionCacheSize, config.ResolutionCacheTTL)
+	}
+	ret.cancelled = newCancelledSubscribers()
+	ret.batcher = newPushBatcher()
+	if config.ContentDedupWindow > 0 {
+		ret.recentContents = newRecentContents(config.ContentDedupWindow)
+	}
+	if config.ShardCount > 1 {
+		ret.shard = NewHashShardFilter(config.ShardCount, config.ShardIndex)
+	}
+	if config.SerializeSubscribers {
+		ret.subscriberLocks = newSubscriberLocks()
+	}
+	if len(config.SerializedDeliveryPoints) > 0 {
+		ret.dpWorkers = newDeliveryPointWorkers()
+	}
+	if config.GlobalRate > 0 {
+		ret.globalRateLimiter = newRateLimiter(config.GlobalRate, config.GlobalRateBurst)
+	}
+	ret.classRateLimiters = newPushClassRateLimiters(config.PushClasses)
+	if config.UnsubscribeThreshold > 1 {
+		ret.unregistered = newUnregisteredDeliveryPoints(config.UnsubscribeThreshold, config.UnsubscribeWindow)
+	}
+	if len(config.ProviderFailover) > 0 {
+		ret.failover = &configuredProviderFailover{db: database, providers: config.ProviderFailover}
+	}
+	if config.HealthRouting == HealthRoutingOrder || config.HealthRouting == HealthRoutingSkip || config.DuplicateDeliveryPoints == DuplicateDeliveryPointsHealthiest {
+		ret.health = newDeliveryPointHealth()
+	}
+	if config.ErrorRateThreshold > 0 {
+		ret.errorRates = newErrorRates(config.ErrorRateWindow, config.ErrorRateThreshold, config.ErrorRateMinPushes)
+	}
+	if config.BlacklistThreshold > 0 {
+		ret.blacklist = newBlacklistedDeliveryPoints(config.BlacklistThreshold, config.BlacklistWindow, config.BlacklistTTL)
+	}
+	if config.ErrorLogThreshold > 0 {
+		ret.errorLogSampler = newErrorLogSampler(config.ErrorLogThreshold, config.ErrorLogWindow)
+	}
+	if config.MaxConcurrentPushes > 0 {
+		ret.pushSlots = newPushSlots(config.MaxConcurrentPushes, config.PriorityStarvationLimit)
+	}
+	if config.MemoryLimit > 0 {
+		ret.memory = newMemoryMonitor(config.MemoryLimit, config.MemoryCheckInterval)
+		ret.retries.track = config.MemoryPressureMaxRetries > 0
+		ret.memoryStop = make(chan struct{})
+		go ret.watchMemory(ret.memoryStop, ret.loggers[LoggerPush])
+	}
+	if config.DeliveryPointRate > 0 {
+		ret.deliveryPointRateLimiter = newKeyedRateLimiter(config.DeliveryPointRate, config.DeliveryPointRateBurst)
+	}
 	ret.errChan = make(chan push.Error)
 	go ret.processError()
 	psm.SetErrorReportChan(ret.errChan)
+	psm.SetRecordRawResponses(config.RecordRawResponses)
 	return ret
 }
 
 // AddPushServiceProvider is used by /addpsp to add a push service provider (for a service+push type) to the database.
 func (backend *PushBackEnd) AddPushServiceProvider(service string, psp *push.PushServiceProvider) error {
+	backend.invalidateService(service)
 	return backend.db.AddPushServiceProviderToService(service, psp)
 }
 
 // RemovePushServiceProvider is used by /rmpsp to remove a push service provider (for a service+push type) from the database.
 func (backend *PushBackEnd) RemovePushServiceProvider(service string, psp *push.PushServiceProvider) error {
+	backend.invalidateService(service)
 	return backend.db.RemovePushServiceProviderFromService(service, psp)
 }
 
@@ -73,11 +234,13 @@ func (backend *PushBackEnd) GetPushServiceProviderConfigs() ([]*push.PushService
 
 // Subscribe adds a new delivery point (subscription) for a service+subscriber to the database.
 func (backend *PushBackEnd) Subscribe(service, sub string, dp *push.DeliveryPoint) (*push.PushServiceProvider, error) {
+	backend.invalidateSubscriber(service, sub)
 	return backend.db.AddDeliveryPointToService(service, sub, dp)
 }
 
 // Unsubscribe removes a delivery point (subscription) for a service+subscriber from the database.
 func (backend *PushBackEnd) Unsubscribe(service, sub string, dp *push.DeliveryPoint) error {
+	backend.invalidateSubscriber(service, sub)
 	return backend.db.RemoveDeliveryPointFromService(service, sub, dp)
 }
 
@@ -85,7 +248,7 @@ func (backend *PushBackEnd) processError() {
 	for err := range backend.errChan {
 		rid := randomUniqID()
 		nullHandler := &NullAPIResponseHandler{}
-		e := backend.fixError(rid, "", err, backend.loggers[LoggerPush], 0*time.Second, nullHandler)
+		e := backend.fixError(rid, "", err, backend.loggers[LoggerPush], retryState{}, nullHandler)
 		if e != nil {
 			switch e0 := e.(type) {
 			case *push.InfoReport:
@@ -102,7 +265,7 @@ func (backend *PushBackEnd) fixError(
 	remoteAddr string,
 	event error,
 	logger log.Logger,
-	after time.Duration,
+	retry retryState,
 	handler APIResponseHandler,
 ) error {
 	if event == nil {
@@ -110,7 +273,7 @@ func (backend *PushBackEnd) fixError(
 	}
 	switch err := event.(type) {
 	case *push.RetryError:
-		backend.fixRetryError(err, reqID, remoteAddr, logger, after, handler)
+		backend.fixRetryError(err, reqID, remoteAddr, logger, retry, handler)
 		return nil
 	case *push.PushServiceProviderUpdate:
 		backend.fixPushServiceProviderUpdate(err, reqID, remoteAddr, logger, handler)
@@ -124,18 +287,44 @@ func (backend *PushBackEnd) fixError(
 	case *push.UnsubscribeUpdate:
 		backend.fixUnsubscribeUpdate(err, reqID, remoteAddr, logger, handler)
 		return nil
+	case *push.PanicError:
+		return backend.fixPanicError(err, reqID, remoteAddr, logger, retry, handler)
 	default:
 		return err
 	}
 }
 
-// fixRetryError will retry sending the push with longer and longer intervals, and give up when the interval exceeds 1 minute.
+// fixPanicError logs the stack trace of a panic in a push service type, and retries the pushes which it didn't finish if retry_on_panic is enabled.
+func (backend *PushBackEnd) fixPanicError(
+	err *push.PanicError,
+	reqID string,
+	remoteAddr string,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+) error {
+	if err.Destination == nil {
+		// Every delivery point that the push service type didn't finish gets a PanicError, but only one of them needs the stack trace.
+		logger.Errorf("RequestID=%v PushServiceProvider=%v %v\n%s", reqID, getProviderNameOrUnknown(err.Provider), err, err.Stack)
+		return err
+	}
+	if !backend.config.RetryOnPanic {
+		return err
+	}
+	backend.fixRetryError(push.NewRetryErrorWithReason(err.Provider, err.Destination, err.Content, 0, err), reqID, remoteAddr, logger, retry, handler)
+	return nil
+}
+
+// fixRetryError will retry sending the push with longer and longer intervals, and give up when the interval exceeds the configured max_backoff (1 minute by default).
+// If max_retries (or uniqush.max_retries for this notification) is set, it instead gives up after that many retries.
+// If the service has other push service providers to fail over to, they are tried first, without waiting for a backoff.
+// A scheduled retry is reported as UNIQUSH_PUSH_RETRYING with the time of the next attempt, and giving up is reported as a failure with the reason, so callers know whether to expect another attempt.
 func (backend *PushBackEnd) fixRetryError(
 	err *push.RetryError,
 	reqID string,
 	remoteAddr string,
 	logger log.Logger,
-	after time.Duration,
+	retry retryState,
 	handler APIResponseHandler,
 ) {
 	if err.Provider == nil || err.Destination == nil || err.Content == nil {
@@ -152,24 +341,91 @@ func (backend *PushBackEnd) fixRetryError(
 	if sub, ok = err.Destination.FixedData["subscriber"]; !ok {
 		return
 	}
-	if after <= 1*time.Second {
-		after = 5 * time.Second
-	}
 	providerName := err.Provider.Name()
 	destinationName := err.Destination.Name()
-	if after > 1*time.Minute {
-		logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed after retry", reqID, service, sub, providerName, destinationName)
-		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &providerName, DeliveryPoint: &destinationName, Code: UNIQUSH_ERROR_FAILED_RETRY})
+	if msgID, delivered := backend.delivered.get(reqID, destinationName); delivered {
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v MsgID=%v Not retrying: already delivered", reqID, service, sub, providerName, destinationName, msgID)
 		return
 	}
-	logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Retry after %v", reqID, service, sub, providerName, destinationName, after)
-	go func() {
-		<-time.After(after)
-		subs := make([]string, 1)
-		subs[0] = sub
-		after = 2 * after
-		backend.pushImpl(reqID, remoteAddr, service, subs, nil, err.Content, nil, backend.loggers[LoggerPush], err.Provider, err.Destination, after, handler)
-	}()
+	backend.retryReasons.add(service, err.ReasonCategory())
+	backend.metrics.IncCounter(MetricRetries, map[string]string{"service": service, "category": err.ReasonCategory()})
+	if backend.failOver(reqID, remoteAddr, service, sub, err, logger, retry, handler) {
+		return
+	}
+	backend.scheduleRetry(reqID, retryAttempt{
+		service:   service,
+		sub:       sub,
+		notif:     err.Content,
+		requested: err.After,
+		target:    fmt.Sprintf("PushServiceProvider=%v DeliveryPoint=%v", providerName, destinationName),
+		abandon: func(code string, reason string) {
+			if code != UNIQUSH_ERROR_FAILED_RETRY {
+				backend.abandonRetry(reqID, remoteAddr, service, sub, err, retry, logger, handler, code, reason)
+				return
+			}
+			retries := retry.retries
+			logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed after %d retries", reqID, service, sub, providerName, destinationName, retries)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &providerName, DeliveryPoint: &destinationName, Code: code, ErrorMsg: &reason, Retries: &retries})
+			backend.deadLetter(reqID, service, sub, err, retry)
+			backend.recordBackoff(reqID, service, sub, destinationName, retry, logger)
+		},
+		drop: func(reason string) {
+			backend.dropRetry(reqID, remoteAddr, service, sub, err, retry, logger, handler, reason)
+		},
+		retrying: func(nextAttempt int64, retries int, schedule []int64) {
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &providerName, DeliveryPoint: &destinationName, Code: UNIQUSH_PUSH_RETRYING, NextAttempt: &nextAttempt, Retries: &retries, RetrySchedule: schedule})
+		},
+		send: func(next retryState) {
+			content, ok := remainingTTL(err.Content, retry.submitted, time.Now())
+			if !ok {
+				backend.abandonRetry(reqID, remoteAddr, service, sub, err, retry, logger, handler, UNIQUSH_ERROR_EXPIRED, "the ttl of the notification elapsed")
+				return
+			}
+			content = backend.transformRetry(service, err.Provider, err.Destination, content, next.retries)
+			backend.pushImpl(reqID, remoteAddr, service, []string{sub}, nil, content, nil, backend.loggers[LoggerPush], err.Provider, err.Destination, next, handler)
+		},
+	}, retry, logger)
+}
+
+// maxRetries returns the maximum number of retries of notif, from uniqush.max_retries, the class of notif, or max_retries.
+func (backend *PushBackEnd) maxRetries(notif *push.Notification) int {
+	if n, ok := getIntOption(notif, OptionMaxRetries); ok {
+		return n
+	}
+	if class := backend.pushClass(notif); class != nil && class.MaxRetries > 0 {
+		return class.MaxRetries
+	}
+	return backend.config.MaxRetries
+}
+
+// dropRetry gives up on a push which couldn't wait for a retry because of max_pending_retries.
+// It is reported as a failure if retry_overflow is reject, and as dropped otherwise.
+func (backend *PushBackEnd) dropRetry(reqID string, remoteAddr string, service string, sub string, err *push.RetryError, retry retryState, logger log.Logger, handler APIResponseHandler, reason string) {
+	atomic.AddInt64(&backend.retriesOverflowed, 1)
+	code := UNIQUSH_RETRY_DROPPED
+	if backend.config.RetryOverflow == RetryOverflowReject {
+		code = UNIQUSH_ERROR_RETRY_QUEUE_FULL
+	}
+	backend.abandonRetry(reqID, remoteAddr, service, sub, err, retry, logger, handler, code, reason)
+}
+
+// abandonRetry reports a push which won't be retried with code, and sends it to the dead letter handler.
+func (backend *PushBackEnd) abandonRetry(reqID string, remoteAddr string, service string, sub string, err *push.RetryError, retry retryState, logger log.Logger, handler APIResponseHandler, code string, reason string) {
+	providerName := err.Provider.Name()
+	destinationName := err.Destination.Name()
+	logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Not retrying: %s", reqID, service, sub, providerName, destinationName, reason)
+	retries := retry.retries
+	handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &providerName, DeliveryPoint: &destinationName, Code: code, ErrorMsg: &reason, Retries: &retries})
+	backend.deadLetter(reqID, service, sub, err, retry)
+	backend.recordBackoff(reqID, service, sub, destinationName, retry, logger)
+}
+
+// refreshResultCode returns the code reported once data refreshed by a push service is saved (see refresh_result).
+func (backend *PushBackEnd) refreshResultCode() string {
+	if backend.config.RefreshReportsFailure {
+		return UNIQUSH_ERROR_DATA_REFRESHED
+	}
+	return UNIQUSH_SUCCESS
 }
 
 func (backend *PushBackEnd) fixPushServiceProviderUpdate(
@@ -189,15 +445,21 @@ func (backend *PushBackEnd) fixPushServiceProviderUpdate(
 		return
 	}
 	psp := err.Provider
-	e := backend.db.ModifyPushServiceProvider(psp)
+	backend.invalidateService(service)
 	pspName := psp.Name()
-	if e != nil {
-		logger.Errorf("RequestID=%v Service=%v PushServiceProvider=%v Update Failed: %v", reqID, service, pspName, e)
-		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_ERROR_UPDATE_PUSH_SERVICE_PROVIDER, ErrorMsg: strPtrOfErr(e)})
-	} else {
-		logger.Infof("RequestID=%v Service=%v PushServiceProvider=%v Update Success", reqID, service, pspName)
-		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_SUCCESS})
-	}
+	backend.updateWithRetry(func() error {
+		return backend.db.ModifyPushServiceProvider(psp)
+	}, func(e error) {
+		if e != nil {
+			logger.Errorf("RequestID=%v Service=%v PushServiceProvider=%v Update Failed: %v", reqID, service, pspName, e)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: UNIQUSH_ERROR_UPDATE_PUSH_SERVICE_PROVIDER, ErrorMsg: strPtrOfErr(e)})
+		} else {
+			logger.Infof("RequestID=%v Service=%v PushServiceProvider=%v Update Success", reqID, service, pspName)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, PushServiceProvider: &pspName, Code: backend.refreshResultCode()})
+		}
+	}, func(e error, after time.Duration) {
+		logger.Warnf("RequestID=%v Service=%v PushServiceProvider=%v Update Failed, retrying after %v: %v", reqID, service, pspName, after, e)
+	})
 }
 
 func (backend *PushBackEnd) fixDeliveryPointUpdate(
@@ -222,15 +484,21 @@ func (backend *PushBackEnd) fixDeliveryPointUpdate(
 		service = ""
 	}
 	dp := err.Destination
-	e := backend.db.ModifyDeliveryPoint(dp)
+	backend.invalidateSubscriber(service, sub)
 	dpName := dp.Name()
-	if e != nil {
-		logger.Errorf("Subscriber=%v DeliveryPoint=%v Update Failed: %v", sub, dpName, e)
-		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Subscriber: &sub, Service: &service, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_UPDATE_DELIVERY_POINT, ErrorMsg: strPtrOfErr(e)})
-	} else {
-		logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v Update Success", service, sub, dpName)
-		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Subscriber: &sub, Service: &service, DeliveryPoint: &dpName, Code: UNIQUSH_SUCCESS, ModifiedDp: true})
-	}
+	backend.updateWithRetry(func() error {
+		return backend.db.ModifyDeliveryPoint(dp)
+	}, func(e error) {
+		if e != nil {
+			logger.Errorf("Subscriber=%v DeliveryPoint=%v Update Failed: %v", sub, dpName, e)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Subscriber: &sub, Service: &service, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_UPDATE_DELIVERY_POINT, ErrorMsg: strPtrOfErr(e)})
+		} else {
+			logger.Infof("Service=%v Subscriber=%v DeliveryPoint=%v Update Success", service, sub, dpName)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Subscriber: &sub, Service: &service, DeliveryPoint: &dpName, Code: backend.refreshResultCode(), ModifiedDp: true})
+		}
+	}, func(e error, after time.Duration) {
+		logger.Warnf("Service=%v Subscriber=%v DeliveryPoint=%v Update Failed, retrying after %v: %v", service, sub, dpName, after, e)
+	})
 }
 
 func (backend *PushBackEnd) fixInvalidRegistrationUpdate(
@@ -255,8 +523,11 @@ func (backend *PushBackEnd) fixInvalidRegistrationUpdate(
 		return
 	}
 	dp := err.Destination
-	e := backend.Unsubscribe(service, sub, dp)
 	dpName := dp.Name()
+	if !backend.unsubscribeAfterThreshold(reqID, remoteAddr, service, sub, dpName, err, logger, handler) {
+		return
+	}
+	e := backend.Unsubscribe(service, sub, dp)
 	if e != nil {
 		logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Removing invalid reg failed: %v", service, sub, dpName, e)
 		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_REMOVE_INVALID_REG, ErrorMsg: strPtrOfErr(e)})
@@ -287,8 +558,11 @@ func (backend *PushBackEnd) fixUnsubscribeUpdate(
 		return
 	}
 	dp := err.Destination
-	e := backend.Unsubscribe(service, sub, dp)
 	dpName := dp.Name()
+	if !backend.unsubscribeAfterThreshold(reqID, remoteAddr, service, sub, dpName, err, logger, handler) {
+		return
+	}
+	e := backend.Unsubscribe(service, sub, dp)
 	if e != nil {
 		logger.Errorf("Service=%v Subscriber=%v DeliveryPoint=%v Unsubscribe failed: %v", service, sub, dpName, e)
 		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_UPDATE_UNSUBSCRIBE, ErrorMsg: strPtrOfErr(e)})
@@ -298,6 +572,17 @@ func (backend *PushBackEnd) fixUnsubscribeUpdate(
 	}
 }
 
+// unsubscribeAfterThreshold returns true if dpName should be unsubscribed because of err. Otherwise, it reports err as a failure of the push.
+func (backend *PushBackEnd) unsubscribeAfterThreshold(reqID string, remoteAddr string, service string, sub string, dpName string, err push.Error, logger log.Logger, handler APIResponseHandler) bool {
+	unsubscribe, count := backend.confirmUnregistered(dpName)
+	if unsubscribe {
+		return true
+	}
+	logger.Warnf("Service=%v Subscriber=%v DeliveryPoint=%v Not unsubscribing after %d of %d unregistered errors: %v", service, sub, dpName, count, backend.config.UnsubscribeThreshold, err)
+	handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_UNREGISTERED, ErrorMsg: strPtrOfErr(err)})
+	return false
+}
+
 func getDeliveryPointNameOrUnknown(dp *push.DeliveryPoint) string {
 	if dp != nil {
 		return dp.Name()
@@ -318,10 +603,20 @@ func (backend *PushBackEnd) collectResult(
 	service string,
 	resChan <-chan *push.Result,
 	logger log.Logger,
-	after time.Duration,
+	retry retryState,
 	handler APIResponseHandler,
 ) {
 	for res := range resChan {
+		if err, ok := res.Err.(*hookRejectedError); ok {
+			// Nothing was sent, so the push doesn't count towards the health, error rate or blacklist of the delivery point.
+			dpName := res.Destination.Name()
+			pspName := res.Provider.Name()
+			sub := res.Destination.FixedData["subscriber"]
+			logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed: rejected by push hook: %v", reqID, service, sub, pspName, dpName, err)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: err.code, ErrorMsg: strPtrOfErr(err)})
+			continue
+		}
+		backend.recordResult(service, res)
 		var sub string
 		ok := false
 		if res.Destination != nil {
@@ -341,24 +636,83 @@ func (backend *PushBackEnd) collectResult(
 		} else {
 			subRepr = "Unknown"
 		}
+		if res.RawResponse != nil {
+			logger.Debugf("RequestID=%v Service=%v Subscriber=%v DeliveryPoint=%v RawResponse: status=%d body=%q", reqID, service, subRepr, getDeliveryPointNameOrUnknown(res.Destination), res.RawResponse.StatusCode, res.RawResponse.Body)
+		}
 		if res.Err == nil {
 			dpName := getDeliveryPointNameOrUnknown(res.Destination)
 			pspName := getProviderNameOrUnknown(res.Provider)
 			msgID := res.MsgID
+			if res.Destination != nil {
+				backend.delivered.add(reqID, dpName, msgID)
+			}
+			backend.awaitReceipt(reqID, service, subRepr, res)
+			if backend.unregistered != nil && res.Destination != nil {
+				backend.unregistered.reset(dpName)
+			}
+			if backend.blacklist != nil && res.Destination != nil {
+				backend.blacklist.reset(dpName)
+			}
 			logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v MsgID=%v Success!", reqID, service, subRepr, pspName, dpName, msgID)
-			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, MessageID: &msgID, Code: UNIQUSH_SUCCESS})
+			backend.recordBackoff(reqID, service, subRepr, dpName, retry, logger)
+			// The delivery point and its push service type tell the caller which device received the push (e.g. when falling back between devices).
+			var pushServiceType *string
+			if res.Destination != nil {
+				name := res.Destination.PushServiceName()
+				pushServiceType = &name
+			}
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, PushServiceType: pushServiceType, MessageID: &msgID, Code: UNIQUSH_SUCCESS, RawResponse: apiRawResponseOf(res.RawResponse), AdjustedFields: adjustedFieldsOf(res)})
 			continue
 		}
-		err := backend.fixError(reqID, remoteAddr, res.Err, logger, after, handler)
+		err := backend.fixError(reqID, remoteAddr, res.Err, logger, retry, handler)
 		if err != nil {
 			dpName := getDeliveryPointNameOrUnknown(res.Destination)
 			pspName := getProviderNameOrUnknown(res.Provider)
-			logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed: %v", reqID, service, subRepr, pspName, dpName, err)
-			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)})
+			backend.recordFailure(reqID, service, subRepr, res, err, logger)
+			backend.recordBackoff(reqID, service, subRepr, dpName, retry, logger)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: failureCode(err), ErrorMsg: strPtrOfErr(err), RawResponse: apiRawResponseOf(res.RawResponse), AdjustedFields: adjustedFieldsOf(res)})
 		}
 	}
 }
 
+// recordResult passes the result of a push to the push hooks, and counts it towards the health and error rate of its delivery point.
+func (backend *PushBackEnd) recordResult(service string, res *push.Result) {
+	backend.runAfterPushHooks(res)
+	if res.Destination != nil {
+		backend.recordHealth(getProviderNameOrUnknown(res.Provider), res.Destination.Name(), res.Err)
+	}
+	backend.recordErrorRate(service, res)
+}
+
+// recordFailure logs the push of res, which failed with err and won't be retried (subject to error_log_sample), and counts the failure towards the blacklist of its delivery point.
+func (backend *PushBackEnd) recordFailure(reqID string, service string, sub string, res *push.Result, err error, logger log.Logger) {
+	dpName := getDeliveryPointNameOrUnknown(res.Destination)
+	pspName := getProviderNameOrUnknown(res.Provider)
+	if backend.errorLogSampler == nil || backend.errorLogSampler.allow(pspName, err.Error(), logger) {
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed: %v", reqID, service, sub, pspName, dpName, err)
+	}
+	if backend.blacklist != nil && res.Destination != nil {
+		if blacklisted, until := backend.blacklist.fail(dpName, time.Now()); blacklisted {
+			logger.Warnf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Blacklisted until %v after %d failures within blacklist_window", reqID, service, sub, pspName, dpName, until.Format(time.RFC3339), backend.config.BlacklistThreshold)
+		}
+	}
+}
+
+// failureCode returns the code to report a push which failed with err.
+func failureCode(err error) string {
+	switch err.(type) {
+	case *encryptionError:
+		return UNIQUSH_ERROR_ENCRYPTION_FAILED
+	case *signingError:
+		return UNIQUSH_ERROR_SIGNING_FAILED
+	case *fieldLimitError:
+		return UNIQUSH_ERROR_FIELD_LIMIT_EXCEEDED
+	case *hookTimeoutError:
+		return UNIQUSH_ERROR_HOOK_TIMEOUT
+	}
+	return UNIQUSH_ERROR_GENERIC
+}
+
 // NumberOfDeliveryPoints returns the number of delivery points for a given service+subscriber.
 func (backend *PushBackEnd) NumberOfDeliveryPoints(service, sub string, logger log.Logger) int {
 	pspDpList, err := backend.db.GetPushServiceProviderDeliveryPointPairs(service, sub, nil)
@@ -405,9 +759,183 @@ func (backend *PushBackEnd) RebuildServiceSet() error {
 	return backend.db.RebuildServiceSet()
 }
 
+// checkRequestAge returns an error if notif was created by the caller longer than max_request_age before now (see OptionRequestTime).
+func (backend *PushBackEnd) checkRequestAge(notif *push.Notification, now time.Time) error {
+	if backend.config.MaxRequestAge <= 0 {
+		return nil
+	}
+	requestTime, ok := getIntOption(notif, OptionRequestTime)
+	if !ok {
+		return nil
+	}
+	if age := now.Sub(time.Unix(int64(requestTime), 0)); age > backend.config.MaxRequestAge {
+		return fmt.Errorf("request too old: it was created %v ago, and max_request_age is %v", age.Round(time.Second), backend.config.MaxRequestAge)
+	}
+	return nil
+}
+
+// errNoSubscribers is returned by validatePush for a push with an empty list of subscribers.
+var errNoSubscribers = errors.New("no subscribers were given")
+
+// errBatchTimeLimit is reported for the subscribers which weren't attempted because a push ran for longer than batch_time_limit.
+var errBatchTimeLimit = errors.New("not attempted: the push exceeded its batch time limit")
+
+// noSubscribers reports a push with an empty list of subscribers, either as UNIQUSH_ERROR_NO_SUBSCRIBER or (if empty_subscribers is ignore) as a push with no results.
+func (backend *PushBackEnd) noSubscribers(reqID string, remoteAddr string, service string, logger log.Logger, handler APIResponseHandler) {
+	if backend.config.IgnoreEmptySubscribers {
+		logger.Infof("RequestID=%v Service=%v NrSubscribers=0 Nothing to push", reqID, service)
+		return
+	}
+	logger.Errorf("RequestID=%v Service=%v Failed: %v", reqID, service, errNoSubscribers)
+	handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_NO_SUBSCRIBER, ErrorMsg: strPtrOfErr(errNoSubscribers)})
+}
+
+// validatePush returns the response code and a descriptive error if the arguments of a call to Push are missing or invalid, before any database lookups or pushes.
+func validatePush(service string, subs []string, notif *push.Notification) (string, error) {
+	if service == "" {
+		return UNIQUSH_ERROR_CANNOT_GET_SERVICE, errors.New("no service was given")
+	}
+	if len(subs) == 0 {
+		return UNIQUSH_ERROR_NO_SUBSCRIBER, errNoSubscribers
+	}
+	for _, sub := range subs {
+		if sub == "" {
+			return UNIQUSH_ERROR_NO_SUBSCRIBER, errors.New("a subscriber name is empty")
+		}
+	}
+	if notif == nil || notif.IsEmpty() {
+		return UNIQUSH_ERROR_EMPTY_NOTIFICATION, errors.New("the notification is empty")
+	}
+	if _, _, err := samplePercent(notif); err != nil {
+		return UNIQUSH_ERROR_BAD_SAMPLE_PERCENT, err
+	}
+	return "", nil
+}
+
 // Push will send a push notification to the given subscriber(s) of a push service.
+// If the service is paused, the push is queued until the service is resumed.
+// If reqID is empty, a random request ID is generated, and used in the logs and results of the push and its retries.
+// If service, subs, or notif are missing, the push is rejected with a descriptive error. An empty list of subscribers is accepted as a push with no results if empty_subscribers is ignore.
+// If max_concurrent_pushes calls are already in progress, this waits for one of them to return (or rejects the push if concurrent_pushes_mode is reject).
 func (backend *PushBackEnd) Push(reqID string, remoteAddr string, service string, subs []string, dpNamesRequested []string, notif *push.Notification, perdp map[string][]string, logger log.Logger, handler APIResponseHandler) {
-	backend.pushImpl(reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, nil, nil, 0*time.Second, handler)
+	backend.push(reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, handler, backend.config.ConcurrentPushesReject)
+}
+
+// TryPush is like Push, but rejects the push instead of waiting if max_concurrent_pushes calls are already in progress. It returns false if the push was rejected for that reason.
+func (backend *PushBackEnd) TryPush(reqID string, remoteAddr string, service string, subs []string, dpNamesRequested []string, notif *push.Notification, perdp map[string][]string, logger log.Logger, handler APIResponseHandler) bool {
+	return backend.push(reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, handler, true)
+}
+
+// push implements Push and TryPush. It returns false if the push was rejected because too many pushes are in progress.
+func (backend *PushBackEnd) push(reqID string, remoteAddr string, service string, subs []string, dpNamesRequested []string, notif *push.Notification, perdp map[string][]string, logger log.Logger, handler APIResponseHandler, reject bool) bool {
+	if reqID == "" {
+		// Without a request ID, the logs of the push (and its retries) couldn't be correlated.
+		reqID = randomUniqID()
+	}
+	if code, err := validatePush(service, subs, notif); err != nil {
+		if err == errNoSubscribers {
+			backend.noSubscribers(reqID, remoteAddr, service, logger, handler)
+			return true
+		}
+		logger.Errorf("RequestID=%v Service=%v Failed: %v", reqID, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: code, ErrorMsg: strPtrOfErr(err)})
+		return true
+	}
+	if backend.config.SortSubscribers && !sort.StringsAreSorted(subs) {
+		subs = append([]string(nil), subs...)
+		sort.Strings(subs)
+	}
+	if err := backend.checkRequestAge(notif, time.Now()); err != nil {
+		logger.Errorf("RequestID=%v Service=%v Failed: %v", reqID, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_REQUEST_TOO_OLD, ErrorMsg: strPtrOfErr(err)})
+		return true
+	}
+	queued, err := backend.paused.enqueue(&queuedPush{reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, time.Now()}, backend.config.MaxPausedPushes)
+	if err != nil {
+		logger.Errorf("RequestID=%v Service=%v Failed: %v", reqID, service, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_SERVICE_PAUSED, ErrorMsg: strPtrOfErr(err)})
+		return true
+	}
+	if queued {
+		logger.Infof("RequestID=%v Service=%v NrSubscribers=%v Queued: service is paused", reqID, service, len(subs))
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_PUSH_QUEUED})
+		return true
+	}
+	priority := pushPriority(notif)
+	if backend.shedLoad(priority, logger) {
+		logger.Errorf("RequestID=%v Service=%v Failed: memory_limit_mb is exceeded", reqID, service)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_MEMORY_PRESSURE})
+		return true
+	}
+	if !backend.acquirePushSlot(priority, reject) {
+		logger.Errorf("RequestID=%v Service=%v Failed: max_concurrent_pushes (%d) pushes are in progress", reqID, service, backend.config.MaxConcurrentPushes)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_TOO_MANY_PUSHES})
+		return false
+	}
+	defer backend.releasePushSlot()
+	timeout := backend.config.ResponseTimeout
+	if d, ok := getDurationOption(notif, OptionTimeout); ok {
+		timeout = d
+	}
+	if timeout <= 0 {
+		backend.pushImpl(reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, nil, nil, newRetryState(time.Now()), handler)
+		return true
+	}
+	backend.pushWithTimeout(reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, timeout, handler)
+	return true
+}
+
+// acquirePushSlot returns true once the push may start, if max_concurrent_pushes is set. If reject is true, it returns false instead of waiting for a slot.
+// Waiting pushes with a higher priority (see OptionQueuePriority) get the next free slot first.
+// Pushes which continue in the background after response_timeout, and retries, don't use slots.
+func (backend *PushBackEnd) acquirePushSlot(priority int, reject bool) bool {
+	if backend.pushSlots == nil {
+		return true
+	}
+	return backend.pushSlots.acquire(priority, reject)
+}
+
+func (backend *PushBackEnd) releasePushSlot() {
+	if backend.pushSlots != nil {
+		backend.pushSlots.release()
+	}
+}
+
+// pushWithTimeout is like pushImpl, but returns after timeout (response_timeout, or uniqush.timeout) even if some pushes haven't finished.
+// Subscribers without any responses are reported as timed out, and their pushes continue in the background.
+// Results which arrive after the timeout are left out of the response, even for subscribers which already had some results, but they are still logged and counted in the metrics.
+func (backend *PushBackEnd) pushWithTimeout(reqID string, remoteAddr string, service string, subs []string, dpNamesRequested []string, notif *push.Notification, perdp map[string][]string, logger log.Logger, timeout time.Duration, handler APIResponseHandler) {
+	detachableHandler := newDetachableResponseHandler(handler)
+	done := make(chan struct{})
+	go func() {
+		backend.pushImpl(reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, nil, nil, newRetryState(time.Now()), detachableHandler)
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	for _, sub := range detachableHandler.detach(subs) {
+		sub := sub
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v Timed out after %v, continuing in the background", reqID, service, sub, timeout)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_TIMEOUT})
+	}
+}
+
+// batchDeadline returns the time after which a push started at now stops attempting more subscribers, or the zero time if it has no batch time limit.
+// OptionBatchTimeLimit overrides batch_time_limit.
+func (backend *PushBackEnd) batchDeadline(notif *push.Notification, now time.Time) time.Time {
+	limit := backend.config.BatchTimeLimit
+	if d, ok := getDurationOption(notif, OptionBatchTimeLimit); ok {
+		limit = d
+	}
+	if limit <= 0 {
+		return time.Time{}
+	}
+	return now.Add(limit)
 }
 
 // pushImpl will fetch subscriptions and send push notifications using the corresponding service.
@@ -423,22 +951,134 @@ func (backend *PushBackEnd) pushImpl(
 	logger log.Logger,
 	provider *push.PushServiceProvider,
 	dest *push.DeliveryPoint,
-	after time.Duration,
+	retry retryState,
 	handler APIResponseHandler,
 ) {
+	logger = newAttemptLogger(logger, retry.attemptID(reqID))
+	if class := backend.pushClass(notif); class != nil && class.LogLevel < log.LOGLEVEL_DEBUG {
+		logger = newLevelLogger(logger, class.LogLevel)
+	}
+	notif = backend.config.applyNotificationDefaults(service, notif)
+	notif = backend.retryCollapseKey(reqID, notif)
 	// dpChanMap maps a PushServiceProvider(by name) to a list of delivery points to send data to (from various subscriptions).
 	// If there are multiple subscriptions, lazily adding to a channel is probably faster than passing a list,
 	// because you'd need to fetch all subscriptions from the DB before starting to push otherwise.
 	dpChanMap := make(map[string]chan *push.DeliveryPoint)
 	// wg is used to wait for all pushes and push responses to complete before returning.
 	wg := new(sync.WaitGroup)
+	// Retries are sent to a single delivery point, so there is nothing to fall back to.
+	fallback := dest == nil && getBoolOption(notif, OptionFallback)
+	retrySubscriber := dest == nil && !fallback && getBoolOption(notif, OptionRetrySubscriber)
+	debugTiming := backend.config.DebugTiming
+	var startTime time.Time
+	if debugTiming {
+		startTime = time.Now()
+	}
+
+	// A retry which the original push waits for runs while the original push holds the subscriber's lock.
+	if backend.subscriberLocks != nil && !(retry.retries > 0 && retry.pending != nil) {
+		unlock := backend.subscriberLocks.lockAll(service, subs)
+		defer unlock()
+	}
+	waitForRetries := retry.retries == 0 && retry.pending == nil && getBoolOption(notif, OptionWaitForRetries)
+	if waitForRetries {
+		retry.pending = new(sync.WaitGroup)
+	}
+	// Retries report their results to the handler of the original push, so they are counted once.
+	if retry.retries == 0 {
+		handler = newMetricsHandler(handler, backend.metrics, service)
+	}
+	if !retry.submitted.IsZero() {
+		handler = newLatencyHandler(handler, retry.submitted)
+	}
+	var summary *batchSummaryHandler
+	if retry.retries == 0 {
+		summary = newBatchSummaryHandler(handler, reqID, service, len(subs))
+		handler = summary
+	}
+	if retry.retries == 0 {
+		entry := backend.inFlight.add(reqID, service, len(subs), handler)
+		defer backend.inFlight.remove(entry)
+		handler = entry
+	}
+	var hash uint64
+	dedupContent := retry.retries == 0 && backend.recentContents != nil
+	if dedupContent {
+		hash = contentHash(notif)
+	}
+	var abort *batchAbortHandler
+	if retry.retries == 0 && backend.config.AbortFailureRate > 0 {
+		abort = newBatchAbortHandler(handler, backend.config.AbortFailureRate, backend.config.AbortMinResults)
+		handler = abort
+	}
+	var minDevices *minDevicesHandler
+	if n, ok := getIntOption(notif, OptionMinSuccessfulDevices); ok && retry.retries == 0 {
+		minDevices = newMinDevicesHandler(handler, n)
+		handler = minDevices
+	}
+	sample := newSubscriberSample(notif)
+	var batchDeadline time.Time
+	if retry.retries == 0 {
+		batchDeadline = backend.batchDeadline(notif, time.Now())
+	}
 
 	// Loop over all subscriptions, fetching the list of corresponding delivery points to send to from the db, starting to push and send pushes.
-	for _, sub := range subs {
+	for i, sub := range subs {
 		// We take a reference to sub in handler.AddDetailsToHandler
 		sub := sub
+		if abort != nil && abort.aborted() {
+			logger.Errorf("RequestID=%v Service=%v NrSubscribers=%v Batch aborted due to high failure rate, skipping the remaining %d subscribers", reqID, service, len(subs), len(subs)-i)
+			for _, skipped := range subs[i:] {
+				skipped := skipped
+				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &skipped, Code: UNIQUSH_ERROR_BATCH_ABORTED, ErrorMsg: strPtrOfErr(errBatchAborted)})
+			}
+			break
+		}
+		if !batchDeadline.IsZero() && time.Now().After(batchDeadline) {
+			logger.Errorf("RequestID=%v Service=%v NrSubscribers=%v Batch time limit exceeded, not attempting the remaining %d subscribers", reqID, service, len(subs), len(subs)-i)
+			for _, skipped := range subs[i:] {
+				skipped := skipped
+				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &skipped, Code: UNIQUSH_ERROR_BATCH_TIME_LIMIT, ErrorMsg: strPtrOfErr(errBatchTimeLimit)})
+			}
+			break
+		}
+		if backend.shard != nil && !backend.shard.OwnsSubscriber(service, sub) {
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v Skipped: not my shard", reqID, service, sub)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_NOT_MY_SHARD})
+			continue
+		}
+		if sample != nil && !sample.includes(sub) {
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v Skipped: not sampled by uniqush.sample_percent", reqID, service, sub)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_NOT_SAMPLED})
+			continue
+		}
+		if backend.cancelled.isCancelled(service, sub, retry.submitted) {
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v Cancelled", reqID, service, sub)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_PUSH_CANCELLED})
+			continue
+		}
+		if dedupContent && !backend.recentContents.add(service, sub, hash, time.Now()) {
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v Skipped: duplicate suppressed, the same content was pushed within content_dedup_window", reqID, service, sub)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_DUPLICATE_SUPPRESSED})
+			continue
+		}
 		dpidx := 0
+		// nextNotification returns notif with the next values of the per-delivery point parameters of /push, if there are any.
+		nextNotification := func() *push.Notification {
+			if len(perdp) == 0 {
+				return notif
+			}
+			note := notif.Clone()
+			for k, v := range perdp {
+				value := v[dpidx%len(v)]
+				note.Data[k] = value
+			}
+			dpidx++
+			return note
+		}
 		var pspDpList []db.PushServiceProviderDeliveryPointPair
+		var fallbackList []db.PushServiceProviderDeliveryPointPair
+		var fallbackNotifs []*push.Notification
 		if provider != nil && dest != nil {
 			// Note: subs always has length 1 when dest != nil
 			pspDpList = make([]db.PushServiceProviderDeliveryPointPair, 1)
@@ -446,7 +1086,18 @@ func (backend *PushBackEnd) pushImpl(
 			pspDpList[0].DeliveryPoint = dest
 		} else {
 			var err error
-			pspDpList, err = backend.db.GetPushServiceProviderDeliveryPointPairs(service, sub, dpNamesRequested)
+			var dbStartTime time.Time
+			if debugTiming {
+				dbStartTime = time.Now()
+			}
+			pspDpList, err = backend.resolveDeliveryPoints(reqID, service, sub, dpNamesRequested, getBoolOption(notif, OptionAllowDuplicates), logger)
+			if debugTiming {
+				logger.Debugf("RequestID=%v Service=%v Subscriber=%v DatabaseTime=%v", reqID, service, sub, time.Since(dbStartTime))
+			}
+			if err != nil && isTransientError(err) {
+				backend.retryLookup(reqID, remoteAddr, service, sub, dpNamesRequested, notif, perdp, logger, retry, handler, err)
+				continue
+			}
 			if err != nil {
 				logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: Database Error: %v", reqID, service, sub, err)
 				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)})
@@ -459,6 +1110,12 @@ func (backend *PushBackEnd) pushImpl(
 			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_DEVICE})
 			continue
 		}
+		if dest == nil {
+			pspDpList = backend.skipUnhealthy(reqID, remoteAddr, service, sub, pspDpList, logger, handler)
+		}
+		if minDevices != nil {
+			minDevices.attempt(sub)
+		}
 
 		for _, pair := range pspDpList {
 			psp := pair.PushServiceProvider
@@ -473,6 +1130,33 @@ func (backend *PushBackEnd) pushImpl(
 				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_NO_DELIVERY_POINT})
 				continue
 			}
+			if fallback || retrySubscriber {
+				fallbackList = append(fallbackList, pair)
+				fallbackNotifs = append(fallbackNotifs, nextNotification())
+				continue
+			}
+			if !backend.admitDeliveryPoint(reqID, remoteAddr, service, sub, psp, dp, notif, logger, handler) {
+				continue
+			}
+			if backend.encryptor != nil || backend.signer != nil || len(backend.hooks) > 0 || backend.config.SerializedDeliveryPoints[dp.Name()] {
+				// Each delivery point gets its own encrypted, signed or hooked notification, so it can't share a push with the other delivery points of psp.
+				// Serialized delivery points are pushed to by their own worker.
+				note := nextNotification()
+				wg.Add(1)
+				go func() {
+					pushStartTime := time.Now()
+					results := backend.pushToDeliveryPoint(reqID, service, psp, dp, note, logger)
+					backend.observeProviderPushTime(service, psp.PushServiceName(), pushStartTime)
+					resChan := make(chan *push.Result, len(results))
+					for _, res := range results {
+						resChan <- res
+					}
+					close(resChan)
+					backend.collectResult(reqID, remoteAddr, service, resChan, logger, retry, handler)
+					wg.Done()
+				}()
+				continue
+			}
 			var dpQueue chan *push.DeliveryPoint
 			var ok bool
 			if dpQueue, ok = dpChanMap[psp.Name()]; !ok {
@@ -480,25 +1164,22 @@ func (backend *PushBackEnd) pushImpl(
 				dpChanMap[psp.Name()] = dpQueue
 				resChan := make(chan *push.Result)
 				wg.Add(1)
-				note := notif
-				if len(perdp) > 0 {
-					note = notif.Clone()
-					for k, v := range perdp {
-						value := v[dpidx%len(v)]
-						note.Data[k] = value
-					}
-					dpidx++
-				}
+				note := nextNotification()
 				// Make the pushservicemanager send to (each delivery point of) the PSP asynchronously
 				go func() {
-					backend.psm.Push(psp, dpQueue, resChan, note)
+					pushStartTime := time.Now()
+					backend.startPush(reqID, service, psp, dpQueue, resChan, note, false, logger)
+					backend.observeProviderPushTime(service, psp.PushServiceName(), pushStartTime)
+					if debugTiming {
+						logger.Debugf("RequestID=%v Service=%v PushServiceProvider=%v ProviderTime=%v", reqID, service, psp.Name(), time.Since(pushStartTime))
+					}
 					wg.Done()
 				}()
 				wg.Add(1)
 				// Wait for the response from the PSP asynchronously
 				go func() {
-					// Note: if this is a retry, the duration `after` will increase, and fixError will account for that when deciding to retry
-					backend.collectResult(reqID, remoteAddr, service, resChan, logger, after, handler)
+					// Note: if this is a retry, retry contains the number of retries and the previous delay, and fixError will account for that when deciding to retry
+					backend.collectResult(reqID, remoteAddr, service, resChan, logger, retry, handler)
 					wg.Done()
 				}()
 			}
@@ -506,6 +1187,17 @@ func (backend *PushBackEnd) pushImpl(
 			// Add this delivery point to the group for that psp.Name()
 			dpQueue <- dp
 		}
+		if len(fallbackList) > 0 {
+			wg.Add(1)
+			go func() {
+				if retrySubscriber {
+					backend.pushSubscriberSet(reqID, remoteAddr, service, sub, fallbackList, fallbackNotifs, logger, retry, handler)
+				} else {
+					backend.pushWithFallback(reqID, remoteAddr, service, sub, fallbackList, fallbackNotifs, logger, retry, handler)
+				}
+				wg.Done()
+			}()
+		}
 	}
 	// Signal that there are no more delivery points so that goroutines can stop reading the next delivery point.
 	for _, dpch := range dpChanMap {
@@ -513,6 +1205,324 @@ func (backend *PushBackEnd) pushImpl(
 	}
 	// Wait for every goroutine started by this method to finish.
 	wg.Wait()
+	if waitForRetries {
+		retry.pending.Wait()
+	}
+	if minDevices != nil {
+		minDevices.complete(reqID, remoteAddr, service, logger)
+	}
+	if summary != nil {
+		summary.complete(backend, logger)
+	}
+	if debugTiming {
+		logger.Debugf("RequestID=%v Service=%v NrSubscribers=%v TotalTime=%v", reqID, service, len(subs), time.Since(startTime))
+	}
+}
+
+// resolveDeliveryPoints returns the pairs of push service providers and delivery points which a push to sub would be sent to, in the order they would be pushed to.
+// If allowDuplicates is true, delivery points returned more than once by the database are pushed to each time, regardless of duplicate_delivery_points.
+func (backend *PushBackEnd) resolveDeliveryPoints(reqID string, service string, sub string, dpNamesRequested []string, allowDuplicates bool, logger log.Logger) ([]db.PushServiceProviderDeliveryPointPair, error) {
+	var pspDpList []db.PushServiceProviderDeliveryPointPair
+	warmed := false
+	if len(dpNamesRequested) == 0 {
+		pspDpList, warmed = backend.warmed.get(service, sub)
+		if !warmed && backend.resolved != nil {
+			pspDpList, warmed = backend.resolved.get(service, sub)
+		}
+	}
+	if !warmed {
+		var err error
+		pspDpList, err = backend.resolver.GetPushServiceProviderDeliveryPointPairs(service, sub, dpNamesRequested)
+		if err != nil {
+			return nil, err
+		}
+		if backend.resolved != nil && len(dpNamesRequested) == 0 {
+			backend.resolved.put(service, sub, pspDpList)
+		}
+	}
+	if !allowDuplicates {
+		pspDpList = backend.removeDuplicateDeliveryPoints(reqID, service, sub, pspDpList, logger)
+	}
+	sortByPriority(pspDpList)
+	backend.sortByHealth(pspDpList)
+	// Delivery points requested by name are always pushed to.
+	if maxDevices := backend.config.MaxDevicesPerSubscriber; maxDevices > 0 && len(dpNamesRequested) == 0 && len(pspDpList) > maxDevices {
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v Skipping %d of %d delivery points: max_devices_per_subscriber is %d", reqID, service, sub, len(pspDpList)-maxDevices, len(pspDpList), maxDevices)
+		pspDpList = pspDpList[:maxDevices]
+	}
+	return pspDpList, nil
+}
+
+// removeDuplicateDeliveryPoints removes delivery points with the same name from pspDpList, depending on the duplicate_delivery_points setting.
+func (backend *PushBackEnd) removeDuplicateDeliveryPoints(reqID string, service string, sub string, pspDpList []db.PushServiceProviderDeliveryPointPair, logger log.Logger) []db.PushServiceProviderDeliveryPointPair {
+	mode := backend.config.DuplicateDeliveryPoints
+	if mode == DuplicateDeliveryPointsPushAll || len(pspDpList) < 2 {
+		return pspDpList
+	}
+	// seen maps the name of each delivery point to its index in result.
+	seen := make(map[string]int, len(pspDpList))
+	result := make([]db.PushServiceProviderDeliveryPointPair, 0, len(pspDpList))
+	now := time.Now()
+	for _, pair := range pspDpList {
+		if pair.DeliveryPoint == nil {
+			result = append(result, pair)
+			continue
+		}
+		dpName := pair.DeliveryPoint.Name()
+		if i, ok := seen[dpName]; ok {
+			if mode == DuplicateDeliveryPointsWarn {
+				logger.Warnf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Skipping duplicate delivery point", reqID, service, sub, getProviderNameOrUnknown(pair.PushServiceProvider), dpName)
+			}
+			if mode == DuplicateDeliveryPointsHealthiest && backend.health != nil {
+				kept := getProviderNameOrUnknown(result[i].PushServiceProvider)
+				other := getProviderNameOrUnknown(pair.PushServiceProvider)
+				if backend.health.score(providerKey(other, dpName), now) > backend.health.score(providerKey(kept, dpName), now) {
+					logger.Debugf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Pushing to the duplicate delivery point through the healthier push service provider instead of %v", reqID, service, sub, other, dpName, kept)
+					result[i] = pair
+				}
+			}
+			continue
+		}
+		seen[dpName] = len(result)
+		result = append(result, pair)
+	}
+	return result
+}
+
+// sortByPriority sorts the delivery points of a subscriber so that the ones with higher priorities are pushed to first.
+// Delivery points with the same priority stay in the order returned by the database.
+func sortByPriority(pspDpList []db.PushServiceProviderDeliveryPointPair) {
+	priority := func(i int) int {
+		if dp := pspDpList[i].DeliveryPoint; dp != nil {
+			return dp.PushPriority()
+		}
+		return 0
+	}
+	sort.SliceStable(pspDpList, func(i, j int) bool {
+		return priority(i) > priority(j)
+	})
+}
+
+// pushWithFallback sends notifs[i] to the delivery point pspDpList[i] of a single subscriber, one delivery point at a time, in order.
+// It stops after the first delivery point that succeeds or will be retried, and moves on to the next delivery point if a push fails permanently.
+func (backend *PushBackEnd) pushWithFallback(
+	reqID string,
+	remoteAddr string,
+	service string,
+	sub string,
+	pspDpList []db.PushServiceProviderDeliveryPointPair,
+	notifs []*push.Notification,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+) {
+	for i, pair := range pspDpList {
+		psp := pair.PushServiceProvider
+		dp := pair.DeliveryPoint
+		if !backend.admitDeliveryPoint(reqID, remoteAddr, service, sub, psp, dp, notifs[i], logger, handler) {
+			continue
+		}
+		results := backend.pushToDeliveryPoint(reqID, service, psp, dp, notifs[i], logger)
+		resChan := make(chan *push.Result, len(results))
+		for _, res := range results {
+			resChan <- res
+		}
+		close(resChan)
+		backend.collectResult(reqID, remoteAddr, service, resChan, logger, retry, handler)
+		if !isPermanentFailure(results) {
+			return
+		}
+		if i+1 < len(pspDpList) {
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Falling back to the next delivery point", reqID, service, sub, psp.Name(), dp.Name())
+		}
+	}
+}
+
+// startPush makes the push service manager send notif to the delivery points from dpQueue, and counts the pushes which have started and finished.
+// If the service has a [batching:<service>] section, the delivery points wait to be sent together with the ones of identical pushes, unless notif has a high uniqush.queue_priority.
+// prepared is true if notif already went through prepareNotification (e.g. before it was encrypted).
+func (backend *PushBackEnd) startPush(reqID string, service string, psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resChan chan<- *push.Result, notif *push.Notification, prepared bool, logger log.Logger) {
+	if batching, ok := backend.config.PushBatching[strings.ToLower(service)]; ok && pushPriority(notif) != pushPriorityHigh {
+		backend.batchedPush(reqID, service, psp, dpQueue, resChan, notif, prepared, logger, batching)
+		return
+	}
+	backend.sendPush(reqID, service, psp, dpQueue, resChan, notif, prepared, logger)
+}
+
+// prepareNotification returns notif with the defaults of the push service type of psp added, and field_limits applied.
+func (backend *PushBackEnd) prepareNotification(psp *push.PushServiceProvider, notif *push.Notification) (*push.Notification, push.Error) {
+	notif = backend.config.applyPushServiceTypeDefaults(psp.PushServiceName(), notif)
+	return backend.applyFieldLimits(psp.PushServiceName(), notif)
+}
+
+// sendPush sends notif to the delivery points from dpQueue through psp, and closes resChan once every result was sent to it.
+// Unless prepared is true, notif goes through prepareNotification first.
+func (backend *PushBackEnd) sendPush(reqID string, service string, psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resChan chan<- *push.Result, notif *push.Notification, prepared bool, logger log.Logger) {
+	logger.Debugf("RequestID=%v Service=%v PushServiceProvider=%v Starting push", reqID, service, psp.Name())
+	if unsupported := backend.psm.UnsupportedHeaders(psp.PushServiceName(), notif); len(unsupported) > 0 {
+		names := make([]string, 0, len(unsupported))
+		for name := range unsupported {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		logger.Warnf("RequestID=%v Service=%v PushServiceProvider=%v Dropping headers not supported by %v: %v", reqID, service, psp.Name(), psp.PushServiceName(), strings.Join(names, ","))
+		notif = notif.WithoutHeaders(unsupported)
+	}
+	if !prepared {
+		var err push.Error
+		notif, err = backend.prepareNotification(psp, notif)
+		if err != nil {
+			logger.Warnf("RequestID=%v Service=%v PushServiceProvider=%v Not sending: %v", reqID, service, psp.Name(), err)
+			for dp := range dpQueue {
+				resChan <- &push.Result{Provider: psp, Destination: dp, Err: err}
+			}
+			close(resChan)
+			return
+		}
+	}
+	backend.warnFieldLimits(reqID, service, psp, notif, logger)
+	atomic.AddInt64(&backend.pushesStarted, 1)
+	finish := backend.concurrency.start(service, time.Now())
+	before, reportsStats := backend.psm.ConnectionPoolStats(psp.PushServiceName())
+	if backend.config.LoopbackServices[strings.ToLower(service)] {
+		backend.psm.PushWithType(srv.LoopbackPushServiceName, psp, dpQueue, resChan, notif)
+	} else {
+		backend.psm.Push(psp, dpQueue, resChan, notif)
+	}
+	finish()
+	atomic.AddInt64(&backend.pushesFinished, 1)
+	if reportsStats {
+		// Other pushes using the same push service type may be counted too, so this is only an approximation for correlating latency with connection churn.
+		after, _ := backend.psm.ConnectionPoolStats(psp.PushServiceName())
+		logger.Debugf("RequestID=%v Service=%v PushServiceProvider=%v ConnectionsReused=%v ConnectionsOpened=%v", reqID, service, psp.Name(), after.Reused-before.Reused, after.Opened-before.Opened)
+	}
+}
+
+// ConnectionPoolStats returns the connection pool stats of a push service type (e.g. "apns"), if it pools its connections to the external push service.
+func (backend *PushBackEnd) ConnectionPoolStats(pushServiceType string) (push.ConnectionPoolStats, bool) {
+	return backend.psm.ConnectionPoolStats(pushServiceType)
+}
+
+// PushesInProgress returns the number of pushes to push service providers which have started but not finished.
+func (backend *PushBackEnd) PushesInProgress() int64 {
+	return atomic.LoadInt64(&backend.pushesStarted) - atomic.LoadInt64(&backend.pushesFinished)
+}
+
+// pushToDeliveryPoint sends notif to a single delivery point, and returns all of the results reported by the push service.
+// If there is a payload encryptor or a notification signer, notif is encrypted or signed first, and the push fails if that fails.
+// The defaults of the push service type, field_limits and the push hooks are applied before that, so that they apply to the fields the app decrypts rather than to the ciphertext.
+// Pushes to the delivery points of serialized_delivery_points wait for the earlier pushes to the same delivery point to finish.
+func (backend *PushBackEnd) pushToDeliveryPoint(reqID string, service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification, logger log.Logger) []*push.Result {
+	notif, err := backend.prepareNotification(psp, notif)
+	if err != nil {
+		logger.Warnf("RequestID=%v Service=%v PushServiceProvider=%v DeliveryPoint=%v Not sending: %v", reqID, service, psp.Name(), dp.Name(), err)
+		return []*push.Result{{Provider: psp, Destination: dp, Err: err}}
+	}
+	notif, err = backend.runBeforePushHooks(service, psp, dp, notif)
+	if err != nil {
+		return []*push.Result{{Provider: psp, Destination: dp, Err: err}}
+	}
+	notif, err = backend.encryptNotification(service, psp, dp, notif)
+	if err != nil {
+		return []*push.Result{{Provider: psp, Destination: dp, Err: err}}
+	}
+	notif, err = backend.signNotification(service, psp, dp, notif)
+	if err != nil {
+		return []*push.Result{{Provider: psp, Destination: dp, Err: err}}
+	}
+	var results []*push.Result
+	send := func() {
+		dpQueue := make(chan *push.DeliveryPoint, 1)
+		dpQueue <- dp
+		close(dpQueue)
+		resChan := make(chan *push.Result)
+		go backend.startPush(reqID, service, psp, dpQueue, resChan, notif, true, logger)
+		for res := range resChan {
+			results = append(results, res)
+		}
+	}
+	if backend.dpWorkers != nil && backend.config.SerializedDeliveryPoints[dp.Name()] {
+		backend.dpWorkers.do(dp.Name(), send)
+	} else {
+		send()
+	}
+	return results
+}
+
+// isPermanentFailure returns true if none of the results of a push to a delivery point were successful or will be retried.
+func isPermanentFailure(results []*push.Result) bool {
+	for _, res := range results {
+		if res.Err == nil {
+			return false
+		}
+		if _, isRetry := res.Err.(*push.RetryError); isRetry {
+			return false
+		}
+	}
+	return true
+}
+
+// admitDeliveryPoint returns true if notif should be sent to dp (i.e. dp matches the filters of notif, isn't blacklisted, and it doesn't exceed any rate limits).
+// Otherwise, it reports the reason the push to dp was skipped.
+func (backend *PushBackEnd) admitDeliveryPoint(
+	reqID string,
+	remoteAddr string,
+	service string,
+	sub string,
+	psp *push.PushServiceProvider,
+	dp *push.DeliveryPoint,
+	notif *push.Notification,
+	logger log.Logger,
+	handler APIResponseHandler,
+) bool {
+	if attr, filtered := unmatchedFilter(notif, dp); filtered {
+		dpName := dp.Name()
+		pspName := psp.Name()
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Skipped: %v doesn't match the filter", reqID, service, sub, pspName, dpName, attr)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_FILTERED})
+		return false
+	}
+	if backend.blacklist != nil {
+		if blacklisted, until := backend.blacklist.blacklisted(dp.Name(), time.Now()); blacklisted {
+			dpName := dp.Name()
+			pspName := psp.Name()
+			err := fmt.Errorf("the delivery point failed repeatedly, and is skipped until %v", until.Format(time.RFC3339))
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Skipped: %v", reqID, service, sub, pspName, dpName, err)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_TEMPORARILY_SKIPPED, ErrorMsg: strPtrOfErr(err)})
+			return false
+		}
+	}
+	if backend.deliveryPointRateLimiter != nil && !backend.deliveryPointRateLimiter.tryTake(dp.Name()) {
+		dpName := dp.Name()
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v DeliveryPoint=%v Failed: delivery point rate limit exceeded", reqID, service, sub, dpName)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_DEVICE_RATE_LIMITED})
+		return false
+	}
+	if !backend.takeRateLimit(backend.globalRateLimiter) {
+		dpName := dp.Name()
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v DeliveryPoint=%v Failed: global rate limit exceeded", reqID, service, sub, dpName)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_RATE_LIMITED})
+		return false
+	}
+	if class, ok := notif.Data[OptionClass]; ok && !backend.takeRateLimit(backend.classRateLimiters[strings.ToLower(class)]) {
+		dpName := dp.Name()
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v DeliveryPoint=%v Failed: rate limit of class %v exceeded", reqID, service, sub, dpName, class)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, DeliveryPoint: &dpName, Code: UNIQUSH_ERROR_RATE_LIMITED})
+		return false
+	}
+	return true
+}
+
+// takeRateLimit returns true if a push can be sent without exceeding the rate of limiter (e.g. global_rate), waiting for that if global_rate_mode is block.
+func (backend *PushBackEnd) takeRateLimit(limiter *rateLimiter) bool {
+	if limiter == nil {
+		return true
+	}
+	if backend.config.GlobalRateReject {
+		return limiter.tryTake()
+	}
+	limiter.wait()
+	return true
 }
 
 // Preview will return the payload data (usually JSON) that would be sent to the given push service type for the given API params.
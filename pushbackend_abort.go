@@ -0,0 +1,71 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// errBatchAborted is reported for the subscribers which were skipped because of abort_failure_rate.
+var errBatchAborted = errors.New("batch aborted due to high failure rate")
+
+// batchAbortHandler counts the successes and failures of a push to many subscribers, so that the rest of the subscribers can be skipped once too many pushes failed (see abort_failure_rate).
+// For example, a bad payload or an outage of the push service would otherwise fail for every subscriber of a large broadcast.
+type batchAbortHandler struct {
+	inner APIResponseHandler
+	// rate is the fraction of failed results above which the push is aborted.
+	rate float64
+	// minResults is the number of results needed before the failure rate is checked.
+	minResults int
+
+	lock      sync.Mutex
+	successes int
+	failures  int
+}
+
+var _ APIResponseHandler = &batchAbortHandler{}
+
+func newBatchAbortHandler(inner APIResponseHandler, rate float64, minResults int) *batchAbortHandler {
+	return &batchAbortHandler{inner: inner, rate: rate, minResults: minResults}
+}
+
+// AddDetailsToHandler counts v, then passes it on to the wrapped handler.
+func (h *batchAbortHandler) AddDetailsToHandler(v APIResponseDetails) {
+	h.lock.Lock()
+	if v.Code == UNIQUSH_SUCCESS {
+		h.successes++
+	} else if isFailureCode(v.Code) {
+		h.failures++
+	}
+	h.lock.Unlock()
+	h.inner.AddDetailsToHandler(v)
+}
+
+// ToJSON serializes the response of the wrapped handler.
+func (h *batchAbortHandler) ToJSON() []byte {
+	return h.inner.ToJSON()
+}
+
+// aborted returns true once at least minResults results were counted, and more than rate of them were failures.
+func (h *batchAbortHandler) aborted() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	total := h.successes + h.failures
+	return total > 0 && total >= h.minResults && float64(h.failures) > h.rate*float64(total)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/uniqush/log"
+)
+
+// attemptID returns the id of this attempt of a push (e.g. "myreq.2" for the first retry of the push with request id "myreq").
+// This distinguishes the log lines of each retry, which share the request id.
+func (r retryState) attemptID(reqID string) string {
+	return fmt.Sprintf("%s.%d", reqID, r.retries+1)
+}
+
+// attemptLogger prefixes every message with the id of an attempt of a push.
+type attemptLogger struct {
+	inner  log.Logger
+	prefix string
+}
+
+var _ log.Logger = &attemptLogger{}
+
+// newAttemptLogger returns a logger which adds AttemptID=attemptID to the messages logged with logger.
+func newAttemptLogger(logger log.Logger, attemptID string) log.Logger {
+	if wrapped, ok := logger.(*attemptLogger); ok {
+		logger = wrapped.inner
+	}
+	return &attemptLogger{inner: logger, prefix: "AttemptID=" + attemptID + " "}
+}
+
+// withPrefix returns v with the prefix first. The prefix is passed as an argument rather than in the format string, in case the request id contains '%'.
+func (l *attemptLogger) withPrefix(v []interface{}) []interface{} {
+	return append([]interface{}{l.prefix}, v...)
+}
+
+func (l *attemptLogger) Debug(v ...interface{}) {
+	l.inner.Debug(l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Debugf(format string, v ...interface{}) {
+	l.inner.Debugf("%s"+format, l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Info(v ...interface{}) {
+	l.inner.Info(l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Infof(format string, v ...interface{}) {
+	l.inner.Infof("%s"+format, l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Config(v ...interface{}) {
+	l.inner.Config(l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Configf(format string, v ...interface{}) {
+	l.inner.Configf("%s"+format, l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Warn(v ...interface{}) {
+	l.inner.Warn(l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Warnf(format string, v ...interface{}) {
+	l.inner.Warnf("%s"+format, l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Error(v ...interface{}) {
+	l.inner.Error(l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Errorf(format string, v ...interface{}) {
+	l.inner.Errorf("%s"+format, l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Alert(v ...interface{}) {
+	l.inner.Alert(l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Alertf(format string, v ...interface{}) {
+	l.inner.Alertf("%s"+format, l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Fatal(v ...interface{}) {
+	l.inner.Fatal(l.withPrefix(v)...)
+}
+
+func (l *attemptLogger) Fatalf(format string, v ...interface{}) {
+	l.inner.Fatalf("%s"+format, l.withPrefix(v)...)
+}
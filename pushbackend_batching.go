@@ -0,0 +1,175 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// pushBatchingSectionPrefix is the prefix of the sections of uniqush.conf which make the identical pushes of a service wait to be sent together, e.g. [batching:myservice].
+const pushBatchingSectionPrefix = "batching:"
+
+// PushBatching makes the pushes of a service with identical notifications wait up to Window to be sent together, in a single request to each push service provider.
+// This trades a little latency for far fewer requests to the push services, for services which send many small pushes at once.
+type PushBatching struct {
+	// Window is how long a push waits for other pushes of the same notification.
+	Window time.Duration
+	// MaxSize is the number of delivery points after which a batch is sent without waiting for the rest of Window (0 means unlimited).
+	MaxSize int
+}
+
+// pushBatch is a push of a notification to a push service provider, which is waiting for the delivery points of other identical pushes.
+type pushBatch struct {
+	reqID   string
+	service string
+	psp     *push.PushServiceProvider
+	notif   *push.Notification
+	logger  log.Logger
+	dps     []*push.DeliveryPoint
+	// prepared is true if notif already went through prepareNotification.
+	prepared bool
+	// resChans maps the name of each delivery point in dps to the channel of the push which it came from.
+	resChans map[string]chan<- *push.Result
+	// done is closed once the results of the batch were sent to resChans.
+	done chan struct{}
+}
+
+// pushBatcher collects the pushes of services with PushBatching into batches.
+type pushBatcher struct {
+	lock    sync.Mutex
+	pending map[string]*pushBatch
+}
+
+func newPushBatcher() *pushBatcher {
+	return &pushBatcher{pending: make(map[string]*pushBatch)}
+}
+
+// batchKey returns the key of the batches which the push of notif to psp can join. Only pushes of notifications with the same fields (including the options of uniqush) can share a request.
+func batchKey(psp *push.PushServiceProvider, notif *push.Notification) string {
+	keys := make([]string, 0, len(notif.Data))
+	for k := range notif.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(notif.Data[k]))
+		h.Write([]byte{0})
+	}
+	return psp.Name() + "\x00" + string(h.Sum(nil))
+}
+
+// batchedPush adds the delivery points from dpQueue to the pending batches of notif, and sends their results to resChan once the batches are sent.
+func (backend *PushBackEnd) batchedPush(reqID string, service string, psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resChan chan<- *push.Result, notif *push.Notification, prepared bool, logger log.Logger, batching PushBatching) {
+	key := batchKey(psp, notif)
+	if prepared {
+		key += "\x00prepared"
+	}
+	waiting := make(map[*pushBatch]bool)
+	for dp := range dpQueue {
+		waiting[backend.batcher.add(backend, key, reqID, service, psp, dp, resChan, notif, prepared, logger, batching)] = true
+	}
+	for b := range waiting {
+		<-b.done
+	}
+	close(resChan)
+}
+
+// add adds dp to the pending batch with key, starting a new batch if there is none, and returns the batch.
+// A batch is sent once its window elapses or it reaches its maximum size, or before a delivery point is added to it a second time.
+func (b *pushBatcher) add(backend *PushBackEnd, key string, reqID string, service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint, resChan chan<- *push.Result, notif *push.Notification, prepared bool, logger log.Logger, batching PushBatching) *pushBatch {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	batch := b.pending[key]
+	if batch != nil {
+		if _, ok := batch.resChans[dp.Name()]; ok {
+			delete(b.pending, key)
+			go backend.sendBatch(batch)
+			batch = nil
+		}
+	}
+	if batch == nil {
+		batch = &pushBatch{
+			reqID:    reqID,
+			service:  service,
+			psp:      psp,
+			notif:    notif,
+			prepared: prepared,
+			logger:   logger,
+			resChans: make(map[string]chan<- *push.Result),
+			done:     make(chan struct{}),
+		}
+		b.pending[key] = batch
+		pending := batch
+		time.AfterFunc(batching.Window, func() {
+			b.lock.Lock()
+			current := b.pending[key] == pending
+			if current {
+				delete(b.pending, key)
+			}
+			b.lock.Unlock()
+			if current {
+				backend.sendBatch(pending)
+			}
+		})
+	}
+	batch.dps = append(batch.dps, dp)
+	batch.resChans[dp.Name()] = resChan
+	if batching.MaxSize > 0 && len(batch.dps) >= batching.MaxSize {
+		delete(b.pending, key)
+		go backend.sendBatch(batch)
+	}
+	return batch
+}
+
+// sendBatch sends a batch to its push service provider, and sends each result to the push which its delivery point came from.
+// Results without a delivery point are sent to every push in the batch.
+func (backend *PushBackEnd) sendBatch(batch *pushBatch) {
+	batch.logger.Debugf("RequestID=%v Service=%v PushServiceProvider=%v Sending a batch of %d delivery points", batch.reqID, batch.service, batch.psp.Name(), len(batch.dps))
+	dpQueue := make(chan *push.DeliveryPoint, len(batch.dps))
+	for _, dp := range batch.dps {
+		dpQueue <- dp
+	}
+	close(dpQueue)
+	results := make(chan *push.Result)
+	go backend.sendPush(batch.reqID, batch.service, batch.psp, dpQueue, results, batch.notif, batch.prepared, batch.logger)
+	for res := range results {
+		if res.Destination != nil {
+			if resChan, ok := batch.resChans[res.Destination.Name()]; ok {
+				resChan <- res
+				continue
+			}
+		}
+		sent := make(map[chan<- *push.Result]bool)
+		for _, resChan := range batch.resChans {
+			if !sent[resChan] {
+				sent[resChan] = true
+				resChan <- res
+			}
+		}
+	}
+	close(batch.done)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type deliveryPointFailures struct {
+	count int
+	first time.Time
+}
+
+// blacklistedDeliveryPoints counts the failed pushes to each delivery point, and skips the delivery points which failed blacklist_threshold times within blacklist_window until blacklist_ttl elapses.
+// This avoids wasting pushes (and push service quotas) on a device which keeps failing, without unsubscribing it.
+type blacklistedDeliveryPoints struct {
+	lock      sync.Mutex
+	threshold int
+	window    time.Duration
+	ttl       time.Duration
+	failures  map[string]*deliveryPointFailures
+	// until maps the blacklisted delivery points to the time they are pushed to again.
+	until     map[string]time.Time
+	lastPrune time.Time
+}
+
+func newBlacklistedDeliveryPoints(threshold int, window time.Duration, ttl time.Duration) *blacklistedDeliveryPoints {
+	return &blacklistedDeliveryPoints{
+		threshold: threshold,
+		window:    window,
+		ttl:       ttl,
+		failures:  make(map[string]*deliveryPointFailures),
+		until:     make(map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// fail counts a failed push to dpName. It returns true (and the time the blacklist expires) if this failure blacklisted dpName.
+func (b *blacklistedDeliveryPoints) fail(dpName string, now time.Time) (blacklisted bool, until time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if now.Sub(b.lastPrune) >= b.window {
+		b.prune(now)
+	}
+	f, ok := b.failures[dpName]
+	if !ok || now.Sub(f.first) >= b.window {
+		f = &deliveryPointFailures{first: now}
+		b.failures[dpName] = f
+	}
+	f.count++
+	if f.count < b.threshold {
+		return false, time.Time{}
+	}
+	delete(b.failures, dpName)
+	until = now.Add(b.ttl)
+	b.until[dpName] = until
+	return true, until
+}
+
+// reset forgets the failures of dpName, after a successful push to it.
+func (b *blacklistedDeliveryPoints) reset(dpName string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.failures, dpName)
+}
+
+// blacklisted returns true (and the time the blacklist expires) if pushes to dpName should be skipped.
+func (b *blacklistedDeliveryPoints) blacklisted(dpName string, now time.Time) (bool, time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	until, ok := b.until[dpName]
+	if !ok {
+		return false, time.Time{}
+	}
+	if !now.Before(until) {
+		delete(b.until, dpName)
+		return false, time.Time{}
+	}
+	return true, until
+}
+
+// prune removes the failures older than the window and the expired blacklist entries. This must be called with the lock held.
+func (b *blacklistedDeliveryPoints) prune(now time.Time) {
+	for name, f := range b.failures {
+		if now.Sub(f.first) >= b.window {
+			delete(b.failures, name)
+		}
+	}
+	for name, until := range b.until {
+		if !now.Before(until) {
+			delete(b.until, name)
+		}
+	}
+	b.lastPrune = now
+}
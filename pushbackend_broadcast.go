@@ -0,0 +1,53 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// Broadcast pushes notif to every subscriber of service, reading broadcast_batch_size subscribers at a time from the database and pushing to each batch with Push before reading the next.
+// This bounds the memory used for services with many subscribers. A subscriber which the database returns in more than one batch is pushed to more than once.
+// It returns an error if the subscribers couldn't be read, after pushing to the batches read before the error.
+func (backend *PushBackEnd) Broadcast(reqID string, remoteAddr string, service string, notif *push.Notification, perdp map[string][]string, logger log.Logger, handler APIResponseHandler) error {
+	if reqID == "" {
+		// Every batch uses the same request ID.
+		reqID = randomUniqID()
+	}
+	var cursor uint64
+	total := 0
+	for {
+		subs, next, err := backend.db.GetSubscribers(service, cursor, backend.config.BroadcastBatchSize)
+		if err != nil {
+			logger.Errorf("RequestID=%v Service=%v Broadcast failed after %d subscribers: Database Error: %v", reqID, service, total, err)
+			return err
+		}
+		if len(subs) > 0 {
+			logger.Infof("RequestID=%v Service=%v Broadcasting to %d more subscribers", reqID, service, len(subs))
+			backend.Push(reqID, remoteAddr, service, subs, nil, notif, perdp, logger, handler)
+			total += len(subs)
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	logger.Infof("RequestID=%v Service=%v NrSubscribers=%v Broadcast finished", reqID, service, total)
+	return nil
+}
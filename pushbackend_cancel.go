@@ -0,0 +1,77 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// cancellationTTL is how long a cancellation is remembered. Pushes submitted before a cancellation which are still pending after this are sent.
+// This bounds the memory used by cancellations, and is longer than retries and paused services normally last.
+const cancellationTTL = 24 * time.Hour
+
+type cancelledSubscriber struct {
+	service string
+	sub     string
+}
+
+// cancelledSubscribers remembers when the pending pushes to each subscriber were cancelled (e.g. because the user opted out).
+type cancelledSubscribers struct {
+	lock      sync.Mutex
+	cancelled map[cancelledSubscriber]time.Time
+	lastPrune time.Time
+}
+
+func newCancelledSubscribers() *cancelledSubscribers {
+	return &cancelledSubscribers{
+		cancelled: make(map[cancelledSubscriber]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+// cancel marks the pushes to sub of service which were submitted until now as cancelled.
+func (c *cancelledSubscribers) cancel(service string, sub string) {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cancelled[cancelledSubscriber{service, sub}] = now
+	if now.Sub(c.lastPrune) < cancellationTTL {
+		return
+	}
+	for key, cancelledAt := range c.cancelled {
+		if now.Sub(cancelledAt) >= cancellationTTL {
+			delete(c.cancelled, key)
+		}
+	}
+	c.lastPrune = now
+}
+
+// isCancelled returns true if a push to sub of service which was submitted at the given time was cancelled.
+func (c *cancelledSubscribers) isCancelled(service string, sub string, submitted time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cancelledAt, ok := c.cancelled[cancelledSubscriber{service, sub}]
+	return ok && !submitted.After(cancelledAt) && time.Since(cancelledAt) < cancellationTTL
+}
+
+// CancelForSubscriber drops the pending pushes to sub of service: pushes queued for a paused service, scheduled retries, and pushes still continuing in the background after response_timeout.
+// Pushes already sent to a push service can't be recalled. Pushes submitted after this call are sent as usual.
+func (backend *PushBackEnd) CancelForSubscriber(service string, sub string) {
+	backend.cancelled.cancel(service, sub)
+}
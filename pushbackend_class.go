@@ -0,0 +1,160 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// pushClassSectionPrefix is the prefix of the sections of uniqush.conf which contain the policy of a class of pushes, e.g. [class:marketing].
+const pushClassSectionPrefix = "class:"
+
+// PushClass is the policy for the pushes of a class (set with OptionClass), e.g. transactional, marketing, or background notifications.
+// This allows limiting pushes by their intent, across services.
+type PushClass struct {
+	// Rate is the maximum number of pushes per second to delivery points for pushes of this class (0 means unlimited). global_rate_mode applies to this too.
+	Rate float64
+	// RateBurst is the number of pushes of this class that can be sent at once before Rate applies.
+	RateBurst int
+	// MaxRetries overrides max_retries for pushes of this class (0 means max_retries is used).
+	MaxRetries int
+	// LogLevel is the most verbose level logged for pushes of this class (e.g. log.LOGLEVEL_WARN to only log problems with marketing pushes).
+	// It can't make the logs more verbose than the loglevel of [Push].
+	LogLevel int
+}
+
+// pushClass returns the policy of the class of notif, or nil if it has no class (or an unknown class).
+func (backend *PushBackEnd) pushClass(notif *push.Notification) *PushClass {
+	name, ok := notif.Data[OptionClass]
+	if !ok {
+		return nil
+	}
+	return backend.config.PushClasses[strings.ToLower(name)]
+}
+
+// newPushClassRateLimiters returns the rate limiters of the classes which have a rate, or nil if there are none.
+func newPushClassRateLimiters(classes map[string]*PushClass) map[string]*rateLimiter {
+	var limiters map[string]*rateLimiter
+	for name, class := range classes {
+		if class.Rate <= 0 {
+			continue
+		}
+		if limiters == nil {
+			limiters = make(map[string]*rateLimiter)
+		}
+		limiters[name] = newRateLimiter(class.Rate, class.RateBurst)
+	}
+	return limiters
+}
+
+// levelLogger discards the messages which are more verbose than level.
+type levelLogger struct {
+	inner log.Logger
+	level int
+}
+
+var _ log.Logger = &levelLogger{}
+
+// newLevelLogger returns a logger which only passes the messages at level or less verbose to logger.
+func newLevelLogger(logger log.Logger, level int) log.Logger {
+	return &levelLogger{inner: logger, level: level}
+}
+
+func (l *levelLogger) Debug(v ...interface{}) {
+	if l.level >= log.LOGLEVEL_DEBUG {
+		l.inner.Debug(v...)
+	}
+}
+
+func (l *levelLogger) Debugf(format string, v ...interface{}) {
+	if l.level >= log.LOGLEVEL_DEBUG {
+		l.inner.Debugf(format, v...)
+	}
+}
+
+func (l *levelLogger) Info(v ...interface{}) {
+	if l.level >= log.LOGLEVEL_INFO {
+		l.inner.Info(v...)
+	}
+}
+
+func (l *levelLogger) Infof(format string, v ...interface{}) {
+	if l.level >= log.LOGLEVEL_INFO {
+		l.inner.Infof(format, v...)
+	}
+}
+
+func (l *levelLogger) Config(v ...interface{}) {
+	if l.level >= log.LOGLEVEL_CONFIG {
+		l.inner.Config(v...)
+	}
+}
+
+func (l *levelLogger) Configf(format string, v ...interface{}) {
+	if l.level >= log.LOGLEVEL_CONFIG {
+		l.inner.Configf(format, v...)
+	}
+}
+
+func (l *levelLogger) Warn(v ...interface{}) {
+	if l.level >= log.LOGLEVEL_WARN {
+		l.inner.Warn(v...)
+	}
+}
+
+func (l *levelLogger) Warnf(format string, v ...interface{}) {
+	if l.level >= log.LOGLEVEL_WARN {
+		l.inner.Warnf(format, v...)
+	}
+}
+
+func (l *levelLogger) Error(v ...interface{}) {
+	if l.level >= log.LOGLEVEL_ERROR {
+		l.inner.Error(v...)
+	}
+}
+
+func (l *levelLogger) Errorf(format string, v ...interface{}) {
+	if l.level >= log.LOGLEVEL_ERROR {
+		l.inner.Errorf(format, v...)
+	}
+}
+
+func (l *levelLogger) Alert(v ...interface{}) {
+	if l.level >= log.LOGLEVEL_ALERT {
+		l.inner.Alert(v...)
+	}
+}
+
+func (l *levelLogger) Alertf(format string, v ...interface{}) {
+	if l.level >= log.LOGLEVEL_ALERT {
+		l.inner.Alertf(format, v...)
+	}
+}
+
+// Fatal is always logged, since it exits.
+func (l *levelLogger) Fatal(v ...interface{}) {
+	l.inner.Fatal(v...)
+}
+
+func (l *levelLogger) Fatalf(format string, v ...interface{}) {
+	l.inner.Fatalf(format, v...)
+}
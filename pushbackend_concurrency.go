@@ -0,0 +1,118 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ServiceConcurrencyStats describes the concurrent pushes of a service to its push service providers.
+type ServiceConcurrencyStats struct {
+	// InProgress is the number of pushes of the service to push service providers which have started but not finished.
+	InProgress int
+	// HighWaterMark is the most pushes of the service which were in progress at once, within the last concurrency_window to two concurrency_windows.
+	HighWaterMark int
+}
+
+// serviceConcurrency tracks the pushes in progress for each service, and their peak in the current and previous windows.
+type serviceConcurrency struct {
+	lock        sync.Mutex
+	window      time.Duration
+	windowStart time.Time
+	inProgress  map[string]int
+	peak        map[string]int
+	// previousPeak is the peak of each service in the window before windowStart.
+	previousPeak map[string]int
+}
+
+func newServiceConcurrency(window time.Duration, now time.Time) *serviceConcurrency {
+	return &serviceConcurrency{
+		window:       window,
+		windowStart:  now,
+		inProgress:   make(map[string]int),
+		peak:         make(map[string]int),
+		previousPeak: make(map[string]int),
+	}
+}
+
+// rotate starts a new window if the current one ended. This must be called with the lock held.
+func (c *serviceConcurrency) rotate(now time.Time) {
+	if now.Sub(c.windowStart) < c.window {
+		return
+	}
+	if now.Sub(c.windowStart) < 2*c.window {
+		c.previousPeak = c.peak
+	} else {
+		c.previousPeak = make(map[string]int)
+	}
+	// The pushes still in progress are the peak of the new window so far.
+	c.peak = make(map[string]int, len(c.inProgress))
+	for service, n := range c.inProgress {
+		c.peak[service] = n
+	}
+	c.windowStart = now
+}
+
+// start records a push of service which started, and returns a function to call once it finishes.
+func (c *serviceConcurrency) start(service string, now time.Time) (finish func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rotate(now)
+	c.inProgress[service]++
+	if n := c.inProgress[service]; n > c.peak[service] {
+		c.peak[service] = n
+	}
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.rotate(time.Now())
+		if c.inProgress[service]--; c.inProgress[service] == 0 {
+			delete(c.inProgress, service)
+		}
+	}
+}
+
+// stats returns the stats of each service with pushes in progress or in either window.
+func (c *serviceConcurrency) stats(now time.Time) map[string]ServiceConcurrencyStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.rotate(now)
+	result := make(map[string]ServiceConcurrencyStats)
+	for _, peaks := range []map[string]int{c.previousPeak, c.peak} {
+		for service, n := range peaks {
+			s := result[service]
+			if n > s.HighWaterMark {
+				s.HighWaterMark = n
+			}
+			result[service] = s
+		}
+	}
+	for service, n := range c.inProgress {
+		s := result[service]
+		s.InProgress = n
+		result[service] = s
+	}
+	return result
+}
+
+// ConcurrencyStats returns the pushes of each service to push service providers which are in progress, and the most that were in progress at once recently.
+// This shows whether limits on the concurrency of a service would be reached.
+func (backend *PushBackEnd) ConcurrencyStats() map[string]ServiceConcurrencyStats {
+	return backend.concurrency.stats(time.Now())
+}
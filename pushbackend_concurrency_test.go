@@ -0,0 +1,50 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestServiceConcurrency(t *testing.T) {
+	start := time.Now()
+	c := newServiceConcurrency(time.Hour, start)
+	finish1 := c.start("myservice", start)
+	finish2 := c.start("myservice", start)
+	finish3 := c.start("otherservice", start)
+	finish2()
+	finish3()
+	testutil.ExpectEquals(t, map[string]ServiceConcurrencyStats{
+		"myservice":    {InProgress: 1, HighWaterMark: 2},
+		"otherservice": {HighWaterMark: 1},
+	}, c.stats(start), "unexpected stats")
+
+	// The peak of the previous window is still reported, and the pushes in progress count towards the new window.
+	testutil.ExpectEquals(t, map[string]ServiceConcurrencyStats{
+		"myservice":    {InProgress: 1, HighWaterMark: 2},
+		"otherservice": {HighWaterMark: 1},
+	}, c.stats(start.Add(90*time.Minute)), "expected the peaks of the previous window to be kept")
+	finish1()
+	testutil.ExpectEquals(t, map[string]ServiceConcurrencyStats{
+		"myservice": {HighWaterMark: 1},
+	}, c.stats(start.Add(150*time.Minute)), "expected the peak of the new window to include the pushes which were in progress when it started")
+	testutil.ExpectEquals(t, map[string]ServiceConcurrencyStats{}, c.stats(start.Add(6*time.Hour)), "expected the peaks of older windows to be forgotten")
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// PushBackEndConfig contains the settings from the [Push] section of uniqush.conf which affect how pushes are sent and retried.
+type PushBackEndConfig struct {
+	// InitBackoff is the delay before the first retry of a failed push. Each subsequent retry waits twice as long as the previous one.
+	InitBackoff time.Duration
+	// MinBackoff is a floor for the delay before any retry.
+	// This prevents a push service which asks to retry immediately from turning retries into a busy loop.
+	MinBackoff time.Duration
+	// MaxBackoff is the longest delay before a retry. uniqush-push gives up once the next delay would exceed this.
+	MaxBackoff time.Duration
+	// MaxRetries is the maximum number of retries of a push to a delivery point (0 means retries are only limited by MaxBackoff).
+	// If this is set, the delay between retries stops increasing at MaxBackoff, instead of giving up.
+	MaxRetries int
+	// MaxRetryHistory is the number of delays of the latest retries of a push which are kept (e.g. for DeadLetter.Delays), so that a push retried many times doesn't keep growing (0 keeps all of them).
+	// This bounds memory use regardless of MaxRetries.
+	MaxRetryHistory int
+	// RetryCollapseKey gives each push without a collapse key (msggroup) one derived from its request ID, so that the duplicate sent by a retry of a push which was delivered despite failing (e.g. after a timeout)
+	// replaces the first copy on the device instead of being shown as well. Skipping delivery points which already succeeded only catches the successes which were reported.
+	RetryCollapseKey bool
+	// MaxPendingRetries is the maximum number of retries waiting for their backoff at once (0 means unlimited).
+	// This bounds memory use while a push service is down for a long time. RetryOverflow controls what happens to retries beyond this.
+	MaxPendingRetries int
+	// RetryOverflow is what happens to a retry when MaxPendingRetries retries are already waiting.
+	RetryOverflow string
+	// RetryRate is the maximum number of retries per second sent once their backoff elapses (0 means unlimited).
+	// This spreads out the retries which come due at once (e.g. after a push service recovers), instead of sending them in a burst.
+	RetryRate float64
+	// RetryRateBurst is the number of retries that can be sent at once before RetryRate applies.
+	RetryRateBurst int
+	// MaxPausedPushes is the maximum number of calls to /push that will be queued for a paused service. Pushes beyond this are rejected.
+	MaxPausedPushes int
+	// MaxDevicesPerSubscriber is the maximum number of delivery points of a subscriber to push to (0 means unlimited).
+	// The delivery points with the highest priorities are used, to avoid wasting push service quotas on abandoned devices.
+	MaxDevicesPerSubscriber int
+	// GlobalRate is the maximum number of pushes per second sent to delivery points, across all services (0 means unlimited).
+	GlobalRate float64
+	// GlobalRateBurst is the number of pushes that can be sent at once before GlobalRate applies.
+	GlobalRateBurst int
+	// GlobalRateReject controls what happens when GlobalRate is exceeded. If true, the push to that delivery point is rejected. If false, it waits.
+	GlobalRateReject bool
+	// MaxConcurrentPushes is the maximum number of calls to /push running at once (0 means unlimited), to keep resource use predictable under bursts of API calls.
+	MaxConcurrentPushes int
+	// ConcurrentPushesReject controls what happens when MaxConcurrentPushes calls are running. If true, the push is rejected. If false, it waits.
+	ConcurrentPushesReject bool
+	// MemoryLimit is the memory use (in bytes, as reported by the MemoryGauge) above which uniqush-push sheds load (0 means it doesn't), e.g. to avoid running out of memory while a push service is down and retries pile up.
+	// While above it, new pushes with MemoryShedPriority or a lower priority (see OptionQueuePriority) are rejected as UNIQUSH_ERROR_MEMORY_PRESSURE.
+	MemoryLimit uint64
+	// MemoryShedPriority is the highest priority of the pushes rejected because of MemoryLimit ("high", "normal", or "low").
+	MemoryShedPriority string
+	// MemoryPressureMaxRetries is the number of pending retries kept while above MemoryLimit (0 means none are dropped). The retries which have been waiting the longest are dropped first.
+	MemoryPressureMaxRetries int
+	// MemoryCheckInterval is how often the memory use is measured, since reading the memory statistics of the runtime briefly stops every goroutine.
+	MemoryCheckInterval time.Duration
+	// PriorityStarvationLimit is the number of calls with higher priorities (see OptionQueuePriority) which can get a slot ahead of a call waiting for one of MaxConcurrentPushes, before it gets the next slot (0 means higher priorities always go first).
+	PriorityStarvationLimit int
+	// DeliveryPointRate is the maximum number of pushes per second to a single delivery point (0 means unlimited).
+	// Pushes beyond this are rejected, to protect users from floods of notifications from a buggy caller.
+	DeliveryPointRate float64
+	// DeliveryPointRateBurst is the number of pushes that can be sent at once to a delivery point before DeliveryPointRate applies.
+	DeliveryPointRateBurst int
+	// AbortFailureRate is the fraction of failed pushes (e.g. 0.9) above which a push to many subscribers stops, and the remaining subscribers are reported as aborted (0 means never).
+	// This avoids wasting effort on the rest of a large broadcast with a bad payload, or during an outage of a push service.
+	AbortFailureRate float64
+	// AbortMinResults is the number of results of a push which are needed before AbortFailureRate is checked.
+	AbortMinResults int
+	// BatchTimeLimit is the longest a push to many subscribers keeps attempting more subscribers (0 means unlimited).
+	// Once it elapses, the remaining subscribers aren't attempted, so that a slow push service can't make a single bulk push run for an hour.
+	BatchTimeLimit time.Duration
+	// ConcurrencyWindow is how long the peak number of concurrent pushes of each service is remembered for ConcurrencyStats.
+	ConcurrencyWindow time.Duration
+	// BroadcastBatchSize is the number of subscribers read from the database at once by Broadcast. Each batch is pushed before reading the next one.
+	BroadcastBatchSize int
+	// DebugTiming enables debug logs of the time spent querying the database, waiting for each push service provider, and in total for each push.
+	DebugTiming bool
+	// ErrorLogThreshold is the number of identical push errors for a push service provider which are logged within ErrorLogWindow (0 means every error is logged).
+	// The rest are counted and logged as a single summary at the end of the window, to avoid floods of logs while a push service is down.
+	ErrorLogThreshold int
+	// ErrorLogWindow is the period over which ErrorLogThreshold applies.
+	ErrorLogWindow time.Duration
+	// ResponseTimeout is the longest time /push will wait for pushes to finish before responding (0 means no limit).
+	// Subscribers without any results yet are reported as timed out, and their pushes continue in the background.
+	// The results which arrive after the response (including the rest of the results of subscribers which had some) are only logged and counted in the metrics.
+	ResponseTimeout time.Duration
+	// MaxRequestAge is the maximum age of a push when it is requested, according to the time the caller created it (see OptionRequestTime). Older pushes are rejected (0 means any age is accepted).
+	// This prevents delivering stale notifications after a long backlog in the caller's queue, or a bad replay.
+	MaxRequestAge time.Duration
+	// IgnoreEmptySubscribers makes /push accept a push with an empty list of subscribers (e.g. a group with no members) as a push with no results, instead of reporting UNIQUSH_ERROR_NO_SUBSCRIBER.
+	IgnoreEmptySubscribers bool
+	// HookTimeout is the longest time the BeforePush of the push hooks, the payload encryptor or the notification signer may each take for a delivery point (0 means no limit).
+	// A push to a delivery point for which any of them takes longer fails with UNIQUSH_ERROR_HOOK_TIMEOUT, so that a pathological hook can't block the rest of the push.
+	HookTimeout time.Duration
+	// DuplicateDeliveryPoints controls what happens when the database returns the same delivery point more than once for a subscriber.
+	DuplicateDeliveryPoints string
+	// RetryOnPanic makes uniqush-push retry the pushes which a push service type didn't finish because it panicked, instead of reporting them as failed.
+	RetryOnPanic bool
+	// SerializeSubscribers makes pushes to the same subscriber wait for each other, so that the subscriber's devices receive them in order.
+	SerializeSubscribers bool
+	// SerializedDeliveryPoints contains the names of the delivery points whose pushes are sent one at a time, in order, by a worker for each delivery point.
+	// This is for very busy devices (e.g. a shared display), whose concurrent pushes would otherwise contend with each other. Other delivery points are pushed to concurrently.
+	SerializedDeliveryPoints map[string]bool
+	// SortSubscribers makes each push start pushing to its subscribers in sorted order, instead of the order they were given in, so that the order is reproducible.
+	SortSubscribers bool
+	// RecordRawResponses makes the push service types which support it (GCM and FCM) keep the status and body of the responses of the push service,
+	// so that they can be logged and included in the responses of /push, for debugging. This is off by default so that response bodies aren't kept during normal operation.
+	RecordRawResponses bool
+	// ShardCount is the number of instances of uniqush-push which subscribers are sharded across (0 or 1 means subscribers aren't sharded).
+	// Each instance only pushes to the subscribers of its shard ShardIndex (from 0 to ShardCount-1), and reports the others as UNIQUSH_NOT_MY_SHARD.
+	ShardCount int
+	ShardIndex int
+	// ContentDedupWindow is how long the content of a push to a subscriber is remembered (0 means it isn't).
+	// A push of the same content to the same subscriber within this window is suppressed as UNIQUSH_DUPLICATE_SUPPRESSED, to protect users from accidental double-sends.
+	ContentDedupWindow time.Duration
+	// WarmupTTL is how long the delivery points looked up by /warmup are used for pushes, instead of looking them up again.
+	WarmupTTL time.Duration
+	// ResolutionCacheSize is the number of subscribers whose delivery points, as resolved by their latest push, are cached for ResolutionCacheTTL (0 means they aren't cached).
+	// The least recently pushed subscribers are evicted first. Cached delivery points are invalidated when the subscriber's delivery points or the service's push service providers change.
+	ResolutionCacheSize int
+	ResolutionCacheTTL  time.Duration
+	// ReceiptTTL is how long a successful push waits for a delivery receipt, if there is a DeliveryReceiptHandler. Receipts which arrive later are ignored.
+	ReceiptTTL time.Duration
+	// MaxAwaitedReceipts is the maximum number of successful pushes waiting for their delivery receipts at once (0 means unlimited).
+	// The oldest pushes stop waiting first, so that push services which don't report every delivery don't make this grow without bound.
+	MaxAwaitedReceipts int
+	// RetryFailedUpdates makes uniqush-push retry saving data refreshed by a push service (e.g. a new registration id or auth token) if the database had a transient error.
+	RetryFailedUpdates bool
+	// RefreshReportsFailure makes /push report a failure instead of a success when a push service refreshes the data of a delivery point or push service provider (e.g. a new registration id), once it is saved.
+	// This is for callers which treat a refresh as a sign that the push should be checked or sent again.
+	RefreshReportsFailure bool
+	// UnsubscribeThreshold is the number of errors saying that a delivery point is no longer registered (with no successful push in between) which are needed to unsubscribe it.
+	// The default of 1 unsubscribes it after the first error. Higher values avoid removing devices because of spurious errors from a push service.
+	UnsubscribeThreshold int
+	// UnsubscribeWindow is the period within which UnsubscribeThreshold errors must be reported.
+	UnsubscribeWindow time.Duration
+	// BlacklistThreshold is the number of failed pushes to a delivery point within BlacklistWindow (with no successful push in between) after which it is skipped for BlacklistTTL (0 means delivery points are never skipped).
+	// Skipped pushes are reported as UNIQUSH_TEMPORARILY_SKIPPED, so that a device which keeps failing doesn't waste push service quotas until it recovers.
+	BlacklistThreshold int
+	BlacklistWindow    time.Duration
+	BlacklistTTL       time.Duration
+	// HealthRouting makes uniqush-push track a health score for each delivery point from the outcomes of recent pushes to it, and use it to order (or skip) the delivery points of a subscriber.
+	HealthRouting string
+	// HealthMinScore is the health score (from 0 to 1) below which delivery points are skipped if HealthRouting is HealthRoutingSkip.
+	HealthMinScore float64
+	// ErrorRateThreshold is the fraction of failed pushes (e.g. 0.2) of a service to a push service type within ErrorRateWindow above which the error rate alerter is notified (0 means error rates aren't tracked).
+	// The alerter is notified again once the error rate falls back to this or below.
+	ErrorRateThreshold float64
+	ErrorRateWindow    time.Duration
+	// ErrorRateMinPushes is the number of pushes within ErrorRateWindow required before ErrorRateThreshold applies, so that a few failures of a rarely used service don't raise an alert.
+	ErrorRateMinPushes int
+	// FieldLimits is what happens to a push whose notification has a field longer than the push service allows for that field (e.g. a collapse key which is too long for APNs).
+	// Total payload size is still checked by each push service type.
+	FieldLimits string
+	// NotificationDefaults maps a lowercase service name to the notification fields (e.g. a sound or icon) to add to each push of that service, unless the push sets them.
+	NotificationDefaults map[string]map[string]string
+	// PushServiceTypeDefaults maps a lowercase push service type (e.g. "apns") to the notification fields (e.g. a sound, or an Android channel_id) to add to each push sent with it, unless the push or the defaults of its service set them.
+	PushServiceTypeDefaults map[string]map[string]string
+	// MaxRetryAfter is the longest delay before a retry which a push service can ask for (e.g. with a Retry-After header), when that is longer than the backoff (0 means the backoff is always used).
+	// Longer requested delays are reduced to this, so that a misbehaving push service can't delay retries for days.
+	MaxRetryAfter time.Duration
+	// ServiceMaxRetryAfter maps a lowercase service name to its MaxRetryAfter, from a [retryafter:<service>] section.
+	ServiceMaxRetryAfter map[string]time.Duration
+	// ProviderFailover maps a lowercase service name to the names of its push service providers (e.g. a primary and a backup APNs certificate), from a [failover:<service>] section.
+	// When a push with one of them fails with an error which can be retried, the push to that delivery point is sent again with the next one (in this order) before scheduling a retry.
+	ProviderFailover map[string][]string
+	// PushBatching maps a lowercase service name to the batching of its pushes, from a [batching:<service>] section.
+	PushBatching map[string]PushBatching
+	// RetryWindows maps a lowercase service name to the time of day during which its retries may be sent. Retries which would be sent outside of it wait for the next window.
+	// Services without a window (e.g. urgent notifications) are retried at any time.
+	RetryWindows map[string]RetryWindow
+	// PushClasses maps the name of a class of pushes (see OptionClass) to its policy.
+	PushClasses map[string]*PushClass
+	// LoopbackServices contains the lowercase names of the services whose pushes are sent to the loopback push service type, which records them in memory (see /loopbackpushes),
+	// instead of to the push service types of their providers. This is for end-to-end tests of those services without reaching the external push services.
+	LoopbackServices map[string]bool
+}
+
+// Values of the duplicate_delivery_points setting.
+const (
+	// DuplicateDeliveryPointsPushAll pushes to every delivery point, as returned by the database.
+	DuplicateDeliveryPointsPushAll = "none"
+	// DuplicateDeliveryPointsDedup pushes only once to each delivery point name.
+	DuplicateDeliveryPointsDedup = "strict"
+	// DuplicateDeliveryPointsWarn pushes only once to each delivery point name, and logs a warning for each duplicate so that the data can be fixed.
+	DuplicateDeliveryPointsWarn = "warn"
+	// DuplicateDeliveryPointsHealthiest pushes only once to each delivery point name, through the push service provider of the duplicates with the best health score.
+	// This picks the provider which works when a device is reachable through more than one of them. See health_routing for how scores are computed.
+	DuplicateDeliveryPointsHealthiest = "healthiest"
+)
+
+// Values of the health_routing setting.
+const (
+	// HealthRoutingOff doesn't track the health of delivery points.
+	HealthRoutingOff = "off"
+	// HealthRoutingOrder pushes to the healthier delivery points of a subscriber first, among the ones with the same priority.
+	HealthRoutingOrder = "order"
+	// HealthRoutingSkip also skips the delivery points with a health score below health_min_score, reporting them as UNIQUSH_TEMPORARILY_SKIPPED.
+	HealthRoutingSkip = "skip"
+)
+
+// Values of the field_limits setting.
+const (
+	// FieldLimitsOff sends fields which exceed the limits of the push service unchanged and logs a warning, leaving the push service to ignore or reject them.
+	FieldLimitsOff = "off"
+	// FieldLimitsReject fails the push to the delivery points of that push service with UNIQUSH_ERROR_FIELD_LIMIT_EXCEEDED, without sending it.
+	FieldLimitsReject = "reject"
+	// FieldLimitsTruncate truncates the fields to the limits of the push service, and lists them in the adjustedFields of each result.
+	FieldLimitsTruncate = "truncate"
+	// FieldLimitsDrop removes the fields from the notification, and lists them in the adjustedFields of each result.
+	FieldLimitsDrop = "drop"
+)
+
+// Values of the retry_overflow setting.
+const (
+	// RetryOverflowReject doesn't retry the push, and reports it as failed.
+	RetryOverflowReject = "reject"
+	// RetryOverflowDropNewest doesn't retry the push, and reports it as dropped.
+	RetryOverflowDropNewest = "drop_newest"
+	// RetryOverflowDropOldest gives up on the retry which has been waiting the longest (reporting it as dropped), to make room for the new one.
+	RetryOverflowDropOldest = "drop_oldest"
+)
+
+// NewPushBackEndConfig returns the default settings of the push backend, which are used for any settings missing from uniqush.conf.
+func NewPushBackEndConfig() *PushBackEndConfig {
+	return &PushBackEndConfig{
+		InitBackoff:     5 * time.Second,
+		MinBackoff:      0,
+		MaxBackoff:      1 * time.Minute,
+		MaxPausedPushes: 1024,
+		WarmupTTL:       10 * time.Minute,
+		ErrorLogWindow:  10 * time.Second,
+		AbortMinResults: 100,
+		MaxRetryHistory: 100,
+
+		PriorityStarvationLimit: 10,
+
+		MemoryShedPriority:  "low",
+		MemoryCheckInterval: time.Second,
+
+		ResolutionCacheTTL: 30 * time.Second,
+		ConcurrencyWindow:  time.Minute,
+		ReceiptTTL:         time.Hour,
+		MaxAwaitedReceipts: 100000,
+
+		BroadcastBatchSize: 1000,
+
+		UnsubscribeThreshold: 1,
+		UnsubscribeWindow:    24 * time.Hour,
+
+		BlacklistWindow: 10 * time.Minute,
+		BlacklistTTL:    time.Hour,
+
+		HealthRouting:  HealthRoutingOff,
+		HealthMinScore: 0.2,
+
+		ErrorRateWindow:    5 * time.Minute,
+		ErrorRateMinPushes: 20,
+
+		FieldLimits: FieldLimitsOff,
+
+		DuplicateDeliveryPoints: DuplicateDeliveryPointsPushAll,
+		RetryOverflow:           RetryOverflowReject,
+	}
+}
+
+// notificationDefaultsSectionPrefix is the prefix of the sections of uniqush.conf which contain the default notification fields of a service, e.g. [defaults:myservice].
+const notificationDefaultsSectionPrefix = "defaults:"
+
+// applyNotificationDefaults returns notif with the default fields of service added, or notif itself if there are no defaults to add.
+// notif is shared with the caller, so it is cloned instead of modified.
+func (c *PushBackEndConfig) applyNotificationDefaults(service string, notif *push.Notification) *push.Notification {
+	return mergeDefaults(c.NotificationDefaults[strings.ToLower(service)], notif)
+}
+
+// pushServiceTypeDefaultsSectionPrefix is the prefix of the sections of uniqush.conf which contain the default notification fields of a push service type, e.g. [typedefaults:apns].
+const pushServiceTypeDefaultsSectionPrefix = "typedefaults:"
+
+// applyPushServiceTypeDefaults returns notif with the default fields of pushServiceType (e.g. "fcm") added, or notif itself if there are no defaults to add.
+// These apply after the defaults of the service, so a default of the service overrides the default of the push service type.
+func (c *PushBackEndConfig) applyPushServiceTypeDefaults(pushServiceType string, notif *push.Notification) *push.Notification {
+	return mergeDefaults(c.PushServiceTypeDefaults[strings.ToLower(pushServiceType)], notif)
+}
+
+// mergeDefaults returns notif with the fields of defaults which notif doesn't set added, cloning notif instead of modifying it.
+func mergeDefaults(defaults map[string]string, notif *push.Notification) *push.Notification {
+	merged := notif
+	for k, v := range defaults {
+		if _, ok := notif.Data[k]; ok {
+			continue
+		}
+		if merged == notif {
+			merged = notif.Clone()
+		}
+		merged.Data[k] = v
+	}
+	return merged
+}
+
+// retryAfterSectionPrefix is the prefix of the sections of uniqush.conf which override max_retry_after for a service, e.g. [retryafter:myservice].
+const retryAfterSectionPrefix = "retryafter:"
+
+// retryAfter returns the delay to use before a retry of a push of service, given its backoff and the delay requested by the push service.
+// clamped is true if the requested delay was reduced to max_retry_after. The delay is never shorter than the backoff, or than min_backoff.
+func (c *PushBackEndConfig) retryAfter(service string, backoff time.Duration, requested time.Duration) (delay time.Duration, clamped bool) {
+	max := c.MaxRetryAfter
+	if d, ok := c.ServiceMaxRetryAfter[strings.ToLower(service)]; ok {
+		max = d
+	}
+	delay = backoff
+	if max > 0 && requested > backoff {
+		delay = requested
+		if requested > max {
+			delay, clamped = max, true
+			if delay < backoff {
+				delay = backoff
+			}
+		}
+	}
+	if delay < c.MinBackoff {
+		delay = c.MinBackoff
+	}
+	return delay, clamped
+}
+
+// retryBackoff returns the delay to use before retrying a push, given the delay accumulated by previous attempts (0 for the first retry).
+func (c *PushBackEndConfig) retryBackoff(after time.Duration) time.Duration {
+	if after == 0 {
+		after = c.InitBackoff
+	}
+	if after < c.MinBackoff {
+		after = c.MinBackoff
+	}
+	return after
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// retryLookup retries the whole push to sub after looking up its delivery points failed with a transient database error (see isTransientError).
+// The retry uses the same backoff, limits and queue as the retries of failed pushes (see scheduleRetry).
+// If the lookup won't be retried (e.g. after max_retries), dbErr is reported as a database error.
+func (backend *PushBackEnd) retryLookup(
+	reqID string,
+	remoteAddr string,
+	service string,
+	sub string,
+	dpNamesRequested []string,
+	notif *push.Notification,
+	perdp map[string][]string,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+	dbErr error,
+) {
+	backend.scheduleRetry(reqID, retryAttempt{
+		service: service,
+		sub:     sub,
+		notif:   notif,
+		target:  fmt.Sprintf("Database Error: %v,", dbErr),
+		abandon: func(code string, reason string) {
+			logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: Database Error: %v, not retrying the database lookup: %s", reqID, service, sub, dbErr, reason)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(dbErr)})
+		},
+		drop: func(reason string) {
+			logger.Errorf("RequestID=%v Service=%v Subscriber=%v Not retrying the database lookup: %s", reqID, service, sub, reason)
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_RETRY_DROPPED, ErrorMsg: strPtrOfErr(dbErr)})
+		},
+		retrying: func(nextAttempt int64, retries int, schedule []int64) {
+			handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_PUSH_RETRYING, ErrorMsg: strPtrOfErr(dbErr), NextAttempt: &nextAttempt, RetrySchedule: schedule})
+		},
+		send: func(next retryState) {
+			content, ok := remainingTTL(notif, retry.submitted, time.Now())
+			if !ok {
+				logger.Errorf("RequestID=%v Service=%v Subscriber=%v Not retrying the database lookup: the ttl of the notification elapsed", reqID, service, sub)
+				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_EXPIRED, ErrorMsg: strPtrOfErr(dbErr)})
+				return
+			}
+			backend.pushImpl(reqID, remoteAddr, service, []string{sub}, dpNamesRequested, content, perdp, backend.loggers[LoggerPush], nil, nil, next, handler)
+		},
+	}, retry, logger)
+}
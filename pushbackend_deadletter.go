@@ -0,0 +1,74 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// DeadLetter describes a push to a delivery point which uniqush-push gave up on after exhausting its retries.
+type DeadLetter struct {
+	RequestID           string
+	Service             string
+	Subscriber          string
+	PushServiceProvider *push.PushServiceProvider
+	DeliveryPoint       *push.DeliveryPoint
+	Notification        *push.Notification
+	// Attempts is the total number of attempts, including the first one.
+	Attempts int
+	// Delays are the delays before each retry, or before the last max_retry_history retries if there were more.
+	Delays []time.Duration
+	// LastError is the error of the last attempt.
+	LastError error
+	// Submitted is when the push was requested. This is zero if the push wasn't requested through /push (e.g. a retry requested by a push service's error report).
+	Submitted time.Time
+}
+
+// DeadLetterHandler receives the pushes which uniqush-push gave up on after exhausting their retries (e.g. to store them for analysis).
+type DeadLetterHandler interface {
+	HandleDeadLetter(letter *DeadLetter)
+}
+
+// SetDeadLetterHandler sets the handler for pushes which failed after exhausting their retries. This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetDeadLetterHandler(handler DeadLetterHandler) {
+	backend.deadLetterHandler = handler
+}
+
+func (backend *PushBackEnd) deadLetter(reqID string, service string, sub string, err *push.RetryError, retry retryState) {
+	if backend.deadLetterHandler == nil {
+		return
+	}
+	var lastError error = err
+	if err.Reason != nil {
+		lastError = err.Reason
+	}
+	backend.deadLetterHandler.HandleDeadLetter(&DeadLetter{
+		RequestID:           reqID,
+		Service:             service,
+		Subscriber:          sub,
+		PushServiceProvider: err.Provider,
+		DeliveryPoint:       err.Destination,
+		Notification:        err.Content,
+		Attempts:            retry.retries + 1,
+		Delays:              retry.delays,
+		LastError:           lastError,
+		Submitted:           retry.submitted,
+	})
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+type recentContentKey struct {
+	service string
+	sub     string
+	hash    uint64
+}
+
+// recentContents remembers the contents recently pushed to each subscriber, to suppress accidental duplicate pushes (see content_dedup_window).
+type recentContents struct {
+	lock      sync.Mutex
+	pushed    map[recentContentKey]time.Time
+	window    time.Duration
+	lastPrune time.Time
+}
+
+func newRecentContents(window time.Duration) *recentContents {
+	return &recentContents{
+		pushed:    make(map[recentContentKey]time.Time),
+		window:    window,
+		lastPrune: time.Now(),
+	}
+}
+
+// add records that content with the given hash is being pushed to sub of service.
+// It returns false without recording anything if the same content was already pushed to sub within the window.
+func (r *recentContents) add(service string, sub string, hash uint64, now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	key := recentContentKey{service, sub, hash}
+	if pushedAt, ok := r.pushed[key]; ok && now.Sub(pushedAt) < r.window {
+		return false
+	}
+	r.pushed[key] = now
+	if now.Sub(r.lastPrune) >= r.window {
+		for k, pushedAt := range r.pushed {
+			if now.Sub(pushedAt) >= r.window {
+				delete(r.pushed, k)
+			}
+		}
+		r.lastPrune = now
+	}
+	return true
+}
+
+// contentHash returns a hash of the fields of notif which are sent to push services.
+// The options of uniqush-push (e.g. uniqush.request_time) are ignored, since they can differ between pushes of the same content.
+func contentHash(notif *push.Notification) uint64 {
+	keys := make([]string, 0, len(notif.Data))
+	for k := range notif.Data {
+		if !strings.HasPrefix(k, "uniqush.") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(notif.Data[k]))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
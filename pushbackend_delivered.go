@@ -0,0 +1,109 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// deliveredKey identifies a delivery point within a request to /push.
+type deliveredKey struct {
+	reqID  string
+	dpName string
+}
+
+type deliveredEntry struct {
+	msgID     string
+	timestamp time.Time
+}
+
+// deliveredPushes remembers the message ids returned by push services for recent successful pushes.
+// A push that is reported as failed (e.g. a timeout) may have actually been delivered by another attempt for the same request.
+// This is used to avoid retrying and delivering the same notification to the same delivery point twice.
+// The entries of a request are kept while it has pending retries, however long those take (e.g. because of max_retry_after or a retry window), and expire ttl after they were added otherwise.
+type deliveredPushes struct {
+	lock    sync.Mutex
+	entries map[deliveredKey]deliveredEntry
+	// retrying counts the pending retries of each request.
+	retrying  map[string]int
+	ttl       time.Duration
+	lastPrune time.Time
+}
+
+func newDeliveredPushes(ttl time.Duration) *deliveredPushes {
+	return &deliveredPushes{
+		entries:   make(map[deliveredKey]deliveredEntry),
+		retrying:  make(map[string]int),
+		ttl:       ttl,
+		lastPrune: time.Now(),
+	}
+}
+
+// retain keeps the entries of reqID until the matching call to release. This is called for each retry of reqID while it is pending.
+func (d *deliveredPushes) retain(reqID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.retrying[reqID]++
+}
+
+// release undoes a call to retain once a retry of reqID was sent or given up on.
+func (d *deliveredPushes) release(reqID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.retrying[reqID] <= 1 {
+		delete(d.retrying, reqID)
+		return
+	}
+	d.retrying[reqID]--
+}
+
+// expiredLocked returns true if the entry for key is older than ttl and its request has no pending retries.
+func (d *deliveredPushes) expiredLocked(key deliveredKey, entry deliveredEntry, now time.Time) bool {
+	return now.Sub(entry.timestamp) >= d.ttl && d.retrying[key.reqID] == 0
+}
+
+// add records that the push for reqID was delivered to dpName, with the msgID returned by the push service.
+func (d *deliveredPushes) add(reqID string, dpName string, msgID string) {
+	now := time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.entries[deliveredKey{reqID, dpName}] = deliveredEntry{msgID: msgID, timestamp: now}
+	if now.Sub(d.lastPrune) < d.ttl {
+		return
+	}
+	// Entries of requests without pending retries will never be looked up again once they are older than ttl.
+	for key, entry := range d.entries {
+		if d.expiredLocked(key, entry, now) {
+			delete(d.entries, key)
+		}
+	}
+	d.lastPrune = now
+}
+
+// get returns the msgID of the successful push of reqID to dpName, if there was one.
+func (d *deliveredPushes) get(reqID string, dpName string) (msgID string, delivered bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	key := deliveredKey{reqID, dpName}
+	entry, ok := d.entries[key]
+	if !ok || d.expiredLocked(key, entry, time.Now()) {
+		return "", false
+	}
+	return entry.msgID, true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestDeliveredPushes(t *testing.T) {
+	d := newDeliveredPushes(time.Minute)
+	_, delivered := d.get("req1", "apns:abc")
+	testutil.ExpectEquals(t, false, delivered, "expected nothing to be delivered yet")
+
+	d.add("req1", "apns:abc", "msg1")
+	msgID, delivered := d.get("req1", "apns:abc")
+	testutil.ExpectEquals(t, true, delivered, "expected push to be delivered")
+	testutil.ExpectStringEquals(t, "msg1", msgID, "unexpected msgID")
+
+	_, delivered = d.get("req2", "apns:abc")
+	testutil.ExpectEquals(t, false, delivered, "expected other requests to be unaffected")
+	_, delivered = d.get("req1", "apns:def")
+	testutil.ExpectEquals(t, false, delivered, "expected other delivery points to be unaffected")
+}
+
+func TestDeliveredPushesExpire(t *testing.T) {
+	d := newDeliveredPushes(time.Minute)
+	d.add("req1", "apns:abc", "msg1")
+	d.entries[deliveredKey{"req1", "apns:abc"}] = deliveredEntry{msgID: "msg1", timestamp: time.Now().Add(-2 * time.Minute)}
+	_, delivered := d.get("req1", "apns:abc")
+	testutil.ExpectEquals(t, false, delivered, "expected old entries to expire")
+
+	d.lastPrune = time.Now().Add(-2 * time.Minute)
+	d.add("req2", "apns:abc", "msg2")
+	testutil.ExpectEquals(t, 1, len(d.entries), "expected expired entries to be pruned")
+}
+
+func TestDeliveredPushesKeptWhileRetrying(t *testing.T) {
+	d := newDeliveredPushes(time.Minute)
+	d.retain("req1")
+	d.retain("req1")
+	d.entries[deliveredKey{"req1", "apns:abc"}] = deliveredEntry{msgID: "msg1", timestamp: time.Now().Add(-2 * time.Minute)}
+	d.lastPrune = time.Now().Add(-2 * time.Minute)
+	d.add("req2", "apns:abc", "msg2")
+	_, delivered := d.get("req1", "apns:abc")
+	testutil.ExpectEquals(t, true, delivered, "expected entries of requests with pending retries to be kept")
+
+	d.release("req1")
+	_, delivered = d.get("req1", "apns:abc")
+	testutil.ExpectEquals(t, true, delivered, "expected entries to be kept until every retry is released")
+	d.release("req1")
+	_, delivered = d.get("req1", "apns:abc")
+	testutil.ExpectEquals(t, false, delivered, "expected old entries to expire once the retries are released")
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+)
+
+// deliveryPointWorkers runs the pushes to each of the delivery points of serialized_delivery_points one at a time, in the order they were submitted.
+// For example, a shared display may receive many concurrent pushes, which would otherwise contend with each other at the push service.
+type deliveryPointWorkers struct {
+	lock sync.Mutex
+	// queues contains the pushes waiting for the worker of each delivery point (by name). A delivery point has an entry while its worker is running.
+	queues map[string][]func()
+}
+
+func newDeliveryPointWorkers() *deliveryPointWorkers {
+	return &deliveryPointWorkers{queues: make(map[string][]func())}
+}
+
+// do runs push on the worker of the delivery point dpName, after the pushes submitted to that worker before it, and waits for push to finish.
+func (w *deliveryPointWorkers) do(dpName string, push func()) {
+	done := make(chan struct{})
+	w.submit(dpName, func() {
+		defer close(done)
+		push()
+	})
+	<-done
+}
+
+// submit queues push for the worker of the delivery point dpName, starting the worker if it isn't running.
+func (w *deliveryPointWorkers) submit(dpName string, push func()) {
+	w.lock.Lock()
+	queue, running := w.queues[dpName]
+	w.queues[dpName] = append(queue, push)
+	w.lock.Unlock()
+	if !running {
+		go w.run(dpName)
+	}
+}
+
+// run sends the queued pushes of the delivery point dpName until there are none left.
+func (w *deliveryPointWorkers) run(dpName string) {
+	for {
+		w.lock.Lock()
+		queue := w.queues[dpName]
+		if len(queue) == 0 {
+			delete(w.queues, dpName)
+			w.lock.Unlock()
+			return
+		}
+		push := queue[0]
+		w.queues[dpName] = queue[1:]
+		w.lock.Unlock()
+		push()
+	}
+}
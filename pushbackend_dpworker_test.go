@@ -0,0 +1,67 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestDeliveryPointWorkers(t *testing.T) {
+	w := newDeliveryPointWorkers()
+	var running int32
+	var lock sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		w.submit("dp1", func() {
+			defer wg.Done()
+			if atomic.AddInt32(&running, 1) != 1 {
+				t.Errorf("Expected pushes to the same delivery point not to run concurrently")
+			}
+			time.Sleep(time.Millisecond)
+			lock.Lock()
+			order = append(order, i)
+			lock.Unlock()
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	// Other delivery points don't wait for dp1.
+	w.do("dp2", func() {})
+	wg.Wait()
+	testutil.ExpectEquals(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, order, "expected the pushes to run in the order they were submitted")
+
+	// The worker exits once its queue is empty.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		w.lock.Lock()
+		n := len(w.queues)
+		w.lock.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the workers to exit, got %d running", n)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// PayloadEncryptor encrypts the notifications sent to each delivery point (e.g. with a key of the subscriber), so that the external push service never sees their contents.
+type PayloadEncryptor interface {
+	// EncryptNotification returns the notification to send to dp instead of notif, e.g. with a single field containing the ciphertext which the app decrypts.
+	// notif must not be modified. If it returns an error, the push to dp fails instead of sending notif unencrypted.
+	EncryptNotification(service string, sub string, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, error)
+}
+
+// SetPayloadEncryptor sets the encryptor for the notifications sent to each delivery point. This must be called before the backend starts sending pushes.
+// With an encryptor, each delivery point gets its own push to its push service provider, instead of sharing one with the other delivery points of that provider.
+func (backend *PushBackEnd) SetPayloadEncryptor(encryptor PayloadEncryptor) {
+	backend.encryptor = encryptor
+}
+
+// encryptionError is the error of a push which wasn't sent because the notification couldn't be encrypted.
+type encryptionError struct {
+	*push.ErrorReport
+}
+
+func newEncryptionError(err error) *encryptionError {
+	return &encryptionError{push.NewErrorf("failed to encrypt the notification: %v", err)}
+}
+
+// encryptNotification returns notif encrypted for dp by the payload encryptor, or notif itself if there is no encryptor.
+// Like the push hooks, the encryptor is limited by hook_timeout.
+func (backend *PushBackEnd) encryptNotification(service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, push.Error) {
+	if backend.encryptor == nil {
+		return notif, nil
+	}
+	var encrypted *push.Notification
+	err := backend.withHookTimeout(service, psp, func() error {
+		var err error
+		encrypted, err = backend.encryptor.EncryptNotification(service, dp.FixedData["subscriber"], dp, notif)
+		return err
+	})
+	if err == errHookTimeout {
+		return nil, &hookTimeoutError{push.NewError("failed to encrypt the notification: the encryptor didn't finish within hook_timeout")}
+	}
+	if err != nil {
+		return nil, newEncryptionError(err)
+	}
+	return encrypted, nil
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// errorRateBuckets is the number of intervals error_rate_window is divided into. Counts expire one interval at a time, as the window moves.
+const errorRateBuckets = 10
+
+// ErrorRateAlerter is notified when the error rate of the pushes of a service to a push service type (e.g. "fcm") crosses error_rate_threshold, e.g. to page whoever is on call.
+// The methods are called synchronously by the push which crossed the threshold, so they should return quickly.
+type ErrorRateAlerter interface {
+	// ErrorRateExceeded is called when the fraction of failed pushes within error_rate_window rises above error_rate_threshold.
+	// pushes is the number of pushes within the window, which is at least error_rate_min_pushes.
+	ErrorRateExceeded(service string, pushServiceType string, rate float64, pushes int)
+	// ErrorRateRecovered is called when the error rate falls back to error_rate_threshold or below, after ErrorRateExceeded was called.
+	ErrorRateRecovered(service string, pushServiceType string, rate float64, pushes int)
+}
+
+// SetErrorRateAlerter sets the alerter which is notified when error rates cross error_rate_threshold. This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetErrorRateAlerter(alerter ErrorRateAlerter) {
+	backend.errorRateAlerter = alerter
+}
+
+type errorRateKey struct {
+	service         string
+	pushServiceType string
+}
+
+type errorRateBucket struct {
+	// interval is the number of the interval of error_rate_window counted by this bucket, since the unix epoch.
+	interval int64
+	pushes   int
+	failures int
+}
+
+type errorRateCounts struct {
+	buckets  [errorRateBuckets]errorRateBucket
+	alerting bool
+}
+
+// errorRates counts the pushes and failures of each service and push service type within a moving window.
+type errorRates struct {
+	lock      sync.Mutex
+	interval  time.Duration
+	threshold float64
+	minPushes int
+	counts    map[errorRateKey]*errorRateCounts
+}
+
+func newErrorRates(window time.Duration, threshold float64, minPushes int) *errorRates {
+	interval := window / errorRateBuckets
+	if interval <= 0 {
+		interval = 1
+	}
+	return &errorRates{
+		interval:  interval,
+		threshold: threshold,
+		minPushes: minPushes,
+		counts:    make(map[errorRateKey]*errorRateCounts),
+	}
+}
+
+// record counts a push of service to pushServiceType. It returns changed=true if this made the error rate cross the threshold,
+// and whether the error rate is now above the threshold.
+func (e *errorRates) record(service string, pushServiceType string, failed bool, now time.Time) (changed bool, alerting bool, rate float64, pushes int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	key := errorRateKey{service: service, pushServiceType: pushServiceType}
+	c, ok := e.counts[key]
+	if !ok {
+		c = new(errorRateCounts)
+		e.counts[key] = c
+	}
+	current := now.UnixNano() / int64(e.interval)
+	b := &c.buckets[current%errorRateBuckets]
+	if b.interval != current {
+		*b = errorRateBucket{interval: current}
+	}
+	b.pushes++
+	if failed {
+		b.failures++
+	}
+	failures := 0
+	for _, b := range c.buckets {
+		if b.interval > current-errorRateBuckets {
+			pushes += b.pushes
+			failures += b.failures
+		}
+	}
+	rate = float64(failures) / float64(pushes)
+	if !c.alerting && pushes >= e.minPushes && rate > e.threshold {
+		c.alerting = true
+		return true, true, rate, pushes
+	}
+	if c.alerting && rate <= e.threshold {
+		c.alerting = false
+		return true, false, rate, pushes
+	}
+	return false, c.alerting, rate, pushes
+}
+
+// recordErrorRate counts the result of a push of service, if error_rate_threshold is set, and notifies the error rate alerter if the error rate crossed the threshold.
+// Updates to the saved data of a delivery point or push service provider aren't an outcome of the push, and are ignored.
+func (backend *PushBackEnd) recordErrorRate(service string, res *push.Result) {
+	if backend.errorRates == nil || (res.Err != nil && !isDeliveryFailure(res.Err)) {
+		return
+	}
+	var pushServiceType string
+	if res.Destination != nil {
+		pushServiceType = res.Destination.PushServiceName()
+	} else if res.Provider != nil {
+		pushServiceType = res.Provider.PushServiceName()
+	} else {
+		return
+	}
+	changed, alerting, rate, pushes := backend.errorRates.record(service, pushServiceType, res.Err != nil, time.Now())
+	if !changed {
+		return
+	}
+	logger := backend.loggers[LoggerPush]
+	if alerting {
+		logger.Warnf("Service=%v PushServiceType=%v Error rate %.2f of %d pushes within error_rate_window exceeds error_rate_threshold", service, pushServiceType, rate, pushes)
+		if backend.errorRateAlerter != nil {
+			backend.errorRateAlerter.ErrorRateExceeded(service, pushServiceType, rate, pushes)
+		}
+		return
+	}
+	logger.Infof("Service=%v PushServiceType=%v Error rate %.2f of %d pushes within error_rate_window recovered", service, pushServiceType, rate, pushes)
+	if backend.errorRateAlerter != nil {
+		backend.errorRateAlerter.ErrorRateRecovered(service, pushServiceType, rate, pushes)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// DeliveryEvent is the outcome of a push to a delivery point, as published to a message bus by an EventPublisherHook.
+type DeliveryEvent struct {
+	PushServiceType     string    `json:"push_service_type"`
+	PushServiceProvider string    `json:"push_service_provider"`
+	DeliveryPoint       string    `json:"delivery_point"`
+	MsgID               string    `json:"msgid,omitempty"`
+	Error               string    `json:"error,omitempty"`
+	Timestamp           time.Time `json:"timestamp"`
+}
+
+// MessagePublisher publishes a message to a topic of a message bus (e.g. a Kafka producer or a NATS connection).
+// Publish should only return nil once the message bus has accepted the message.
+type MessagePublisher interface {
+	Publish(topic string, message []byte) error
+}
+
+// EventPublisherHook is a PushHook which publishes a DeliveryEvent (encoded as JSON) to a topic for the outcome of every push.
+// Events are buffered, so that pushes don't wait for the message bus. Events which fail to publish are retried until they succeed (i.e. at least once).
+// If the message bus is down for long enough to fill the buffer, new events are dropped (and counted) instead of blocking pushes.
+type EventPublisherHook struct {
+	dropped int64 // accessed atomically
+
+	publisher  MessagePublisher
+	topic      string
+	buffer     chan []byte
+	retryDelay time.Duration
+	logger     log.Logger
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+var _ PushHook = &EventPublisherHook{}
+
+// maxEventRetryDelay is the longest delay between attempts to publish an event.
+const maxEventRetryDelay = 30 * time.Second
+
+// NewEventPublisherHook returns a hook which publishes the outcome of every push to topic, buffering up to bufferSize events while the message bus is slow or down.
+// Register it with AddPushHook.
+func NewEventPublisherHook(publisher MessagePublisher, topic string, bufferSize int, logger log.Logger) *EventPublisherHook {
+	hook := &EventPublisherHook{
+		publisher:  publisher,
+		topic:      topic,
+		buffer:     make(chan []byte, bufferSize),
+		retryDelay: time.Second,
+		logger:     logger,
+		done:       make(chan struct{}),
+	}
+	go hook.run()
+	return hook
+}
+
+// BeforePush never rejects or changes pushes.
+func (hook *EventPublisherHook) BeforePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, error) {
+	return notif, nil
+}
+
+// AfterPush queues the outcome of the push to dp to be published.
+func (hook *EventPublisherHook) AfterPush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, msgID string, err error) {
+	event := DeliveryEvent{
+		PushServiceProvider: psp.Name(),
+		PushServiceType:     psp.PushServiceName(),
+		DeliveryPoint:       dp.Name(),
+		MsgID:               msgID,
+		Timestamp:           time.Now(),
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	message, e := json.Marshal(event)
+	if e != nil {
+		hook.logger.Errorf("PushServiceProvider=%v DeliveryPoint=%v Failed to encode delivery event: %v", event.PushServiceProvider, event.DeliveryPoint, e)
+		return
+	}
+	select {
+	case hook.buffer <- message:
+	default:
+		atomic.AddInt64(&hook.dropped, 1)
+		hook.logger.Errorf("PushServiceProvider=%v DeliveryPoint=%v Dropped delivery event: buffer of topic %v is full", event.PushServiceProvider, event.DeliveryPoint, hook.topic)
+	}
+}
+
+// run publishes the buffered events in order, retrying each one with backoff until it is published.
+func (hook *EventPublisherHook) run() {
+	defer close(hook.done)
+	for message := range hook.buffer {
+		delay := hook.retryDelay
+		for {
+			err := hook.publisher.Publish(hook.topic, message)
+			if err == nil {
+				break
+			}
+			hook.logger.Errorf("Failed to publish delivery event to topic %v, retrying after %v: %v", hook.topic, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > maxEventRetryDelay {
+				delay = maxEventRetryDelay
+			}
+		}
+	}
+}
+
+// Dropped returns the number of events which were dropped because the buffer was full.
+func (hook *EventPublisherHook) Dropped() int64 {
+	return atomic.LoadInt64(&hook.dropped)
+}
+
+// Close waits for the buffered events to be published. It must be called after the backend has stopped pushing (e.g. after Finalize).
+func (hook *EventPublisherHook) Close() {
+	hook.closeOnce.Do(func() {
+		close(hook.buffer)
+	})
+	<-hook.done
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// flakyPublisher fails the first failures calls to Publish, then records the published messages.
+type flakyPublisher struct {
+	lock     sync.Mutex
+	failures int
+	topics   []string
+	messages [][]byte
+}
+
+func (p *flakyPublisher) Publish(topic string, message []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("message bus is down")
+	}
+	p.topics = append(p.topics, topic)
+	p.messages = append(p.messages, message)
+	return nil
+}
+
+func TestEventPublisherHook(t *testing.T) {
+	backend, mdb, _ := newTestPushBackEnd(nil)
+	publisher := &flakyPublisher{failures: 1}
+	hook := NewEventPublisherHook(publisher, "push-events", 10, backend.loggers[LoggerPush])
+	hook.retryDelay = time.Millisecond
+	backend.AddPushHook(hook)
+	dp := mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	hook.Close()
+
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	if len(publisher.messages) != 1 {
+		t.Fatalf("Expected 1 published event, got %d", len(publisher.messages))
+	}
+	testutil.ExpectEquals(t, "push-events", publisher.topics[0], "unexpected topic")
+	var event DeliveryEvent
+	if err := json.Unmarshal(publisher.messages[0], &event); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	testutil.ExpectEquals(t, dp.Name(), event.DeliveryPoint, "unexpected delivery point")
+	testutil.ExpectEquals(t, mockPushServiceTypeName, event.PushServiceType, "unexpected push service type")
+	testutil.ExpectEquals(t, "", event.Error, "expected the push to succeed")
+	testutil.ExpectEquals(t, int64(0), hook.Dropped(), "expected no dropped events")
+}
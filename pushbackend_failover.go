@@ -0,0 +1,106 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// providerFailoverSectionPrefix is the prefix of the sections of uniqush.conf which list the push service providers of a service to fail over between, e.g. [failover:myservice].
+const providerFailoverSectionPrefix = "failover:"
+
+// ProviderFailoverResolver finds the push service providers to try when a push service provider fails to push to a delivery point with an error which can be retried (e.g. a backup APNs certificate).
+type ProviderFailoverResolver interface {
+	// FailoverProviders returns the providers to try instead of psp for dp, in order. They must have the same push service type as dp.
+	FailoverProviders(service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint) ([]*push.PushServiceProvider, error)
+}
+
+// SetProviderFailoverResolver overrides how the push service providers to fail over to are found (by default, from the [failover:<service>] sections of uniqush.conf).
+// This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetProviderFailoverResolver(resolver ProviderFailoverResolver) {
+	backend.failover = resolver
+}
+
+// configuredProviderFailover fails over between the push service providers listed (by name) for each service in uniqush.conf.
+type configuredProviderFailover struct {
+	db db.PushDatabase
+	// providers maps a lowercase service name to the names of its push service providers, in the order they are tried.
+	providers map[string][]string
+}
+
+var _ ProviderFailoverResolver = &configuredProviderFailover{}
+
+// FailoverProviders returns the providers listed for service, except psp and the providers which can't push to dp.
+func (f *configuredProviderFailover) FailoverProviders(service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint) ([]*push.PushServiceProvider, error) {
+	names := f.providers[strings.ToLower(service)]
+	if len(names) == 0 {
+		return nil, nil
+	}
+	psps, err := f.db.GetPushServiceProviderConfigs()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*push.PushServiceProvider, len(psps))
+	for _, candidate := range psps {
+		if candidate.FixedData["service"] == service && candidate.PushServiceName() == dp.PushServiceName() {
+			byName[candidate.Name()] = candidate
+		}
+	}
+	var result []*push.PushServiceProvider
+	for _, name := range names {
+		if candidate, ok := byName[name]; ok && name != psp.Name() {
+			result = append(result, candidate)
+		}
+	}
+	return result, nil
+}
+
+// failOver pushes to the delivery point of err with the next push service provider of the service which hasn't failed in this attempt, and returns true if there was one.
+// The results of that push are reported like those of the original push, so a retryable failure fails over again until every provider was tried.
+func (backend *PushBackEnd) failOver(reqID string, remoteAddr string, service string, sub string, err *push.RetryError, logger log.Logger, retry retryState, handler APIResponseHandler) bool {
+	if backend.failover == nil {
+		return false
+	}
+	providerName := err.Provider.Name()
+	destinationName := err.Destination.Name()
+	providers, lookupErr := backend.failover.FailoverProviders(service, err.Provider, err.Destination)
+	if lookupErr != nil {
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Cannot get the push service providers to fail over to: %v", reqID, service, sub, providerName, destinationName, lookupErr)
+		return false
+	}
+	failed := retry.withFailedProvider(providerName)
+	for _, psp := range providers {
+		if failed.providerFailed(psp.Name()) {
+			continue
+		}
+		logger.Warnf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failing over to PushServiceProvider=%v: %v", reqID, service, sub, providerName, destinationName, psp.Name(), err)
+		results := backend.pushToDeliveryPoint(reqID, service, psp, err.Destination, err.Content, logger)
+		resChan := make(chan *push.Result, len(results))
+		for _, res := range results {
+			resChan <- res
+		}
+		close(resChan)
+		backend.collectResult(reqID, remoteAddr, service, resChan, logger, failed, handler)
+		return true
+	}
+	return false
+}
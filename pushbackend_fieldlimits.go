@@ -0,0 +1,115 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// adjustedFieldsKey is set to the comma-separated keys of a notification which field_limits truncated or dropped before the push.
+// Like the other keys beginning with "uniqush.", it isn't sent to the push service. collectResult reads it from the Content of each result to report the adjustment.
+const adjustedFieldsKey = "uniqush.adjusted_fields"
+
+// fieldLimitError is the error of a push which wasn't sent because a field of the notification exceeds the limit of the push service (with field_limits=reject).
+type fieldLimitError struct {
+	*push.ErrorReport
+}
+
+// applyFieldLimits checks notif against the limits of pushServiceType on the length of individual fields (see push.FieldLimiter), and handles the fields exceeding them according to field_limits.
+// It returns notif itself if nothing was adjusted, and a copy of notif with adjustedFieldsKey set otherwise.
+func (backend *PushBackEnd) applyFieldLimits(pushServiceType string, notif *push.Notification) (*push.Notification, push.Error) {
+	mode := backend.config.FieldLimits
+	if mode == FieldLimitsOff || mode == "" {
+		return notif, nil
+	}
+	limits := backend.psm.FieldLimits(pushServiceType, notif)
+	exceeded := exceededFieldLimits(limits, notif)
+	if len(exceeded) == 0 {
+		return notif, nil
+	}
+	if mode == FieldLimitsReject {
+		return nil, &fieldLimitError{push.NewErrorf("fields exceed the limits of %s: %s", pushServiceType, describeFieldLimits(limits, notif, exceeded))}
+	}
+	adjusted := notif.Clone()
+	for _, key := range exceeded {
+		if mode == FieldLimitsDrop {
+			delete(adjusted.Data, key)
+		} else {
+			adjusted.Data[key] = truncateUTF8(adjusted.Data[key], limits[key])
+		}
+	}
+	adjusted.Data[adjustedFieldsKey] = strings.Join(exceeded, ",")
+	return adjusted, nil
+}
+
+// exceededFieldLimits returns the sorted keys of notif whose values are longer than their limits.
+func exceededFieldLimits(limits map[string]int, notif *push.Notification) []string {
+	var exceeded []string
+	for key, limit := range limits {
+		if value, ok := notif.Data[key]; ok && len(value) > limit {
+			exceeded = append(exceeded, key)
+		}
+	}
+	sort.Strings(exceeded)
+	return exceeded
+}
+
+// describeFieldLimits describes the lengths and limits of the keys of notif in exceeded, for errors and logs.
+func describeFieldLimits(limits map[string]int, notif *push.Notification, exceeded []string) string {
+	details := make([]string, len(exceeded))
+	for i, key := range exceeded {
+		details[i] = fmt.Sprintf("%s (%d > %d bytes)", key, len(notif.Data[key]), limits[key])
+	}
+	return strings.Join(details, ", ")
+}
+
+// warnFieldLimits logs the fields of notif which exceed the limits of the push service type of psp, if field_limits is off and leaves them to the push service.
+func (backend *PushBackEnd) warnFieldLimits(reqID string, service string, psp *push.PushServiceProvider, notif *push.Notification, logger log.Logger) {
+	if mode := backend.config.FieldLimits; mode != FieldLimitsOff && mode != "" {
+		return
+	}
+	limits := backend.psm.FieldLimits(psp.PushServiceName(), notif)
+	if exceeded := exceededFieldLimits(limits, notif); len(exceeded) > 0 {
+		logger.Warnf("RequestID=%v Service=%v PushServiceProvider=%v Fields exceed the limits of %v, which may ignore or reject them: %v", reqID, service, psp.Name(), psp.PushServiceName(), describeFieldLimits(limits, notif, exceeded))
+	}
+}
+
+// adjustedFieldsOf returns the keys of the notification of res which field_limits truncated or dropped, or nil if none were.
+func adjustedFieldsOf(res *push.Result) []string {
+	if res.Content == nil || res.Content.Data[adjustedFieldsKey] == "" {
+		return nil
+	}
+	return strings.Split(res.Content.Data[adjustedFieldsKey], ",")
+}
+
+// truncateUTF8 returns the longest prefix of s which is at most n bytes long and doesn't end in the middle of a UTF-8 sequence.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
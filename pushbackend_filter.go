@@ -0,0 +1,55 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// unmatchedFilter returns the name of the first attribute of dp (from its VolatileData, e.g. app_version or locale) which doesn't match the filters of notif (see OptionFilterPrefix).
+// It returns false if dp matches every filter.
+func unmatchedFilter(notif *push.Notification, dp *push.DeliveryPoint) (string, bool) {
+	for k, v := range notif.Data {
+		if !strings.HasPrefix(k, OptionFilterPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(k, OptionFilterPrefix)
+		if !matchesFilter(dp.VolatileData[attr], v) {
+			return attr, true
+		}
+	}
+	return "", false
+}
+
+// matchesFilter returns true if value is one of the comma separated values of filter.
+// A value of the filter ending in "*" matches any value with that prefix (e.g. "en*" matches "en_US").
+func matchesFilter(value string, filter string) bool {
+	for _, accepted := range strings.Split(filter, ",") {
+		accepted = strings.TrimSpace(accepted)
+		if prefix := strings.TrimSuffix(accepted, "*"); prefix != accepted {
+			if strings.HasPrefix(value, prefix) {
+				return true
+			}
+		} else if value == accepted {
+			return true
+		}
+	}
+	return false
+}
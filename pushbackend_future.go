@@ -0,0 +1,69 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// PushFuture is the result of a push started by PushAsync, which is available once the push has finished.
+type PushFuture struct {
+	done     chan struct{}
+	response APIPushResponse
+}
+
+// Done returns a channel which is closed once the push has finished, for use in select statements.
+func (f *PushFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the push has finished, and returns its results.
+func (f *PushFuture) Wait() APIPushResponse {
+	<-f.done
+	return f.response
+}
+
+// Result returns the results of the push without blocking. ok is false if the push hasn't finished yet.
+func (f *PushFuture) Result() (response APIPushResponse, ok bool) {
+	select {
+	case <-f.done:
+		return f.response, true
+	default:
+		return APIPushResponse{}, false
+	}
+}
+
+// PushAsync starts a push like Push, and returns a PushFuture for its results instead of waiting for them.
+// The push waits for its retries (see OptionWaitForRetries), so the results include the outcome of each delivery point unless response_timeout elapses first.
+func (backend *PushBackEnd) PushAsync(reqID string, remoteAddr string, service string, subs []string, dpNamesRequested []string, notif *push.Notification, perdp map[string][]string, logger log.Logger) *PushFuture {
+	if notif != nil {
+		notif = notif.Clone()
+		notif.Data[OptionWaitForRetries] = "1"
+	}
+	future := &PushFuture{done: make(chan struct{})}
+	handler := newPushResponseHandler(logger)
+	go func() {
+		defer close(future.done)
+		backend.Push(reqID, remoteAddr, service, subs, dpNamesRequested, notif, perdp, logger, handler)
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+		future.response = handler.response
+	}()
+	return future
+}
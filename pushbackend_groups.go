@@ -0,0 +1,68 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// GroupResolver expands a group (e.g. the followers of a topic) into the subscribers it contains, so that /push can broadcast to a group without listing every subscriber.
+type GroupResolver interface {
+	// GroupMembers returns the subscribers of service which are members of group.
+	GroupMembers(service string, group string) ([]string, error)
+}
+
+// errNoGroupResolver is returned when pushing to a group if SetGroupResolver wasn't called.
+var errNoGroupResolver = errors.New("no group resolver is configured")
+
+// SetGroupResolver sets how /push expands the groups given with the group parameter. This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetGroupResolver(resolver GroupResolver) {
+	backend.groups = resolver
+}
+
+// ExpandGroups returns subs followed by the members of each of groups, without duplicates.
+func (backend *PushBackEnd) ExpandGroups(service string, subs []string, groups []string) ([]string, error) {
+	if len(groups) == 0 {
+		return subs, nil
+	}
+	if backend.groups == nil {
+		return nil, errNoGroupResolver
+	}
+	seen := make(map[string]bool, len(subs))
+	expanded := make([]string, 0, len(subs))
+	add := func(sub string) {
+		if !seen[sub] {
+			seen[sub] = true
+			expanded = append(expanded, sub)
+		}
+	}
+	for _, sub := range subs {
+		add(sub)
+	}
+	for _, group := range groups {
+		members, err := backend.groups.GroupMembers(service, group)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get the members of group %q: %v", group, err)
+		}
+		for _, sub := range members {
+			add(sub)
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+const (
+	// healthScoreWeight is the weight of the latest push to a delivery point in its health score. The rest is the score before that push.
+	healthScoreWeight = 0.3
+	// healthScoreIdleTime is how long a delivery point must go without pushes before its health score is forgotten, so that skipped delivery points are tried again eventually.
+	healthScoreIdleTime = time.Hour
+)
+
+type healthScore struct {
+	score   float64
+	updated time.Time
+}
+
+// deliveryPointHealth tracks a health score for each delivery point, from 1 (every recent push succeeded) down to 0 (every recent push failed).
+// The score is a moving average of the outcomes of the pushes to the delivery point, weighted towards the latest ones. Delivery points without recent pushes have a score of 1.
+type deliveryPointHealth struct {
+	lock      sync.Mutex
+	scores    map[string]*healthScore
+	lastPrune time.Time
+}
+
+func newDeliveryPointHealth() *deliveryPointHealth {
+	return &deliveryPointHealth{
+		scores:    make(map[string]*healthScore),
+		lastPrune: time.Now(),
+	}
+}
+
+// record updates the score of dpName with the outcome of a push to it.
+func (h *deliveryPointHealth) record(dpName string, succeeded bool, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if now.Sub(h.lastPrune) >= healthScoreIdleTime {
+		h.prune(now)
+	}
+	s, ok := h.scores[dpName]
+	if !ok {
+		s = &healthScore{score: 1}
+		h.scores[dpName] = s
+	}
+	outcome := 0.0
+	if succeeded {
+		outcome = 1
+	}
+	s.score = s.score*(1-healthScoreWeight) + outcome*healthScoreWeight
+	s.updated = now
+}
+
+// score returns the health score of dpName.
+func (h *deliveryPointHealth) score(dpName string, now time.Time) float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s, ok := h.scores[dpName]
+	if !ok || now.Sub(s.updated) >= healthScoreIdleTime {
+		return 1
+	}
+	return s.score
+}
+
+// providerKey is the key of the score of the pushes to dpName through the push service provider pspName.
+// These are tracked separately from the scores of delivery points, for duplicate_delivery_points=healthiest.
+func providerKey(pspName string, dpName string) string {
+	return pspName + "\x00" + dpName
+}
+
+// prune forgets the scores of the delivery points which were idle for healthScoreIdleTime. This must be called with the lock held.
+func (h *deliveryPointHealth) prune(now time.Time) {
+	for name, s := range h.scores {
+		if now.Sub(s.updated) >= healthScoreIdleTime {
+			delete(h.scores, name)
+		}
+	}
+	h.lastPrune = now
+}
+
+// scoresOf returns the health scores of the delivery points in pspDpList, in the same order.
+func (h *deliveryPointHealth) scoresOf(pspDpList []db.PushServiceProviderDeliveryPointPair, now time.Time) []float64 {
+	scores := make([]float64, len(pspDpList))
+	for i, pair := range pspDpList {
+		scores[i] = 1
+		if pair.DeliveryPoint != nil {
+			scores[i] = h.score(pair.DeliveryPoint.Name(), now)
+		}
+	}
+	return scores
+}
+
+// recordHealth updates the health score of the delivery point of a push (and of that delivery point through the push service provider pspName) with its result,
+// if health_routing is enabled or duplicate_delivery_points is healthiest.
+// Updates to the saved data of a delivery point or push service provider aren't an outcome of the push, and are ignored.
+func (backend *PushBackEnd) recordHealth(pspName string, dpName string, err error) {
+	if backend.health == nil {
+		return
+	}
+	if err != nil && !isDeliveryFailure(err) {
+		return
+	}
+	now := time.Now()
+	backend.health.record(dpName, err == nil, now)
+	backend.health.record(providerKey(pspName, dpName), err == nil, now)
+}
+
+// sortByHealth sorts the delivery points of a subscriber with the same priority so that the healthier ones are pushed to first, if health_routing is enabled.
+func (backend *PushBackEnd) sortByHealth(pspDpList []db.PushServiceProviderDeliveryPointPair) {
+	if backend.health == nil || len(pspDpList) < 2 || (backend.config.HealthRouting != HealthRoutingOrder && backend.config.HealthRouting != HealthRoutingSkip) {
+		return
+	}
+	now := time.Now()
+	info := func(pair db.PushServiceProviderDeliveryPointPair) (priority int, score float64) {
+		if pair.DeliveryPoint == nil {
+			return 0, 1
+		}
+		return pair.DeliveryPoint.PushPriority(), backend.health.score(pair.DeliveryPoint.Name(), now)
+	}
+	sort.SliceStable(pspDpList, func(i, j int) bool {
+		pi, si := info(pspDpList[i])
+		pj, sj := info(pspDpList[j])
+		if pi != pj {
+			return pi > pj
+		}
+		return si > sj
+	})
+}
+
+// skipUnhealthy removes the delivery points with a health score below health_min_score from pspDpList, if health_routing is skip, and reports them as UNIQUSH_TEMPORARILY_SKIPPED.
+// If every delivery point of the subscriber is unhealthy, the healthiest one is still pushed to, so that the subscriber isn't cut off.
+func (backend *PushBackEnd) skipUnhealthy(reqID string, remoteAddr string, service string, sub string, pspDpList []db.PushServiceProviderDeliveryPointPair, logger log.Logger, handler APIResponseHandler) []db.PushServiceProviderDeliveryPointPair {
+	if backend.health == nil || backend.config.HealthRouting != HealthRoutingSkip {
+		return pspDpList
+	}
+	scores := backend.health.scoresOf(pspDpList, time.Now())
+	var healthy []db.PushServiceProviderDeliveryPointPair
+	var unhealthy []int
+	best := 0
+	for i, pair := range pspDpList {
+		if scores[i] > scores[best] {
+			best = i
+		}
+		if scores[i] >= backend.config.HealthMinScore || pair.DeliveryPoint == nil || pair.PushServiceProvider == nil {
+			healthy = append(healthy, pair)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	if len(unhealthy) == 0 {
+		return pspDpList
+	}
+	for _, i := range unhealthy {
+		if len(healthy) == 0 && i == best {
+			continue
+		}
+		pair := pspDpList[i]
+		pspName := pair.PushServiceProvider.Name()
+		dpName := pair.DeliveryPoint.Name()
+		err := fmt.Errorf("the health score of the delivery point (%.2f) is below health_min_score (%.2f)", scores[i], backend.config.HealthMinScore)
+		logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Skipped: %v", reqID, service, sub, pspName, dpName, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &pspName, DeliveryPoint: &dpName, Code: UNIQUSH_TEMPORARILY_SKIPPED, ErrorMsg: strPtrOfErr(err)})
+	}
+	if len(healthy) == 0 {
+		healthy = append(healthy, pspDpList[best])
+	}
+	return healthy
+}
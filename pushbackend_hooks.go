@@ -0,0 +1,125 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// PushHook is called around every push to a delivery point (e.g. to check a feature flag, add per-device data to the payload, or record pushes in a ledger).
+type PushHook interface {
+	// BeforePush is called right before notif is sent to dp, once dp passed the filters and rate limits of the push. It is called again for every retry.
+	// notif already has the defaults of the push service type and field_limits applied, and is encrypted and signed (if there is an encryptor or a signer) after BeforePush returns.
+	// notif is a clone for dp alone, so BeforePush may modify it (e.g. to enrich the payload). It returns the notification to send, which is usually notif itself.
+	// If it returns an error, nothing is sent to dp, and the error is reported as the reason.
+	BeforePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, error)
+	// AfterPush is called for each result of a push to dp, with the message id from the push service (on success) or the error.
+	AfterPush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, msgID string, err error)
+}
+
+// AddPushHook registers a hook which is called around every push sent by this backend. This must be called before the backend starts sending pushes.
+// Since each delivery point gets its own notification, pushes to delivery points can't share a push to their push service provider once there is a hook (as with a payload encryptor).
+func (backend *PushBackEnd) AddPushHook(hook PushHook) {
+	backend.hooks = append(backend.hooks, hook)
+}
+
+// errHookTimeout is returned by withHookTimeout if the push hooks, the encryptor or the signer take longer than hook_timeout.
+// The encryptor and the signer report a hookTimeoutError instead.
+var errHookTimeout = errors.New("the push hooks didn't finish within hook_timeout")
+
+// hookTimeoutError is the error of a push which wasn't sent because the encryptor or the signer took longer than hook_timeout.
+type hookTimeoutError struct {
+	*push.ErrorReport
+}
+
+// hookRejectedError is the error of a push which wasn't sent because the BeforePush of a push hook returned an error or took longer than hook_timeout.
+// code is UNIQUSH_ERROR_REJECTED_BY_HOOK or UNIQUSH_ERROR_HOOK_TIMEOUT.
+type hookRejectedError struct {
+	*push.ErrorReport
+	code string
+}
+
+// runBeforePushHooks returns the notification which the hooks returned for dp, starting from a clone of notif, or a hookRejectedError if the push to dp shouldn't be sent.
+// If hook_timeout is set, the push is rejected once the hooks have run for that long (see withHookTimeout).
+func (backend *PushBackEnd) runBeforePushHooks(service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, push.Error) {
+	if len(backend.hooks) == 0 {
+		return notif, nil
+	}
+	var ret *push.Notification
+	err := backend.withHookTimeout(service, psp, func() error {
+		var err error
+		ret, err = backend.callBeforePushHooks(psp, dp, notif.Clone())
+		return err
+	})
+	if err == errHookTimeout {
+		return nil, &hookRejectedError{push.NewError(err.Error()), UNIQUSH_ERROR_HOOK_TIMEOUT}
+	}
+	if err != nil {
+		return nil, &hookRejectedError{push.NewError(err.Error()), UNIQUSH_ERROR_REJECTED_BY_HOOK}
+	}
+	return ret, nil
+}
+
+// withHookTimeout returns the error of f, which runs code outside of uniqush-push for a push through psp (the push hooks, the encryptor or the signer).
+// If hook_timeout is set, it returns errHookTimeout once f has run for that long, instead of waiting for a slow f (e.g. one calling a remote service) to finish.
+// The time spent is reported as MetricBeforePushTime.
+func (backend *PushBackEnd) withHookTimeout(service string, psp *push.PushServiceProvider, f func() error) error {
+	start := time.Now()
+	defer func() {
+		backend.metrics.ObserveHistogram(MetricBeforePushTime, time.Since(start).Seconds(), map[string]string{"service": service, "push_service_type": psp.PushServiceName()})
+	}()
+	if backend.config.HookTimeout <= 0 {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	timer := time.NewTimer(backend.config.HookTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		// f keeps running in the background, but the push won't wait for it.
+		return errHookTimeout
+	}
+}
+
+// callBeforePushHooks passes notif through the BeforePush of each hook in order, and returns the notification returned by the last one.
+func (backend *PushBackEnd) callBeforePushHooks(psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, error) {
+	for _, hook := range backend.hooks {
+		var err error
+		if notif, err = hook.BeforePush(psp, dp, notif); err != nil {
+			return nil, err
+		}
+	}
+	return notif, nil
+}
+
+func (backend *PushBackEnd) runAfterPushHooks(res *push.Result) {
+	if len(backend.hooks) == 0 || res.Destination == nil {
+		return
+	}
+	for _, hook := range backend.hooks {
+		hook.AfterPush(res.Provider, res.Destination, res.MsgID, res.Err)
+	}
+}
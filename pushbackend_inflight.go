@@ -0,0 +1,114 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// InFlightPush describes a push which uniqush-push is still sending, for debugging pushes which are stuck.
+type InFlightPush struct {
+	RequestID     string    `json:"requestId"`
+	Service       string    `json:"service"`
+	NrSubscribers int       `json:"nrSubscribers"`
+	Started       time.Time `json:"started"`
+	// Done is the number of results so far (e.g. successes and failures of delivery points).
+	Done int `json:"done"`
+	// Retrying is the number of retries which were scheduled so far.
+	Retrying int `json:"retrying"`
+}
+
+// inFlightEntry counts the results of an in-flight push, then passes them on to the handler of the push.
+type inFlightEntry struct {
+	inner APIResponseHandler
+	lock  sync.Mutex
+	push  InFlightPush
+}
+
+var _ APIResponseHandler = &inFlightEntry{}
+
+// AddDetailsToHandler counts v, then passes it on to the wrapped handler.
+func (e *inFlightEntry) AddDetailsToHandler(v APIResponseDetails) {
+	e.lock.Lock()
+	if v.Code == UNIQUSH_PUSH_RETRYING {
+		e.push.Retrying++
+	} else {
+		e.push.Done++
+	}
+	e.lock.Unlock()
+	e.inner.AddDetailsToHandler(v)
+}
+
+// ToJSON serializes the response of the wrapped handler.
+func (e *inFlightEntry) ToJSON() []byte {
+	return e.inner.ToJSON()
+}
+
+// inFlightPushes is the registry of the pushes which have started but not finished.
+type inFlightPushes struct {
+	lock sync.Mutex
+	// entries is a set, since request ids aren't unique for pushes sent without the REST API.
+	entries map[*inFlightEntry]struct{}
+}
+
+func newInFlightPushes() *inFlightPushes {
+	return &inFlightPushes{entries: make(map[*inFlightEntry]struct{})}
+}
+
+// add registers a push, and returns the handler to use for its results. remove must be called with that handler once the push finishes.
+func (p *inFlightPushes) add(reqID string, service string, nrSubscribers int, handler APIResponseHandler) *inFlightEntry {
+	entry := &inFlightEntry{
+		inner: handler,
+		push:  InFlightPush{RequestID: reqID, Service: service, NrSubscribers: nrSubscribers, Started: time.Now()},
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.entries[entry] = struct{}{}
+	return entry
+}
+
+func (p *inFlightPushes) remove(entry *inFlightEntry) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.entries, entry)
+}
+
+// snapshot returns the pushes in progress, oldest first.
+func (p *inFlightPushes) snapshot() []InFlightPush {
+	p.lock.Lock()
+	pushes := make([]InFlightPush, 0, len(p.entries))
+	for entry := range p.entries {
+		entry.lock.Lock()
+		pushes = append(pushes, entry.push)
+		entry.lock.Unlock()
+	}
+	p.lock.Unlock()
+	sort.Slice(pushes, func(i, j int) bool {
+		return pushes[i].Started.Before(pushes[j].Started)
+	})
+	return pushes
+}
+
+// InFlightPushes returns the pushes which have started but not finished, oldest first.
+// A push remains in flight until every delivery point has a result, even if /push already responded because of response_timeout.
+// Retries which /push doesn't wait for (see OptionWaitForRetries) are sent after the push is finished.
+func (backend *PushBackEnd) InFlightPushes() []InFlightPush {
+	return backend.inFlight.snapshot()
+}
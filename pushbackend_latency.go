@@ -0,0 +1,47 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import "time"
+
+// latencyHandler adds the time since a push was submitted to the details of each final result of the push, e.g. for callers which monitor delivery times.
+// Retries keep the time of the original push, so the latency of a retried push includes its backoffs.
+type latencyHandler struct {
+	inner     APIResponseHandler
+	submitted time.Time
+}
+
+var _ APIResponseHandler = &latencyHandler{}
+
+func newLatencyHandler(inner APIResponseHandler, submitted time.Time) *latencyHandler {
+	return &latencyHandler{inner: inner, submitted: submitted}
+}
+
+// AddDetailsToHandler sets the latency of v if it is a final result, then passes it on to the wrapped handler.
+func (h *latencyHandler) AddDetailsToHandler(v APIResponseDetails) {
+	if v.LatencyMs == nil && v.Code != UNIQUSH_PUSH_RETRYING && v.Code != UNIQUSH_PUSH_QUEUED {
+		latency := int64(time.Since(h.submitted) / time.Millisecond)
+		v.LatencyMs = &latency
+	}
+	h.inner.AddDetailsToHandler(v)
+}
+
+// ToJSON serializes the response of the wrapped handler.
+func (h *latencyHandler) ToJSON() []byte {
+	return h.inner.ToJSON()
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+type sampledErrorKey struct {
+	pspName string
+	err     string
+}
+
+type sampledError struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+// errorLogSampler limits how often the same error is logged for a push service provider (e.g. while the push service is down).
+// After threshold identical errors within a window, it stops logging them, and logs a single summary of the rest at the end of the window.
+type errorLogSampler struct {
+	lock      sync.Mutex
+	threshold int
+	window    time.Duration
+	errors    map[sampledErrorKey]*sampledError
+	lastPrune time.Time
+}
+
+func newErrorLogSampler(threshold int, window time.Duration) *errorLogSampler {
+	return &errorLogSampler{
+		threshold: threshold,
+		window:    window,
+		errors:    make(map[sampledErrorKey]*sampledError),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow returns true if the error err of pspName should be logged. Otherwise, it is counted in the summary which is logged to logger at the end of the window.
+func (s *errorLogSampler) allow(pspName string, err string, logger log.Logger) bool {
+	key := sampledErrorKey{pspName, err}
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.Sub(s.lastPrune) >= s.window {
+		// Errors often contain the delivery point, so most keys are never seen again.
+		// Entries with suppressed errors are removed by their summary instead.
+		for k, e := range s.errors {
+			if now.Sub(e.windowStart) >= s.window && e.suppressed == 0 {
+				delete(s.errors, k)
+			}
+		}
+		s.lastPrune = now
+	}
+	entry, ok := s.errors[key]
+	if !ok || now.Sub(entry.windowStart) >= s.window {
+		// If the previous window had suppressed errors, its summary still refers to the old entry.
+		entry = &sampledError{windowStart: now}
+		s.errors[key] = entry
+	}
+	entry.count++
+	if entry.count <= s.threshold {
+		return true
+	}
+	entry.suppressed++
+	if entry.suppressed == 1 {
+		time.AfterFunc(entry.windowStart.Add(s.window).Sub(now), func() {
+			s.summarize(key, entry, logger)
+		})
+	}
+	return false
+}
+
+// summarize logs the number of errors which weren't logged during the window of entry.
+func (s *errorLogSampler) summarize(key sampledErrorKey, entry *sampledError, logger log.Logger) {
+	s.lock.Lock()
+	suppressed := entry.suppressed
+	if s.errors[key] == entry {
+		delete(s.errors, key)
+	}
+	s.lock.Unlock()
+	logger.Errorf("PushServiceProvider=%v Failed %d more times in the last %v (not logged individually): %v", key.pspName, suppressed, s.window, key.err)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// lockedBuffer is a bytes.Buffer which can be written by the summary timer while the test reads it.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestErrorLogSampler(t *testing.T) {
+	output := &lockedBuffer{}
+	logger := log.NewLogger(output, "[Test]", log.LOGLEVEL_DEBUG)
+	sampler := newErrorLogSampler(2, 20*time.Millisecond)
+
+	var allowed []bool
+	for i := 0; i < 5; i++ {
+		allowed = append(allowed, sampler.allow("apns:psp1", "connection refused", logger))
+	}
+	testutil.ExpectEquals(t, []bool{true, true, false, false, false}, allowed, "expected errors beyond the threshold to be suppressed")
+	testutil.ExpectEquals(t, true, sampler.allow("apns:psp2", "connection refused", logger), "expected other psps to be unaffected")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output.String(), "Failed 3 more times") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !strings.Contains(output.String(), "PushServiceProvider=apns:psp1 Failed 3 more times") {
+		t.Errorf("Expected a summary of the suppressed errors, got %q", output.String())
+	}
+	testutil.ExpectEquals(t, true, sampler.allow("apns:psp1", "connection refused", logger), "expected errors to be logged again in the next window")
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// MemoryGauge returns the memory in use by the process, in bytes. It is compared to memory_limit_mb to decide whether to shed load.
+type MemoryGauge func() uint64
+
+// heapInUse is the default MemoryGauge, which reports the bytes in in-use spans of the heap.
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// memoryMonitor measures the memory use of the process at most once per interval, and reports whether it is above limit.
+type memoryMonitor struct {
+	lock     sync.Mutex
+	gauge    MemoryGauge
+	limit    uint64
+	interval time.Duration
+	checked  time.Time
+	inUse    uint64
+	pressure bool
+}
+
+func newMemoryMonitor(limit uint64, interval time.Duration) *memoryMonitor {
+	return &memoryMonitor{
+		gauge:    heapInUse,
+		limit:    limit,
+		interval: interval,
+	}
+}
+
+// check returns whether the memory use is above the limit as of its latest measurement, and whether that changed with this call.
+func (m *memoryMonitor) check(now time.Time) (pressure bool, changed bool, inUse uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.checked.IsZero() && now.Sub(m.checked) < m.interval {
+		return m.pressure, false, m.inUse
+	}
+	m.checked = now
+	m.inUse = m.gauge()
+	wasUnderPressure := m.pressure
+	m.pressure = m.inUse > m.limit
+	return m.pressure, m.pressure != wasUnderPressure, m.inUse
+}
+
+// SetMemoryGauge replaces the measurement of the memory use compared to memory_limit_mb (by default, the heap in use), e.g. with the memory use of the container reported by cgroups.
+// This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetMemoryGauge(gauge MemoryGauge) {
+	if backend.memory != nil {
+		backend.memory.lock.Lock()
+		backend.memory.gauge = gauge
+		backend.memory.lock.Unlock()
+	}
+}
+
+// checkMemory returns true if the process is above memory_limit_mb as of the latest measurement, and logs when that changes.
+func (backend *PushBackEnd) checkMemory(logger log.Logger) bool {
+	pressure, changed, inUse := backend.memory.check(time.Now())
+	if changed {
+		if pressure {
+			logger.Warnf("Memory in use (%d bytes) is above memory_limit_mb, shedding load", inUse)
+		} else {
+			logger.Infof("Memory in use (%d bytes) is below memory_limit_mb again, no longer shedding load", inUse)
+		}
+	}
+	return pressure
+}
+
+// watchMemory measures the memory use every memory_check_interval until stop is closed, and while it is above memory_limit_mb, drops the oldest pending retries beyond memory_pressure_max_retries.
+// This runs on its own, since retries keep piling up during an outage of a push service even if no new pushes arrive.
+func (backend *PushBackEnd) watchMemory(stop <-chan struct{}, logger log.Logger) {
+	ticker := time.NewTicker(backend.config.MemoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !backend.checkMemory(logger) {
+			continue
+		}
+		if keep := backend.config.MemoryPressureMaxRetries; keep > 0 {
+			if dropped := backend.retries.shed(keep, "dropped because of memory pressure"); dropped > 0 {
+				logger.Warnf("Dropped the %d oldest pending retries because of memory pressure", dropped)
+			}
+		}
+	}
+}
+
+// shedLoad returns true if a new push with priority should be rejected because the process is above memory_limit_mb.
+func (backend *PushBackEnd) shedLoad(priority int, logger log.Logger) bool {
+	if backend.memory == nil {
+		return false
+	}
+	return backend.checkMemory(logger) && priority >= pushPriorityNamed(backend.config.MemoryShedPriority)
+}
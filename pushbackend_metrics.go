@@ -0,0 +1,102 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Metrics receives measurements of the pushes sent by uniqush-push, for a metrics backend chosen by the operator (see StatsdMetrics and PrometheusMetrics).
+// Implementations must be safe for concurrent use, and should return quickly, since they are called while pushes are being sent.
+type Metrics interface {
+	// IncCounter adds 1 to the counter name with the given labels.
+	IncCounter(name string, labels map[string]string)
+	// ObserveHistogram records value (e.g. a duration in seconds) in the histogram name with the given labels.
+	ObserveHistogram(name string, value float64, labels map[string]string)
+}
+
+// The names of the metrics reported to Metrics, and the labels of each.
+const (
+	// MetricPushResults counts the results of pushes to delivery points and subscribers, by "service" and response "code" (e.g. UNIQUSH_SUCCESS).
+	MetricPushResults = "uniqush_push_results_total"
+	// MetricPushLatency is the time in seconds from a push being requested to each of its results, including retries, by "service".
+	MetricPushLatency = "uniqush_push_latency_seconds"
+	// MetricProviderPushTime is the time in seconds spent sending a push to the delivery points of a push service provider, by "service" and "push_service_type".
+	MetricProviderPushTime = "uniqush_provider_push_seconds"
+	// MetricBeforePushTime is the time in seconds spent in the BeforePush of the push hooks, the encryptor and the signer (each observed separately) for each delivery point, by "service" and "push_service_type".
+	MetricBeforePushTime = "uniqush_before_push_seconds"
+	// MetricRetries counts the retries requested by push services, by "service" and "category" (see push.RetryError.ReasonCategory).
+	MetricRetries = "uniqush_retries_total"
+)
+
+// NullMetrics discards every measurement. This is what the backend uses unless SetMetrics was called.
+type NullMetrics struct{}
+
+var _ Metrics = NullMetrics{}
+
+// IncCounter does nothing.
+func (NullMetrics) IncCounter(name string, labels map[string]string) {}
+
+// ObserveHistogram does nothing.
+func (NullMetrics) ObserveHistogram(name string, value float64, labels map[string]string) {}
+
+// SetMetrics sets the metrics backend which measurements of pushes are reported to. This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetMetrics(metrics Metrics) {
+	if metrics == nil {
+		metrics = NullMetrics{}
+	}
+	backend.metrics = metrics
+}
+
+// observeProviderPushTime reports the time since start spent sending a push to the delivery points of a push service provider.
+func (backend *PushBackEnd) observeProviderPushTime(service string, pushServiceType string, start time.Time) {
+	backend.metrics.ObserveHistogram(MetricProviderPushTime, time.Since(start).Seconds(), map[string]string{"service": service, "push_service_type": pushServiceType})
+}
+
+// metricsHandler reports each result of a push to Metrics, then passes it on to the handler of the push.
+type metricsHandler struct {
+	inner   APIResponseHandler
+	metrics Metrics
+	service string
+}
+
+var _ APIResponseHandler = &metricsHandler{}
+
+func newMetricsHandler(inner APIResponseHandler, metrics Metrics, service string) *metricsHandler {
+	return &metricsHandler{inner: inner, metrics: metrics, service: service}
+}
+
+// AddDetailsToHandler counts v by its code (and records its latency, if it has one), then passes it on to the wrapped handler.
+func (h *metricsHandler) AddDetailsToHandler(v APIResponseDetails) {
+	h.metrics.IncCounter(MetricPushResults, map[string]string{"service": h.service, "code": v.Code})
+	if v.LatencyMs != nil {
+		h.metrics.ObserveHistogram(MetricPushLatency, float64(*v.LatencyMs)/1000, map[string]string{"service": h.service})
+	}
+	h.inner.AddDetailsToHandler(v)
+}
+
+// ToJSON serializes the response of the wrapped handler.
+func (h *metricsHandler) ToJSON() []byte {
+	return h.inner.ToJSON()
+}
+
+// formatMetricValue formats a counter or observation the same way for every adapter.
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/uniqush/log"
+)
+
+// minDevicesHandler counts the delivery points of each subscriber which were pushed to successfully (see OptionMinSuccessfulDevices), then passes the results on to the handler of the push.
+type minDevicesHandler struct {
+	inner     APIResponseHandler
+	min       int
+	lock      sync.Mutex
+	attempted []string
+	successes map[string]int
+	retrying  map[string]int
+}
+
+var _ APIResponseHandler = &minDevicesHandler{}
+
+func newMinDevicesHandler(inner APIResponseHandler, min int) *minDevicesHandler {
+	return &minDevicesHandler{
+		inner:     inner,
+		min:       min,
+		successes: make(map[string]int),
+		retrying:  make(map[string]int),
+	}
+}
+
+// AddDetailsToHandler counts v if it is the success or pending retry of a delivery point, then passes it on to the wrapped handler.
+func (h *minDevicesHandler) AddDetailsToHandler(v APIResponseDetails) {
+	if v.Subscriber != nil && v.DeliveryPoint != nil {
+		h.lock.Lock()
+		switch v.Code {
+		case UNIQUSH_SUCCESS:
+			h.successes[*v.Subscriber]++
+		case UNIQUSH_PUSH_RETRYING:
+			h.retrying[*v.Subscriber]++
+		}
+		h.lock.Unlock()
+	}
+	h.inner.AddDetailsToHandler(v)
+}
+
+// ToJSON serializes the response of the wrapped handler.
+func (h *minDevicesHandler) ToJSON() []byte {
+	return h.inner.ToJSON()
+}
+
+// attempt records that the delivery points of sub are being pushed to, so that complete checks how many of them succeeded.
+func (h *minDevicesHandler) attempt(sub string) {
+	h.lock.Lock()
+	h.attempted = append(h.attempted, sub)
+	h.lock.Unlock()
+}
+
+// complete reports UNIQUSH_ERROR_TOO_FEW_DEVICES for each subscriber with fewer than min delivery points which succeeded or are waiting to be retried.
+// The results of the delivery points are reported as usual.
+func (h *minDevicesHandler) complete(reqID string, remoteAddr string, service string, logger log.Logger) {
+	h.lock.Lock()
+	var failed []string
+	var counts []int
+	for _, sub := range h.attempted {
+		if h.successes[sub]+h.retrying[sub] < h.min {
+			failed = append(failed, sub)
+			counts = append(counts, h.successes[sub])
+		}
+	}
+	h.lock.Unlock()
+	for i, sub := range failed {
+		sub := sub
+		err := fmt.Errorf("%d of the subscriber's delivery points succeeded, but uniqush.min_successful_devices requires at least %d", counts[i], h.min)
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v Failed: %v", reqID, service, sub, err)
+		h.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, Code: UNIQUSH_ERROR_TOO_FEW_DEVICES, ErrorMsg: strPtrOfErr(err)})
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// queuedPush contains the arguments of a call to Push for a paused service, so that the push can be sent once the service is resumed.
+type queuedPush struct {
+	reqID            string
+	remoteAddr       string
+	service          string
+	subs             []string
+	dpNamesRequested []string
+	notif            *push.Notification
+	perdp            map[string][]string
+	logger           log.Logger
+	queuedAt         time.Time
+}
+
+// isStale returns true if the ttl (in seconds) of the notification elapsed while the push was queued.
+// There is no point in sending such a push once the service is resumed, since the push service would discard it anyway.
+func (req *queuedPush) isStale(now time.Time) bool {
+	ttlstr, ok := req.notif.Data["ttl"]
+	if !ok {
+		return false
+	}
+	ttl, err := strconv.ParseUint(ttlstr, 10, 32)
+	if err != nil {
+		return false
+	}
+	return now.Sub(req.queuedAt) > time.Duration(ttl)*time.Second
+}
+
+// pausedServices tracks the services for which pushes should be queued instead of sent (e.g. during an incident).
+type pausedServices struct {
+	lock   sync.Mutex
+	queues map[string][]*queuedPush
+}
+
+func newPausedServices() *pausedServices {
+	return &pausedServices{
+		queues: make(map[string][]*queuedPush),
+	}
+}
+
+// pause starts queueing pushes for service. It returns false if the service was already paused.
+func (p *pausedServices) pause(service string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.queues[service]; ok {
+		return false
+	}
+	p.queues[service] = make([]*queuedPush, 0)
+	return true
+}
+
+// resume stops queueing pushes for service, and returns the pushes that were queued while it was paused.
+func (p *pausedServices) resume(service string) (queue []*queuedPush, wasPaused bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	queue, wasPaused = p.queues[service]
+	delete(p.queues, service)
+	return queue, wasPaused
+}
+
+// enqueue adds req to the queue of its service, if that service is paused.
+// It returns an error if the service is paused but already has maxQueued pushes queued.
+func (p *pausedServices) enqueue(req *queuedPush, maxQueued int) (queued bool, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	queue, ok := p.queues[req.service]
+	if !ok {
+		return false, nil
+	}
+	if len(queue) >= maxQueued {
+		return false, fmt.Errorf("service %q is paused and already has %d queued pushes", req.service, len(queue))
+	}
+	p.queues[req.service] = append(queue, req)
+	return true, nil
+}
+
+// Pause will queue pushes to service (up to max_paused_pushes of them) instead of sending them, until Resume is called. Other services are unaffected.
+func (backend *PushBackEnd) Pause(service string) error {
+	if !backend.paused.pause(service) {
+		return fmt.Errorf("service %q is already paused", service)
+	}
+	return nil
+}
+
+// Resume will stop queueing pushes to service, and send the pushes which were queued while it was paused.
+// The responses to the queued pushes were already sent, so the results are only logged. Pushes whose ttl elapsed while queued are dropped.
+func (backend *PushBackEnd) Resume(service string) error {
+	queue, wasPaused := backend.paused.resume(service)
+	if !wasPaused {
+		return fmt.Errorf("service %q is not paused", service)
+	}
+	go func() {
+		for _, req := range queue {
+			if req.isStale(time.Now()) {
+				req.logger.Infof("RequestID=%v Service=%v Dropped queued push: its ttl elapsed while the service was paused", req.reqID, req.service)
+				continue
+			}
+			backend.pushImpl(req.reqID, req.remoteAddr, req.service, req.subs, req.dpNamesRequested, req.notif, req.perdp, req.logger, nil, nil, newRetryState(req.queuedAt), &NullAPIResponseHandler{})
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestPausedServicesQueuesUntilResumed(t *testing.T) {
+	p := newPausedServices()
+	req := &queuedPush{reqID: "req1", service: "myservice", subs: []string{"sub1"}}
+
+	queued, err := p.enqueue(req, 1)
+	testutil.ExpectEquals(t, nil, err, "unexpected error for a service that is not paused")
+	testutil.ExpectEquals(t, false, queued, "expected pushes to services that are not paused to be sent immediately")
+
+	testutil.ExpectEquals(t, true, p.pause("myservice"), "expected first pause to succeed")
+	testutil.ExpectEquals(t, false, p.pause("myservice"), "expected second pause to fail")
+
+	queued, err = p.enqueue(req, 1)
+	testutil.ExpectEquals(t, nil, err, "unexpected error queueing a push")
+	testutil.ExpectEquals(t, true, queued, "expected push to paused service to be queued")
+
+	queued, err = p.enqueue(&queuedPush{reqID: "req2", service: "myservice"}, 1)
+	if err == nil {
+		t.Errorf("Expected an error when the queue of a paused service is full")
+	}
+	testutil.ExpectEquals(t, false, queued, "expected push to be rejected when the queue is full")
+
+	queued, err = p.enqueue(&queuedPush{reqID: "req3", service: "otherservice"}, 1)
+	testutil.ExpectEquals(t, nil, err, "expected other services to be unaffected")
+	testutil.ExpectEquals(t, false, queued, "expected other services to be unaffected")
+
+	queue, wasPaused := p.resume("myservice")
+	testutil.ExpectEquals(t, true, wasPaused, "expected service to have been paused")
+	testutil.ExpectEquals(t, []*queuedPush{req}, queue, "expected the queued push to be returned")
+
+	_, wasPaused = p.resume("myservice")
+	testutil.ExpectEquals(t, false, wasPaused, "expected service to no longer be paused")
+}
+
+func TestQueuedPushIsStale(t *testing.T) {
+	queuedAt := time.Now()
+	notif := push.NewEmptyNotification()
+	req := &queuedPush{notif: notif, queuedAt: queuedAt}
+	testutil.ExpectEquals(t, false, req.isStale(queuedAt.Add(time.Hour)), "expected pushes without a ttl to never be stale")
+
+	notif.Data["ttl"] = "60"
+	testutil.ExpectEquals(t, false, req.isStale(queuedAt.Add(time.Minute)), "expected push to not be stale before the ttl elapses")
+	testutil.ExpectEquals(t, true, req.isStale(queuedAt.Add(61*time.Second)), "expected push to be stale after the ttl elapses")
+}
+
+func TestResumeDropsStalePushes(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+
+	testutil.ExpectEquals(t, nil, backend.Pause("myservice"), "unexpected error pausing")
+	testPush(backend, "myservice", []string{"sub1"}, map[string]string{"ttl": "1"})
+	testPush(backend, "myservice", []string{"sub2"}, map[string]string{"ttl": "3600"})
+	time.Sleep(1100 * time.Millisecond)
+	testutil.ExpectEquals(t, nil, backend.Resume("myservice"), "unexpected error resuming")
+	// The queued pushes are sent in order, so once the push to sub2 is sent, the push to sub1 would have been sent too.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mockService.getPushed()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	testutil.ExpectEquals(t, []string{"token2"}, mockService.getPushed(), "expected the push whose ttl elapsed to be dropped")
+}
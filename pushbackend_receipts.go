@@ -0,0 +1,170 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// DeliveredPush identifies a successful push which a delivery receipt refers to.
+type DeliveredPush struct {
+	RequestID           string
+	Service             string
+	Subscriber          string
+	PushServiceProvider *push.PushServiceProvider
+	DeliveryPoint       *push.DeliveryPoint
+	MsgID               string
+	// PushedAt is when the push service accepted the push.
+	PushedAt time.Time
+	// DeliveredAt is when the push service delivered the push (or failed to), according to the receipt. It is when the receipt arrived if the push service doesn't report that.
+	DeliveredAt time.Time
+}
+
+// DeliveryReceiptHandler is called when a push service reports whether a successful push was delivered to the device.
+// Only push service types which implement push.DeliveryReceiptReporter report deliveries.
+type DeliveryReceiptHandler interface {
+	DeliveryConfirmed(delivered *DeliveredPush)
+	DeliveryFailed(delivered *DeliveredPush, err error)
+}
+
+type receiptKey struct {
+	pushServiceType string
+	msgID           string
+}
+
+// awaitedReceipts maps the message ids of recent successful pushes to the pushes, until their delivery receipts arrive.
+// It keeps at most size pushes (0 means unlimited), for at most ttl each.
+type awaitedReceipts struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[receiptKey]*list.Element
+	// order contains the *DeliveredPush values, most recently pushed first.
+	order *list.List
+}
+
+func newAwaitedReceipts(size int, ttl time.Duration) *awaitedReceipts {
+	return &awaitedReceipts{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[receiptKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (a *awaitedReceipts) add(delivered *DeliveredPush) {
+	key := receiptKey{delivered.PushServiceProvider.PushServiceName(), delivered.MsgID}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if element, ok := a.entries[key]; ok {
+		a.order.Remove(element)
+	}
+	a.entries[key] = a.order.PushFront(delivered)
+	// Pushes are added in the order they succeeded, so the expired ones are at the back.
+	for a.order.Len() > 0 {
+		oldest := a.order.Back().Value.(*DeliveredPush)
+		if (a.size == 0 || a.order.Len() <= a.size) && delivered.PushedAt.Sub(oldest.PushedAt) < a.ttl {
+			break
+		}
+		a.order.Remove(a.order.Back())
+		delete(a.entries, receiptKey{oldest.PushServiceProvider.PushServiceName(), oldest.MsgID})
+	}
+}
+
+// take returns and forgets the push which receipt refers to, if it is still awaited.
+func (a *awaitedReceipts) take(receipt *push.DeliveryReceipt, now time.Time) (*DeliveredPush, bool) {
+	key := receiptKey{receipt.PushServiceType, receipt.MsgID}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	element, ok := a.entries[key]
+	if !ok {
+		return nil, false
+	}
+	a.order.Remove(element)
+	delete(a.entries, key)
+	delivered := element.Value.(*DeliveredPush)
+	if now.Sub(delivered.PushedAt) >= a.ttl {
+		return nil, false
+	}
+	return delivered, true
+}
+
+// SetDeliveryReceiptHandler makes the backend remember the message ids of successful pushes (see receipt_ttl and max_awaited_receipts), and call handler when the push services report whether they were delivered.
+// This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetDeliveryReceiptHandler(handler DeliveryReceiptHandler) {
+	backend.receiptHandler = handler
+	backend.awaitedReceipts = newAwaitedReceipts(backend.config.MaxAwaitedReceipts, backend.config.ReceiptTTL)
+	receipts := make(chan *push.DeliveryReceipt)
+	backend.psm.SetDeliveryReceiptChan(receipts)
+	go backend.processDeliveryReceipts(receipts)
+}
+
+// awaitReceipt remembers a successful push to dp, if there is a DeliveryReceiptHandler.
+func (backend *PushBackEnd) awaitReceipt(reqID string, service string, sub string, res *push.Result) {
+	if backend.receiptHandler == nil || res.Provider == nil || res.Destination == nil || res.MsgID == "" {
+		return
+	}
+	backend.awaitedReceipts.add(&DeliveredPush{
+		RequestID:           reqID,
+		Service:             service,
+		Subscriber:          sub,
+		PushServiceProvider: res.Provider,
+		DeliveryPoint:       res.Destination,
+		MsgID:               res.MsgID,
+		PushedAt:            time.Now(),
+	})
+}
+
+func (backend *PushBackEnd) processDeliveryReceipts(receipts <-chan *push.DeliveryReceipt) {
+	for receipt := range receipts {
+		backend.ResolveDeliveryReceipt(receipt)
+	}
+}
+
+// ResolveDeliveryReceipt matches receipt to the successful push it refers to, and calls the DeliveryReceiptHandler with it.
+// Push service types which implement push.DeliveryReceiptReporter are resolved automatically. This is for listeners which receive the feedback of a push service some other way (e.g. a webhook).
+// It returns false if there is no DeliveryReceiptHandler, or if the push is unknown or stopped waiting for its receipt.
+func (backend *PushBackEnd) ResolveDeliveryReceipt(receipt *push.DeliveryReceipt) (*DeliveredPush, bool) {
+	if backend.receiptHandler == nil {
+		return nil, false
+	}
+	logger := backend.loggers[LoggerPush]
+	now := time.Now()
+	awaited, ok := backend.awaitedReceipts.take(receipt, now)
+	if !ok {
+		logger.Debugf("PushServiceType=%v MsgID=%v Ignoring delivery receipt for an unknown push", receipt.PushServiceType, receipt.MsgID)
+		return nil, false
+	}
+	delivered := *awaited
+	delivered.DeliveredAt = now
+	if !receipt.Timestamp.IsZero() {
+		delivered.DeliveredAt = receipt.Timestamp
+	}
+	if receipt.Err != nil {
+		logger.Errorf("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v MsgID=%v Delivery failed: %v", delivered.RequestID, delivered.Service, delivered.Subscriber, delivered.PushServiceProvider.Name(), delivered.DeliveryPoint.Name(), delivered.MsgID, receipt.Err)
+		backend.receiptHandler.DeliveryFailed(&delivered, receipt.Err)
+		return &delivered, true
+	}
+	logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v MsgID=%v Delivery confirmed", delivered.RequestID, delivered.Service, delivered.Subscriber, delivered.PushServiceProvider.Name(), delivered.DeliveryPoint.Name(), delivered.MsgID)
+	backend.receiptHandler.DeliveryConfirmed(&delivered)
+	return &delivered, true
+}
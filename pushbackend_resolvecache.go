@@ -0,0 +1,131 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/uniqush/uniqush-push/db"
+)
+
+type resolvedEntry struct {
+	key     warmupKey
+	pairs   []db.PushServiceProviderDeliveryPointPair
+	expires time.Time
+}
+
+// resolvedDeliveryPoints is an LRU cache of the delivery points resolved for pushes to all of a subscriber's delivery points, so that frequently pushed subscribers don't wait for the database.
+// Unlike warmedDeliveryPoints, it is filled by the pushes themselves, and only keeps the size most recently pushed subscribers.
+type resolvedDeliveryPoints struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[warmupKey]*list.Element
+	// order contains the *resolvedEntry values, most recently used first.
+	order *list.List
+}
+
+func newResolvedDeliveryPoints(size int, ttl time.Duration) *resolvedDeliveryPoints {
+	return &resolvedDeliveryPoints{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[warmupKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (r *resolvedDeliveryPoints) put(service string, sub string, pairs []db.PushServiceProviderDeliveryPointPair) {
+	key := warmupKey{service, sub}
+	entry := &resolvedEntry{
+		key:     key,
+		pairs:   append([]db.PushServiceProviderDeliveryPointPair(nil), pairs...),
+		expires: time.Now().Add(r.ttl),
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if element, ok := r.entries[key]; ok {
+		element.Value = entry
+		r.order.MoveToFront(element)
+		return
+	}
+	r.entries[key] = r.order.PushFront(entry)
+	for r.order.Len() > r.size {
+		oldest := r.order.Remove(r.order.Back()).(*resolvedEntry)
+		delete(r.entries, oldest.key)
+	}
+}
+
+// get returns a copy of the cached delivery points of sub, which the caller may reorder.
+func (r *resolvedDeliveryPoints) get(service string, sub string) ([]db.PushServiceProviderDeliveryPointPair, bool) {
+	key := warmupKey{service, sub}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	element, ok := r.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*resolvedEntry)
+	if !time.Now().Before(entry.expires) {
+		r.order.Remove(element)
+		delete(r.entries, key)
+		return nil, false
+	}
+	r.order.MoveToFront(element)
+	return append([]db.PushServiceProviderDeliveryPointPair(nil), entry.pairs...), true
+}
+
+// invalidateSubscriber removes the cached delivery points of sub, after its subscriptions change.
+func (r *resolvedDeliveryPoints) invalidateSubscriber(service string, sub string) {
+	key := warmupKey{service, sub}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if element, ok := r.entries[key]; ok {
+		r.order.Remove(element)
+		delete(r.entries, key)
+	}
+}
+
+// invalidateService removes the cached delivery points of every subscriber of service, after its push service providers change.
+func (r *resolvedDeliveryPoints) invalidateService(service string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for key, element := range r.entries {
+		if key.service == service {
+			r.order.Remove(element)
+			delete(r.entries, key)
+		}
+	}
+}
+
+// invalidateSubscriber removes the delivery points of sub from the caches of resolved delivery points, after its subscriptions change (including changes saved by refreshData).
+func (backend *PushBackEnd) invalidateSubscriber(service string, sub string) {
+	backend.warmed.invalidateSubscriber(service, sub)
+	if backend.resolved != nil {
+		backend.resolved.invalidateSubscriber(service, sub)
+	}
+}
+
+// invalidateService removes the delivery points of every subscriber of service from the caches of resolved delivery points, after its push service providers change.
+func (backend *PushBackEnd) invalidateService(service string) {
+	backend.warmed.invalidateService(service)
+	if backend.resolved != nil {
+		backend.resolved.invalidateService(service)
+	}
+}
@@ -0,0 +1,37 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"github.com/uniqush/uniqush-push/db"
+)
+
+// DeliveryPointResolver looks up the pairs of push service providers and delivery points to push to for a subscriber of a service.
+// Every db.PushDatabase is a DeliveryPointResolver, and the backend's database is used unless another resolver is set.
+type DeliveryPointResolver interface {
+	// GetPushServiceProviderDeliveryPointPairs returns the pairs for subscriber. If dpNamesRequested is non-empty, only those delivery points are returned.
+	GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]db.PushServiceProviderDeliveryPointPair, error)
+}
+
+var _ DeliveryPointResolver = db.PushDatabase(nil)
+
+// SetDeliveryPointResolver overrides how /push finds the delivery points of subscribers (e.g. to return fixed delivery points, or to consult an external service).
+// Subscriptions are still managed by the backend's database. This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetDeliveryPointResolver(resolver DeliveryPointResolver) {
+	backend.resolver = resolver
+}
@@ -0,0 +1,409 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// retryState is passed to each retry of a push to a delivery point.
+type retryState struct {
+	// after is the delay to use as the basis of the next retry's backoff (0 for the first attempt).
+	after time.Duration
+	// retries is the number of retries which were already sent (0 for the first attempt).
+	retries int
+	// delays are the delays before each of the retries which were already sent, or the most recent max_retry_history of them.
+	delays []time.Duration
+	// delaysTruncated is true once the oldest delays were dropped because of max_retry_history.
+	delaysTruncated bool
+	// submitted is when the push was originally requested (zero if unknown).
+	submitted time.Time
+	// waited is the total time spent waiting before the retries which were already sent.
+	// This can be less than the sum of delays if the retries were flushed.
+	waited time.Duration
+	// pending tracks the retries which the original push waits for before returning (see OptionWaitForRetries). It is nil if the push doesn't wait.
+	pending *sync.WaitGroup
+	// failedProviders are the names of the push service providers which already failed in this attempt, so that failover doesn't try them again.
+	// Each retry can try every provider again.
+	failedProviders []string
+}
+
+// newRetryState returns the retryState for the first attempt of a push requested at submitted.
+func newRetryState(submitted time.Time) retryState {
+	return retryState{submitted: submitted}
+}
+
+// next returns the retryState for the retry which was sent after waiting for a backoff of delay.
+// Only the most recent maxHistory delays are kept (0 keeps all of them), so that a push retried many times doesn't keep growing.
+func (r retryState) next(delay time.Duration, waited time.Duration, maxHistory int) retryState {
+	kept := r.delays
+	truncated := r.delaysTruncated
+	if maxHistory > 0 && len(kept) >= maxHistory {
+		kept = kept[len(kept)-maxHistory+1:]
+		truncated = true
+	}
+	delays := make([]time.Duration, len(kept), len(kept)+1)
+	copy(delays, kept)
+	return retryState{
+		after:           2 * delay,
+		retries:         r.retries + 1,
+		delays:          append(delays, delay),
+		delaysTruncated: truncated,
+		submitted:       r.submitted,
+		waited:          r.waited + waited,
+		pending:         r.pending,
+	}
+}
+
+// nextRetry returns the retryState for the retry of a push to sub which was sent after waiting for a backoff of delay, and logs a warning once its history of delays is truncated.
+func (backend *PushBackEnd) nextRetry(reqID string, service string, sub string, retry retryState, delay time.Duration, waited time.Duration, logger log.Logger) retryState {
+	next := retry.next(delay, waited, backend.config.MaxRetryHistory)
+	if next.delaysTruncated && !retry.delaysTruncated {
+		logger.Warnf("RequestID=%v Service=%v Subscriber=%v Retries=%v Only keeping the delays of the last %d retries (max_retry_history)", reqID, service, sub, next.retries, backend.config.MaxRetryHistory)
+	}
+	return next
+}
+
+// withFailedProvider returns the retryState for pushing again in the same attempt, after the push service provider pspName failed.
+func (r retryState) withFailedProvider(pspName string) retryState {
+	failed := make([]string, len(r.failedProviders), len(r.failedProviders)+1)
+	copy(failed, r.failedProviders)
+	r.failedProviders = append(failed, pspName)
+	return r
+}
+
+// providerFailed returns true if the push service provider pspName already failed in this attempt.
+func (r retryState) providerFailed(pspName string) bool {
+	for _, name := range r.failedProviders {
+		if name == pspName {
+			return true
+		}
+	}
+	return false
+}
+
+// pastDeadline returns true if t is later than the uniqush.timeout of notif after the push was submitted.
+// It returns false if notif has no timeout, or if submitted is unknown.
+func pastDeadline(notif *push.Notification, submitted time.Time, t time.Time) bool {
+	timeout, ok := getDurationOption(notif, OptionTimeout)
+	return ok && !submitted.IsZero() && t.After(submitted.Add(timeout))
+}
+
+// remainingTTL returns notif with its ttl (in seconds) reduced by the time since the push was submitted, so that a retry expires at the same time as the original push would.
+// It returns false if the ttl has elapsed. notif is returned unchanged if it has no positive ttl, or if submitted is unknown.
+// The ttl can differ between delivery points with the per-delivery point parameters of /push, and each retry keeps the ttl of its delivery point.
+func remainingTTL(notif *push.Notification, submitted time.Time, now time.Time) (*push.Notification, bool) {
+	ttlstr, ok := notif.Data["ttl"]
+	if !ok || submitted.IsZero() {
+		return notif, true
+	}
+	ttl, err := strconv.ParseUint(ttlstr, 10, 32)
+	if err != nil || ttl == 0 {
+		return notif, true
+	}
+	remaining := time.Duration(ttl)*time.Second - now.Sub(submitted)
+	if remaining <= 0 {
+		return notif, false
+	}
+	// Round up, since a ttl of 0 would mean that the notification expires immediately.
+	seconds := (remaining + time.Second - 1) / time.Second
+	ret := notif.Clone()
+	ret.Data["ttl"] = strconv.FormatInt(int64(seconds), 10)
+	return ret, true
+}
+
+// retryCollapseKey returns notif with a collapse key derived from reqID if retry_collapse_key is on and notif doesn't have a collapse key already.
+// The key is the same for every attempt of the push, so that a retry replaces an earlier attempt which was delivered despite failing.
+func (backend *PushBackEnd) retryCollapseKey(reqID string, notif *push.Notification) *push.Notification {
+	if !backend.config.RetryCollapseKey {
+		return notif
+	}
+	sum := sha256.Sum256([]byte(reqID))
+	// This is well within the limits of every push service on the length of collapse keys (e.g. 64 bytes for apns-collapse-id).
+	return mergeDefaults(map[string]string{push.CollapseKey: "uniqush-" + hex.EncodeToString(sum[:12])}, notif)
+}
+
+// maxRetrySchedule is the most attempts listed in the retry schedule of a response (see OptionRetrySchedule).
+const maxRetrySchedule = 10
+
+// retrySchedule returns the unix timestamps of the planned retries of a push to service, starting with the retry which will be sent at first after a backoff of after.
+// The later retries are the ones which the backoff would schedule if each retry failed. They don't account for delays which the push service may ask for.
+// retries is the number of retries which were already sent, so that max_retries (maxRetries) is respected.
+func (backend *PushBackEnd) retrySchedule(notif *push.Notification, service string, first time.Time, after time.Duration, retries int, maxRetries int, submitted time.Time) []int64 {
+	schedule := []int64{first.Unix()}
+	t := first
+	for n := retries + 1; len(schedule) < maxRetrySchedule; n++ {
+		after = backend.config.retryBackoff(2 * after)
+		if maxRetries > 0 && after > backend.config.MaxBackoff {
+			after = backend.config.MaxBackoff
+		}
+		if (maxRetries > 0 && n >= maxRetries) || after > backend.config.MaxBackoff {
+			break
+		}
+		t = t.Add(backend.config.retryDelay(service, after, t))
+		if pastDeadline(notif, submitted, t) {
+			break
+		}
+		schedule = append(schedule, t.Unix())
+	}
+	return schedule
+}
+
+// retryAttempt describes a retry for scheduleRetry, and how each outcome of scheduling it is reported.
+type retryAttempt struct {
+	service string
+	sub     string
+	// notif has the options of the push which limit its retries (uniqush.max_retries, uniqush.timeout and uniqush.retry_schedule).
+	notif *push.Notification
+	// requested is the delay which the push service asked to wait before retrying, or 0.
+	requested time.Duration
+	// target identifies what is retried in the logs, e.g. "PushServiceProvider=psp DeliveryPoint=dp".
+	target string
+	// abandon reports that the retry won't be sent, with UNIQUSH_ERROR_FAILED_RETRY once the retry limit is reached, or UNIQUSH_ERROR_TIMEOUT.
+	abandon func(code string, reason string)
+	// drop reports that the retry was dropped because of max_pending_retries, or while it was waiting.
+	drop func(reason string)
+	// retrying reports the retry as pending, since the response won't include its result.
+	retrying func(nextAttempt int64, retries int, schedule []int64)
+	// send sends the retry once its delay elapsed.
+	send func(next retryState)
+}
+
+// scheduleRetry waits for the backoff of the next retry after retry and then sends it, or gives up once max_retries, max_backoff or uniqush.timeout is reached.
+// The push service and the retry window of the service may delay the retry beyond its backoff. The backoff of the next retry is still based on this backoff.
+func (backend *PushBackEnd) scheduleRetry(reqID string, attempt retryAttempt, retry retryState, logger log.Logger) {
+	service := attempt.service
+	sub := attempt.sub
+	after := backend.config.retryBackoff(retry.after)
+	maxRetries := backend.maxRetries(attempt.notif)
+	if maxRetries > 0 {
+		// With a limit on the number of retries, the delay stops increasing at max_backoff instead of giving up.
+		if after > backend.config.MaxBackoff {
+			after = backend.config.MaxBackoff
+		}
+	}
+	if maxRetries > 0 && retry.retries >= maxRetries {
+		attempt.abandon(UNIQUSH_ERROR_FAILED_RETRY, fmt.Sprintf("retry limit reached: giving up after %d retries (max_retries is %d)", retry.retries, maxRetries))
+		return
+	}
+	if after > backend.config.MaxBackoff {
+		attempt.abandon(UNIQUSH_ERROR_FAILED_RETRY, fmt.Sprintf("retry limit reached: giving up after %d retries, since the next backoff (%v) would exceed max_backoff (%v)", retry.retries, after, backend.config.MaxBackoff))
+		return
+	}
+	requested, clamped := backend.config.retryAfter(service, after, attempt.requested)
+	if clamped {
+		logger.Warnf("RequestID=%v Service=%v Subscriber=%v %v Push service asked to retry after %v, clamped to max_retry_after", reqID, service, sub, attempt.target, attempt.requested)
+	}
+	delay := backend.config.retryDelay(service, requested, time.Now())
+	if pastDeadline(attempt.notif, retry.submitted, time.Now().Add(delay)) {
+		attempt.abandon(UNIQUSH_ERROR_TIMEOUT, "the retry would be sent after the uniqush.timeout of the push")
+		return
+	}
+	scheduled := backend.retries.schedule()
+	if scheduled == nil {
+		attempt.drop("the queue of pending retries is full")
+		return
+	}
+	logger.Infof("RequestID=%v Service=%v Subscriber=%v %v Retry after %v", reqID, service, sub, attempt.target, delay)
+	if retry.pending == nil {
+		// The response won't include the result of the retry, so it lists the retry as pending instead.
+		first := time.Now().Add(delay)
+		var schedule []int64
+		if getBoolOption(attempt.notif, OptionRetrySchedule) {
+			schedule = backend.retrySchedule(attempt.notif, service, first, after, retry.retries, maxRetries, retry.submitted)
+		}
+		attempt.retrying(first.Unix(), retry.retries, schedule)
+	} else {
+		retry.pending.Add(1)
+	}
+	// The pushes already delivered for reqID must be remembered until the retry was sent, however long it waits.
+	backend.delivered.retain(reqID)
+	go func() {
+		defer backend.delivered.release(reqID)
+		if retry.pending != nil {
+			defer retry.pending.Done()
+		}
+		waitStart := time.Now()
+		if !backend.retries.wait(delay, scheduled) {
+			attempt.drop(scheduled.dropReason)
+			return
+		}
+		attempt.send(backend.nextRetry(reqID, service, sub, retry, after, time.Since(waitStart), logger))
+	}()
+}
+
+// scheduledRetry is a retry which is waiting for its backoff.
+type scheduledRetry struct {
+	// flushed is closed when the retries scheduled before this one are flushed.
+	flushed <-chan struct{}
+	// dropped is closed if the retry is dropped to make room for a newer one, or because of memory pressure. It is nil if pending retries aren't tracked.
+	dropped chan struct{}
+	// dropReason is why the retry was dropped, once dropped is closed.
+	dropReason string
+	element    *list.Element
+}
+
+// retryScheduler allows the retries which are waiting for their backoff to be sent immediately, and limits how many retries wait at once.
+type retryScheduler struct {
+	lock sync.Mutex
+	// flushed is closed (and replaced) to wake up every retry scheduled before the flush.
+	flushed chan struct{}
+	// capacity is the maximum number of pending retries (0 means unlimited).
+	capacity   int
+	dropOldest bool
+	// pending contains the *scheduledRetry values which are waiting, oldest first. It is only used if capacity or track is set.
+	pending *list.List
+	// track makes the scheduler track pending retries without a capacity, so that they can be dropped under memory pressure (see memory_pressure_max_retries).
+	track bool
+	// rate limits how quickly retries are sent once their backoff elapses (see retry_rate). This is nil if there is no limit.
+	rate *rateLimiter
+}
+
+func newRetryScheduler(capacity int, dropOldest bool) *retryScheduler {
+	return &retryScheduler{
+		flushed:    make(chan struct{}),
+		capacity:   capacity,
+		dropOldest: dropOldest,
+		pending:    list.New(),
+	}
+}
+
+// schedule returns the scheduledRetry to pass to wait. This must be called before the retry starts waiting.
+// If capacity retries are already pending, the oldest one is dropped (if dropOldest is set), or nil is returned and the new retry must not be sent.
+func (r *retryScheduler) schedule() *scheduledRetry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	s := &scheduledRetry{flushed: r.flushed}
+	if r.capacity <= 0 && !r.track {
+		return s
+	}
+	if r.capacity > 0 && r.pending.Len() >= r.capacity {
+		if !r.dropOldest {
+			return nil
+		}
+		r.dropOldestLocked("dropped to make room for newer retries")
+	}
+	s.dropped = make(chan struct{})
+	s.element = r.pending.PushBack(s)
+	return s
+}
+
+// wait blocks until the backoff of a retry elapses, or until the retries are flushed, and then until retry_rate allows sending it.
+// It returns false if the retry was dropped instead. The retry still counts as pending while it waits for retry_rate.
+func (r *retryScheduler) wait(after time.Duration, s *scheduledRetry) bool {
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.flushed:
+	case <-s.dropped:
+		return false
+	}
+	if r.rate != nil {
+		r.rate.wait()
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if s.element != nil {
+		r.pending.Remove(s.element)
+		s.element = nil
+	}
+	return true
+}
+
+// dropOldestLocked drops the retry which has been waiting the longest. r.lock must be held.
+func (r *retryScheduler) dropOldestLocked(reason string) {
+	oldest := r.pending.Remove(r.pending.Front()).(*scheduledRetry)
+	oldest.element = nil
+	oldest.dropReason = reason
+	close(oldest.dropped)
+}
+
+// shed drops the retries which have been waiting the longest, until at most keep retries are pending. It returns the number of retries dropped.
+func (r *retryScheduler) shed(keep int, reason string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	dropped := 0
+	for r.pending.Len() > keep {
+		r.dropOldestLocked(reason)
+		dropped++
+	}
+	return dropped
+}
+
+func (r *retryScheduler) flush() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	close(r.flushed)
+	r.flushed = make(chan struct{})
+}
+
+// FlushRetries sends every retry which is currently waiting for its backoff immediately (e.g. for a controlled failover, or in integration tests).
+// The delays of any further retries of those pushes are unaffected.
+func (backend *PushBackEnd) FlushRetries() {
+	backend.retries.flush()
+}
+
+// recordBackoff logs and counts the time that a push to a delivery point spent waiting for retries, once that push succeeds or fails for good.
+// This allows attributing delivery latency to backoff rather than to push services.
+func (backend *PushBackEnd) recordBackoff(reqID string, service string, sub string, dpName string, retry retryState, logger log.Logger) {
+	if retry.retries == 0 {
+		return
+	}
+	atomic.AddInt64(&backend.backoffWaited, int64(retry.waited))
+	logger.Infof("RequestID=%v Service=%v Subscriber=%v DeliveryPoint=%v Retries=%v BackoffTime=%v", reqID, service, sub, dpName, retry.retries, retry.waited)
+}
+
+// TotalBackoffTime returns the total time that finished pushes spent waiting for retries.
+func (backend *PushBackEnd) TotalBackoffTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&backend.backoffWaited))
+}
+
+// RetryQueueStats describes the retries which are waiting for their backoff.
+type RetryQueueStats struct {
+	// Pending is the number of retries waiting for their backoff. It is only counted if Capacity or memory_pressure_max_retries is set.
+	Pending int
+	// Capacity is max_pending_retries (0 means unlimited).
+	Capacity int
+	// Overflow is the retry_overflow policy applied to retries beyond Capacity.
+	Overflow string
+	// Overflowed is the number of retries which were rejected or dropped because the queue was full.
+	Overflowed int64
+}
+
+// RetryQueueStats returns the capacity, overflow policy and current usage of the queue of pending retries.
+func (backend *PushBackEnd) RetryQueueStats() RetryQueueStats {
+	backend.retries.lock.Lock()
+	defer backend.retries.lock.Unlock()
+	return RetryQueueStats{
+		Pending:    backend.retries.pending.Len(),
+		Capacity:   backend.retries.capacity,
+		Overflow:   backend.config.RetryOverflow,
+		Overflowed: atomic.LoadInt64(&backend.retriesOverflowed),
+	}
+}
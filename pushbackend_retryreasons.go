@@ -0,0 +1,71 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// retryReasonKey identifies a counter of retryReasonCounters.
+type retryReasonKey struct {
+	service  string
+	category string
+}
+
+// retryReasonCounters counts the retries requested by push services, by service and by the category of the reason (see push.RetryError.ReasonCategory).
+// This tells whether retries are caused by unstable push services or by network issues.
+type retryReasonCounters struct {
+	lock   sync.Mutex
+	counts map[retryReasonKey]int64
+}
+
+func newRetryReasonCounters() *retryReasonCounters {
+	return &retryReasonCounters{counts: make(map[retryReasonKey]int64)}
+}
+
+func (c *retryReasonCounters) add(service string, category string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[retryReasonKey{service, category}]++
+}
+
+// RetryReasonCount is the number of retries requested for pushes of Service, for reasons of a category (e.g. push.RetryCategoryTimeout).
+type RetryReasonCount struct {
+	Service  string `json:"service"`
+	Category string `json:"category"`
+	Count    int64  `json:"count"`
+}
+
+// RetryReasonCounts returns the number of retries requested since uniqush-push started, for each service and category of reason, sorted by service and category.
+func (backend *PushBackEnd) RetryReasonCounts() []RetryReasonCount {
+	c := backend.retryReasons
+	c.lock.Lock()
+	result := make([]RetryReasonCount, 0, len(c.counts))
+	for key, count := range c.counts {
+		result = append(result, RetryReasonCount{Service: key.service, Category: key.category, Count: count})
+	}
+	c.lock.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Service != result[j].Service {
+			return result[i].Service < result[j].Service
+		}
+		return result[i].Category < result[j].Category
+	})
+	return result
+}
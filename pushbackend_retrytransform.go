@@ -0,0 +1,47 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// RetryTransformer changes the notification sent by each retry (e.g. to drop rich media from the payload, or send a simpler alert to a device which keeps failing).
+type RetryTransformer interface {
+	// TransformRetry returns the notification to send to dp in retry number retries (1 for the first retry).
+	// notif is the notification which the retry would otherwise send, which may already have been transformed by an earlier retry, so transforms should be idempotent.
+	// notif must not be modified. Return a changed clone of it (see push.Notification.Clone), or notif itself to send it unchanged.
+	TransformRetry(service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification, retries int) *push.Notification
+}
+
+// SetRetryTransformer sets the transformer which can change the notification before each retry. By default, retries send the same notification as the original push.
+// This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetRetryTransformer(transformer RetryTransformer) {
+	backend.retryTransformer = transformer
+}
+
+// transformRetry returns the notification to send to dp in retry number retries, as changed by the retry transformer.
+func (backend *PushBackEnd) transformRetry(service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification, retries int) *push.Notification {
+	if backend.retryTransformer == nil {
+		return notif
+	}
+	if transformed := backend.retryTransformer.TransformRetry(service, psp, dp, notif, retries); transformed != nil {
+		return transformed
+	}
+	return notif
+}
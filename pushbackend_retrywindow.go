@@ -0,0 +1,89 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// retryWindowSectionPrefix is the prefix of the sections of uniqush.conf which restrict the retries of a service to a time of day, e.g. [retrywindow:myservice].
+const retryWindowSectionPrefix = "retrywindow:"
+
+// RetryWindow is the time of day (in the local time zone of uniqush-push) during which retries of a service may be sent, e.g. to avoid retrying non-urgent notifications at night.
+// The window wraps around midnight if End is before Start (e.g. 22:00-06:00).
+type RetryWindow struct {
+	// Start and End are offsets from midnight.
+	Start time.Duration
+	End   time.Duration
+}
+
+// parseRetryWindow parses the start and end of a window, which are formatted like "09:00".
+func parseRetryWindow(start string, end string) (RetryWindow, error) {
+	startOffset, err := parseTimeOfDay(start)
+	if err != nil {
+		return RetryWindow{}, err
+	}
+	endOffset, err := parseTimeOfDay(end)
+	if err != nil {
+		return RetryWindow{}, err
+	}
+	if startOffset == endOffset {
+		return RetryWindow{}, fmt.Errorf("retry window %s-%s is empty", start, end)
+	}
+	return RetryWindow{Start: startOffset, End: endOffset}, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %v", value, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains returns true if an offset from midnight is within the window.
+func (w RetryWindow) contains(offset time.Duration) bool {
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// next returns t if it is within the window, or else the start of the next window after t.
+func (w RetryWindow) next(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if w.contains(t.Sub(midnight)) {
+		return t
+	}
+	start := midnight.Add(w.Start)
+	if !start.After(t) {
+		start = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(w.Start)
+	}
+	return start
+}
+
+// retryDelay returns how long a retry of service should wait, given its backoff. This is longer than the backoff if the backoff ends outside of the service's retry window.
+func (c *PushBackEndConfig) retryDelay(service string, backoff time.Duration, now time.Time) time.Duration {
+	window, ok := c.RetryWindows[strings.ToLower(service)]
+	if !ok {
+		return backoff
+	}
+	return window.next(now.Add(backoff)).Sub(now)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// subscriberSample selects a percentage of the subscribers of a push by a hash of their names (see OptionSamplePercent), e.g. for gradual rollouts of a feature.
+type subscriberSample struct {
+	// threshold is the number of the sampleBuckets which are included in the sample.
+	threshold uint64
+	seed      string
+}
+
+// sampleBuckets is the number of buckets subscribers are hashed into, so that percentages with two decimals can be sampled.
+const sampleBuckets = 10000
+
+// samplePercent returns the percentage of subscribers sampled by notif, and false if notif isn't sampled (i.e. if OptionSamplePercent isn't set, or is exactly 100).
+// It returns an error if OptionSamplePercent isn't a number from 0 to 100, so that a typo doesn't push to every subscriber.
+func samplePercent(notif *push.Notification) (float64, bool, error) {
+	value, ok := notif.Data[OptionSamplePercent]
+	if !ok {
+		return 0, false, nil
+	}
+	percent, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(percent) || percent < 0 || percent > 100 {
+		return 0, false, fmt.Errorf("%s must be a percentage from 0 to 100, got %q", OptionSamplePercent, value)
+	}
+	return percent, percent != 100, nil
+}
+
+// newSubscriberSample returns the sample of subscribers selected by the options of notif, or nil if notif isn't sampled.
+// notif must have been checked by validatePush.
+func newSubscriberSample(notif *push.Notification) *subscriberSample {
+	percent, sampled, err := samplePercent(notif)
+	if err != nil || !sampled {
+		return nil
+	}
+	return &subscriberSample{
+		threshold: uint64(percent * sampleBuckets / 100),
+		seed:      notif.Data[OptionSampleSeed],
+	}
+}
+
+// includes returns true if sub is in the sample.
+// A subscriber stays in the sample as the percentage increases, so that a rollout only ever adds subscribers.
+func (s *subscriberSample) includes(sub string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(s.seed))
+	h.Write([]byte{0})
+	h.Write([]byte(sub))
+	return h.Sum64()%sampleBuckets < s.threshold
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"hash/fnv"
+)
+
+// ShardFilter decides which subscribers this instance of uniqush-push pushes to, when subscribers are sharded across several instances.
+// /push reports the other subscribers as UNIQUSH_NOT_MY_SHARD, so that a coordinator can send them to the right instance.
+type ShardFilter interface {
+	// OwnsSubscriber returns true if this instance pushes to sub.
+	OwnsSubscriber(service string, sub string) bool
+}
+
+// hashShardFilter assigns each subscriber to one of count shards by a hash of its name. This instance owns the shard index.
+type hashShardFilter struct {
+	count uint32
+	index uint32
+}
+
+var _ ShardFilter = &hashShardFilter{}
+
+// NewHashShardFilter returns a ShardFilter which owns the subscribers whose FNV-1a hash is index modulo count.
+// The service isn't hashed, so that a subscriber of several services is owned by the same instance.
+func NewHashShardFilter(count int, index int) ShardFilter {
+	return &hashShardFilter{count: uint32(count), index: uint32(index)}
+}
+
+func (f *hashShardFilter) OwnsSubscriber(service string, sub string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(sub))
+	return h.Sum32()%f.count == f.index
+}
+
+// SetShardFilter restricts pushes to the subscribers owned by this instance. This must be called before the backend starts sending pushes.
+func (backend *PushBackEnd) SetShardFilter(filter ShardFilter) {
+	backend.shard = filter
+}
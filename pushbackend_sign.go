@@ -0,0 +1,106 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// NotificationSigner signs the notifications sent to each delivery point, so that the app receiving them can verify that they came from the operator of uniqush-push and weren't tampered with.
+type NotificationSigner interface {
+	// SignNotification returns the signature of notif for dp, which is added to the notification as its signature field. notif must not be modified.
+	// If it returns an error, the push to dp fails instead of sending notif unsigned.
+	SignNotification(service string, sub string, dp *push.DeliveryPoint, notif *push.Notification) (string, error)
+}
+
+// SetNotificationSigner sets the signer of the notifications sent to each delivery point, and the field of the notification which contains the signature (e.g. "sig").
+// This must be called before the backend starts sending pushes. With a signer, each delivery point gets its own push to its push service provider, like with a PayloadEncryptor.
+// If there is also a payload encryptor, the encrypted notification is signed.
+func (backend *PushBackEnd) SetNotificationSigner(field string, signer NotificationSigner) {
+	backend.signatureField = field
+	backend.signer = signer
+}
+
+// HMACSigner is a NotificationSigner which signs the fields of a notification with HMAC-SHA256, and encodes the signature with base64.
+// The signed message is each field of the notification except the ones reserved by uniqush (beginning with "uniqush."), sorted by key.
+// Each key and each value is encoded as a netstring, i.e. its length in bytes in decimal, ":", the bytes, and ",". For example, {"msg": "hello"} is signed as "3:msg,5:hello,".
+// The lengths make the message unambiguous, so that no other notification has the same message. Raw payloads (uniqush.payload.*) are sent as given, so they aren't signed.
+type HMACSigner struct {
+	Key []byte
+}
+
+// SignNotification implements NotificationSigner.
+func (s *HMACSigner) SignNotification(service string, sub string, dp *push.DeliveryPoint, notif *push.Notification) (string, error) {
+	keys := make([]string, 0, len(notif.Data))
+	for k := range notif.Data {
+		if !strings.HasPrefix(k, "uniqush.") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	mac := hmac.New(sha256.New, s.Key)
+	for _, k := range keys {
+		writeNetstring(mac, k)
+		writeNetstring(mac, notif.Data[k])
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func writeNetstring(w io.Writer, s string) {
+	io.WriteString(w, strconv.Itoa(len(s))+":"+s+",")
+}
+
+// signingError is the error of a push which wasn't sent because the notification couldn't be signed.
+type signingError struct {
+	*push.ErrorReport
+}
+
+func newSigningError(err error) *signingError {
+	return &signingError{push.NewErrorf("failed to sign the notification: %v", err)}
+}
+
+// signNotification returns notif with the signature for dp added by the notification signer, or notif itself if there is no signer.
+// notif must already have gone through prepareNotification, so that the fields the app receives are the ones which were signed.
+func (backend *PushBackEnd) signNotification(service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, push.Error) {
+	if backend.signer == nil {
+		return notif, nil
+	}
+	var signature string
+	signErr := backend.withHookTimeout(service, psp, func() error {
+		var err error
+		signature, err = backend.signer.SignNotification(service, dp.FixedData["subscriber"], dp, notif)
+		return err
+	})
+	if signErr == errHookTimeout {
+		return nil, &hookTimeoutError{push.NewError("failed to sign the notification: the signer didn't finish within hook_timeout")}
+	}
+	if signErr != nil {
+		return nil, newSigningError(signErr)
+	}
+	signed := notif.Clone()
+	signed.Data[backend.signatureField] = signature
+	return signed, nil
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// The priorities of calls to Push waiting for one of max_concurrent_pushes slots (see OptionQueuePriority), from the first to be let through to the last.
+const (
+	pushPriorityHigh = iota
+	pushPriorityNormal
+	pushPriorityLow
+	numPushPriorities
+)
+
+// pushPriority returns the priority of notif when waiting for a slot, from uniqush.queue_priority.
+func pushPriority(notif *push.Notification) int {
+	return pushPriorityNamed(notif.Data[OptionQueuePriority])
+}
+
+// pushPriorityNamed returns the priority named name ("high", "normal", or "low"). Other names are the normal priority.
+func pushPriorityNamed(name string) int {
+	switch strings.ToLower(name) {
+	case "high":
+		return pushPriorityHigh
+	case "low":
+		return pushPriorityLow
+	default:
+		return pushPriorityNormal
+	}
+}
+
+// pushSlots limits the number of calls to Push running at once. When every slot is in use, the waiting calls get the next free slot in order of priority, then in the order they started waiting.
+// To avoid starving a lower priority, a call waiting with it is let through once starvationLimit calls with higher priorities were let through ahead of it.
+type pushSlots struct {
+	lock            sync.Mutex
+	free            int
+	starvationLimit int
+	// waiting contains a list of channels for each priority, which are closed to let the waiting calls through.
+	waiting [numPushPriorities]*list.List
+	// passed counts the calls with higher priorities let through while calls with each priority were waiting.
+	passed [numPushPriorities]int
+}
+
+func newPushSlots(size int, starvationLimit int) *pushSlots {
+	s := &pushSlots{free: size, starvationLimit: starvationLimit}
+	for i := range s.waiting {
+		s.waiting[i] = list.New()
+	}
+	return s
+}
+
+// acquire returns true once the caller may use a slot. If reject is true, it returns false instead of waiting for a slot.
+func (s *pushSlots) acquire(priority int, reject bool) bool {
+	s.lock.Lock()
+	if s.free > 0 {
+		s.free--
+		s.lock.Unlock()
+		return true
+	}
+	if reject {
+		s.lock.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	s.waiting[priority].PushBack(ready)
+	s.lock.Unlock()
+	<-ready
+	return true
+}
+
+// release passes the caller's slot on to the next waiting call, or frees it if no calls are waiting.
+func (s *pushSlots) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	next := -1
+	for priority := numPushPriorities - 1; priority > pushPriorityHigh; priority-- {
+		if s.waiting[priority].Len() > 0 && s.starvationLimit > 0 && s.passed[priority] >= s.starvationLimit {
+			next = priority
+			break
+		}
+	}
+	if next < 0 {
+		for priority := 0; priority < numPushPriorities; priority++ {
+			if s.waiting[priority].Len() > 0 {
+				next = priority
+				break
+			}
+		}
+	}
+	if next < 0 {
+		s.free++
+		return
+	}
+	for priority := next + 1; priority < numPushPriorities; priority++ {
+		if s.waiting[priority].Len() > 0 {
+			s.passed[priority]++
+		}
+	}
+	s.passed[next] = 0
+	close(s.waiting[next].Remove(s.waiting[next].Front()).(chan struct{}))
+}
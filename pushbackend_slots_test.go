@@ -0,0 +1,82 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// waitForSlots starts a call to acquire for each priority in order, waiting for each one to be queued before starting the next, and returns the order in which they get a slot.
+func waitForSlots(t *testing.T, s *pushSlots, priorities []int) <-chan int {
+	t.Helper()
+	order := make(chan int, len(priorities))
+	for i, priority := range priorities {
+		i, priority := i, priority
+		go func() {
+			s.acquire(priority, false)
+			order <- i
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for queuedCount(s) < i+1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return order
+}
+
+func queuedCount(s *pushSlots) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for _, waiting := range s.waiting {
+		n += waiting.Len()
+	}
+	return n
+}
+
+// releaseAll releases a slot n times, and returns the indexes of the calls which got them in order.
+func releaseAll(s *pushSlots, order <-chan int, n int) []int {
+	var got []int
+	for i := 0; i < n; i++ {
+		s.release()
+		got = append(got, <-order)
+	}
+	return got
+}
+
+func TestPushSlotsPriority(t *testing.T) {
+	s := newPushSlots(1, 0)
+	testutil.ExpectEquals(t, true, s.acquire(pushPriorityNormal, true), "expected a free slot")
+	testutil.ExpectEquals(t, false, s.acquire(pushPriorityHigh, true), "expected no free slot")
+
+	order := waitForSlots(t, s, []int{pushPriorityLow, pushPriorityNormal, pushPriorityHigh, pushPriorityHigh})
+	testutil.ExpectEquals(t, []int{2, 3, 1, 0}, releaseAll(s, order, 4), "expected higher priorities to get a slot first")
+	s.release()
+	testutil.ExpectEquals(t, true, s.acquire(pushPriorityLow, true), "expected the slot to be freed once no calls are waiting")
+}
+
+func TestPushSlotsStarvationLimit(t *testing.T) {
+	s := newPushSlots(1, 2)
+	s.acquire(pushPriorityNormal, false)
+
+	order := waitForSlots(t, s, []int{pushPriorityLow, pushPriorityHigh, pushPriorityHigh, pushPriorityHigh})
+	testutil.ExpectEquals(t, []int{1, 2, 0, 3}, releaseAll(s, order, 4), "expected the low priority call to get a slot after 2 higher priority calls")
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+type subscriberLock struct {
+	lock sync.Mutex
+	// refs is the number of pushes holding or waiting for lock.
+	refs int
+}
+
+// subscriberLocks serializes pushes to the same subscribers of a service, so that pushes to a subscriber's devices arrive in order.
+type subscriberLocks struct {
+	lock  sync.Mutex
+	locks map[string]*subscriberLock
+}
+
+func newSubscriberLocks() *subscriberLocks {
+	return &subscriberLocks{locks: make(map[string]*subscriberLock)}
+}
+
+// lockAll blocks until no other push holds a lock on any of subs of service, and returns a function to release those locks.
+// The locks are acquired in sorted order, so that concurrent pushes to overlapping sets of subscribers can't deadlock.
+func (s *subscriberLocks) lockAll(service string, subs []string) (unlock func()) {
+	keys := make([]string, 0, len(subs))
+	seen := make(map[string]bool, len(subs))
+	for _, sub := range subs {
+		key := service + "\x00" + sub
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	held := make([]*subscriberLock, len(keys))
+	s.lock.Lock()
+	for i, key := range keys {
+		l, ok := s.locks[key]
+		if !ok {
+			l = new(subscriberLock)
+			s.locks[key] = l
+		}
+		l.refs++
+		held[i] = l
+	}
+	s.lock.Unlock()
+	for _, l := range held {
+		l.lock.Lock()
+	}
+
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for i, l := range held {
+			l.lock.Unlock()
+			l.refs--
+			if l.refs == 0 {
+				delete(s.locks, keys[i])
+			}
+		}
+	}
+}
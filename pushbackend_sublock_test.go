@@ -0,0 +1,57 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestSubscriberLocks(t *testing.T) {
+	s := newSubscriberLocks()
+	unlock := s.lockAll("myservice", []string{"sub2", "sub1", "sub1"})
+
+	locked := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		unlockOther := s.lockAll("myservice", []string{"sub1"})
+		close(locked)
+		unlockOther()
+		close(done)
+	}()
+	otherService := s.lockAll("otherservice", []string{"sub1"})
+	otherService()
+
+	select {
+	case <-locked:
+		t.Fatalf("Expected the second push to sub1 to wait for the first")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the second push to sub1 to proceed after the first")
+	}
+	<-done
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	testutil.ExpectEquals(t, 0, len(s.locks), "expected unused locks to be removed")
+}
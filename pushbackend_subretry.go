@@ -0,0 +1,170 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// isDeliveryFailure returns true if err means that a push to a delivery point wasn't delivered, and wasn't only an update to the saved data of the delivery point or push service provider.
+func isDeliveryFailure(err error) bool {
+	switch err.(type) {
+	case *push.PushServiceProviderUpdate, *push.DeliveryPointUpdate, *push.InvalidRegistrationUpdate, *push.UnsubscribeUpdate:
+		return false
+	default:
+		return err != nil
+	}
+}
+
+// pushSubscriberSet sends notifs[i] to the delivery point pspDpList[i] of a single subscriber, and retries every delivery point which failed together (see OptionRetrySubscriber).
+// Successful pushes and updates are reported as usual, while failures are reported once the subscriber is retried or given up on.
+func (backend *PushBackEnd) pushSubscriberSet(
+	reqID string,
+	remoteAddr string,
+	service string,
+	sub string,
+	pspDpList []db.PushServiceProviderDeliveryPointPair,
+	notifs []*push.Notification,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+) {
+	var failed []db.PushServiceProviderDeliveryPointPair
+	var failures []*push.RetryError
+	for i, pair := range pspDpList {
+		psp := pair.PushServiceProvider
+		dp := pair.DeliveryPoint
+		notif := notifs[i]
+		if msgID, delivered := backend.delivered.get(reqID, dp.Name()); delivered {
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v MsgID=%v Not retrying: already delivered", reqID, service, sub, psp.Name(), dp.Name(), msgID)
+			continue
+		}
+		note := notif
+		if retry.retries > 0 {
+			note = backend.transformRetry(service, psp, dp, notif, retry.retries)
+		}
+		if !backend.admitDeliveryPoint(reqID, remoteAddr, service, sub, psp, dp, note, logger, handler) {
+			continue
+		}
+		results := backend.pushToDeliveryPoint(reqID, service, psp, dp, note, logger)
+		resChan := make(chan *push.Result, len(results))
+		var failure *push.RetryError
+		for _, res := range results {
+			// Pushes rejected by a push hook are reported as usual instead of being retried.
+			if _, rejected := res.Err.(*hookRejectedError); rejected || !isDeliveryFailure(res.Err) {
+				resChan <- res
+				continue
+			}
+			backend.recordResult(service, res)
+			switch err := res.Err.(type) {
+			case *push.RetryError:
+				failure = push.NewRetryErrorWithReason(psp, dp, notif, err.After, err.Reason)
+				failure.Category = err.Category
+			default:
+				// The push service won't retry this by itself, so it is logged and counted towards the blacklist like any other failure.
+				backend.recordFailure(reqID, service, sub, res, err, logger)
+				failure = push.NewRetryErrorWithReason(psp, dp, notif, 0, err)
+			}
+		}
+		close(resChan)
+		backend.collectResult(reqID, remoteAddr, service, resChan, logger, retry, handler)
+		if failure != nil {
+			logger.Infof("RequestID=%v Service=%v Subscriber=%v PushServiceProvider=%v DeliveryPoint=%v Failed once: %v", reqID, service, sub, psp.Name(), dp.Name(), failure)
+			failed = append(failed, pair)
+			failures = append(failures, failure)
+		}
+	}
+	if len(failed) > 0 {
+		backend.retrySubscriberSet(reqID, remoteAddr, service, sub, failed, failures, logger, retry, handler)
+	}
+}
+
+// retrySubscriberSet schedules a single retry of the delivery points of sub which failed, using the same backoff and limits as fixRetryError does for a single delivery point (see scheduleRetry).
+// failures are the errors of the delivery points in failed, in the same order, and their contents are the notifications which are retried.
+func (backend *PushBackEnd) retrySubscriberSet(
+	reqID string,
+	remoteAddr string,
+	service string,
+	sub string,
+	failed []db.PushServiceProviderDeliveryPointPair,
+	failures []*push.RetryError,
+	logger log.Logger,
+	retry retryState,
+	handler APIResponseHandler,
+) {
+	var requested time.Duration
+	for _, err := range failures {
+		backend.retryReasons.add(service, err.ReasonCategory())
+		backend.metrics.IncCounter(MetricRetries, map[string]string{"service": service, "category": err.ReasonCategory()})
+		if err.After > requested {
+			requested = err.After
+		}
+	}
+	backend.scheduleRetry(reqID, retryAttempt{
+		service: service,
+		sub:     sub,
+		// The options of the push are the same for every delivery point, unlike the per-delivery point parameters of /push.
+		notif:     failures[0].Content,
+		requested: requested,
+		target:    fmt.Sprintf("FailedDeliveryPoints=%d", len(failed)),
+		abandon: func(code string, reason string) {
+			for _, err := range failures {
+				backend.abandonRetry(reqID, remoteAddr, service, sub, err, retry, logger, handler, code, reason)
+			}
+		},
+		drop: func(reason string) {
+			for _, err := range failures {
+				backend.dropRetry(reqID, remoteAddr, service, sub, err, retry, logger, handler, reason)
+			}
+		},
+		retrying: func(nextAttempt int64, retries int, schedule []int64) {
+			for _, err := range failures {
+				providerName := err.Provider.Name()
+				destinationName := err.Destination.Name()
+				handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Subscriber: &sub, PushServiceProvider: &providerName, DeliveryPoint: &destinationName, Code: UNIQUSH_PUSH_RETRYING, NextAttempt: &nextAttempt, Retries: &retries, RetrySchedule: schedule})
+			}
+		},
+		send: func(next retryState) {
+			var retryList []db.PushServiceProviderDeliveryPointPair
+			var contents []*push.Notification
+			for i, err := range failures {
+				content, ok := remainingTTL(err.Content, retry.submitted, time.Now())
+				if !ok {
+					backend.abandonRetry(reqID, remoteAddr, service, sub, err, retry, logger, handler, UNIQUSH_ERROR_EXPIRED, "the ttl of the notification elapsed")
+					continue
+				}
+				retryList = append(retryList, failed[i])
+				contents = append(contents, content)
+			}
+			if len(retryList) == 0 {
+				return
+			}
+			// A retry which the original push waits for runs while the original push holds the subscriber's lock.
+			if backend.subscriberLocks != nil && retry.pending == nil {
+				unlock := backend.subscriberLocks.lockAll(service, []string{sub})
+				defer unlock()
+			}
+			backend.pushSubscriberSet(reqID, remoteAddr, service, sub, retryList, contents, newAttemptLogger(backend.loggers[LoggerPush], next.attemptID(reqID)), next, handler)
+		},
+	}, retry, logger)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+)
+
+// PushBatchSummary contains the totals of the results of a call to Push, once every push (and any retry the call waited for) finished.
+type PushBatchSummary struct {
+	RequestID     string
+	Service       string
+	NrSubscribers int
+	Succeeded     int
+	Failed        int
+	// Retrying is the number of retries which were still pending when the push finished.
+	Retrying int
+	// Unsubscribed is the number of delivery points which were unsubscribed because the push service reported them as no longer registered.
+	Unsubscribed int
+	// Dropped is the number of other delivery points or subscribers which weren't pushed to, without that being a failure (e.g. cancelled or filtered pushes).
+	Dropped int
+	Elapsed time.Duration
+}
+
+// BatchSummaryHandler receives the summary of each call to Push (e.g. to monitor large pushes without aggregating the logs of each delivery point).
+type BatchSummaryHandler interface {
+	PushBatchComplete(summary *PushBatchSummary)
+}
+
+// SetBatchSummaryHandler sets the handler for the summaries of calls to Push. This must be called before the backend starts sending pushes.
+// The summaries are logged whether or not there is a handler.
+func (backend *PushBackEnd) SetBatchSummaryHandler(handler BatchSummaryHandler) {
+	backend.batchSummaryHandler = handler
+}
+
+// batchSummaryHandler counts the results of a call to Push, then passes them on to the handler of the push.
+type batchSummaryHandler struct {
+	inner   APIResponseHandler
+	started time.Time
+	lock    sync.Mutex
+	summary PushBatchSummary
+}
+
+var _ APIResponseHandler = &batchSummaryHandler{}
+
+func newBatchSummaryHandler(inner APIResponseHandler, reqID string, service string, nrSubscribers int) *batchSummaryHandler {
+	return &batchSummaryHandler{
+		inner:   inner,
+		started: time.Now(),
+		summary: PushBatchSummary{RequestID: reqID, Service: service, NrSubscribers: nrSubscribers},
+	}
+}
+
+// AddDetailsToHandler counts v, then passes it on to the wrapped handler.
+func (h *batchSummaryHandler) AddDetailsToHandler(v APIResponseDetails) {
+	h.lock.Lock()
+	switch {
+	case v.Code == UNIQUSH_SUCCESS:
+		h.summary.Succeeded++
+	case v.Code == UNIQUSH_PUSH_RETRYING:
+		h.summary.Retrying++
+	case v.Code == UNIQUSH_UPDATE_UNSUBSCRIBE || v.Code == UNIQUSH_REMOVE_INVALID_REG:
+		h.summary.Unsubscribed++
+	case isDroppedCode(v.Code):
+		h.summary.Dropped++
+	case isFailureCode(v.Code):
+		h.summary.Failed++
+	}
+	h.lock.Unlock()
+	h.inner.AddDetailsToHandler(v)
+}
+
+// ToJSON serializes the response of the wrapped handler.
+func (h *batchSummaryHandler) ToJSON() []byte {
+	return h.inner.ToJSON()
+}
+
+// complete logs the summary of the push, and passes it to the BatchSummaryHandler of backend.
+func (h *batchSummaryHandler) complete(backend *PushBackEnd, logger log.Logger) {
+	h.lock.Lock()
+	summary := h.summary
+	h.lock.Unlock()
+	summary.Elapsed = time.Since(h.started)
+	logger.Infof("RequestID=%v Service=%v [PushBatchComplete] NrSubscribers=%v Succeeded=%v Failed=%v Retrying=%v Unsubscribed=%v Dropped=%v ElapsedTime=%v",
+		summary.RequestID, summary.Service, summary.NrSubscribers, summary.Succeeded, summary.Failed, summary.Retrying, summary.Unsubscribed, summary.Dropped, summary.Elapsed)
+	if backend.batchSummaryHandler != nil {
+		backend.batchSummaryHandler.PushBatchComplete(&summary)
+	}
+}
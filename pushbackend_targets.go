@@ -0,0 +1,58 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"github.com/uniqush/log"
+)
+
+// PushTarget is a delivery point which a push would be sent to, and the push service provider it would be sent with.
+type PushTarget struct {
+	DeliveryPoint       string `json:"deliveryPoint"`
+	PushServiceProvider string `json:"pushServiceProvider"`
+	PushServiceType     string `json:"pushServiceType"`
+}
+
+// PushTargets returns the delivery points which a push to each of subs would be sent to, in the order they would be pushed to, without sending anything.
+// This is meant for answering "which devices would this notify?".
+func (backend *PushBackEnd) PushTargets(service string, subs []string, dpNamesRequested []string, logger log.Logger) (map[string][]PushTarget, error) {
+	targets := make(map[string][]PushTarget, len(subs))
+	for _, sub := range subs {
+		pspDpList, err := backend.resolveDeliveryPoints("", service, sub, dpNamesRequested, false, logger)
+		if err != nil {
+			logger.Errorf("Query=PushTargets Service=%v Subscriber=%v Failed: Database Error %v", service, sub, err)
+			return nil, err
+		}
+		subTargets := make([]PushTarget, 0, len(pspDpList))
+		for _, pair := range pspDpList {
+			psp := pair.PushServiceProvider
+			dp := pair.DeliveryPoint
+			// Pushes to these would fail without being sent.
+			if psp == nil || dp == nil {
+				continue
+			}
+			subTargets = append(subTargets, PushTarget{
+				DeliveryPoint:       dp.Name(),
+				PushServiceProvider: psp.Name(),
+				PushServiceType:     dp.PushServiceName(),
+			})
+		}
+		targets[sub] = subTargets
+	}
+	return targets, nil
+}
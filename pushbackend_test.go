@@ -0,0 +1,2219 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/srv"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+const mockPushServiceTypeName = "mockpush"
+
+// mockPushServiceType records the devtokens of delivery points it pushed to.
+// Pushes to devtokens beginning with "fail" fail, pushes to devtokens beginning with "retry" are retried,
+// pushes to devtokens beginning with "unregistered" report that the delivery point should be unsubscribed,
+// and pushes to devtokens beginning with "lateretry" succeed, but also ask to be retried after 50ms (as if the push service reported an error for a push it delivered).
+type mockPushServiceType struct {
+	lock   sync.Mutex
+	pushed []string
+	// messages are the msg fields of the notifications sent to each devtoken in pushed.
+	messages []string
+	// batches is the number of calls to Push, each of which corresponds to a request to the external push service.
+	batches  int
+	receipts chan<- *push.DeliveryReceipt
+}
+
+var _ push.PushServiceType = &mockPushServiceType{}
+
+var (
+	mockPushService     = &mockPushServiceType{}
+	mockPushServiceOnce sync.Once
+)
+
+// getMockPushServiceType registers the mock push service type with the push service manager singleton (once), and clears the recorded pushes.
+func getMockPushServiceType() *mockPushServiceType {
+	mockPushServiceOnce.Do(func() {
+		push.GetPushServiceManager().RegisterPushServiceType(mockPushService)
+	})
+	mockPushService.lock.Lock()
+	mockPushService.pushed = nil
+	mockPushService.messages = nil
+	mockPushService.batches = 0
+	mockPushService.lock.Unlock()
+	return mockPushService
+}
+
+func (m *mockPushServiceType) getPushed() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string(nil), m.pushed...)
+}
+
+func (m *mockPushServiceType) getMessages() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string(nil), m.messages...)
+}
+
+func (m *mockPushServiceType) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	psp.FixedData["service"] = kv["service"]
+	psp.FixedData["name"] = kv["name"]
+	return nil
+}
+
+func (m *mockPushServiceType) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	if err := dp.AddCommonData(kv); err != nil {
+		return err
+	}
+	dp.FixedData["devtoken"] = kv["devtoken"]
+	return nil
+}
+
+func (m *mockPushServiceType) Name() string {
+	return mockPushServiceTypeName
+}
+
+func (m *mockPushServiceType) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	m.lock.Lock()
+	m.batches++
+	m.lock.Unlock()
+	for dp := range dpQueue {
+		devtoken := dp.FixedData["devtoken"]
+		m.lock.Lock()
+		m.pushed = append(m.pushed, devtoken)
+		m.messages = append(m.messages, notif.Data["msg"])
+		m.lock.Unlock()
+		res := &push.Result{Provider: psp, Destination: dp, Content: notif}
+		switch {
+		case strings.HasPrefix(devtoken, "primaryretry") && psp.FixedData["name"] != "backup":
+			// Only the push service provider named "backup" can push to these.
+			res.Err = push.NewRetryError(psp, dp, notif, 0)
+		case strings.HasPrefix(devtoken, "panic"):
+			panic("mock panic")
+		case strings.HasPrefix(devtoken, "fail"):
+			res.Err = push.NewError("mock failure")
+		case strings.HasPrefix(devtoken, "retry"):
+			res.Err = push.NewRetryError(psp, dp, notif, 0)
+		case strings.HasPrefix(devtoken, "unregistered"):
+			res.Err = push.NewUnsubscribeUpdate(psp, dp)
+		case strings.HasPrefix(devtoken, "lateretry"):
+			res.MsgID = "mockmsg:" + devtoken
+			resQueue <- res
+			res = &push.Result{Provider: psp, Destination: dp, Content: notif, Err: push.NewRetryError(psp, dp, notif, 50*time.Millisecond)}
+		default:
+			res.MsgID = "mockmsg:" + devtoken
+		}
+		resQueue <- res
+	}
+	close(resQueue)
+}
+
+// FieldLimits limits "msg" to 5 bytes, which only matters for tests which set field_limits.
+func (m *mockPushServiceType) FieldLimits(notif *push.Notification) map[string]int {
+	return map[string]int{"msg": 5}
+}
+
+func (m *mockPushServiceType) Preview(notif *push.Notification) ([]byte, push.Error) {
+	return []byte(notif.String()), nil
+}
+
+func (m *mockPushServiceType) SetErrorReportChan(errChan chan<- push.Error) {}
+
+func (m *mockPushServiceType) SetDeliveryReceiptChan(receipts chan<- *push.DeliveryReceipt) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.receipts = receipts
+}
+
+// sendReceipt reports the delivery of a message, as an external push service with delivery receipts would.
+func (m *mockPushServiceType) sendReceipt(msgID string, err error) {
+	m.lock.Lock()
+	receipts := m.receipts
+	m.lock.Unlock()
+	receipts <- &push.DeliveryReceipt{PushServiceType: mockPushServiceTypeName, MsgID: msgID, Err: err}
+}
+
+func (m *mockPushServiceType) SetPushServiceConfig(conf *push.PushServiceConfig) {}
+
+func (m *mockPushServiceType) Finalize() {}
+
+// mockPushDatabase returns the delivery points of mock subscribers (and the push service providers in psps), and records which delivery points were removed.
+type mockPushDatabase struct {
+	lock    sync.Mutex
+	pairs   map[string][]db.PushServiceProviderDeliveryPointPair
+	psps    []*push.PushServiceProvider
+	err     error
+	removed []string
+}
+
+var _ db.PushDatabase = &mockPushDatabase{}
+
+func newMockPushDatabase() *mockPushDatabase {
+	return &mockPushDatabase{pairs: make(map[string][]db.PushServiceProviderDeliveryPointPair)}
+}
+
+// addMockSubscription adds a delivery point with the given devtoken for service+sub, using a psp for that service.
+func (mdb *mockPushDatabase) addMockSubscription(t *testing.T, service string, sub string, devtoken string) *push.DeliveryPoint {
+	t.Helper()
+	psm := push.GetPushServiceManager()
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": mockPushServiceTypeName, "service": service, "name": "psp"})
+	if err != nil {
+		t.Fatalf("Failed to build mock psp: %v", err)
+	}
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": mockPushServiceTypeName, "service": service, "subscriber": sub, "devtoken": devtoken})
+	if err != nil {
+		t.Fatalf("Failed to build mock delivery point: %v", err)
+	}
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+	key := service + "/" + sub
+	mdb.pairs[key] = append(mdb.pairs[key], db.PushServiceProviderDeliveryPointPair{PushServiceProvider: psp, DeliveryPoint: dp})
+	return dp
+}
+
+func (mdb *mockPushDatabase) GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]db.PushServiceProviderDeliveryPointPair, error) {
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+	if mdb.err != nil {
+		return nil, mdb.err
+	}
+	return append([]db.PushServiceProviderDeliveryPointPair(nil), mdb.pairs[service+"/"+subscriber]...), nil
+}
+
+func (mdb *mockPushDatabase) RemoveDeliveryPointFromService(service string, subscriber string, deliveryPoint *push.DeliveryPoint) error {
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+	mdb.removed = append(mdb.removed, deliveryPoint.FixedData["devtoken"])
+	return nil
+}
+
+func (mdb *mockPushDatabase) RemovePushServiceProviderFromService(service string, psp *push.PushServiceProvider) error {
+	return nil
+}
+
+func (mdb *mockPushDatabase) AddPushServiceProviderToService(service string, psp *push.PushServiceProvider) error {
+	return nil
+}
+
+func (mdb *mockPushDatabase) ModifyPushServiceProvider(psp *push.PushServiceProvider) error {
+	return nil
+}
+
+func (mdb *mockPushDatabase) GetPushServiceProviderConfigs() ([]*push.PushServiceProvider, error) {
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+	return append([]*push.PushServiceProvider(nil), mdb.psps...), nil
+}
+
+func (mdb *mockPushDatabase) RebuildServiceSet() error {
+	return nil
+}
+
+func (mdb *mockPushDatabase) AddDeliveryPointToService(service string, subscriber string, dp *push.DeliveryPoint) (*push.PushServiceProvider, error) {
+	return nil, nil
+}
+
+func (mdb *mockPushDatabase) ModifyDeliveryPoint(dp *push.DeliveryPoint) error {
+	return nil
+}
+
+func (mdb *mockPushDatabase) GetSubscriptions(services []string, user string, logger log.Logger) ([]map[string]string, error) {
+	return nil, nil
+}
+
+// GetSubscribers returns the subscribers of service in sorted order, using the index of the next subscriber as the cursor.
+func (mdb *mockPushDatabase) GetSubscribers(service string, cursor uint64, count int) ([]string, uint64, error) {
+	mdb.lock.Lock()
+	defer mdb.lock.Unlock()
+	if mdb.err != nil {
+		return nil, 0, mdb.err
+	}
+	var subs []string
+	for key := range mdb.pairs {
+		if strings.HasPrefix(key, service+"/") {
+			subs = append(subs, strings.TrimPrefix(key, service+"/"))
+		}
+	}
+	sort.Strings(subs)
+	end := int(cursor) + count
+	if end >= len(subs) {
+		return subs[cursor:], 0, nil
+	}
+	return subs[cursor:end], uint64(end), nil
+}
+
+func (mdb *mockPushDatabase) FlushCache() error {
+	return nil
+}
+
+func newTestLoggers() []log.Logger {
+	loggers := make([]log.Logger, NumberOfLoggers)
+	for i := range loggers {
+		loggers[i] = log.NewLogger(ioutil.Discard, "[Test]", log.LOGLEVEL_DEBUG)
+	}
+	return loggers
+}
+
+// newTestPushBackEnd returns a backend using the mock push service type and a mock database.
+func newTestPushBackEnd(config *PushBackEndConfig) (*PushBackEnd, *mockPushDatabase, *mockPushServiceType) {
+	mockService := getMockPushServiceType()
+	mdb := newMockPushDatabase()
+	return NewPushBackEnd(push.GetPushServiceManager(), mdb, newTestLoggers(), config), mdb, mockService
+}
+
+// testPush sends a push with the message "hello" to subs of service, and returns the response.
+func testPush(backend *PushBackEnd, service string, subs []string, extraData map[string]string) APIPushResponse {
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	for k, v := range extraData {
+		notif.Data[k] = v
+	}
+	handler := newPushResponseHandler(backend.loggers[LoggerPush])
+	backend.Push("testreq", "127.0.0.1", service, subs, nil, notif, nil, backend.loggers[LoggerPush], handler)
+	return handler.response
+}
+
+func TestPushToEachDeliveryPoint(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "failtoken2")
+
+	response := testPush(backend, "myservice", []string{"sub1", "sub2", "sub3"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected one push to succeed")
+	testutil.ExpectEquals(t, 2, response.FailureCount, "expected one push to fail and one subscriber to have no devices")
+	testutil.ExpectEquals(t, []string{"token1", "failtoken2"}, mockService.getPushed(), "unexpected pushes")
+}
+
+func TestIsPermanentFailure(t *testing.T) {
+	success := &push.Result{MsgID: "1"}
+	failure := &push.Result{Err: push.NewError("failed")}
+	retry := &push.Result{Err: push.NewRetryErrorWithReason(nil, nil, nil, 0, errors.New("timeout"))}
+
+	testutil.ExpectEquals(t, true, isPermanentFailure([]*push.Result{failure}), "expected errors to be permanent")
+	testutil.ExpectEquals(t, false, isPermanentFailure([]*push.Result{failure, success}), "expected a success to not be a permanent failure")
+	testutil.ExpectEquals(t, false, isPermanentFailure([]*push.Result{retry}), "expected retries to not be a permanent failure")
+}
+
+func TestPushWithFallback(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "token2")
+	mdb.addMockSubscription(t, "myservice", "sub1", "token3")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionFallback: "1"})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the fallback delivery point to succeed")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the first delivery point to fail")
+	testutil.ExpectEquals(t, []string{"failtoken1", "token2"}, mockService.getPushed(), "expected pushes to stop after the first success")
+}
+
+func TestPushWithFallbackPerDeliveryPoint(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "token2")
+
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	notif.Data[OptionFallback] = "1"
+	handler := newPushResponseHandler(backend.loggers[LoggerPush])
+	backend.Push("testreq", "127.0.0.1", "myservice", []string{"sub1"}, nil, notif, map[string][]string{"msg": {"one", "two"}}, backend.loggers[LoggerPush], handler)
+	testutil.ExpectEquals(t, 1, handler.response.SuccessCount, "expected the fallback delivery point to succeed")
+	testutil.ExpectEquals(t, []string{"one", "two"}, mockService.getMessages(), "expected each delivery point to get its own per-delivery point values")
+}
+
+func TestDuplicateDeliveryPoints(t *testing.T) {
+	for _, mode := range []string{DuplicateDeliveryPointsPushAll, DuplicateDeliveryPointsDedup, DuplicateDeliveryPointsWarn} {
+		config := NewPushBackEndConfig()
+		config.DuplicateDeliveryPoints = mode
+		backend, mdb, mockService := newTestPushBackEnd(config)
+		mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+		mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+
+		testPush(backend, "myservice", []string{"sub1"}, nil)
+		expected := []string{"token1"}
+		if mode == DuplicateDeliveryPointsPushAll {
+			expected = []string{"token1", "token1"}
+		}
+		testutil.ExpectEquals(t, expected, mockService.getPushed(), "unexpected pushes for duplicate_delivery_points="+mode)
+
+		testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionAllowDuplicates: "1"})
+		expected = append(expected, "token1", "token1")
+		testutil.ExpectEquals(t, expected, mockService.getPushed(), "expected uniqush.allow_duplicate_delivery_points to push to each duplicate for duplicate_delivery_points="+mode)
+	}
+}
+
+func TestDuplicateDeliveryPointsHealthiest(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.DuplicateDeliveryPoints = DuplicateDeliveryPointsHealthiest
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	psm := push.GetPushServiceManager()
+	dp := mdb.addMockSubscription(t, "myservice", "sub1", "primaryretrytoken1")
+	backup, err := psm.BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": mockPushServiceTypeName, "service": "myservice", "name": "backup"})
+	if err != nil {
+		t.Fatalf("Failed to build mock psp: %v", err)
+	}
+	mdb.lock.Lock()
+	mdb.pairs["myservice/sub1"] = append(mdb.pairs["myservice/sub1"], db.PushServiceProviderDeliveryPointPair{PushServiceProvider: backup, DeliveryPoint: dp})
+	mdb.lock.Unlock()
+
+	// Without any recent pushes, the first provider is used.
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.RetryingCount, "expected the push through the first provider to be retried")
+	testutil.ExpectEquals(t, 1, len(mockService.getPushed()), "expected the duplicate delivery point to be pushed to once")
+
+	response = testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to use the healthier provider")
+	testutil.ExpectEquals(t, backup.Name(), *response.SuccessDetails[0].PushServiceProvider, "unexpected provider")
+}
+
+func TestDeliveryPointRateLimit(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.DeliveryPointRate = 0.001
+	config.DeliveryPointRateBurst = 1
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	response := testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+	testutil.ExpectEquals(t, []string{"token1", "token2"}, mockService.getPushed(), "expected second push to sub1 to be rate limited")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected one failure")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_DEVICE_RATE_LIMITED, response.FailureDetails[0].Code, "unexpected code")
+}
+
+func TestPushInPriorityOrder(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "token2").VolatileData[push.Priority] = "5"
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken3").VolatileData[push.Priority] = "10"
+
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionFallback: "1"})
+	testutil.ExpectEquals(t, []string{"failtoken3", "token2"}, mockService.getPushed(), "expected pushes in order of priority")
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the fallback to succeed")
+	testutil.ExpectEquals(t, mockPushServiceTypeName, *response.SuccessDetails[0].PushServiceType, "expected the push service type of the device which received the push")
+}
+
+func TestMaxDevicesPerSubscriber(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.MaxDevicesPerSubscriber = 2
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "token2").VolatileData[push.Priority] = "5"
+	mdb.addMockSubscription(t, "myservice", "sub1", "token3").VolatileData[push.Priority] = "10"
+
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 2, response.SuccessCount, "expected pushes to only 2 delivery points")
+	testutil.ExpectEquals(t, []string{"token3", "token2"}, mockService.getPushed(), "expected the delivery points with the highest priorities to be used")
+}
+
+func TestPushesInProgress(t *testing.T) {
+	backend, mdb, _ := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, int64(1), backend.pushesStarted, "expected one push to be started")
+	testutil.ExpectEquals(t, int64(0), backend.PushesInProgress(), "expected no pushes in progress after Push returns")
+}
+
+// fixedResolver returns the same delivery points for every subscriber.
+type fixedResolver struct {
+	pairs []db.PushServiceProviderDeliveryPointPair
+}
+
+func (r *fixedResolver) GetPushServiceProviderDeliveryPointPairs(service string, subscriber string, dpNamesRequested []string) ([]db.PushServiceProviderDeliveryPointPair, error) {
+	return r.pairs, nil
+}
+
+func TestSetDeliveryPointResolver(t *testing.T) {
+	backend, _, mockService := newTestPushBackEnd(nil)
+	otherDB := newMockPushDatabase()
+	otherDB.addMockSubscription(t, "otherservice", "othersub", "token1")
+	backend.SetDeliveryPointResolver(&fixedResolver{pairs: otherDB.pairs["otherservice/othersub"]})
+
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected push to the delivery point from the resolver")
+	testutil.ExpectEquals(t, []string{"token1"}, mockService.getPushed(), "unexpected pushes")
+}
+
+func TestPanicInPushServiceType(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "panictoken1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "token2")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, []string{"panictoken1"}, mockService.getPushed(), "expected pushes to stop after the panic")
+	testutil.ExpectEquals(t, 0, response.SuccessCount, "expected no successes")
+	testutil.ExpectEquals(t, 2, response.FailureCount, "expected the panic and the unfinished delivery point to be reported as failures")
+}
+
+func TestFlushRetries(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, []string{"retrytoken1"}, mockService.getPushed(), "expected the retry to wait for its backoff")
+	backend.FlushRetries()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mockService.getPushed()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	testutil.ExpectEquals(t, []string{"retrytoken1", "retrytoken1"}, mockService.getPushed(), "expected the retry to be sent after flushing")
+}
+
+// flushRetriesUntil keeps flushing scheduled retries until at least n pushes were sent by the mock push service type, or a few seconds have passed.
+func flushRetriesUntil(backend *PushBackEnd, mockService *mockPushServiceType, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mockService.getPushed()) < n && time.Now().Before(deadline) {
+		backend.FlushRetries()
+		time.Sleep(time.Millisecond)
+	}
+	// Give any unexpected extra retry a chance to be sent.
+	backend.FlushRetries()
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestMaxRetriesOption(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	flushRetriesUntil(backend, mockService, 2)
+	testutil.ExpectEquals(t, 2, len(mockService.getPushed()), "expected one retry before exceeding max_backoff")
+
+	mockService = getMockPushServiceType()
+	testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionMaxRetries: "3"})
+	flushRetriesUntil(backend, mockService, 4)
+	testutil.ExpectEquals(t, 4, len(mockService.getPushed()), "expected uniqush.max_retries retries")
+}
+
+func TestPushTargets(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	dp1 := mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	dp2 := mdb.addMockSubscription(t, "myservice", "sub1", "token2")
+	dp2.VolatileData[push.Priority] = "1"
+
+	targets, err := backend.PushTargets("myservice", []string{"sub1", "sub2"}, nil, backend.loggers[LoggerPush])
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	pspName := mdb.pairs["myservice/sub1"][0].PushServiceProvider.Name()
+	expected := map[string][]PushTarget{
+		"sub1": {
+			{DeliveryPoint: dp2.Name(), PushServiceProvider: pspName, PushServiceType: mockPushServiceTypeName},
+			{DeliveryPoint: dp1.Name(), PushServiceProvider: pspName, PushServiceType: mockPushServiceTypeName},
+		},
+		"sub2": {},
+	}
+	testutil.ExpectEquals(t, expected, targets, "unexpected push targets")
+	testutil.ExpectEquals(t, 0, len(mockService.getPushed()), "expected nothing to be pushed")
+}
+
+type recordingDeadLetterHandler struct {
+	lock    sync.Mutex
+	letters []*DeadLetter
+}
+
+func (h *recordingDeadLetterHandler) HandleDeadLetter(letter *DeadLetter) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.letters = append(h.letters, letter)
+}
+
+func TestDeadLetter(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	deadLetters := &recordingDeadLetterHandler{}
+	backend.SetDeadLetterHandler(deadLetters)
+	dp := mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+
+	before := time.Now()
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	flushRetriesUntil(backend, mockService, 2)
+
+	deadLetters.lock.Lock()
+	defer deadLetters.lock.Unlock()
+	if len(deadLetters.letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(deadLetters.letters))
+	}
+	letter := deadLetters.letters[0]
+	testutil.ExpectEquals(t, "sub1", letter.Subscriber, "unexpected subscriber")
+	testutil.ExpectEquals(t, dp.Name(), letter.DeliveryPoint.Name(), "unexpected delivery point")
+	testutil.ExpectEquals(t, 2, letter.Attempts, "expected the first attempt and one retry")
+	testutil.ExpectEquals(t, []time.Duration{time.Hour}, letter.Delays, "unexpected delays")
+	testutil.ExpectEquals(t, "Retry", letter.LastError.Error(), "unexpected last error")
+	if letter.Submitted.Before(before) || letter.Submitted.After(time.Now()) {
+		t.Errorf("Unexpected submit time %v", letter.Submitted)
+	}
+	if backend.TotalBackoffTime() <= 0 || backend.TotalBackoffTime() >= time.Hour {
+		t.Errorf("Expected the flushed wait before the retry to be recorded, got %v", backend.TotalBackoffTime())
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	dp := mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	testutil.ExpectEquals(t, nil, backend.Warmup("myservice", []string{"sub1"}, backend.loggers[LoggerPush]), "unexpected error warming up")
+
+	mdb.err = errors.New("database is down")
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to use the delivery points from the warmup")
+	testutil.ExpectEquals(t, []string{"token1"}, mockService.getPushed(), "unexpected pushes")
+
+	backend.Unsubscribe("myservice", "sub1", dp)
+	response = testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 0, response.SuccessCount, "expected changes to the subscriptions to invalidate the warmup")
+}
+
+func TestResolutionCache(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.ResolutionCacheSize = 1
+	backend, mdb, _ := newTestPushBackEnd(config)
+	dp := mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	mdb.err = errors.New("database is down")
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the second push to use the cached delivery points")
+
+	mdb.err = nil
+	testPush(backend, "myservice", []string{"sub2"}, nil)
+	mdb.err = errors.New("database is down")
+	response = testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 0, response.SuccessCount, "expected sub1 to be evicted by the push to sub2")
+	response = testPush(backend, "myservice", []string{"sub2"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected sub2 to be cached")
+
+	mdb.err = nil
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	backend.Unsubscribe("myservice", "sub1", dp)
+	mdb.err = errors.New("database is down")
+	response = testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 0, response.SuccessCount, "expected changes to the subscriptions to invalidate the cache")
+}
+
+func TestUpdateWithRetry(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Millisecond
+	config.RetryFailedUpdates = true
+	backend, _, _ := newTestPushBackEnd(config)
+
+	transientErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	attempts := 0
+	retries := 0
+	done := make(chan error, 1)
+	backend.updateWithRetry(func() error {
+		attempts++
+		if attempts < 3 {
+			return transientErr
+		}
+		return nil
+	}, func(err error) {
+		done <- err
+	}, func(err error, after time.Duration) {
+		retries++
+	})
+	testutil.ExpectEquals(t, nil, <-done, "expected the update to succeed after retrying")
+	testutil.ExpectEquals(t, 3, attempts, "unexpected number of attempts")
+	testutil.ExpectEquals(t, 2, retries, "unexpected number of retries")
+
+	permanentErr := errors.New("invalid delivery point")
+	backend.updateWithRetry(func() error {
+		return permanentErr
+	}, func(err error) {
+		done <- err
+	}, func(err error, after time.Duration) {
+		t.Errorf("Did not expect a retry of %v", err)
+	})
+	testutil.ExpectEquals(t, permanentErr, <-done, "expected errors which aren't transient to be reported without retrying")
+}
+
+func TestPushValidation(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	handler := newPushResponseHandler(backend.loggers[LoggerPush])
+
+	backend.Push("testreq", "127.0.0.1", "myservice", []string{"sub1"}, nil, nil, nil, backend.loggers[LoggerPush], handler)
+	backend.Push("testreq", "127.0.0.1", "", []string{"sub1"}, nil, push.NewEmptyNotification(), nil, backend.loggers[LoggerPush], handler)
+
+	testutil.ExpectEquals(t, 2, handler.response.FailureCount, "expected invalid pushes to fail")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_EMPTY_NOTIFICATION, handler.response.FailureDetails[0].Code, "unexpected code for a nil notification")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_CANNOT_GET_SERVICE, handler.response.FailureDetails[1].Code, "unexpected code for an empty service")
+	testutil.ExpectEquals(t, 0, len(mockService.getPushed()), "expected invalid pushes not to be sent")
+
+	code, _ := validatePush("myservice", []string{"sub1", ""}, push.NewEmptyNotification())
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_NO_SUBSCRIBER, code, "unexpected code for an empty subscriber")
+}
+
+func TestEmptySubscribers(t *testing.T) {
+	backend, _, mockService := newTestPushBackEnd(nil)
+	response := testPush(backend, "myservice", []string{}, nil)
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected an empty list of subscribers to fail by default")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_NO_SUBSCRIBER, response.FailureDetails[0].Code, "unexpected code for an empty list of subscribers")
+
+	config := NewPushBackEndConfig()
+	config.IgnoreEmptySubscribers = true
+	backend, _, mockService = newTestPushBackEnd(config)
+	response = testPush(backend, "myservice", nil, nil)
+	testutil.ExpectEquals(t, 0, response.FailureCount, "expected an empty list of subscribers to be ignored")
+	testutil.ExpectEquals(t, 0, response.SuccessCount, "expected no results for an empty list of subscribers")
+	testutil.ExpectEquals(t, 0, len(mockService.getPushed()), "expected nothing to be pushed")
+
+	response = testPush(backend, "", nil, nil)
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_CANNOT_GET_SERVICE, response.FailureDetails[0].Code, "expected a missing service to fail even if empty subscribers are ignored")
+}
+
+func TestCancelForSubscriber(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+	mdb.addMockSubscription(t, "otherservice", "sub3", "retrytoken3")
+
+	testPush(backend, "otherservice", []string{"sub3"}, nil)
+	backend.CancelForSubscriber("otherservice", "sub3")
+	flushRetriesUntil(backend, mockService, 1)
+	testutil.ExpectEquals(t, []string{"retrytoken3"}, mockService.getPushed(), "expected the pending retry to be cancelled")
+
+	testutil.ExpectEquals(t, nil, backend.Pause("myservice"), "unexpected error pausing")
+	testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+	backend.CancelForSubscriber("myservice", "sub1")
+	testutil.ExpectEquals(t, nil, backend.Resume("myservice"), "unexpected error resuming")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mockService.getPushed()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	testutil.ExpectEquals(t, []string{"retrytoken3", "token2"}, mockService.getPushed(), "expected the queued push to sub1 to be cancelled")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected pushes submitted after cancelling to be sent")
+}
+
+func TestWaitForRetriesOption(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Millisecond
+	// The retries run while the push holds the subscriber's lock.
+	config.SerializeSubscribers = true
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionMaxRetries: "2", OptionWaitForRetries: "1"})
+	testutil.ExpectEquals(t, 3, len(mockService.getPushed()), "expected the push to wait for both retries")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the result of the retries in the response")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_FAILED_RETRY, response.FailureDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, 2, *response.FailureDetails[0].Retries, "expected the number of retries which were sent")
+	testutil.ExpectEquals(t, "retry limit reached: giving up after 2 retries (max_retries is 2)", *response.FailureDetails[0].ErrorMsg, "expected the reason for giving up")
+}
+
+func TestTryPushRejectsBeyondMaxConcurrentPushes(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.MaxConcurrentPushes = 1
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+
+	// Simulate a push which is still in progress.
+	testutil.ExpectEquals(t, true, backend.acquirePushSlot(pushPriorityNormal, true), "expected a free slot")
+	handler := newPushResponseHandler(backend.loggers[LoggerPush])
+	testutil.ExpectEquals(t, false, backend.TryPush("testreq", "127.0.0.1", "myservice", []string{"sub1"}, nil, notif, nil, backend.loggers[LoggerPush], handler), "expected the push to be rejected")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_TOO_MANY_PUSHES, handler.response.FailureDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, 0, len(mockService.getPushed()), "expected no pushes")
+
+	backend.releasePushSlot()
+	handler = newPushResponseHandler(backend.loggers[LoggerPush])
+	testutil.ExpectEquals(t, true, backend.TryPush("testreq", "127.0.0.1", "myservice", []string{"sub1"}, nil, notif, nil, backend.loggers[LoggerPush], handler), "expected the push to be sent")
+	testutil.ExpectEquals(t, 1, handler.response.SuccessCount, "expected the push to succeed")
+	testutil.ExpectEquals(t, true, backend.acquirePushSlot(pushPriorityNormal, true), "expected the slot to be released after the push")
+}
+
+func TestPushResponseListsPendingRetries(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, _ := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	dp := mdb.addMockSubscription(t, "myservice", "sub2", "retrytoken2")
+
+	before := time.Now()
+	response := testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to sub1 to succeed")
+	testutil.ExpectEquals(t, 1, response.RetryingCount, "expected the push to sub2 to be pending")
+	details := response.RetryingDetails[0]
+	testutil.ExpectEquals(t, "sub2", *details.Subscriber, "unexpected subscriber")
+	testutil.ExpectEquals(t, dp.Name(), *details.DeliveryPoint, "unexpected delivery point")
+	testutil.ExpectEquals(t, 0, *details.Retries, "expected the first retry to be pending")
+	if nextAttempt := time.Unix(*details.NextAttempt, 0); nextAttempt.Before(before.Add(time.Hour).Truncate(time.Second)) {
+		t.Errorf("Expected the next attempt to be after the backoff, got %v", nextAttempt)
+	}
+}
+
+func TestRetrySchedule(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Minute
+	config.MaxBackoff = 5 * time.Minute
+	backend, mdb, _ := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.RetryingCount, "expected the push to be pending")
+	testutil.ExpectEquals(t, 0, len(response.RetryingDetails[0].RetrySchedule), "expected no schedule without uniqush.retry_schedule")
+
+	response = testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionRetrySchedule: "1"})
+	testutil.ExpectEquals(t, 1, response.RetryingCount, "expected the push to be pending")
+	details := response.RetryingDetails[0]
+	// The backoff doubles from 1 minute until it would exceed max_backoff.
+	next := *details.NextAttempt
+	testutil.ExpectEquals(t, []int64{next, next + 120, next + 360}, details.RetrySchedule, "unexpected schedule")
+
+	response = testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionRetrySchedule: "1", OptionMaxRetries: "5"})
+	details = response.RetryingDetails[0]
+	// With max_retries, the backoff stops increasing at max_backoff.
+	next = *details.NextAttempt
+	testutil.ExpectEquals(t, []int64{next, next + 120, next + 360, next + 660, next + 960}, details.RetrySchedule, "unexpected schedule with max_retries")
+}
+
+// recordingReceiptHandler sends the delivery receipts it is called with to a channel.
+type recordingReceiptHandler struct {
+	confirmed chan *DeliveredPush
+	failed    chan error
+}
+
+func (h *recordingReceiptHandler) DeliveryConfirmed(delivered *DeliveredPush) {
+	h.confirmed <- delivered
+}
+
+func (h *recordingReceiptHandler) DeliveryFailed(delivered *DeliveredPush, err error) {
+	h.failed <- err
+}
+
+func TestDeliveryReceipts(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	receipts := &recordingReceiptHandler{confirmed: make(chan *DeliveredPush, 1), failed: make(chan error, 1)}
+	backend.SetDeliveryReceiptHandler(receipts)
+	dp := mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+	testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+
+	mockService.sendReceipt("mockmsg:token1", nil)
+	delivered := <-receipts.confirmed
+	testutil.ExpectEquals(t, "sub1", delivered.Subscriber, "unexpected subscriber")
+	testutil.ExpectEquals(t, dp.Name(), delivered.DeliveryPoint.Name(), "unexpected delivery point")
+	testutil.ExpectEquals(t, "testreq", delivered.RequestID, "unexpected request id")
+
+	mockService.sendReceipt("mockmsg:unknown", nil)
+	mockService.sendReceipt("mockmsg:token2", errors.New("device is offline"))
+	testutil.ExpectEquals(t, "device is offline", (<-receipts.failed).Error(), "expected the failed delivery to be reported")
+	testutil.ExpectEquals(t, 0, len(receipts.confirmed), "expected receipts for unknown pushes to be ignored")
+}
+
+func TestResolveDeliveryReceipt(t *testing.T) {
+	backend, mdb, _ := newTestPushBackEnd(nil)
+	_, ok := backend.ResolveDeliveryReceipt(&push.DeliveryReceipt{PushServiceType: mockPushServiceTypeName, MsgID: "mockmsg:token1"})
+	testutil.ExpectEquals(t, false, ok, "expected receipts to be ignored without a handler")
+
+	receipts := &recordingReceiptHandler{confirmed: make(chan *DeliveredPush, 1), failed: make(chan error, 1)}
+	backend.SetDeliveryReceiptHandler(receipts)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	before := time.Now()
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+
+	deliveredAt := time.Unix(1500000000, 0)
+	delivered, ok := backend.ResolveDeliveryReceipt(&push.DeliveryReceipt{PushServiceType: mockPushServiceTypeName, MsgID: "mockmsg:token1", Timestamp: deliveredAt})
+	testutil.ExpectEquals(t, true, ok, "expected the receipt to be resolved")
+	testutil.ExpectEquals(t, "testreq", delivered.RequestID, "unexpected request id")
+	testutil.ExpectEquals(t, "sub1", delivered.Subscriber, "unexpected subscriber")
+	testutil.ExpectEquals(t, deliveredAt, delivered.DeliveredAt, "expected the timestamp of the receipt")
+	testutil.ExpectEquals(t, false, delivered.PushedAt.Before(before), "expected the time of the push")
+	testutil.ExpectEquals(t, delivered, <-receipts.confirmed, "expected the handler to be called")
+
+	_, ok = backend.ResolveDeliveryReceipt(&push.DeliveryReceipt{PushServiceType: mockPushServiceTypeName, MsgID: "mockmsg:token1"})
+	testutil.ExpectEquals(t, false, ok, "expected a receipt to be resolved only once")
+}
+
+func TestAwaitedReceiptsLimit(t *testing.T) {
+	newTestPushBackEnd(nil)
+	psp, err := push.GetPushServiceManager().BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": mockPushServiceTypeName, "service": "myservice", "name": "psp"})
+	if err != nil {
+		t.Fatalf("Failed to build mock psp: %v", err)
+	}
+	now := time.Now()
+	awaited := newAwaitedReceipts(2, time.Minute)
+	for i, msgID := range []string{"msg1", "msg2", "msg3"} {
+		awaited.add(&DeliveredPush{PushServiceProvider: psp, MsgID: msgID, PushedAt: now.Add(time.Duration(i) * time.Second)})
+	}
+	_, ok := awaited.take(&push.DeliveryReceipt{PushServiceType: mockPushServiceTypeName, MsgID: "msg1"}, now)
+	testutil.ExpectEquals(t, false, ok, "expected the oldest push to be evicted")
+	_, ok = awaited.take(&push.DeliveryReceipt{PushServiceType: mockPushServiceTypeName, MsgID: "msg2"}, now)
+	testutil.ExpectEquals(t, true, ok, "expected the newer pushes to be kept")
+
+	awaited.add(&DeliveredPush{PushServiceProvider: psp, MsgID: "msg4", PushedAt: now.Add(2 * time.Minute)})
+	testutil.ExpectEquals(t, 1, len(awaited.entries), "expected expired pushes to be pruned")
+	_, ok = awaited.take(&push.DeliveryReceipt{PushServiceType: mockPushServiceTypeName, MsgID: "msg4"}, now.Add(4*time.Minute))
+	testutil.ExpectEquals(t, false, ok, "expected receipts arriving after receipt_ttl to be ignored")
+}
+
+func TestUnsubscribeThreshold(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.UnsubscribeThreshold = 2
+	backend, mdb, _ := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "unregisteredtoken1")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_UNREGISTERED, response.FailureDetails[0].Code, "expected the first unregistered error to be reported as a failure")
+	testutil.ExpectEquals(t, 0, len(mdb.removed), "expected the delivery point to be kept after one error")
+
+	response = testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.DroppedCount, "expected the delivery point to be unsubscribed")
+	testutil.ExpectEquals(t, []string{"unregisteredtoken1"}, mdb.removed, "expected the delivery point to be removed after two errors")
+}
+
+func TestMaxPendingRetries(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	config.MaxPendingRetries = 1
+	backend, mdb, _ := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "retrytoken2")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.RetryingCount, "expected the push to sub1 to be pending")
+	response = testPush(backend, "myservice", []string{"sub2"}, nil)
+	testutil.ExpectEquals(t, 0, response.RetryingCount, "expected the retry queue to be full")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the push to sub2 to be rejected")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_RETRY_QUEUE_FULL, response.FailureDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, RetryQueueStats{Pending: 1, Capacity: 1, Overflow: RetryOverflowReject, Overflowed: 1}, backend.RetryQueueStats(), "unexpected retry queue stats")
+}
+
+func TestMaxPendingRetriesDropOldest(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	config.MaxPendingRetries = 1
+	config.RetryOverflow = RetryOverflowDropOldest
+	backend, mdb, _ := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "retrytoken2")
+	deadLetters := &recordingDeadLetterHandler{}
+	backend.SetDeadLetterHandler(deadLetters)
+
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	response := testPush(backend, "myservice", []string{"sub2"}, nil)
+	testutil.ExpectEquals(t, 1, response.RetryingCount, "expected the push to sub2 to replace the pending retry of sub1")
+	var letters []*DeadLetter
+	for i := 0; i < 100 && len(letters) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		deadLetters.lock.Lock()
+		letters = deadLetters.letters
+		deadLetters.lock.Unlock()
+	}
+	if len(letters) != 1 || letters[0].Subscriber != "sub1" {
+		t.Fatalf("Expected the retry of sub1 to be dropped, got %v", letters)
+	}
+	testutil.ExpectEquals(t, RetryQueueStats{Pending: 1, Capacity: 1, Overflow: RetryOverflowDropOldest, Overflowed: 1}, backend.RetryQueueStats(), "unexpected retry queue stats")
+}
+
+func TestMemoryPressure(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	config.MemoryLimit = 1000
+	config.MemoryPressureMaxRetries = 1
+	config.MemoryCheckInterval = time.Millisecond
+	backend, mdb, _ := newTestPushBackEnd(config)
+	defer close(backend.memoryStop)
+	var inUse uint64 = 500
+	var inUseLock sync.Mutex
+	setInUse := func(n uint64) {
+		inUseLock.Lock()
+		inUse = n
+		inUseLock.Unlock()
+		// Let memory_check_interval elapse, so that the next check measures the new value.
+		time.Sleep(5 * time.Millisecond)
+	}
+	backend.SetMemoryGauge(func() uint64 {
+		inUseLock.Lock()
+		defer inUseLock.Unlock()
+		return inUse
+	})
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "retrytoken2")
+	mdb.addMockSubscription(t, "myservice", "sub3", "token3")
+	low := map[string]string{OptionQueuePriority: "low"}
+
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	response := testPush(backend, "myservice", []string{"sub2"}, low)
+	testutil.ExpectEquals(t, 1, response.RetryingCount, "expected low priority pushes to be sent below memory_limit_mb")
+	testutil.ExpectEquals(t, 2, backend.RetryQueueStats().Pending, "expected both retries to be pending")
+
+	setInUse(2000)
+	// The retries are dropped without waiting for another push.
+	deadline := time.Now().Add(5 * time.Second)
+	for backend.RetryQueueStats().Pending > 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	testutil.ExpectEquals(t, 1, backend.RetryQueueStats().Pending, "expected the oldest retry to be dropped")
+	response = testPush(backend, "myservice", []string{"sub3"}, low)
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected low priority pushes to be rejected above memory_limit_mb")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_MEMORY_PRESSURE, response.FailureDetails[0].Code, "unexpected code")
+	response = testPush(backend, "myservice", []string{"sub3"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected normal priority pushes to be sent")
+
+	setInUse(500)
+	response = testPush(backend, "myservice", []string{"sub3"}, low)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected low priority pushes to be sent once memory use drops")
+}
+
+var loopbackOnce sync.Once
+
+func TestLoopbackServices(t *testing.T) {
+	loopbackOnce.Do(srv.InstallLoopback)
+	config := NewPushBackEndConfig()
+	config.LoopbackServices = map[string]bool{"myservice": true}
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken1")
+	srv.ClearLoopbackPushes()
+
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{"msg": "hello"})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the loopback push service type to report success")
+	testutil.ExpectEquals(t, 0, len(mockService.getPushed()), "expected nothing to be sent with the push service type of the provider")
+	pushes := srv.ClearLoopbackPushes()
+	if len(pushes) != 1 || pushes[0].Subscriber != "sub1" || pushes[0].PushServiceType != mockPushServiceTypeName || pushes[0].Data["msg"] != "hello" {
+		t.Errorf("Expected the push to be recorded by the loopback push service type, got %#v", pushes)
+	}
+}
+
+func TestPushBatchesAcrossSubscribers(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(NewPushBackEndConfig())
+	subs := []string{"sub1", "sub2", "sub3"}
+	for i, sub := range subs {
+		mdb.addMockSubscription(t, "myservice", sub, fmt.Sprintf("token%d", i+1))
+	}
+
+	response := testPush(backend, "myservice", subs, nil)
+	testutil.ExpectEquals(t, 3, response.SuccessCount, "expected a result for each subscriber")
+	mockService.lock.Lock()
+	batches := mockService.batches
+	mockService.lock.Unlock()
+	testutil.ExpectEquals(t, 1, batches, "expected the delivery points of every subscriber to share a single push to their push service provider")
+}
+
+func TestSerializedDeliveryPoints(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(NewPushBackEndConfig())
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+	hot := mdb.addMockSubscription(t, "myservice", "display", "token3")
+	backend.config.SerializedDeliveryPoints = map[string]bool{hot.Name(): true}
+	backend.dpWorkers = newDeliveryPointWorkers()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response := testPush(backend, "myservice", []string{"sub1", "sub2", "display"}, nil)
+			testutil.ExpectEquals(t, 3, response.SuccessCount, "expected a result for each subscriber")
+		}()
+	}
+	wg.Wait()
+	mockService.lock.Lock()
+	batches := mockService.batches
+	mockService.lock.Unlock()
+	testutil.ExpectEquals(t, 10, batches, "expected the serialized delivery point to be pushed to on its own by each push")
+}
+
+func TestPushBatching(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.PushBatching = map[string]PushBatching{"myservice": {Window: 50 * time.Millisecond, MaxSize: 3}}
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	for i := 1; i <= 3; i++ {
+		mdb.addMockSubscription(t, "myservice", fmt.Sprintf("sub%d", i), fmt.Sprintf("token%d", i))
+	}
+	mdb.addMockSubscription(t, "myservice", "sub4", "failtoken4")
+	batches := func() int {
+		mockService.lock.Lock()
+		defer mockService.lock.Unlock()
+		return mockService.batches
+	}
+	pushConcurrently := func(subs []string, extraData map[string]string) []APIPushResponse {
+		responses := make([]APIPushResponse, len(subs))
+		var wg sync.WaitGroup
+		for i, sub := range subs {
+			i, sub := i, sub
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				responses[i] = testPush(backend, "myservice", []string{sub}, extraData)
+			}()
+		}
+		wg.Wait()
+		return responses
+	}
+
+	responses := pushConcurrently([]string{"sub1", "sub2", "sub4"}, nil)
+	testutil.ExpectEquals(t, 1, batches(), "expected the identical pushes to share a request to the push service provider")
+	testutil.ExpectEquals(t, 1, responses[0].SuccessCount, "expected each push to get the result of its own delivery point")
+	testutil.ExpectEquals(t, 1, responses[1].SuccessCount, "expected each push to get the result of its own delivery point")
+	testutil.ExpectEquals(t, 1, responses[2].FailureCount, "expected each push to get the result of its own delivery point")
+
+	// A batch is sent as soon as it reaches max_size, without waiting for the window.
+	start := time.Now()
+	pushConcurrently([]string{"sub1", "sub2", "sub3"}, nil)
+	testutil.ExpectEquals(t, 2, batches(), "expected the pushes to share a request")
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("Expected a full batch to be sent immediately, took %v", elapsed)
+	}
+
+	pushConcurrently([]string{"sub1", "sub2"}, map[string]string{OptionQueuePriority: "high"})
+	testutil.ExpectEquals(t, 4, batches(), "expected high priority pushes to be sent without batching")
+	responses = pushConcurrently([]string{"sub1", "sub2"}, nil)
+	responses = append(responses, testPush(backend, "myservice", []string{"sub3"}, map[string]string{"msg": "other"}))
+	testutil.ExpectEquals(t, 6, batches(), "expected different notifications not to share a request")
+	testutil.ExpectEquals(t, 1, responses[2].SuccessCount, "unexpected result of the other notification")
+}
+
+func TestFieldLimits(t *testing.T) {
+	for _, mode := range []string{FieldLimitsOff, FieldLimitsReject, FieldLimitsTruncate, FieldLimitsDrop} {
+		config := NewPushBackEndConfig()
+		config.FieldLimits = mode
+		backend, mdb, mockService := newTestPushBackEnd(config)
+		output := &lockedBuffer{}
+		backend.loggers[LoggerPush] = log.NewLogger(output, "[Test]", log.LOGLEVEL_WARN)
+		mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+
+		response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{"msg": "héllo world"})
+		switch mode {
+		case FieldLimitsOff:
+			testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to be sent unchanged")
+			testutil.ExpectEquals(t, []string{"héllo world"}, mockService.getMessages(), "unexpected message")
+			if logs := output.String(); !strings.Contains(logs, "Fields exceed the limits of "+mockPushServiceTypeName+", which may ignore or reject them: msg (12 > 5 bytes)") {
+				t.Errorf("Expected a warning about the field exceeding its limit, got %q", logs)
+			}
+		case FieldLimitsReject:
+			testutil.ExpectEquals(t, 1, response.FailureCount, "expected the push to be rejected")
+			testutil.ExpectEquals(t, UNIQUSH_ERROR_FIELD_LIMIT_EXCEEDED, response.FailureDetails[0].Code, "unexpected code")
+			testutil.ExpectEquals(t, 0, len(mockService.getPushed()), "expected nothing to be sent")
+		case FieldLimitsTruncate:
+			testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the truncated push to be sent")
+			// The field is truncated to 5 bytes without splitting the two byte "é".
+			testutil.ExpectEquals(t, []string{"héll"}, mockService.getMessages(), "unexpected message")
+			testutil.ExpectEquals(t, []string{"msg"}, response.SuccessDetails[0].AdjustedFields, "expected the truncated field to be reported")
+		case FieldLimitsDrop:
+			testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to be sent without the field")
+			testutil.ExpectEquals(t, []string{""}, mockService.getMessages(), "unexpected message")
+			testutil.ExpectEquals(t, []string{"msg"}, response.SuccessDetails[0].AdjustedFields, "expected the dropped field to be reported")
+		}
+	}
+}
+
+type recordingErrorRateAlerter struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (a *recordingErrorRateAlerter) ErrorRateExceeded(service string, pushServiceType string, rate float64, pushes int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.events = append(a.events, fmt.Sprintf("exceeded %s %s %.2f %d", service, pushServiceType, rate, pushes))
+}
+
+func (a *recordingErrorRateAlerter) ErrorRateRecovered(service string, pushServiceType string, rate float64, pushes int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.events = append(a.events, fmt.Sprintf("recovered %s %s %.2f %d", service, pushServiceType, rate, pushes))
+}
+
+func TestErrorRateAlerter(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.ErrorRateThreshold = 0.5
+	config.ErrorRateMinPushes = 2
+	backend, mdb, _ := newTestPushBackEnd(config)
+	alerter := &recordingErrorRateAlerter{}
+	backend.SetErrorRateAlerter(alerter)
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+
+	// A single failure is too few pushes to alert on.
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 0, len(alerter.events), "expected no alert before error_rate_min_pushes pushes")
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, []string{"exceeded myservice mockpush 1.00 2"}, alerter.events, "expected an alert once the error rate exceeded the threshold")
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, len(alerter.events), "expected a single alert while the error rate stays above the threshold")
+	for i := 0; i < 3; i++ {
+		testPush(backend, "myservice", []string{"sub2"}, nil)
+	}
+	testutil.ExpectEquals(t, []string{"exceeded myservice mockpush 1.00 2", "recovered myservice mockpush 0.50 6"}, alerter.events, "expected a recovery once the error rate fell to the threshold")
+}
+
+func TestErrorRatesWindow(t *testing.T) {
+	rates := newErrorRates(10*time.Second, 0.5, 1)
+	now := time.Now()
+	changed, alerting, _, _ := rates.record("myservice", "mock", true, now)
+	testutil.ExpectEquals(t, true, changed && alerting, "expected the first failure to exceed the threshold")
+	// The failure is forgotten once it leaves the window.
+	changed, alerting, rate, pushes := rates.record("myservice", "mock", false, now.Add(11*time.Second))
+	testutil.ExpectEquals(t, true, changed && !alerting, "expected the error rate to recover once the failure left the window")
+	testutil.ExpectEquals(t, 0.0, rate, "unexpected error rate")
+	testutil.ExpectEquals(t, 1, pushes, "unexpected number of pushes")
+}
+
+func TestRetryRate(t *testing.T) {
+	scheduler := newRetryScheduler(0, false)
+	scheduler.rate = newRateLimiter(10, 1)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		testutil.ExpectEquals(t, true, scheduler.wait(0, scheduler.schedule()), "expected the retry to be sent")
+	}
+	// The first retry is sent immediately, and the others 100ms apart.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected retry_rate to spread out the retries which came due at once, but they were sent within %v", elapsed)
+	}
+}
+
+func TestAttemptIDIsLogged(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	output := &lockedBuffer{}
+	backend.loggers[LoggerPush] = log.NewLogger(output, "[Test]", log.LOGLEVEL_DEBUG)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+
+	testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionMaxRetries: "1"})
+	flushRetriesUntil(backend, mockService, 2)
+	logs := output.String()
+	if !strings.Contains(logs, "AttemptID=testreq.1 RequestID=testreq") || !strings.Contains(logs, "AttemptID=testreq.2 RequestID=testreq") {
+		t.Errorf("Expected the logs of each attempt to include its attempt id, got %q", logs)
+	}
+}
+
+func TestPushAsync(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "retrytoken2")
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	notif.Data[OptionMaxRetries] = "1"
+
+	future := backend.PushAsync("testreq", "127.0.0.1", "myservice", []string{"sub1", "sub2"}, nil, notif, nil, backend.loggers[LoggerPush])
+	flushRetriesUntil(backend, mockService, 3)
+	response := future.Wait()
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to sub1 to succeed")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the retry of sub2 to fail")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_FAILED_RETRY, response.FailureDetails[0].Code, "unexpected code")
+	if _, ok := future.Result(); !ok {
+		t.Error("Expected the result to be available after Wait")
+	}
+	_, waits := notif.Data[OptionWaitForRetries]
+	testutil.ExpectEquals(t, false, waits, "expected the caller's notification to be unchanged")
+}
+
+func TestRefreshReportsFailure(t *testing.T) {
+	for _, reportsFailure := range []bool{false, true} {
+		config := NewPushBackEndConfig()
+		config.RefreshReportsFailure = reportsFailure
+		backend, mdb, _ := newTestPushBackEnd(config)
+		dp := mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+		handler := newPushResponseHandler(backend.loggers[LoggerPush])
+
+		backend.fixDeliveryPointUpdate(push.NewDeliveryPointUpdate(dp), "testreq", "127.0.0.1", backend.loggers[LoggerPush], handler)
+		if reportsFailure {
+			testutil.ExpectEquals(t, 1, handler.response.FailureCount, "expected the refresh to be reported as a failure")
+			testutil.ExpectEquals(t, UNIQUSH_ERROR_DATA_REFRESHED, handler.response.FailureDetails[0].Code, "unexpected code")
+		} else {
+			testutil.ExpectEquals(t, 1, handler.response.SuccessCount, "expected the refresh to be reported as a success")
+		}
+	}
+}
+
+// fixedGroups is a GroupResolver with a fixed list of members for each group.
+type fixedGroups map[string][]string
+
+func (g fixedGroups) GroupMembers(service string, group string) ([]string, error) {
+	members, ok := g[group]
+	if !ok {
+		return nil, fmt.Errorf("no group %q", group)
+	}
+	return members, nil
+}
+
+func TestExpandGroups(t *testing.T) {
+	backend, _, _ := newTestPushBackEnd(nil)
+	_, err := backend.ExpandGroups("myservice", nil, []string{"group1"})
+	testutil.ExpectEquals(t, errNoGroupResolver, err, "expected groups to require a resolver")
+
+	backend.SetGroupResolver(fixedGroups{"group1": {"sub1", "sub2"}, "group2": {"sub2", "sub3"}})
+	subs, err := backend.ExpandGroups("myservice", []string{"sub3", "sub4"}, []string{"group1", "group2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, []string{"sub3", "sub4", "sub1", "sub2"}, subs, "expected the members of each group without duplicates")
+	if _, err := backend.ExpandGroups("myservice", nil, []string{"missing"}); err == nil {
+		t.Error("Expected an error for a group the resolver can't expand")
+	}
+}
+
+func TestAbortFailureRate(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.AbortFailureRate = 0.5
+	config.AbortMinResults = 3
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	var subs []string
+	for i := 0; i < 20; i++ {
+		sub := fmt.Sprintf("sub%d", i)
+		mdb.addMockSubscription(t, "myservice", sub, fmt.Sprintf("failtoken%d", i))
+		subs = append(subs, sub)
+	}
+
+	response := testPush(backend, "myservice", subs, nil)
+	testutil.ExpectEquals(t, 20, response.FailureCount, "expected every subscriber to be reported as failed")
+	aborted := 0
+	for _, details := range response.FailureDetails {
+		if details.Code == UNIQUSH_ERROR_BATCH_ABORTED {
+			aborted++
+		}
+	}
+	if aborted == 0 || aborted+len(mockService.getPushed()) != 20 {
+		t.Errorf("Expected the subscribers after the first failures to be skipped, got %d pushed and %d aborted", len(mockService.getPushed()), aborted)
+	}
+}
+
+func TestBatchTimeLimit(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(NewPushBackEndConfig())
+	var subs []string
+	for i := 0; i < 5; i++ {
+		sub := fmt.Sprintf("sub%d", i)
+		mdb.addMockSubscription(t, "myservice", sub, fmt.Sprintf("token%d", i))
+		subs = append(subs, sub)
+	}
+
+	response := testPush(backend, "myservice", subs, map[string]string{OptionBatchTimeLimit: "1m"})
+	testutil.ExpectEquals(t, 5, response.SuccessCount, "expected every subscriber to be attempted within the limit")
+
+	response = testPush(backend, "myservice", subs, map[string]string{OptionBatchTimeLimit: "1ns"})
+	testutil.ExpectEquals(t, 5, response.FailureCount, "expected no subscriber to be attempted once the limit elapsed")
+	for _, details := range response.FailureDetails {
+		testutil.ExpectEquals(t, UNIQUSH_ERROR_BATCH_TIME_LIMIT, details.Code, "unexpected code")
+	}
+	testutil.ExpectEquals(t, 5, len(mockService.getPushed()), "expected only the first push to reach the push service")
+}
+
+func TestSamplePercent(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(NewPushBackEndConfig())
+	var subs []string
+	for i := 0; i < 200; i++ {
+		sub := fmt.Sprintf("sub%d", i)
+		mdb.addMockSubscription(t, "myservice", sub, sub)
+		subs = append(subs, sub)
+	}
+	sampled := func(options map[string]string) map[string]bool {
+		mockService.lock.Lock()
+		mockService.pushed = nil
+		mockService.lock.Unlock()
+		response := testPush(backend, "myservice", subs, options)
+		testutil.ExpectEquals(t, 200, response.SuccessCount+response.DroppedCount, "expected a result for every subscriber")
+		result := make(map[string]bool)
+		for _, sub := range mockService.getPushed() {
+			result[sub] = true
+		}
+		for _, details := range response.DroppedDetails {
+			testutil.ExpectEquals(t, UNIQUSH_NOT_SAMPLED, details.Code, "unexpected code")
+		}
+		return result
+	}
+
+	quarter := sampled(map[string]string{OptionSamplePercent: "25"})
+	if len(quarter) < 20 || len(quarter) > 80 {
+		t.Errorf("Expected about a quarter of the subscribers to be sampled, got %d", len(quarter))
+	}
+	testutil.ExpectEquals(t, quarter, sampled(map[string]string{OptionSamplePercent: "25"}), "expected the same subscribers to be sampled by each push")
+	half := sampled(map[string]string{OptionSamplePercent: "50"})
+	for sub := range quarter {
+		if !half[sub] {
+			t.Errorf("Expected %s to stay in the sample as the percentage increases", sub)
+		}
+	}
+	if seeded := sampled(map[string]string{OptionSamplePercent: "25", OptionSampleSeed: "rollout2"}); fmt.Sprint(seeded) == fmt.Sprint(quarter) {
+		t.Errorf("Expected a different seed to sample different subscribers")
+	}
+	testutil.ExpectEquals(t, 0, len(sampled(map[string]string{OptionSamplePercent: "0"})), "expected no subscribers to be sampled")
+	testutil.ExpectEquals(t, 200, len(sampled(map[string]string{OptionSamplePercent: "100"})), "expected every subscriber to be sampled")
+
+	for _, invalid := range []string{"5%", "-1", "150", "abc", "NaN", ""} {
+		mockService.lock.Lock()
+		mockService.pushed = nil
+		mockService.lock.Unlock()
+		response := testPush(backend, "myservice", subs, map[string]string{OptionSamplePercent: invalid})
+		testutil.ExpectEquals(t, 1, response.FailureCount, fmt.Sprintf("expected %q to be rejected", invalid))
+		testutil.ExpectEquals(t, UNIQUSH_ERROR_BAD_SAMPLE_PERCENT, response.FailureDetails[0].Code, "unexpected code")
+		testutil.ExpectEquals(t, 0, len(mockService.getPushed()), fmt.Sprintf("expected nothing to be pushed for %q", invalid))
+	}
+}
+
+func TestRetryHistoryLimit(t *testing.T) {
+	retry := newRetryState(time.Now())
+	for i := 1; i <= 5; i++ {
+		retry = retry.next(time.Duration(i)*time.Second, time.Duration(i)*time.Second, 3)
+	}
+	testutil.ExpectEquals(t, 5, retry.retries, "expected every retry to be counted")
+	testutil.ExpectEquals(t, []time.Duration{3 * time.Second, 4 * time.Second, 5 * time.Second}, retry.delays, "expected only the latest delays to be kept")
+	testutil.ExpectEquals(t, true, retry.delaysTruncated, "expected the delays to be truncated")
+	testutil.ExpectEquals(t, 15*time.Second, retry.waited, "expected the total wait to include the dropped delays")
+
+	retry = newRetryState(time.Now()).next(time.Second, time.Second, 0).next(time.Second, time.Second, 0)
+	testutil.ExpectEquals(t, 2, len(retry.delays), "expected every delay to be kept without a limit")
+	testutil.ExpectEquals(t, false, retry.delaysTruncated, "expected the delays not to be truncated")
+}
+
+func TestRemainingTTL(t *testing.T) {
+	submitted := time.Now()
+	notif := push.NewEmptyNotification()
+	notif.Data["ttl"] = "60"
+
+	retried, ok := remainingTTL(notif, submitted, submitted.Add(15500*time.Millisecond))
+	testutil.ExpectEquals(t, true, ok, "expected the ttl not to have elapsed")
+	testutil.ExpectEquals(t, "45", retried.Data["ttl"], "expected the ttl to shrink by the elapsed time")
+	testutil.ExpectEquals(t, "60", notif.Data["ttl"], "expected the original notification to be unchanged")
+	_, ok = remainingTTL(notif, submitted, submitted.Add(time.Minute))
+	testutil.ExpectEquals(t, false, ok, "expected the ttl to have elapsed")
+
+	notif.Data["ttl"] = "0"
+	retried, ok = remainingTTL(notif, submitted, submitted.Add(time.Hour))
+	testutil.ExpectEquals(t, true, ok, "expected a ttl of 0 to be left alone")
+	testutil.ExpectEquals(t, notif, retried, "expected a ttl of 0 to be left alone")
+}
+
+func TestRetryCollapseKey(t *testing.T) {
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	backend, _, _ := newTestPushBackEnd(nil)
+	testutil.ExpectEquals(t, notif, backend.retryCollapseKey("req1", notif), "expected no collapse key unless retry_collapse_key is on")
+
+	config := NewPushBackEndConfig()
+	config.RetryCollapseKey = true
+	backend, _, _ = newTestPushBackEnd(config)
+	key := backend.retryCollapseKey("req1", notif).Data[push.CollapseKey]
+	if !strings.HasPrefix(key, "uniqush-") {
+		t.Errorf("Expected a collapse key derived from the request ID, got %q", key)
+	}
+	testutil.ExpectEquals(t, "", notif.Data[push.CollapseKey], "expected the original notification to be unchanged")
+	testutil.ExpectEquals(t, key, backend.retryCollapseKey("req1", notif).Data[push.CollapseKey], "expected every attempt of the push to use the same collapse key")
+	if other := backend.retryCollapseKey("req2", notif).Data[push.CollapseKey]; other == key {
+		t.Errorf("Expected other requests to use other collapse keys, got %q for both", key)
+	}
+	notif.Data[push.CollapseKey] = "scores"
+	testutil.ExpectEquals(t, "scores", backend.retryCollapseKey("req1", notif).Data[push.CollapseKey], "expected the collapse key of the push to be kept")
+}
+
+func TestRetryExpiresWithTTL(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	notif.Data["ttl"] = "1"
+	notif.Data[OptionWaitForRetries] = "1"
+	handler := newPushResponseHandler(backend.loggers[LoggerPush])
+
+	go func() {
+		time.Sleep(1100 * time.Millisecond)
+		backend.FlushRetries()
+	}()
+	backend.Push("testreq", "127.0.0.1", "myservice", []string{"sub1"}, nil, notif, nil, backend.loggers[LoggerPush], handler)
+	testutil.ExpectEquals(t, []string{"retrytoken1"}, mockService.getPushed(), "expected the expired push not to be retried")
+	testutil.ExpectEquals(t, 1, handler.response.FailureCount, "expected the expired push to fail")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_EXPIRED, handler.response.FailureDetails[0].Code, "unexpected code")
+}
+
+// blockingHandler passes the results of a push to a channel, blocking the push until they are received.
+type blockingHandler struct {
+	details chan APIResponseDetails
+}
+
+func (h *blockingHandler) AddDetailsToHandler(v APIResponseDetails) {
+	h.details <- v
+}
+
+func (h *blockingHandler) ToJSON() []byte {
+	return nil
+}
+
+func TestInFlightPushes(t *testing.T) {
+	backend, mdb, _ := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+	handler := &blockingHandler{details: make(chan APIResponseDetails)}
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	done := make(chan struct{})
+	go func() {
+		backend.Push("testreq", "127.0.0.1", "myservice", []string{"sub1", "sub2"}, nil, notif, nil, backend.loggers[LoggerPush], handler)
+		close(done)
+	}()
+
+	<-handler.details
+	pushes := backend.InFlightPushes()
+	if len(pushes) != 1 {
+		t.Fatalf("Expected one push in flight, got %v", pushes)
+	}
+	testutil.ExpectEquals(t, "testreq", pushes[0].RequestID, "unexpected request id")
+	testutil.ExpectEquals(t, 2, pushes[0].NrSubscribers, "unexpected number of subscribers")
+	testutil.ExpectEquals(t, 1, pushes[0].Done, "expected the first result to be counted")
+	<-handler.details
+	<-done
+	testutil.ExpectEquals(t, 0, len(backend.InFlightPushes()), "expected the push to be removed once it finished")
+}
+
+func TestShardFilter(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.ShardCount = 2
+	config.ShardIndex = 0
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	other := NewHashShardFilter(2, 1)
+	var subs []string
+	owned := 0
+	for i := 0; i < 10; i++ {
+		sub := fmt.Sprintf("sub%d", i)
+		mdb.addMockSubscription(t, "myservice", sub, "token"+sub)
+		subs = append(subs, sub)
+		if backend.shard.OwnsSubscriber("myservice", sub) {
+			owned++
+		}
+		testutil.ExpectEquals(t, !backend.shard.OwnsSubscriber("myservice", sub), other.OwnsSubscriber("myservice", sub), "expected each subscriber to have exactly one shard")
+	}
+
+	response := testPush(backend, "myservice", subs, nil)
+	testutil.ExpectEquals(t, owned, response.SuccessCount, "expected pushes to the subscribers of this shard")
+	testutil.ExpectEquals(t, owned, len(mockService.getPushed()), "expected pushes to the subscribers of this shard")
+	testutil.ExpectEquals(t, 10-owned, response.DroppedCount, "expected the other subscribers to be reported as not my shard")
+}
+
+func TestPushClass(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	config.GlobalRateReject = true
+	config.PushClasses = map[string]*PushClass{
+		"marketing": {RateBurst: 1, MaxRetries: 1, LogLevel: log.LOGLEVEL_ERROR},
+		"bulk":      {Rate: 0.001, RateBurst: 1, LogLevel: log.LOGLEVEL_DEBUG},
+	}
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	output := &lockedBuffer{}
+	backend.loggers[LoggerPush] = log.NewLogger(output, "[Test]", log.LOGLEVEL_DEBUG)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+	mdb.addMockSubscription(t, "myservice", "sub3", "token3")
+
+	testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionClass: "Marketing"})
+	flushRetriesUntil(backend, mockService, 2)
+	testutil.ExpectEquals(t, []string{"retrytoken1", "retrytoken1"}, mockService.getPushed(), "expected max_retries of the class to apply")
+	if logs := output.String(); strings.Contains(logs, "Retry after") || !strings.Contains(logs, "Failed after 1 retries") {
+		t.Errorf("Expected only errors to be logged for the class, got %q", logs)
+	}
+
+	response := testPush(backend, "myservice", []string{"sub2", "sub3"}, map[string]string{OptionClass: "bulk"})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the first push of the class to be sent")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the rate of the class to reject the second push")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_RATE_LIMITED, response.FailureDetails[0].Code, "unexpected code")
+}
+
+func TestLatencyIncludesBackoff(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = 50 * time.Millisecond
+	config.MaxBackoff = 50 * time.Millisecond
+	backend, mdb, _ := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "retrytoken2")
+
+	response := testPush(backend, "myservice", []string{"sub1", "sub2"}, map[string]string{OptionMaxRetries: "1", OptionWaitForRetries: "1"})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to sub1 to succeed")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the retry of sub2 to fail")
+	if response.SuccessDetails[0].LatencyMs == nil {
+		t.Error("Expected the latency of the successful push to be reported")
+	}
+	if latency := response.FailureDetails[0].LatencyMs; latency == nil || *latency < 50 {
+		t.Errorf("Expected the latency of the retried push to include the backoff, got %v", latency)
+	}
+}
+
+func TestRetryReasonCounts(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+
+	testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionMaxRetries: "1"})
+	flushRetriesUntil(backend, mockService, 2)
+	expected := []RetryReasonCount{{Service: "myservice", Category: push.RetryCategoryUnknown, Count: 2}}
+	testutil.ExpectEquals(t, expected, backend.RetryReasonCounts(), "expected the original push and the retry to be counted")
+}
+
+func TestAttributeFilters(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1").VolatileData[push.Locale] = "en_US"
+	mdb.addMockSubscription(t, "myservice", "sub1", "token2").VolatileData[push.Locale] = "de_DE"
+	mdb.addMockSubscription(t, "myservice", "sub1", "token3")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionFilterPrefix + push.Locale: "en*, fr"})
+	testutil.ExpectEquals(t, []string{"token1"}, mockService.getPushed(), "expected only the matching delivery point to be pushed to")
+	testutil.ExpectEquals(t, 2, response.DroppedCount, "expected the other delivery points to be filtered")
+	testutil.ExpectEquals(t, UNIQUSH_FILTERED, response.DroppedDetails[0].Code, "unexpected code")
+}
+
+func TestRetryTransientDatabaseErrors(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+
+	mdb.lock.Lock()
+	mdb.err = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	mdb.lock.Unlock()
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.RetryingCount, "expected the lookup to be retried after a transient error")
+	mdb.lock.Lock()
+	mdb.err = nil
+	mdb.lock.Unlock()
+	flushRetriesUntil(backend, mockService, 1)
+	testutil.ExpectEquals(t, []string{"token1"}, mockService.getPushed(), "expected the retry to push to the subscriber")
+
+	mdb.lock.Lock()
+	mdb.err = errors.New("invalid data")
+	mdb.lock.Unlock()
+	response = testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected other database errors to fail")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_DATABASE, response.FailureDetails[0].Code, "unexpected code")
+}
+
+func TestBroadcast(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.BroadcastBatchSize = 2
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+	mdb.addMockSubscription(t, "myservice", "sub3", "token3")
+	mdb.addMockSubscription(t, "otherservice", "sub4", "token4")
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	handler := newPushResponseHandler(backend.loggers[LoggerPush])
+
+	err := backend.Broadcast("testreq", "127.0.0.1", "myservice", notif, nil, backend.loggers[LoggerPush], handler)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, 3, handler.response.SuccessCount, "expected every subscriber of the service to be pushed to")
+	testutil.ExpectEquals(t, []string{"token1", "token2", "token3"}, mockService.getPushed(), "unexpected pushes")
+}
+
+func TestTimeoutOption(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "retrytoken2")
+
+	response := testPush(backend, "myservice", []string{"sub1", "sub2"}, map[string]string{OptionTimeout: "10s"})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to sub1 to succeed within the timeout")
+	testutil.ExpectEquals(t, 0, response.RetryingCount, "expected no retry to be scheduled after the timeout")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the push to sub2 to fail")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_TIMEOUT, response.FailureDetails[0].Code, "unexpected code")
+	flushRetriesUntil(backend, mockService, 2)
+	testutil.ExpectEquals(t, []string{"token1", "retrytoken2"}, mockService.getPushed(), "expected sub2 not to be retried")
+}
+
+type recordingBatchSummaryHandler struct {
+	summaries []*PushBatchSummary
+}
+
+func (h *recordingBatchSummaryHandler) PushBatchComplete(summary *PushBatchSummary) {
+	h.summaries = append(h.summaries, summary)
+}
+
+func TestBatchSummary(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, _ := newTestPushBackEnd(config)
+	summaries := &recordingBatchSummaryHandler{}
+	backend.SetBatchSummaryHandler(summaries)
+	output := &lockedBuffer{}
+	backend.loggers[LoggerPush] = log.NewLogger(output, "[Test]", log.LOGLEVEL_DEBUG)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "failtoken2")
+	mdb.addMockSubscription(t, "myservice", "sub3", "retrytoken3")
+	mdb.addMockSubscription(t, "myservice", "sub4", "unregisteredtoken4")
+
+	testPush(backend, "myservice", []string{"sub1", "sub2", "sub3", "sub4"}, nil)
+	testutil.ExpectEquals(t, 1, len(summaries.summaries), "expected one summary for the push")
+	summary := summaries.summaries[0]
+	summary.Elapsed = 0
+	expected := &PushBatchSummary{RequestID: "testreq", Service: "myservice", NrSubscribers: 4, Succeeded: 1, Failed: 1, Retrying: 1, Unsubscribed: 1}
+	testutil.ExpectEquals(t, expected, summary, "unexpected summary")
+	if !strings.Contains(output.String(), "[PushBatchComplete] NrSubscribers=4 Succeeded=1 Failed=1 Retrying=1 Unsubscribed=1 Dropped=0") {
+		t.Errorf("Expected the summary to be logged, got %q", output.String())
+	}
+}
+
+func TestMaxRequestAge(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.MaxRequestAge = time.Minute
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionRequestTime: old})
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the old push to be rejected")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_REQUEST_TOO_OLD, response.FailureDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, 0, len(mockService.getPushed()), "expected nothing to be pushed")
+
+	recent := strconv.FormatInt(time.Now().Unix(), 10)
+	response = testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionRequestTime: recent})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected a recent push to be sent")
+	response = testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected a push without a request time to be sent")
+}
+
+func TestContentDedup(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.ContentDedupWindow = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+
+	testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionRequestTime: "1"})
+	response := testPush(backend, "myservice", []string{"sub1", "sub2"}, map[string]string{OptionRequestTime: "2"})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to sub2 to be sent")
+	testutil.ExpectEquals(t, 1, response.DroppedCount, "expected the duplicate push to sub1 to be suppressed")
+	testutil.ExpectEquals(t, UNIQUSH_DUPLICATE_SUPPRESSED, response.DroppedDetails[0].Code, "unexpected code")
+	testPush(backend, "myservice", []string{"sub1"}, map[string]string{"msg": "other"})
+	testutil.ExpectEquals(t, []string{"token1", "token2", "token1"}, mockService.getPushed(), "expected other content to be pushed")
+}
+
+func TestMetrics(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	metrics := NewPrometheusMetrics(nil)
+	backend.SetMetrics(metrics)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "retrytoken2")
+
+	testPush(backend, "myservice", []string{"sub1", "sub2"}, map[string]string{OptionMaxRetries: "1"})
+	flushRetriesUntil(backend, mockService, 3)
+	output := string(metrics.format())
+	for _, expected := range []string{
+		`uniqush_push_results_total{code="UNIQUSH_SUCCESS",service="myservice"} 1`,
+		`uniqush_push_results_total{code="UNIQUSH_PUSH_RETRYING",service="myservice"} 1`,
+		`uniqush_push_results_total{code="UNIQUSH_ERROR_FAILED_RETRY",service="myservice"} 1`,
+		`uniqush_retries_total{category="unknown",service="myservice"} 2`,
+		`uniqush_push_latency_seconds_count{service="myservice"} 2`,
+		`uniqush_provider_push_seconds_count{push_service_type="` + mockPushServiceTypeName + `",service="myservice"} 2`,
+	} {
+		if !strings.Contains(output, expected+"\n") {
+			t.Errorf("Expected %q in the metrics, got %q", expected, output)
+		}
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.BlacklistThreshold = 2
+	config.BlacklistTTL = 50 * time.Millisecond
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+
+	for i := 0; i < 2; i++ {
+		response := testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+		testutil.ExpectEquals(t, 1, response.FailureCount, "expected the push to the failing delivery point to fail")
+	}
+	response := testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+	testutil.ExpectEquals(t, 1, response.DroppedCount, "expected the failing delivery point to be skipped")
+	testutil.ExpectEquals(t, UNIQUSH_TEMPORARILY_SKIPPED, response.DroppedDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected other delivery points to be pushed to")
+	testutil.ExpectEquals(t, []string{"failtoken1", "token2", "failtoken1", "token2", "token2"}, mockService.getPushed(), "expected the blacklisted delivery point not to be pushed to")
+
+	time.Sleep(60 * time.Millisecond)
+	response = testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the delivery point to be pushed to once the blacklist expired")
+}
+
+func TestProviderFailover(t *testing.T) {
+	// Register the mock push service type before building its providers.
+	getMockPushServiceType()
+	psm := push.GetPushServiceManager()
+	var psps []*push.PushServiceProvider
+	for _, name := range []string{"psp", "backup"} {
+		psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": mockPushServiceTypeName, "service": "myservice", "name": name})
+		if err != nil {
+			t.Fatalf("Failed to build mock psp: %v", err)
+		}
+		psps = append(psps, psp)
+	}
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	config.ProviderFailover = map[string][]string{"myservice": {psps[0].Name(), psps[1].Name()}}
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.psps = psps
+	mdb.addMockSubscription(t, "myservice", "sub1", "primaryretrytoken1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "retrytoken2")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to succeed with the backup provider")
+	testutil.ExpectEquals(t, psps[1].Name(), *response.SuccessDetails[0].PushServiceProvider, "unexpected provider")
+	testutil.ExpectEquals(t, 0, response.RetryingCount, "expected no retry with a backoff")
+	testutil.ExpectEquals(t, []string{"primaryretrytoken1", "primaryretrytoken1"}, mockService.getPushed(), "expected the delivery point to be pushed to by each provider")
+
+	// Once every provider failed, the push is retried with a backoff as usual.
+	response = testPush(backend, "myservice", []string{"sub2"}, nil)
+	testutil.ExpectEquals(t, 1, response.RetryingCount, "expected a retry once every provider failed")
+	testutil.ExpectEquals(t, psps[1].Name(), *response.RetryingDetails[0].PushServiceProvider, "expected the retry to use the last provider")
+}
+
+// slowHook blocks the pushes to delivery points whose devtoken starts with "slow" until release is closed.
+type slowHook struct {
+	release chan struct{}
+}
+
+func (h *slowHook) BeforePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, error) {
+	if strings.HasPrefix(dp.FixedData["devtoken"], "slow") {
+		<-h.release
+	}
+	return notif, nil
+}
+
+func (h *slowHook) AfterPush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, msgID string, err error) {
+}
+
+// enrichingHook rejects the pushes to delivery points whose devtoken starts with "veto", adds the devtoken to the msg of the others, and records the results of the pushes.
+type enrichingHook struct {
+	lock    sync.Mutex
+	results []string
+}
+
+func (h *enrichingHook) BeforePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, error) {
+	devtoken := dp.FixedData["devtoken"]
+	if strings.HasPrefix(devtoken, "veto") {
+		return nil, errors.New("vetoed")
+	}
+	notif.Data["msg"] += " " + devtoken
+	return notif, nil
+}
+
+func (h *enrichingHook) AfterPush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, msgID string, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	result := msgID
+	if err != nil {
+		result = err.Error()
+	}
+	h.results = append(h.results, dp.FixedData["devtoken"]+"="+result)
+}
+
+func (h *enrichingHook) getResults() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ret := append([]string(nil), h.results...)
+	sort.Strings(ret)
+	return ret
+}
+
+func TestPushHook(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	hook := &enrichingHook{}
+	backend.AddPushHook(hook)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+	mdb.addMockSubscription(t, "myservice", "sub3", "vetotoken3")
+	mdb.addMockSubscription(t, "myservice", "sub4", "failtoken4")
+
+	response := testPush(backend, "myservice", []string{"sub1", "sub2", "sub3", "sub4"}, nil)
+	testutil.ExpectEquals(t, 2, response.SuccessCount, "expected the pushes accepted by the hook to succeed")
+	testutil.ExpectEquals(t, 2, response.FailureCount, "expected the vetoed push and the push to failtoken4 to fail")
+	codes := []string{response.FailureDetails[0].Code, response.FailureDetails[1].Code}
+	sort.Strings(codes)
+	testutil.ExpectEquals(t, []string{UNIQUSH_ERROR_GENERIC, UNIQUSH_ERROR_REJECTED_BY_HOOK}, codes, "unexpected codes")
+
+	pushed := mockService.getPushed()
+	sort.Strings(pushed)
+	testutil.ExpectEquals(t, []string{"failtoken4", "token1", "token2"}, pushed, "expected the vetoed push to not be sent")
+	messages := mockService.getMessages()
+	sort.Strings(messages)
+	testutil.ExpectEquals(t, []string{"hello failtoken4", "hello token1", "hello token2"}, messages, "expected each delivery point to get the notification enriched by the hook")
+	testutil.ExpectEquals(t, []string{"failtoken4=mock failure", "token1=mockmsg:token1", "token2=mockmsg:token2"}, hook.getResults(), "expected AfterPush to be called for each push which was sent")
+}
+
+func TestHookTimeout(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.HookTimeout = 10 * time.Millisecond
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	metrics := NewPrometheusMetrics(nil)
+	backend.SetMetrics(metrics)
+	hook := &slowHook{release: make(chan struct{})}
+	defer close(hook.release)
+	backend.AddPushHook(hook)
+	mdb.addMockSubscription(t, "myservice", "sub1", "slowtoken1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+
+	response := testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the push with the slow hook to fail")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_HOOK_TIMEOUT, response.FailureDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the other push to be sent")
+	testutil.ExpectEquals(t, []string{"token2"}, mockService.getPushed(), "expected only the other delivery point to be pushed to")
+	expected := `uniqush_before_push_seconds_count{push_service_type="` + mockPushServiceTypeName + `",service="myservice"} 2` + "\n"
+	if output := string(metrics.format()); !strings.Contains(output, expected) {
+		t.Errorf("Expected %q in the metrics, got %q", expected, output)
+	}
+}
+
+func TestRetrySubscriberFailureAccounting(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Millisecond
+	config.BlacklistThreshold = 2
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	output := &lockedBuffer{}
+	backend.loggers[LoggerPush] = log.NewLogger(output, "[Test]", log.LOGLEVEL_WARN)
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken1")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionRetrySubscriber: "1", OptionMaxRetries: "3", OptionWaitForRetries: "1"})
+	testutil.ExpectEquals(t, []string{"failtoken1", "failtoken1"}, mockService.getPushed(), "expected the delivery point to be skipped once it is blacklisted")
+	testutil.ExpectEquals(t, 1, response.DroppedCount, "expected the last retry to be skipped")
+	testutil.ExpectEquals(t, UNIQUSH_TEMPORARILY_SKIPPED, response.DroppedDetails[0].Code, "unexpected code")
+	if logs := output.String(); strings.Count(logs, "DeliveryPoint="+*response.DroppedDetails[0].DeliveryPoint+" Failed: mock failure") != 2 {
+		t.Errorf("Expected each failure to be logged, got %q", logs)
+	}
+}
+
+func TestDeliveredKeptForLateRetries(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Millisecond
+	config.MaxBackoff = 10 * time.Millisecond
+	config.MaxRetryAfter = time.Second
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "lateretry1")
+
+	// The retry is sent after 50ms, which is longer than twice the max_backoff.
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionRetrySubscriber: "1", OptionMaxRetries: "2", OptionWaitForRetries: "1"})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to succeed")
+	testutil.ExpectEquals(t, 0, response.FailureCount, "expected no failures")
+	testutil.ExpectEquals(t, []string{"lateretry1"}, mockService.getPushed(), "expected the retry of the delivered push to be skipped")
+}
+
+func TestRetrySubscriberOption(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Millisecond
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken2")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionRetrySubscriber: "1", OptionMaxRetries: "2", OptionWaitForRetries: "1"})
+	testutil.ExpectEquals(t, []string{"token1", "failtoken2", "failtoken2", "failtoken2"}, mockService.getPushed(), "expected only the failed delivery point to be retried")
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to token1 to succeed")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the failed delivery point to be reported once")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_FAILED_RETRY, response.FailureDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, 2, *response.FailureDetails[0].Retries, "expected the number of retries of the subscriber")
+}
+
+func TestRetrySubscriberPerDeliveryPoint(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Millisecond
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken2")
+
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	notif.Data[OptionRetrySubscriber] = "1"
+	notif.Data[OptionMaxRetries] = "1"
+	notif.Data[OptionWaitForRetries] = "1"
+	handler := newPushResponseHandler(backend.loggers[LoggerPush])
+	backend.Push("testreq", "127.0.0.1", "myservice", []string{"sub1"}, nil, notif, map[string][]string{"msg": {"one", "two"}}, backend.loggers[LoggerPush], handler)
+	testutil.ExpectEquals(t, []string{"token1", "failtoken2", "failtoken2"}, mockService.getPushed(), "expected only the failed delivery point to be retried")
+	testutil.ExpectEquals(t, []string{"one", "two", "two"}, mockService.getMessages(), "expected each delivery point and its retries to get its own per-delivery point values")
+}
+
+func TestGeneratedRequestID(t *testing.T) {
+	backend, mdb, _ := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "token2")
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+
+	handler := newPushResponseHandler(backend.loggers[LoggerPush])
+	backend.Push("", "127.0.0.1", "myservice", []string{"sub1"}, nil, notif, nil, backend.loggers[LoggerPush], handler)
+	details := handler.response.SuccessDetails
+	testutil.ExpectEquals(t, 2, len(details), "expected both pushes to succeed")
+	if *details[0].RequestID == "" {
+		t.Errorf("Expected a request ID to be generated")
+	}
+	testutil.ExpectEquals(t, *details[0].RequestID, *details[1].RequestID, "expected every result to have the same request ID")
+}
+
+func TestSortSubscribers(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.SortSubscribers = true
+	backend, _, _ := newTestPushBackEnd(config)
+	// Queued pushes keep the subscribers in the order they will be pushed to.
+	backend.Pause("myservice")
+
+	subs := []string{"sub3", "sub1", "sub2"}
+	testPush(backend, "myservice", subs, nil)
+	queue, _ := backend.paused.resume("myservice")
+	testutil.ExpectEquals(t, 1, len(queue), "expected the push to be queued")
+	testutil.ExpectEquals(t, []string{"sub1", "sub2", "sub3"}, queue[0].subs, "expected the subscribers to be sorted")
+	testutil.ExpectEquals(t, []string{"sub3", "sub1", "sub2"}, subs, "expected the subscribers of the caller to be left unchanged")
+}
+
+// simplifyingRetryTransformer replaces the message of each retry, and records the retry numbers and the messages it was called with.
+type simplifyingRetryTransformer struct {
+	lock     sync.Mutex
+	retries  []int
+	messages []string
+}
+
+func (s *simplifyingRetryTransformer) TransformRetry(service string, psp *push.PushServiceProvider, dp *push.DeliveryPoint, notif *push.Notification, retries int) *push.Notification {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.retries = append(s.retries, retries)
+	s.messages = append(s.messages, notif.Data["msg"])
+	ret := notif.Clone()
+	ret.Data["msg"] = "simple"
+	return ret
+}
+
+func TestRetryTransformer(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.InitBackoff = time.Millisecond
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	transformer := &simplifyingRetryTransformer{}
+	backend.SetRetryTransformer(transformer)
+	mdb.addMockSubscription(t, "myservice", "sub1", "retrytoken1")
+
+	testPush(backend, "myservice", []string{"sub1"}, map[string]string{OptionMaxRetries: "2", OptionWaitForRetries: "1"})
+	testutil.ExpectEquals(t, 3, len(mockService.getPushed()), "expected both retries to be sent")
+	testutil.ExpectEquals(t, []int{1, 2}, transformer.retries, "expected the transformer to be called before each retry")
+	testutil.ExpectEquals(t, []string{"hello", "simple"}, transformer.messages, "expected each retry to send the transformed notification")
+}
+
+func TestMinSuccessfulDevices(t *testing.T) {
+	backend, mdb, _ := newTestPushBackEnd(nil)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "failtoken2")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token3")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token4")
+
+	response := testPush(backend, "myservice", []string{"sub1", "sub2"}, map[string]string{OptionMinSuccessfulDevices: "2"})
+	testutil.ExpectEquals(t, 3, response.SuccessCount, "expected the results of the delivery points to be reported as usual")
+	testutil.ExpectEquals(t, 2, response.FailureCount, "expected the failed delivery point and sub1 to be reported")
+	var tooFew []string
+	for _, details := range response.FailureDetails {
+		if details.Code == UNIQUSH_ERROR_TOO_FEW_DEVICES {
+			tooFew = append(tooFew, *details.Subscriber)
+			testutil.ExpectEquals(t, "1 of the subscriber's delivery points succeeded, but uniqush.min_successful_devices requires at least 2", *details.ErrorMsg, "unexpected error message")
+		}
+	}
+	testutil.ExpectEquals(t, []string{"sub1"}, tooFew, "expected only sub1 to have too few devices")
+}
+
+func TestHealthRouting(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.HealthRouting = HealthRoutingSkip
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	token1 := mdb.addMockSubscription(t, "myservice", "sub1", "failtoken1")
+	token2 := mdb.addMockSubscription(t, "myservice", "sub1", "token2")
+	mdb.addMockSubscription(t, "myservice", "sub2", "failtoken3")
+
+	testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+	pspDpList, _ := backend.resolveDeliveryPoints("testreq", "myservice", "sub1", nil, false, backend.loggers[LoggerPush])
+	testutil.ExpectEquals(t, []string{token2.Name(), token1.Name()}, []string{pspDpList[0].DeliveryPoint.Name(), pspDpList[1].DeliveryPoint.Name()}, "expected the healthier delivery point to be pushed to first")
+
+	// Each failure reduces the score by 30%, so the fifth one takes it below the default health_min_score of 0.2.
+	for i := 0; i < 4; i++ {
+		testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+	}
+	mockService = getMockPushServiceType()
+	response := testPush(backend, "myservice", []string{"sub1", "sub2"}, nil)
+	testutil.ExpectEquals(t, 1, response.DroppedCount, "expected the unhealthy delivery point of sub1 to be skipped")
+	testutil.ExpectEquals(t, UNIQUSH_TEMPORARILY_SKIPPED, response.DroppedDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, token1.Name(), *response.DroppedDetails[0].DeliveryPoint, "unexpected delivery point")
+	pushed := mockService.getPushed()
+	sort.Strings(pushed)
+	testutil.ExpectEquals(t, []string{"failtoken3", "token2"}, pushed, "expected the only delivery point of sub2 to be pushed to, even though it is unhealthy")
+}
+
+// mockEncryptor "encrypts" the message of each notification by prefixing it with the subscriber, and fails for subscribers without a key.
+type mockEncryptor struct{}
+
+func (mockEncryptor) EncryptNotification(service string, sub string, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, error) {
+	if sub == "nokey" {
+		return nil, errors.New("no key for the subscriber")
+	}
+	encrypted := notif.Clone()
+	encrypted.Data["msg"] = sub + ":" + notif.Data["msg"]
+	return encrypted, nil
+}
+
+func TestPayloadEncryptor(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	backend.SetPayloadEncryptor(mockEncryptor{})
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "nokey", "token2")
+
+	response := testPush(backend, "myservice", []string{"sub1", "nokey"}, nil)
+	testutil.ExpectEquals(t, []string{"token1"}, mockService.getPushed(), "expected the push which couldn't be encrypted not to be sent")
+	testutil.ExpectEquals(t, []string{"sub1:hello"}, mockService.getMessages(), "expected the encrypted notification to be sent")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the push which couldn't be encrypted to fail")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_ENCRYPTION_FAILED, response.FailureDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, "failed to encrypt the notification: no key for the subscriber", *response.FailureDetails[0].ErrorMsg, "unexpected error message")
+}
+
+func TestFieldLimitsBeforeEncryption(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.FieldLimits = FieldLimitsTruncate
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	backend.SetPayloadEncryptor(mockEncryptor{})
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{"msg": "hello world"})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the push to succeed")
+	testutil.ExpectEquals(t, []string{"sub1:hello"}, mockService.getMessages(), "expected the plaintext to be truncated before it was encrypted")
+	testutil.ExpectEquals(t, []string{"msg"}, response.SuccessDetails[0].AdjustedFields, "expected the truncated field to be reported")
+}
+
+// sealingEncryptor "encrypts" every field of each notification into its message, so that no field is sent in plaintext.
+type sealingEncryptor struct{}
+
+func (sealingEncryptor) EncryptNotification(service string, sub string, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, error) {
+	var fields []string
+	for k, v := range notif.Data {
+		fields = append(fields, k+"="+v)
+	}
+	sort.Strings(fields)
+	encrypted := push.NewEmptyNotification()
+	encrypted.Data["msg"] = strings.Join(fields, ",")
+	return encrypted, nil
+}
+
+func TestPushServiceTypeDefaultsBeforeEncryption(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.PushServiceTypeDefaults = map[string]map[string]string{mockPushServiceTypeName: {"sound": "chime"}}
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	backend.SetPayloadEncryptor(sealingEncryptor{})
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+
+	testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, []string{"msg=hello,sound=chime"}, mockService.getMessages(), "expected the defaults of the push service type to be encrypted")
+}
+
+// slowEncryptor blocks the encryption for the subscribers whose names start with "slow" until release is closed.
+type slowEncryptor struct {
+	release chan struct{}
+}
+
+func (e *slowEncryptor) EncryptNotification(service string, sub string, dp *push.DeliveryPoint, notif *push.Notification) (*push.Notification, error) {
+	if strings.HasPrefix(sub, "slow") {
+		<-e.release
+	}
+	return notif, nil
+}
+
+func TestEncryptorHookTimeout(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.HookTimeout = 10 * time.Millisecond
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	metrics := NewPrometheusMetrics(nil)
+	backend.SetMetrics(metrics)
+	encryptor := &slowEncryptor{release: make(chan struct{})}
+	defer close(encryptor.release)
+	backend.SetPayloadEncryptor(encryptor)
+	mdb.addMockSubscription(t, "myservice", "slowsub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub2", "token2")
+
+	response := testPush(backend, "myservice", []string{"slowsub1", "sub2"}, nil)
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the push with the slow encryptor to fail")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_HOOK_TIMEOUT, response.FailureDetails[0].Code, "unexpected code")
+	testutil.ExpectEquals(t, []string{"token2"}, mockService.getPushed(), "expected only the other delivery point to be pushed to")
+	expected := `uniqush_before_push_seconds_count{push_service_type="` + mockPushServiceTypeName + `",service="myservice"} 2` + "\n"
+	if output := string(metrics.format()); !strings.Contains(output, expected) {
+		t.Errorf("Expected %q in the metrics, got %q", expected, output)
+	}
+}
+
+// failingSigner fails to sign every notification.
+type failingSigner struct{}
+
+func (failingSigner) SignNotification(service string, sub string, dp *push.DeliveryPoint, notif *push.Notification) (string, error) {
+	return "", errors.New("no signing key")
+}
+
+func TestNotificationSigner(t *testing.T) {
+	backend, mdb, mockService := newTestPushBackEnd(nil)
+	key := []byte("secret")
+	// The mock push service type only records the message, so the signature replaces it.
+	backend.SetNotificationSigner("msg", &HMACSigner{Key: key})
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+
+	response := testPush(backend, "myservice", []string{"sub1"}, map[string]string{"uniqush.foo": "ignored"})
+	testutil.ExpectEquals(t, 1, response.SuccessCount, "expected the signed push to succeed")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("3:msg,5:hello,"))
+	testutil.ExpectEquals(t, []string{base64.StdEncoding.EncodeToString(mac.Sum(nil))}, mockService.getMessages(), "expected the fields of the notification to be signed")
+
+	backend.SetNotificationSigner("sig", failingSigner{})
+	response = testPush(backend, "myservice", []string{"sub1"}, nil)
+	testutil.ExpectEquals(t, 1, len(mockService.getPushed()), "expected the push which couldn't be signed not to be sent")
+	testutil.ExpectEquals(t, 1, response.FailureCount, "expected the push which couldn't be signed to fail")
+	testutil.ExpectEquals(t, UNIQUSH_ERROR_SIGNING_FAILED, response.FailureDetails[0].Code, "unexpected code")
+}
+
+func TestHMACSignerIsUnambiguous(t *testing.T) {
+	signer := &HMACSigner{Key: []byte("secret")}
+	sign := func(data map[string]string) string {
+		notif := push.NewEmptyNotification()
+		notif.Data = data
+		signature, err := signer.SignNotification("myservice", "sub1", nil, notif)
+		if err != nil {
+			t.Fatalf("Unexpected error signing: %v", err)
+		}
+		return signature
+	}
+	if sign(map[string]string{"a": "x\nb=y"}) == sign(map[string]string{"a": "x", "b": "y"}) {
+		t.Error("Expected notifications with different fields to have different signatures")
+	}
+	if sign(map[string]string{"a": "1:b,1:c"}) == sign(map[string]string{"a": "", "b": "c"}) {
+		t.Error("Expected values containing netstrings not to be confused with other fields")
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+)
+
+// detachableResponseHandler forwards details to another APIResponseHandler, until detach is called.
+// This is used to respond to /push after a timeout, while pushes that haven't finished continue in the background.
+type detachableResponseHandler struct {
+	lock     sync.Mutex
+	handler  APIResponseHandler
+	detached bool
+	// subscribers is the set of subscribers that had at least one response.
+	subscribers map[string]bool
+}
+
+var _ APIResponseHandler = &detachableResponseHandler{}
+
+func newDetachableResponseHandler(handler APIResponseHandler) *detachableResponseHandler {
+	return &detachableResponseHandler{
+		handler:     handler,
+		subscribers: make(map[string]bool),
+	}
+}
+
+// AddDetailsToHandler forwards v to the wrapped handler, unless this was detached.
+func (h *detachableResponseHandler) AddDetailsToHandler(v APIResponseDetails) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.detached {
+		return
+	}
+	if v.Subscriber != nil {
+		h.subscribers[*v.Subscriber] = true
+	}
+	h.handler.AddDetailsToHandler(v)
+}
+
+// ToJSON returns the serialization of the wrapped handler.
+func (h *detachableResponseHandler) ToJSON() []byte {
+	return h.handler.ToJSON()
+}
+
+// detach stops forwarding details to the wrapped handler, and returns the subscribers of subs which have no responses yet.
+func (h *detachableResponseHandler) detach(subs []string) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.detached = true
+	var pending []string
+	for _, sub := range subs {
+		if !h.subscribers[sub] {
+			pending = append(pending, sub)
+		}
+	}
+	return pending
+}
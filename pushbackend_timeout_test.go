@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestDetachableResponseHandler(t *testing.T) {
+	handler := newPushResponseHandler(nil)
+	detachableHandler := newDetachableResponseHandler(handler)
+	sub1 := "sub1"
+	detachableHandler.AddDetailsToHandler(APIResponseDetails{Subscriber: &sub1, Code: UNIQUSH_SUCCESS})
+
+	pending := detachableHandler.detach([]string{"sub1", "sub2"})
+	testutil.ExpectEquals(t, []string{"sub2"}, pending, "expected only subscribers without responses to be pending")
+
+	sub2 := "sub2"
+	detachableHandler.AddDetailsToHandler(APIResponseDetails{Subscriber: &sub2, Code: UNIQUSH_SUCCESS})
+	testutil.ExpectEquals(t, 1, handler.response.SuccessCount, "expected details after detaching to be ignored")
+}
+
+func TestResponseTimeoutPartialResults(t *testing.T) {
+	config := NewPushBackEndConfig()
+	config.ResponseTimeout = 20 * time.Millisecond
+	backend, mdb, mockService := newTestPushBackEnd(config)
+	metrics := NewPrometheusMetrics(nil)
+	backend.SetMetrics(metrics)
+	hook := &slowHook{release: make(chan struct{})}
+	backend.AddPushHook(hook)
+	mdb.addMockSubscription(t, "myservice", "sub1", "token1")
+	mdb.addMockSubscription(t, "myservice", "sub1", "slowtoken2")
+
+	notif := push.NewEmptyNotification()
+	notif.Data["msg"] = "hello"
+	handler := newPushResponseHandler(backend.loggers[LoggerPush])
+	backend.Push("testreq", "127.0.0.1", "myservice", []string{"sub1"}, nil, notif, nil, backend.loggers[LoggerPush], handler)
+	testutil.ExpectEquals(t, 1, handler.response.SuccessCount, "expected the push which finished before the timeout to be reported")
+	testutil.ExpectEquals(t, 0, handler.response.FailureCount, "expected the subscriber to not be reported as timed out, since it had a result")
+
+	// The push to slowtoken2 finishes after the response, and is only counted in the metrics.
+	close(hook.release)
+	expected := `uniqush_push_results_total{code="UNIQUSH_SUCCESS",service="myservice"} 2` + "\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(string(metrics.format()), expected) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if output := string(metrics.format()); !strings.Contains(output, expected) {
+		t.Errorf("Expected %q in the metrics, got %q", expected, output)
+	}
+	testutil.ExpectEquals(t, 2, len(mockService.getPushed()), "expected the slow push to continue in the background")
+	testutil.ExpectEquals(t, 1, handler.response.SuccessCount, "expected results after the timeout to be left out of the response")
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type unregisteredCount struct {
+	count int
+	first time.Time
+}
+
+// unregisteredDeliveryPoints counts the consecutive errors saying that a delivery point is no longer registered, so that a single spurious error doesn't unsubscribe a device.
+type unregisteredDeliveryPoints struct {
+	lock      sync.Mutex
+	threshold int
+	window    time.Duration
+	counts    map[string]*unregisteredCount
+	lastPrune time.Time
+}
+
+func newUnregisteredDeliveryPoints(threshold int, window time.Duration) *unregisteredDeliveryPoints {
+	return &unregisteredDeliveryPoints{
+		threshold: threshold,
+		window:    window,
+		counts:    make(map[string]*unregisteredCount),
+		lastPrune: time.Now(),
+	}
+}
+
+// add counts an unregistered error for dpName. It returns true (and forgets dpName) once there were threshold errors within the window, and the number of errors so far.
+func (u *unregisteredDeliveryPoints) add(dpName string) (unsubscribe bool, count int) {
+	now := time.Now()
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if now.Sub(u.lastPrune) >= u.window {
+		for name, c := range u.counts {
+			if now.Sub(c.first) >= u.window {
+				delete(u.counts, name)
+			}
+		}
+		u.lastPrune = now
+	}
+	c, ok := u.counts[dpName]
+	if !ok || now.Sub(c.first) >= u.window {
+		c = &unregisteredCount{first: now}
+		u.counts[dpName] = c
+	}
+	c.count++
+	if c.count < u.threshold {
+		return false, c.count
+	}
+	delete(u.counts, dpName)
+	return true, c.count
+}
+
+// reset forgets the unregistered errors of dpName, after a successful push to it.
+func (u *unregisteredDeliveryPoints) reset(dpName string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.counts, dpName)
+}
+
+// confirmUnregistered returns true if the delivery point dpName should be unsubscribed after an error saying that it is no longer registered.
+// If unsubscribe_threshold is more than 1, this is only true once that many errors were reported without a successful push in between.
+func (backend *PushBackEnd) confirmUnregistered(dpName string) (unsubscribe bool, count int) {
+	if backend.unregistered == nil {
+		return true, 1
+	}
+	return backend.unregistered.add(dpName)
+}
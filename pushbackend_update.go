@@ -0,0 +1,51 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// isTransientError returns true for errors which are likely to go away if the operation is retried.
+// Network errors (e.g. a timeout or a refused connection to the database) are transient.
+func isTransientError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// updateWithRetry saves the data that a push service refreshed (e.g. a new registration id) by calling update, and passes the final result to done.
+// If retry_failed_updates is enabled and update fails with a transient error, update is retried in the background with the same backoff as pushes, calling retrying before each retry.
+func (backend *PushBackEnd) updateWithRetry(update func() error, done func(error), retrying func(err error, after time.Duration)) {
+	err := update()
+	if err == nil || !backend.config.RetryFailedUpdates || !isTransientError(err) {
+		done(err)
+		return
+	}
+	go func() {
+		after := backend.config.retryBackoff(0)
+		for err != nil && isTransientError(err) && after <= backend.config.MaxBackoff {
+			retrying(err, after)
+			time.Sleep(after)
+			err = update()
+			after = backend.config.retryBackoff(2 * after)
+		}
+		done(err)
+	}()
+}
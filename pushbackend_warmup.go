@@ -0,0 +1,112 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uniqush/log"
+	"github.com/uniqush/uniqush-push/db"
+)
+
+type warmupKey struct {
+	service string
+	sub     string
+}
+
+type warmupEntry struct {
+	pairs   []db.PushServiceProviderDeliveryPointPair
+	expires time.Time
+}
+
+// warmedDeliveryPoints caches the delivery points of subscribers which were resolved ahead of time by Warmup, so that pushes to them don't wait for the database.
+type warmedDeliveryPoints struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	entries   map[warmupKey]warmupEntry
+	lastPrune time.Time
+}
+
+func newWarmedDeliveryPoints(ttl time.Duration) *warmedDeliveryPoints {
+	return &warmedDeliveryPoints{
+		ttl:       ttl,
+		entries:   make(map[warmupKey]warmupEntry),
+		lastPrune: time.Now(),
+	}
+}
+
+func (w *warmedDeliveryPoints) put(service string, sub string, pairs []db.PushServiceProviderDeliveryPointPair) {
+	now := time.Now()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.entries[warmupKey{service, sub}] = warmupEntry{pairs: pairs, expires: now.Add(w.ttl)}
+	if now.Sub(w.lastPrune) < w.ttl {
+		return
+	}
+	for key, entry := range w.entries {
+		if !now.Before(entry.expires) {
+			delete(w.entries, key)
+		}
+	}
+	w.lastPrune = now
+}
+
+// get returns a copy of the cached delivery points of sub, which the caller may reorder.
+func (w *warmedDeliveryPoints) get(service string, sub string) ([]db.PushServiceProviderDeliveryPointPair, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	entry, ok := w.entries[warmupKey{service, sub}]
+	if !ok || !time.Now().Before(entry.expires) {
+		return nil, false
+	}
+	return append([]db.PushServiceProviderDeliveryPointPair(nil), entry.pairs...), true
+}
+
+// invalidateSubscriber removes the cached delivery points of sub, after its subscriptions change.
+func (w *warmedDeliveryPoints) invalidateSubscriber(service string, sub string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.entries, warmupKey{service, sub})
+}
+
+// invalidateService removes the cached delivery points of every subscriber of service, after its push service providers change.
+func (w *warmedDeliveryPoints) invalidateService(service string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for key := range w.entries {
+		if key.service == service {
+			delete(w.entries, key)
+		}
+	}
+}
+
+// Warmup looks up the delivery points of subs ahead of time (e.g. before a scheduled campaign), so that pushes to them in the next warmup_ttl don't wait for the database.
+// The cache is only used for pushes to all of a subscriber's delivery points, and is invalidated when the subscriber's delivery points or the service's push service providers change.
+func (backend *PushBackEnd) Warmup(service string, subs []string, logger log.Logger) error {
+	for _, sub := range subs {
+		pspDpList, err := backend.resolver.GetPushServiceProviderDeliveryPointPairs(service, sub, nil)
+		if err != nil {
+			logger.Errorf("Service=%v Subscriber=%v Warmup Failed: Database Error %v", service, sub, err)
+			return err
+		}
+		backend.warmed.put(service, sub, pspDpList)
+	}
+	logger.Infof("Service=%v NrSubscribers=%v Warmup Success", service, len(subs))
+	return nil
+}
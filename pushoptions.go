@@ -0,0 +1,102 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// These are the optional parameters of /push which change how uniqush-push sends that push.
+// Keys beginning with "uniqush." are reserved, and every push service type leaves them out of the payload sent to the external push service.
+const (
+	// OptionFallback ("1" to enable) makes uniqush push to each subscriber's delivery points one at a time, stopping at the first one that doesn't fail permanently.
+	OptionFallback = "uniqush.fallback"
+	// OptionMaxRetries (a positive integer) overrides the max_retries setting for this push, e.g. to retry critical notifications for longer.
+	OptionMaxRetries = "uniqush.max_retries"
+	// OptionWaitForRetries ("1" to enable) makes /push wait for the retries of this push to succeed or fail, and respond with their results.
+	// By default, /push responds without the results of retries. The wait is still limited by response_timeout.
+	OptionWaitForRetries = "uniqush.wait_for_retries"
+	// OptionClass (e.g. "marketing") selects the policy of a [class:<name>] section of uniqush.conf for this push, e.g. a lower rate limit or fewer retries.
+	OptionClass = "uniqush.class"
+	// OptionAllowDuplicates ("1" to enable) pushes to a delivery point as many times as the database returns it for a subscriber, ignoring the duplicate_delivery_points setting.
+	// This is for sends which are meant to be redundant (e.g. A/B tests of delivery paths).
+	OptionAllowDuplicates = "uniqush.allow_duplicate_delivery_points"
+	// OptionBroadcast ("1" to enable) makes /push send the push to every subscriber of the service, instead of the subscribers it was given.
+	OptionBroadcast = "uniqush.broadcast"
+	// OptionTimeout (a duration, e.g. "500ms") overrides response_timeout for this push, and prevents scheduling retries later than this after the push was requested.
+	// This lets latency-sensitive callers get a response quickly, while bulk pushes can wait longer.
+	OptionTimeout = "uniqush.timeout"
+	// OptionRequestTime (a unix timestamp) is when the caller created this push, e.g. before queueing it. Pushes older than max_request_age are rejected.
+	OptionRequestTime = "uniqush.request_time"
+	// OptionRetrySubscriber ("1" to enable) retries each subscriber as a whole: if any of its delivery points fail, they are retried together with a single backoff, instead of each being retried on its own.
+	// Delivery points which already succeeded aren't pushed to again. This is ignored if OptionFallback is set.
+	OptionRetrySubscriber = "uniqush.retry_subscriber"
+	// OptionMinSuccessfulDevices (a positive integer) reports a subscriber as UNIQUSH_ERROR_TOO_FEW_DEVICES unless at least this many of its delivery points succeed, e.g. for notifications which must reach more than one device.
+	// Delivery points which are still waiting to be retried when the push returns count towards this. Combine this with OptionWaitForRetries to only count the retries which succeeded,
+	// and with OptionRetrySubscriber to retry the delivery points which failed.
+	OptionMinSuccessfulDevices = "uniqush.min_successful_devices"
+	// OptionQueuePriority ("high", "normal", or "low") is the priority of this push when waiting for one of max_concurrent_pushes calls to /push to finish, e.g. so that urgent pushes aren't stuck behind bulk ones.
+	// The default is normal. See priority_starvation_limit.
+	OptionQueuePriority = "uniqush.queue_priority"
+	// OptionBatchTimeLimit (a duration, e.g. "60s") overrides batch_time_limit for this push. Subscribers which weren't attempted within this time after the push started are reported as UNIQUSH_ERROR_BATCH_TIME_LIMIT.
+	OptionBatchTimeLimit = "uniqush.batch_time_limit"
+	// OptionRetrySchedule ("1" to enable) lists the planned retries of a push which is waiting to be retried in the retrySchedule of the response, e.g. to show when the next attempt will be.
+	// The schedule is computed from the backoff settings, assuming each retry fails.
+	OptionRetrySchedule = "uniqush.retry_schedule"
+	// OptionSamplePercent (a percentage from 0 to 100, e.g. "12.5") only pushes to that percentage of the subscribers, chosen by a hash of their names, and reports the others as UNIQUSH_NOT_SAMPLED.
+	// The same subscribers are chosen by every push with the same percentage and OptionSampleSeed, e.g. for a gradual rollout.
+	// A push with any other value (e.g. "5%") is rejected as UNIQUSH_ERROR_BAD_SAMPLE_PERCENT, rather than sent to every subscriber.
+	OptionSamplePercent = "uniqush.sample_percent"
+	// OptionSampleSeed (any string) chooses a different sample of subscribers for OptionSamplePercent, e.g. so that separate rollouts don't reach the same subscribers first.
+	OptionSampleSeed = "uniqush.sample_seed"
+)
+
+// OptionFilterPrefix is the prefix of the optional parameters of /push which restrict the push to the delivery points with matching attributes.
+// For example, uniqush.filter.locale=en*,fr and uniqush.filter.app_version=2.1.0 only push to the delivery points subscribed with those values, and report the others as UNIQUSH_FILTERED.
+const OptionFilterPrefix = "uniqush.filter."
+
+// getBoolOption returns true if the option key of the notification is set to "1" or "true".
+func getBoolOption(notif *push.Notification, key string) bool {
+	switch notif.Data[key] {
+	case "1", "true":
+		return true
+	default:
+		return false
+	}
+}
+
+// getIntOption returns the value of the option key of the notification, if it is set to a positive integer.
+func getIntOption(notif *push.Notification, key string) (int, bool) {
+	value, err := strconv.Atoi(notif.Data[key])
+	if err != nil || value <= 0 {
+		return 0, false
+	}
+	return value, true
+}
+
+// getDurationOption returns the value of the option key of the notification, if it is set to a positive duration (e.g. "10s").
+func getDurationOption(notif *push.Notification, key string) (time.Duration, bool) {
+	value, err := time.ParseDuration(notif.Data[key])
+	if err != nil || value <= 0 {
+		return 0, false
+	}
+	return value, true
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket. It allows up to burst events at once, refilling at rate events per second.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill must be called with the lock held.
+func (r *rateLimiter) refill(now time.Time) {
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+}
+
+// tryTake takes a token if one is available, and returns false otherwise.
+func (r *rateLimiter) tryTake() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.refill(time.Now())
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// reserve takes a token, and returns how long the caller must wait before using it.
+func (r *rateLimiter) reserve() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.refill(time.Now())
+	r.tokens--
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// wait blocks until a token is available, then takes it.
+func (r *rateLimiter) wait() {
+	if d := r.reserve(); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// keyedRateLimiter is a separate token bucket for each key (e.g. each delivery point).
+type keyedRateLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	burst     int
+	limiters  map[string]*rateLimiter
+	lastPrune time.Time
+}
+
+func newKeyedRateLimiter(rate float64, burst int) *keyedRateLimiter {
+	return &keyedRateLimiter{
+		rate:      rate,
+		burst:     burst,
+		limiters:  make(map[string]*rateLimiter),
+		lastPrune: time.Now(),
+	}
+}
+
+// tryTake takes a token from the bucket for key if one is available, and returns false otherwise.
+func (k *keyedRateLimiter) tryTake(key string) bool {
+	k.lock.Lock()
+	now := time.Now()
+	if now.Sub(k.lastPrune) >= time.Minute {
+		k.prune(now)
+	}
+	limiter, ok := k.limiters[key]
+	if !ok {
+		limiter = newRateLimiter(k.rate, k.burst)
+		k.limiters[key] = limiter
+	}
+	k.lock.Unlock()
+	return limiter.tryTake()
+}
+
+// prune removes the buckets which have been idle long enough to be full again, since they are equivalent to new buckets.
+// This must be called with the lock held.
+func (k *keyedRateLimiter) prune(now time.Time) {
+	for key, limiter := range k.limiters {
+		limiter.lock.Lock()
+		limiter.refill(now)
+		full := limiter.tokens >= limiter.burst
+		limiter.lock.Unlock()
+		if full {
+			delete(k.limiters, key)
+		}
+	}
+	k.lastPrune = now
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+func TestRateLimiterTryTake(t *testing.T) {
+	r := newRateLimiter(1, 2)
+	testutil.ExpectEquals(t, true, r.tryTake(), "expected first token to be available")
+	testutil.ExpectEquals(t, true, r.tryTake(), "expected burst to allow a second token")
+	testutil.ExpectEquals(t, false, r.tryTake(), "expected bucket to be empty")
+
+	r.last = r.last.Add(-1 * time.Second)
+	testutil.ExpectEquals(t, true, r.tryTake(), "expected a token to be refilled after a second")
+	testutil.ExpectEquals(t, false, r.tryTake(), "expected bucket to be empty again")
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	r := newRateLimiter(10, 1)
+	testutil.ExpectEquals(t, time.Duration(0), r.reserve(), "expected no wait for the first token")
+	wait := r.reserve()
+	if wait <= 50*time.Millisecond || wait > 100*time.Millisecond {
+		t.Errorf("Expected a wait of about 100ms for the second token, got %v", wait)
+	}
+}
+
+func TestKeyedRateLimiter(t *testing.T) {
+	k := newKeyedRateLimiter(1, 1)
+	testutil.ExpectEquals(t, true, k.tryTake("a"), "expected first token for a to be available")
+	testutil.ExpectEquals(t, false, k.tryTake("a"), "expected bucket for a to be empty")
+	testutil.ExpectEquals(t, true, k.tryTake("b"), "expected keys to have separate buckets")
+
+	k.limiters["b"].last = k.limiters["b"].last.Add(-1 * time.Second)
+	k.prune(time.Now())
+	_, hasA := k.limiters["a"]
+	_, hasB := k.limiters["b"]
+	testutil.ExpectEquals(t, true, hasA, "expected bucket which isn't full to be kept")
+	testutil.ExpectEquals(t, false, hasB, "expected full bucket to be pruned")
+}
@@ -34,6 +34,7 @@ import (
 
 	"github.com/uniqush/log"
 	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/srv"
 )
 
 // RestAPI implements uniqush's REST API (/push, /subscribe, /addpsp, etc).
@@ -52,6 +53,21 @@ func randomUniqID() string {
 	return fmt.Sprintf("%x-%v", time.Now().Unix(), base64.URLEncoding.EncodeToString(d[:]))
 }
 
+// RequestIDHeader is the HTTP header which callers of /push can use to choose the request ID of the push, e.g. to correlate uniqush's logs with their own.
+// The request ID (chosen or generated) is sent back in the same header and in the requestId of the response.
+const RequestIDHeader = "X-Request-Id"
+
+var validRequestIDPattern = regexp.MustCompile(`^[a-zA-Z.0-9_@=:-]{1,128}$`)
+
+// requestIDOf returns the request ID chosen by the caller of r, or a random one if it is missing or invalid.
+// Request IDs are logged as RequestID=<id>, so they can't contain spaces.
+func requestIDOf(r *http.Request) string {
+	if reqID := r.Header.Get(RequestIDHeader); validRequestIDPattern.MatchString(reqID) {
+		return reqID
+	}
+	return randomUniqID()
+}
+
 // NewRestAPI constructs the data structures for the singleton REST API of uniqush-push
 func NewRestAPI(psm *push.PushServiceManager, loggers []log.Logger, version string, backend *PushBackEnd) *RestAPI {
 	ret := new(RestAPI)
@@ -77,6 +93,15 @@ const (
 	QuerySubscriptionsURL                   = "/subscriptions"
 	QueryPushServiceProviders               = "/psps"
 	RebuildServiceSetURL                    = "/rebuildserviceset"
+	PauseServiceURL                         = "/pause"
+	ResumeServiceURL                        = "/resume"
+	QueryPushTargetsURL                     = "/pushtargets"
+	WarmupURL                               = "/warmup"
+	CancelPushesURL                         = "/cancel"
+	QueryInFlightPushesURL                  = "/inflight"
+	QueryLoopbackPushesURL                  = "/loopbackpushes"
+	// MetricsURL serves the measurements of pushes, if the metrics backend is prometheus.
+	MetricsURL = "/metrics"
 )
 
 // TODO: Switch to the stricter regex in a subsequent release.
@@ -131,6 +156,23 @@ func getSubscribersFromMap(kv map[string]string, validate bool) (subs []string,
 	return
 }
 
+// getGroupsFromMap returns the optional groups (a comma separated list of groups to push to, in addition to the subscribers).
+func getGroupsFromMap(kv map[string]string) []string {
+	v, ok := kv["group"]
+	if !ok {
+		if v, ok = kv["groups"]; !ok {
+			return nil
+		}
+	}
+	var groups []string
+	for _, group := range strings.Split(v, ",") {
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
 // Get the optional delivery_point_ids from a map.
 func getDeliveryPointIdsFromMap(kv map[string]string) (deliveryPointNames []string, err error) {
 	var v string
@@ -273,15 +315,26 @@ func (api *RestAPI) pushNotification(reqID string, kv map[string]string, perdp m
 		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE})
 		return
 	}
+	if broadcast := kv[OptionBroadcast]; broadcast == "1" || broadcast == "true" {
+		api.broadcastNotification(reqID, kv, perdp, logger, remoteAddr, service, handler)
+		return
+	}
+	groups := getGroupsFromMap(kv)
 	subs, err := getSubscribersFromMap(kv, false)
-	if err != nil {
+	if err != nil && len(groups) == 0 {
 		logger.Errorf("RequestID=%v From=%v Service=%v Cannot get subscriber: %v", reqID, remoteAddr, service, err)
 		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER})
 		return
 	}
+	subs, err = api.backend.ExpandGroups(service, subs, groups)
+	if err != nil {
+		logger.Errorf("RequestID=%v From=%v Service=%v Groups=\"%+v\" Cannot get group members: %v", reqID, remoteAddr, service, groups, err)
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_GROUP, ErrorMsg: strPtrOfErr(err)})
+		return
+	}
 	if len(subs) == 0 {
-		logger.Errorf("RequestID=%v From=%v Service=%v NoSubscriber", reqID, remoteAddr, service)
-		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_NO_SUBSCRIBER})
+		// e.g. subscribers= was given empty, or the groups have no members.
+		api.backend.noSubscribers(reqID, remoteAddr, service, logger, handler)
 		return
 	}
 	dpIds, err := getDeliveryPointIdsFromMap(kv)
@@ -290,11 +343,6 @@ func (api *RestAPI) pushNotification(reqID string, kv map[string]string, perdp m
 		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT_ID})
 		return
 	}
-	if len(subs) == 0 {
-		logger.Errorf("RequestID=%v From=%v Service=%v NoSubscriber", reqID, remoteAddr, service)
-		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_NO_SUBSCRIBER})
-		return
-	}
 
 	notif, details, err := api.buildNotificationFromKV(reqID, kv, logger, remoteAddr, service, subs)
 	if err != nil {
@@ -307,6 +355,81 @@ func (api *RestAPI) pushNotification(reqID string, kv map[string]string, perdp m
 	api.backend.Push(reqID, remoteAddr, service, subs, dpIds, notif, perdp, logger, handler)
 }
 
+// broadcastNotification pushes the notification in kv to every subscriber of service (see uniqush.broadcast).
+func (api *RestAPI) broadcastNotification(reqID string, kv map[string]string, perdp map[string][]string, logger log.Logger, remoteAddr string, service string, handler APIResponseHandler) {
+	notif, details, err := api.buildNotificationFromKV(reqID, kv, logger, remoteAddr, service, nil)
+	if err != nil {
+		handler.AddDetailsToHandler(*details)
+		return
+	}
+	logger.Infof("RequestID=%v From=%v Service=%v Broadcast", reqID, remoteAddr, service)
+	err = api.backend.Broadcast(reqID, remoteAddr, service, notif, perdp, logger, handler)
+	if err != nil {
+		handler.AddDetailsToHandler(APIResponseDetails{RequestID: &reqID, From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)})
+	}
+}
+
+// changePause will pause (or resume) pushes to the service given in kv.
+func (api *RestAPI) changePause(kv map[string]string, logger log.Logger, remoteAddr string, pause bool) APIResponseDetails {
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	if pause {
+		err = api.backend.Pause(service)
+	} else {
+		err = api.backend.Resume(service)
+	}
+	if err != nil {
+		logger.Errorf("From=%v Service=%v Failed: %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_GENERIC, ErrorMsg: strPtrOfErr(err)}
+	}
+	if pause {
+		logger.Infof("From=%v Service=%v Paused", remoteAddr, service)
+	} else {
+		logger.Infof("From=%v Service=%v Resumed", remoteAddr, service)
+	}
+	return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_SUCCESS}
+}
+
+// warmup looks up the delivery points of the subscribers given in kv ahead of time, for pushes sent within warmup_ttl.
+func (api *RestAPI) warmup(kv map[string]string, logger log.Logger, remoteAddr string) APIResponseDetails {
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	subs, err := getSubscribersFromMap(kv, false)
+	if err != nil || len(subs) == 0 {
+		logger.Errorf("From=%v Service=%v NoSubscriber", remoteAddr, service)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_NO_SUBSCRIBER}
+	}
+	if err := api.backend.Warmup(service, subs, logger); err != nil {
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_DATABASE, ErrorMsg: strPtrOfErr(err)}
+	}
+	return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_SUCCESS}
+}
+
+// cancelPushes drops the pending pushes to the subscribers given in kv (e.g. after they opted out).
+func (api *RestAPI) cancelPushes(kv map[string]string, logger log.Logger, remoteAddr string) APIResponseDetails {
+	service, err := getServiceFromMap(kv)
+	if err != nil {
+		logger.Errorf("From=%v Cannot get service name: %v; %v", remoteAddr, service, err)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_CANNOT_GET_SERVICE, ErrorMsg: strPtrOfErr(err)}
+	}
+	subs, err := getSubscribersFromMap(kv, false)
+	if err != nil || len(subs) == 0 {
+		logger.Errorf("From=%v Service=%v NoSubscriber", remoteAddr, service)
+		return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_ERROR_NO_SUBSCRIBER}
+	}
+	for _, sub := range subs {
+		api.backend.CancelForSubscriber(service, sub)
+		logger.Infof("From=%v Service=%v Subscriber=%v Cancelled pending pushes", remoteAddr, service, sub)
+	}
+	return APIResponseDetails{From: &remoteAddr, Service: &service, Code: UNIQUSH_SUCCESS}
+}
+
 // preview takes key-value pairs (pushservicetype, plus data for building the payload), a logger, and logging data.
 func (api *RestAPI) preview(reqID string, kv map[string]string, logger log.Logger, remoteAddr string) PreviewAPIResponseDetails {
 	pushServiceType, ok := kv["pushservicetype"]
@@ -401,6 +524,38 @@ func (api *RestAPI) querySubscriptions(kv map[string][]string, logger log.Logger
 	return json
 }
 
+// queryPushTargets returns JSON describing the delivery points that /push would send to for the same service, subscribers, and delivery point ids, without sending anything.
+func (api *RestAPI) queryPushTargets(kv map[string]string, logger log.Logger) []byte {
+	type responseType struct {
+		Targets      map[string][]PushTarget `json:"targets"`
+		ErrorMessage *string                 `json:"errorMsg,omitempty"`
+		Code         string                  `json:"code"`
+	}
+	r := responseType{Targets: map[string][]PushTarget{}, Code: UNIQUSH_SUCCESS}
+	service, err := getServiceFromMap(kv)
+	var subs, dpIds []string
+	if err != nil {
+		r.Code = UNIQUSH_ERROR_CANNOT_GET_SERVICE
+	} else if subs, err = getSubscribersFromMap(kv, false); err != nil || len(subs) == 0 {
+		r.Code = UNIQUSH_ERROR_NO_SUBSCRIBER
+	} else if dpIds, err = getDeliveryPointIdsFromMap(kv); err != nil {
+		r.Code = UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT_ID
+	} else if targets, dbErr := api.backend.PushTargets(service, subs, dpIds, logger); dbErr != nil {
+		r.Code = UNIQUSH_ERROR_DATABASE
+		err = dbErr
+	} else {
+		r.Targets = targets
+	}
+	if err != nil {
+		r.ErrorMessage = strPtrOfErr(err)
+	}
+	json, err := json.Marshal(r)
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
 func encodePSPForAPI(psp *push.PushServiceProvider) map[string]string {
 	result := make(map[string]string)
 	for key, value := range psp.VolatileData {
@@ -442,6 +597,41 @@ func (api *RestAPI) queryPSPs(logger log.Logger) []byte {
 	return json
 }
 
+// queryInFlightPushes returns JSON describing the pushes which are being sent. This API is intended for debugging pushes which are stuck.
+func (api *RestAPI) queryInFlightPushes() []byte {
+	type responseType struct {
+		Pushes []InFlightPush `json:"pushes"`
+		Code   string         `json:"code"`
+	}
+	json, err := json.Marshal(responseType{Pushes: api.backend.InFlightPushes(), Code: UNIQUSH_SUCCESS})
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
+// queryLoopbackPushes returns JSON describing the pushes recorded by the loopback push service type, for end-to-end tests. If clear is true, they are forgotten afterwards.
+func (api *RestAPI) queryLoopbackPushes(clear bool) []byte {
+	type responseType struct {
+		Pushes []srv.LoopbackPush `json:"pushes"`
+		Code   string             `json:"code"`
+	}
+	var pushes []srv.LoopbackPush
+	if clear {
+		pushes = srv.ClearLoopbackPushes()
+	} else {
+		pushes = srv.LoopbackPushes()
+	}
+	if pushes == nil {
+		pushes = []srv.LoopbackPush{}
+	}
+	json, err := json.Marshal(responseType{Pushes: pushes, Code: UNIQUSH_SUCCESS})
+	if err != nil {
+		return []byte("Failed to serialize response")
+	}
+	return json
+}
+
 // rebuildServiceSet is used to make sure that the /subscriptions and /psps APIs work properly, on uniqush setups created before those APIs existed.
 func (api *RestAPI) rebuildServiceSet(logger log.Logger) []byte {
 	err := api.backend.RebuildServiceSet()
@@ -500,6 +690,21 @@ func (api *RestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		n := api.rebuildServiceSet(api.loggers[LoggerServices])
 		fmt.Fprintf(w, "%s\r\n", n)
 		return
+	case QueryInFlightPushesURL:
+		n := api.queryInFlightPushes()
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryLoopbackPushesURL:
+		r.ParseForm()
+		n := api.queryLoopbackPushes(r.Form.Get("clear") == "1")
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
+	case QueryPushTargetsURL:
+		r.ParseForm()
+		kv, _ := parseKV(r.Form)
+		n := api.queryPushTargets(kv, api.loggers[LoggerWeb])
+		fmt.Fprintf(w, "%s\r\n", n)
+		return
 	case QueryNumberOfDeliveryPointsURL:
 		r.ParseForm()
 		n := api.numberOfDeliveryPoints(r.Form, api.loggers[LoggerWeb])
@@ -549,10 +754,29 @@ func (api *RestAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		handler = newSimpleResponseHandler(api.loggers[LoggerUnsub], "Unsubscribe")
 		details = api.changeSubscription(kv, api.loggers[LoggerUnsub], remoteAddr, false)
 		handler.AddDetailsToHandler(details)
+	case PauseServiceURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerPush], "Pause")
+		details = api.changePause(kv, api.loggers[LoggerPush], remoteAddr, true)
+		handler.AddDetailsToHandler(details)
+	case ResumeServiceURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerPush], "Resume")
+		details = api.changePause(kv, api.loggers[LoggerPush], remoteAddr, false)
+		handler.AddDetailsToHandler(details)
+	case WarmupURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerPush], "Warmup")
+		details = api.warmup(kv, api.loggers[LoggerPush], remoteAddr)
+		handler.AddDetailsToHandler(details)
+	case CancelPushesURL:
+		handler = newSimpleResponseHandler(api.loggers[LoggerPush], "Cancel")
+		details = api.cancelPushes(kv, api.loggers[LoggerPush], remoteAddr)
+		handler.AddDetailsToHandler(details)
 	case PushNotificationURL:
-		handler = newPushResponseHandler(api.loggers[LoggerPush])
-		rid := randomUniqID()
-		api.pushNotification(rid, kv, perdp, api.loggers[LoggerPush], remoteAddr, handler)
+		pushHandler := newPushResponseHandler(api.loggers[LoggerPush])
+		rid := requestIDOf(r)
+		pushHandler.response.RequestID = rid
+		w.Header().Set(RequestIDHeader, rid)
+		api.pushNotification(rid, kv, perdp, api.loggers[LoggerPush], remoteAddr, pushHandler)
+		handler = pushHandler
 	}
 	if handler != nil {
 		// Be consistent about ending responses in \r\n
@@ -580,6 +804,19 @@ func (api *RestAPI) Run(addr string, stopChan chan<- bool) {
 	http.Handle(QuerySubscriptionsURL, api)
 	http.Handle(QueryPushServiceProviders, api)
 	http.Handle(RebuildServiceSetURL, api)
+	http.Handle(PauseServiceURL, api)
+	http.Handle(ResumeServiceURL, api)
+	http.Handle(QueryPushTargetsURL, api)
+	http.Handle(WarmupURL, api)
+	http.Handle(CancelPushesURL, api)
+	http.Handle(QueryInFlightPushesURL, api)
+	if len(api.backend.config.LoopbackServices) > 0 || srv.LoopbackEndpointEnabled() {
+		// The recorded pushes are only for end-to-end tests, so they aren't exposed unless the loopback push service type is configured.
+		http.Handle(QueryLoopbackPushesURL, api)
+	}
+	if metrics, ok := api.backend.metrics.(http.Handler); ok {
+		http.Handle(MetricsURL, metrics)
+	}
 
 	api.stopChan = stopChan
 	err := http.ListenAndServe(addr, nil)
@@ -21,12 +21,18 @@ var _ APIResponseHandler = &APIPushResponseHandler{}
 type APIPushResponse struct {
 	Type           string               `json:"type"`
 	Date           int64                `json:"date"`
+	RequestID      string               `json:"requestId,omitempty"`
 	SuccessCount   int                  `json:"successCount"`
 	FailureCount   int                  `json:"failureCount"`
 	DroppedCount   int                  `json:"droppedCount"`
+	QueuedCount    int                  `json:"queuedCount"`
 	SuccessDetails []APIResponseDetails `json:"successDetails"`
 	FailureDetails []APIResponseDetails `json:"failureDetails"`
 	DroppedDetails []APIResponseDetails `json:"droppedDetails"`
+	QueuedDetails  []APIResponseDetails `json:"queuedDetails"`
+	// RetryingCount and RetryingDetails are the delivery points whose pushes were still waiting to be retried when the response was sent, with the time of the next attempt.
+	RetryingCount   int                  `json:"retryingCount"`
+	RetryingDetails []APIResponseDetails `json:"retryingDetails"`
 }
 
 func newPushResponseHandler(logger log.Logger) *APIPushResponseHandler {
@@ -43,18 +49,38 @@ func newAPIPushResponse() APIPushResponse {
 		SuccessDetails: make([]APIResponseDetails, 0),
 		FailureDetails: make([]APIResponseDetails, 0),
 		DroppedDetails: make([]APIResponseDetails, 0),
+		QueuedDetails:  make([]APIResponseDetails, 0),
+
+		RetryingDetails: make([]APIResponseDetails, 0),
 	}
 }
 
+// isDroppedCode returns true if a delivery point or subscriber with this code wasn't pushed to, but that isn't a failure (e.g. the device was unsubscribed).
+func isDroppedCode(code string) bool {
+	return code == UNIQUSH_UPDATE_UNSUBSCRIBE || code == UNIQUSH_REMOVE_INVALID_REG || code == UNIQUSH_PUSH_CANCELLED || code == UNIQUSH_RETRY_DROPPED || code == UNIQUSH_NOT_MY_SHARD || code == UNIQUSH_FILTERED || code == UNIQUSH_DUPLICATE_SUPPRESSED || code == UNIQUSH_TEMPORARILY_SKIPPED || code == UNIQUSH_NOT_SAMPLED
+}
+
+// isFailureCode returns true if the code is reported in the failureDetails of /push.
+func isFailureCode(code string) bool {
+	return code != UNIQUSH_SUCCESS && code != UNIQUSH_PUSH_QUEUED && code != UNIQUSH_PUSH_RETRYING && !isDroppedCode(code)
+}
+
 // AddDetailsToHandler will record information about one response (of one or more responses) to an individual push attempt to a psp.
 func (handler *APIPushResponseHandler) AddDetailsToHandler(v APIResponseDetails) {
+	v.HTTPStatus = HTTPStatusOf(v.Code)
 	handler.mutex.Lock()
 	if v.Code == UNIQUSH_SUCCESS {
 		handler.response.SuccessDetails = append(handler.response.SuccessDetails, v)
 		handler.response.SuccessCount++
-	} else if v.Code == UNIQUSH_UPDATE_UNSUBSCRIBE || v.Code == UNIQUSH_REMOVE_INVALID_REG {
+	} else if isDroppedCode(v.Code) {
 		handler.response.DroppedDetails = append(handler.response.DroppedDetails, v)
 		handler.response.DroppedCount++
+	} else if v.Code == UNIQUSH_PUSH_QUEUED {
+		handler.response.QueuedDetails = append(handler.response.QueuedDetails, v)
+		handler.response.QueuedCount++
+	} else if v.Code == UNIQUSH_PUSH_RETRYING {
+		handler.response.RetryingDetails = append(handler.response.RetryingDetails, v)
+		handler.response.RetryingCount++
 	} else {
 		handler.response.FailureDetails = append(handler.response.FailureDetails, v)
 		handler.response.FailureCount++
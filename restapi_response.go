@@ -1,20 +1,55 @@
 package main
 
+import (
+	"net/http"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
 // These are constants with codes for a uniqush response type.
 // nolint: golint
 const (
 	/* Not errors */
 
-	UNIQUSH_SUCCESS            = "UNIQUSH_SUCCESS"
-	UNIQUSH_REMOVE_INVALID_REG = "UNIQUSH_REMOVE_INVALID_REG"
-	UNIQUSH_UPDATE_UNSUBSCRIBE = "UNIQUSH_UPDATE_UNSUBSCRIBE"
+	UNIQUSH_SUCCESS              = "UNIQUSH_SUCCESS"
+	UNIQUSH_REMOVE_INVALID_REG   = "UNIQUSH_REMOVE_INVALID_REG"
+	UNIQUSH_UPDATE_UNSUBSCRIBE   = "UNIQUSH_UPDATE_UNSUBSCRIBE"
+	UNIQUSH_PUSH_QUEUED          = "UNIQUSH_PUSH_QUEUED"
+	UNIQUSH_PUSH_CANCELLED       = "UNIQUSH_PUSH_CANCELLED"
+	UNIQUSH_PUSH_RETRYING        = "UNIQUSH_PUSH_RETRYING"
+	UNIQUSH_RETRY_DROPPED        = "UNIQUSH_RETRY_DROPPED"
+	UNIQUSH_NOT_MY_SHARD         = "UNIQUSH_NOT_MY_SHARD"
+	UNIQUSH_FILTERED             = "UNIQUSH_FILTERED"
+	UNIQUSH_DUPLICATE_SUPPRESSED = "UNIQUSH_DUPLICATE_SUPPRESSED"
+	UNIQUSH_TEMPORARILY_SKIPPED  = "UNIQUSH_TEMPORARILY_SKIPPED"
+	UNIQUSH_NOT_SAMPLED          = "UNIQUSH_NOT_SAMPLED"
 
 	/* Errors */
 
-	UNIQUSH_ERROR_GENERIC            = "UNIQUSH_ERROR_GENERIC"
-	UNIQUSH_ERROR_EMPTY_NOTIFICATION = "UNIQUSH_ERROR_EMPTY_NOTIFICATION"
-	UNIQUSH_ERROR_DATABASE           = "UNIQUSH_ERROR_DATABASE"
-	UNIQUSH_ERROR_FAILED_RETRY       = "UNIQUSH_ERROR_FAILED_RETRY"
+	UNIQUSH_ERROR_GENERIC              = "UNIQUSH_ERROR_GENERIC"
+	UNIQUSH_ERROR_EMPTY_NOTIFICATION   = "UNIQUSH_ERROR_EMPTY_NOTIFICATION"
+	UNIQUSH_ERROR_DATABASE             = "UNIQUSH_ERROR_DATABASE"
+	UNIQUSH_ERROR_FAILED_RETRY         = "UNIQUSH_ERROR_FAILED_RETRY"
+	UNIQUSH_ERROR_SERVICE_PAUSED       = "UNIQUSH_ERROR_SERVICE_PAUSED"
+	UNIQUSH_ERROR_RATE_LIMITED         = "UNIQUSH_ERROR_RATE_LIMITED"
+	UNIQUSH_ERROR_TOO_MANY_PUSHES      = "UNIQUSH_ERROR_TOO_MANY_PUSHES"
+	UNIQUSH_ERROR_UNREGISTERED         = "UNIQUSH_ERROR_UNREGISTERED"
+	UNIQUSH_ERROR_RETRY_QUEUE_FULL     = "UNIQUSH_ERROR_RETRY_QUEUE_FULL"
+	UNIQUSH_ERROR_DATA_REFRESHED       = "UNIQUSH_ERROR_DATA_REFRESHED"
+	UNIQUSH_ERROR_BATCH_ABORTED        = "UNIQUSH_ERROR_BATCH_ABORTED"
+	UNIQUSH_ERROR_EXPIRED              = "UNIQUSH_ERROR_EXPIRED"
+	UNIQUSH_ERROR_DEVICE_RATE_LIMITED  = "UNIQUSH_ERROR_DEVICE_RATE_LIMITED"
+	UNIQUSH_ERROR_TIMEOUT              = "UNIQUSH_ERROR_TIMEOUT"
+	UNIQUSH_ERROR_REJECTED_BY_HOOK     = "UNIQUSH_ERROR_REJECTED_BY_HOOK"
+	UNIQUSH_ERROR_HOOK_TIMEOUT         = "UNIQUSH_ERROR_HOOK_TIMEOUT"
+	UNIQUSH_ERROR_REQUEST_TOO_OLD      = "UNIQUSH_ERROR_REQUEST_TOO_OLD"
+	UNIQUSH_ERROR_TOO_FEW_DEVICES      = "UNIQUSH_ERROR_TOO_FEW_DEVICES"
+	UNIQUSH_ERROR_ENCRYPTION_FAILED    = "UNIQUSH_ERROR_ENCRYPTION_FAILED"
+	UNIQUSH_ERROR_SIGNING_FAILED       = "UNIQUSH_ERROR_SIGNING_FAILED"
+	UNIQUSH_ERROR_FIELD_LIMIT_EXCEEDED = "UNIQUSH_ERROR_FIELD_LIMIT_EXCEEDED"
+	UNIQUSH_ERROR_BATCH_TIME_LIMIT     = "UNIQUSH_ERROR_BATCH_TIME_LIMIT"
+	UNIQUSH_ERROR_MEMORY_PRESSURE      = "UNIQUSH_ERROR_MEMORY_PRESSURE"
+	UNIQUSH_ERROR_BAD_SAMPLE_PERCENT   = "UNIQUSH_ERROR_BAD_SAMPLE_PERCENT"
 
 	UNIQUSH_ERROR_BUILD_PUSH_SERVICE_PROVIDER  = "UNIQUSH_ERROR_BUILD_PUSH_SERVICE_PROVIDER"
 	UNIQUSH_ERROR_UPDATE_PUSH_SERVICE_PROVIDER = "UNIQUSH_ERROR_UPDATE_PUSH_SERVICE_PROVIDER"
@@ -31,9 +66,77 @@ const (
 	UNIQUSH_ERROR_NO_DELIVERY_POINT        = "UNIQUSH_ERROR_NO_DELIVERY_POINT"
 	UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER = "UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER"
 	UNIQUSH_ERROR_NO_SUBSCRIBER            = "UNIQUSH_ERROR_NO_SUBSCRIBER"
+	UNIQUSH_ERROR_CANNOT_GET_GROUP         = "UNIQUSH_ERROR_CANNOT_GET_GROUP"
 	UNIQUSH_ERROR_NO_PUSH_SERVICE_TYPE     = "UNIQUSH_ERROR_NO_PUSH_SERVICE_TYPE"
 )
 
+// httpStatuses maps the codes of responses to the equivalent HTTP status, so that the callers of uniqush-push can respond with it without a translation table of their own.
+var httpStatuses = map[string]int{
+	UNIQUSH_SUCCESS:              http.StatusOK,
+	UNIQUSH_REMOVE_INVALID_REG:   http.StatusGone,
+	UNIQUSH_UPDATE_UNSUBSCRIBE:   http.StatusGone,
+	UNIQUSH_PUSH_QUEUED:          http.StatusAccepted,
+	UNIQUSH_PUSH_CANCELLED:       http.StatusConflict,
+	UNIQUSH_PUSH_RETRYING:        http.StatusTooManyRequests,
+	UNIQUSH_RETRY_DROPPED:        http.StatusServiceUnavailable,
+	UNIQUSH_NOT_MY_SHARD:         http.StatusMisdirectedRequest,
+	UNIQUSH_FILTERED:             http.StatusNoContent,
+	UNIQUSH_DUPLICATE_SUPPRESSED: http.StatusConflict,
+	UNIQUSH_TEMPORARILY_SKIPPED:  http.StatusServiceUnavailable,
+	UNIQUSH_NOT_SAMPLED:          http.StatusNoContent,
+
+	UNIQUSH_ERROR_GENERIC:              http.StatusInternalServerError,
+	UNIQUSH_ERROR_EMPTY_NOTIFICATION:   http.StatusBadRequest,
+	UNIQUSH_ERROR_DATABASE:             http.StatusServiceUnavailable,
+	UNIQUSH_ERROR_FAILED_RETRY:         http.StatusServiceUnavailable,
+	UNIQUSH_ERROR_SERVICE_PAUSED:       http.StatusServiceUnavailable,
+	UNIQUSH_ERROR_RATE_LIMITED:         http.StatusTooManyRequests,
+	UNIQUSH_ERROR_TOO_MANY_PUSHES:      http.StatusTooManyRequests,
+	UNIQUSH_ERROR_UNREGISTERED:         http.StatusGone,
+	UNIQUSH_ERROR_RETRY_QUEUE_FULL:     http.StatusServiceUnavailable,
+	UNIQUSH_ERROR_DATA_REFRESHED:       http.StatusConflict,
+	UNIQUSH_ERROR_BATCH_ABORTED:        http.StatusServiceUnavailable,
+	UNIQUSH_ERROR_EXPIRED:              http.StatusGatewayTimeout,
+	UNIQUSH_ERROR_DEVICE_RATE_LIMITED:  http.StatusTooManyRequests,
+	UNIQUSH_ERROR_TIMEOUT:              http.StatusGatewayTimeout,
+	UNIQUSH_ERROR_REJECTED_BY_HOOK:     http.StatusForbidden,
+	UNIQUSH_ERROR_HOOK_TIMEOUT:         http.StatusGatewayTimeout,
+	UNIQUSH_ERROR_REQUEST_TOO_OLD:      http.StatusBadRequest,
+	UNIQUSH_ERROR_TOO_FEW_DEVICES:      http.StatusServiceUnavailable,
+	UNIQUSH_ERROR_ENCRYPTION_FAILED:    http.StatusInternalServerError,
+	UNIQUSH_ERROR_SIGNING_FAILED:       http.StatusInternalServerError,
+	UNIQUSH_ERROR_FIELD_LIMIT_EXCEEDED: http.StatusRequestEntityTooLarge,
+	UNIQUSH_ERROR_BATCH_TIME_LIMIT:     http.StatusGatewayTimeout,
+	UNIQUSH_ERROR_MEMORY_PRESSURE:      http.StatusServiceUnavailable,
+	UNIQUSH_ERROR_BAD_SAMPLE_PERCENT:   http.StatusBadRequest,
+
+	UNIQUSH_ERROR_BUILD_PUSH_SERVICE_PROVIDER:  http.StatusBadRequest,
+	UNIQUSH_ERROR_UPDATE_PUSH_SERVICE_PROVIDER: http.StatusInternalServerError,
+
+	UNIQUSH_ERROR_BAD_DELIVERY_POINT:    http.StatusBadRequest,
+	UNIQUSH_ERROR_BUILD_DELIVERY_POINT:  http.StatusBadRequest,
+	UNIQUSH_ERROR_UPDATE_DELIVERY_POINT: http.StatusInternalServerError,
+
+	UNIQUSH_ERROR_CANNOT_GET_SERVICE:           http.StatusBadRequest,
+	UNIQUSH_ERROR_CANNOT_GET_SUBSCRIBER:        http.StatusBadRequest,
+	UNIQUSH_ERROR_CANNOT_GET_DELIVERY_POINT_ID: http.StatusBadRequest,
+
+	UNIQUSH_ERROR_NO_DEVICE:                http.StatusNotFound,
+	UNIQUSH_ERROR_NO_DELIVERY_POINT:        http.StatusNotFound,
+	UNIQUSH_ERROR_NO_PUSH_SERVICE_PROVIDER: http.StatusNotFound,
+	UNIQUSH_ERROR_NO_SUBSCRIBER:            http.StatusNotFound,
+	UNIQUSH_ERROR_CANNOT_GET_GROUP:         http.StatusNotFound,
+	UNIQUSH_ERROR_NO_PUSH_SERVICE_TYPE:     http.StatusNotFound,
+}
+
+// HTTPStatusOf returns the HTTP status equivalent to the code of a response (e.g. 410 for UNIQUSH_ERROR_UNREGISTERED), or 500 for an unknown code.
+func HTTPStatusOf(code string) int {
+	if status, ok := httpStatuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
 // APIResponseDetails is used to represent responses of various APIs. Different APIs use different subsets of fields.
 type APIResponseDetails struct {
 	RequestID           *string `json:"requestId,omitempty"`
@@ -42,10 +145,39 @@ type APIResponseDetails struct {
 	Subscriber          *string `json:"subscriber,omitempty"`
 	PushServiceProvider *string `json:"pushServiceProvider,omitempty"`
 	DeliveryPoint       *string `json:"deliveryPoint,omitempty"`
+	PushServiceType     *string `json:"pushServiceType,omitempty"`
 	MessageID           *string `json:"messageId,omitempty"`
 	Code                string  `json:"code"`
 	ErrorMsg            *string `json:"errorMsg,omitempty"`
 	ModifiedDp          bool    `json:"modifiedDp,omitempty"`
+	// NextAttempt is the unix timestamp of the next retry of a push which is waiting to be retried.
+	NextAttempt *int64 `json:"nextAttempt,omitempty"`
+	// RetrySchedule is the unix timestamps of the planned retries of a push which is waiting to be retried, starting with NextAttempt, if uniqush.retry_schedule is set.
+	// The later retries are only sent if the earlier ones fail, and the push service may ask for them to be delayed.
+	RetrySchedule []int64 `json:"retrySchedule,omitempty"`
+	// Retries is the number of retries of the push to the delivery point which were already sent, for a push which is waiting to be retried or which won't be retried again.
+	Retries *int `json:"retries,omitempty"`
+	// LatencyMs is the number of milliseconds between the request to push and the final result of the push to the delivery point, including the backoff of any retries.
+	LatencyMs *int64 `json:"latencyMs,omitempty"`
+	// RawResponse is the response of the external push service to the push, if record_raw_responses is enabled and the push service type supports it.
+	RawResponse *APIRawResponse `json:"rawResponse,omitempty"`
+	// AdjustedFields are the fields of the notification which were truncated or dropped to fit the limits of the push service (see field_limits).
+	AdjustedFields []string `json:"adjustedFields,omitempty"`
+	// HTTPStatus is the HTTP status equivalent to Code (see HTTPStatusOf), so that a REST frontend can respond with it directly. It is set by the handlers of the responses of the REST API.
+	HTTPStatus int `json:"httpStatus,omitempty"`
+}
+
+// APIRawResponse is the unparsed response of an external push service, for debugging.
+type APIRawResponse struct {
+	StatusCode int    `json:"statusCode"`
+	Body       string `json:"body"`
+}
+
+func apiRawResponseOf(raw *push.RawResponse) *APIRawResponse {
+	if raw == nil {
+		return nil
+	}
+	return &APIRawResponse{StatusCode: raw.StatusCode, Body: raw.Body}
 }
 
 // PreviewAPIResponseDetails represents the response of /preview. It contains a representation of the payload that would be sent to external push services
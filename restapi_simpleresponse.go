@@ -46,6 +46,7 @@ func newAPISimpleResponse(apiType string) APISimpleResponse {
 
 // AddDetailsToHandler will set the only response's status and details.
 func (handler *APISimpleResponseHandler) AddDetailsToHandler(v APIResponseDetails) {
+	v.HTTPStatus = HTTPStatusOf(v.Code)
 	if v.Code == UNIQUSH_SUCCESS {
 		handler.response.Status = StatusSuccess
 	} else {
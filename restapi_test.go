@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http/httptest"
 	"testing"
 
 	"github.com/uniqush/uniqush-push/testutil"
@@ -58,3 +59,31 @@ func TestValidateLegacyService(t *testing.T) {
 	err := validateSubscribers([]string{legacyName})
 	testutil.ExpectEquals(t, nil, err, "expected valid for "+legacyName)
 }
+
+func TestRequestIDOf(t *testing.T) {
+	r := httptest.NewRequest("POST", PushNotificationURL, nil)
+	r.Header.Set(RequestIDHeader, "caller-123")
+	testutil.ExpectEquals(t, "caller-123", requestIDOf(r), "expected the request ID chosen by the caller")
+
+	r.Header.Set(RequestIDHeader, "has spaces")
+	if reqID := requestIDOf(r); reqID == "has spaces" || reqID == "" {
+		t.Errorf("Expected a random request ID instead of an invalid one, got %q", reqID)
+	}
+	r.Header.Del(RequestIDHeader)
+	if requestIDOf(r) == "" {
+		t.Errorf("Expected a random request ID without %s", RequestIDHeader)
+	}
+}
+
+func TestHTTPStatusOf(t *testing.T) {
+	testutil.ExpectEquals(t, 200, HTTPStatusOf(UNIQUSH_SUCCESS), "unexpected status for a delivered push")
+	testutil.ExpectEquals(t, 410, HTTPStatusOf(UNIQUSH_UPDATE_UNSUBSCRIBE), "unexpected status for an unsubscribed delivery point")
+	testutil.ExpectEquals(t, 429, HTTPStatusOf(UNIQUSH_PUSH_RETRYING), "unexpected status for a push waiting to be retried")
+	testutil.ExpectEquals(t, 503, HTTPStatusOf(UNIQUSH_ERROR_FAILED_RETRY), "unexpected status for a push which failed every retry")
+	testutil.ExpectEquals(t, 404, HTTPStatusOf(UNIQUSH_ERROR_NO_DEVICE), "unexpected status for a subscriber without devices")
+	testutil.ExpectEquals(t, 500, HTTPStatusOf("UNIQUSH_UNKNOWN"), "unexpected status for an unknown code")
+
+	handler := newPushResponseHandler(nil)
+	handler.AddDetailsToHandler(APIResponseDetails{Code: UNIQUSH_ERROR_UNREGISTERED})
+	testutil.ExpectEquals(t, 410, handler.response.FailureDetails[0].HTTPStatus, "expected the push response to include the status of each result")
+}
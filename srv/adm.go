@@ -36,6 +36,8 @@ import (
 const (
 	admTokenURL   string = "https://api.amazon.com/auth/O2/token"
 	admServiceURL string = "https://api.amazon.com/messaging/registrations/"
+	// admMaxConsolidationKeyLength is the maximum length of the consolidationKey of a message, in characters.
+	admMaxConsolidationKeyLength = 64
 )
 
 type pspLockResponse struct {
@@ -354,7 +356,11 @@ func admSinglePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, data [
 				}
 			}
 			retryDuration := time.Duration(retrySecond) * time.Second
-			err = push.NewRetryError(psp, dp, notif, retryDuration)
+			category := push.RetryCategoryProvider
+			if resp.StatusCode == 429 {
+				category = push.RetryCategoryRateLimited
+			}
+			err = push.NewRetryErrorWithCategory(psp, dp, notif, retryDuration, category)
 			return id, err
 		}
 
@@ -378,7 +384,7 @@ func admSinglePush(psp *push.PushServiceProvider, dp *push.DeliveryPoint, data [
 			err = push.NewBadDeliveryPointWithDetails(dp, "InvalidRegistrationId")
 		case "accesstokenexpired":
 			// retry would fix it.
-			err = push.NewRetryError(psp, dp, notif, 10*time.Second)
+			err = push.NewRetryErrorWithCategory(psp, dp, notif, 10*time.Second, push.RetryCategoryAuth)
 		default:
 			err = push.NewErrorf("%v: %v", resp.StatusCode, fail.Reason)
 		}
@@ -415,6 +421,11 @@ func (adm *admPushService) notifToJSON(notif *push.Notification) ([]byte, push.E
 	return data, nil
 }
 
+// FieldLimits returns the maximum length of the collapse key, which is sent as the consolidationKey of the message.
+func (adm *admPushService) FieldLimits(notif *push.Notification) map[string]int {
+	return map[string]int{push.CollapseKey: admMaxConsolidationKeyLength}
+}
+
 func (adm *admPushService) Preview(notif *push.Notification) ([]byte, push.Error) {
 	return adm.notifToJSON(notif)
 }
@@ -7,6 +7,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/uniqush/uniqush-push/push"
 )
 
 // CloseTimeout is the timeout for closing inactive APNs binary API (encrypted TCP) connections.
@@ -50,7 +52,8 @@ type workerRequest struct {
 }
 
 // NewPool creates a thread with numWorkers workers, which will wait until they are first needed to open a connection.
-func NewPool(manager ConnManager, numWorkers int, maxWaitTime int) *Pool {
+// Each payload sent is recorded in connections, as either reusing a connection or opening one.
+func NewPool(manager ConnManager, numWorkers int, maxWaitTime int, connections *push.ConnectionPoolCounter) *Pool {
 	ret := Pool{
 		manager:     manager,
 		isClosed:    false,
@@ -61,7 +64,7 @@ func NewPool(manager ConnManager, numWorkers int, maxWaitTime int) *Pool {
 	// Create exactly numWorkers threads.
 	ret.wg.Add(numWorkers)
 	for i := 0; i < numWorkers; i++ {
-		go poolWorker(&ret.wg, ret.manager, ret.requests, maxWaitTime)
+		go poolWorker(&ret.wg, ret.manager, ret.requests, maxWaitTime, connections)
 	}
 	return &ret
 }
@@ -88,7 +91,7 @@ func (pool *Pool) Push(payload []byte) error {
 }
 
 // poolWorker sends data to APNs. A different connection receives the APNs responses.
-func poolWorker(wg *sync.WaitGroup, manager ConnManager, requests <-chan workerRequest, maxWaitTime int) {
+func poolWorker(wg *sync.WaitGroup, manager ConnManager, requests <-chan workerRequest, maxWaitTime int, connections *push.ConnectionPoolCounter) {
 	defer wg.Done()
 	var conn net.Conn
 	var err error
@@ -113,6 +116,7 @@ func poolWorker(wg *sync.WaitGroup, manager ConnManager, requests <-chan workerR
 		}
 		lastRequestTime = curTime
 
+		reused := conn != nil
 		if conn == nil {
 			// Lazily attempt to open a connection. If that fails, tell the requester that the connection failed.
 			conn, closed, err = manager.NewConn()
@@ -122,6 +126,7 @@ func poolWorker(wg *sync.WaitGroup, manager ConnManager, requests <-chan workerR
 				continue
 			}
 		}
+		connections.Record(reused)
 		deadline := time.Now().Add(time.Duration(maxWaitTime) * time.Second)
 		conn.SetWriteDeadline(deadline)
 		err := writeN(conn, request.Payload)
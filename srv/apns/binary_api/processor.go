@@ -50,6 +50,8 @@ type BinaryPushRequestProcessor struct {
 	poolSize   int
 	reqLock    sync.RWMutex
 	finished   bool
+	// connections counts how often the worker pools reused their connections to APNs.
+	connections push.ConnectionPoolCounter
 
 	// connManagerMaker is called to create a ConnManager for a given push.PushServiceProvider
 	connManagerMaker func(psp *push.PushServiceProvider, resultChan chan<- *common.APNSResult) ConnManager
@@ -92,6 +94,11 @@ func (prp *BinaryPushRequestProcessor) Finalize() {
 	prp.wgFinalize.Wait()
 }
 
+// ConnectionPoolStats returns how many payloads the worker pools sent on a connection to APNs which was already open.
+func (prp *BinaryPushRequestProcessor) ConnectionPoolStats() push.ConnectionPoolStats {
+	return prp.connections.Stats()
+}
+
 // GetMaxPayloadSize returns 2048 (2 kilobytes), the largest payload size supported by the APNs binary provider API.
 func (prp *BinaryPushRequestProcessor) GetMaxPayloadSize() int {
 	// https://developer.apple.com/library/archive/documentation/NetworkingInternet/Conceptual/RemoteNotificationsPG/BinaryProviderAPI.html#//apple_ref/doc/uid/TP40008194-CH13-SW1
@@ -336,7 +343,7 @@ func (prp *BinaryPushRequestProcessor) pushWorkerGroup(psp *push.PushServiceProv
 	// This will create a goroutine listening on each connection it creates, to be sent to us on resultChan.
 	manager := newLoggingConnManager(prp.connManagerMaker(psp, (chan<- *common.APNSResult)(resultChan)), prp.errChan)
 	// There's a pool for each push endpoint.
-	workerpool := NewPool(manager, prp.poolSize, maxWaitTime)
+	workerpool := NewPool(manager, prp.poolSize, maxWaitTime, &prp.connections)
 	defer workerpool.Close()
 
 	workerid := fmt.Sprintf("worker-%v-%v", time.Now().Unix(), rand.Int63())
@@ -47,6 +47,10 @@ type PushRequest struct {
 	Payload   []byte
 	MaxMsgID  uint32
 	Expiry    uint32
+	// CollapseID is the apns-collapse-id of the HTTP/2 API (empty if the notification doesn't collapse). The binary API doesn't support this.
+	CollapseID string
+	// Headers are the headers of the HTTP/2 API set by the notification (see push.HeaderPrefix), which override the headers uniqush-push would send.
+	Headers map[string]string
 
 	// DPList is a list of delivery points of the same length as Devtokens. DPList[i].FixedData["dev_token"] == string(Devtokens[i])
 	DPList  []*push.DeliveryPoint
@@ -33,6 +33,8 @@ type HTTPPushRequestProcessor struct {
 	clients       map[string]HTTPClient
 	clientsLock   sync.RWMutex
 	clientFactory ClientFactory // can be overridden by test
+	// connections counts how often requests reused a pooled connection to APNs.
+	connections push.ConnectionPoolCounter
 }
 
 // NewRequestProcessor returns a new HTTPPushProcessor using net/http DefaultClient connection pool
@@ -53,6 +55,11 @@ func (prp *HTTPPushRequestProcessor) GetMaxPayloadSize() int {
 	return 4096
 }
 
+// ConnectionPoolStats returns how many requests to APNs reused a pooled connection.
+func (prp *HTTPPushRequestProcessor) ConnectionPoolStats() push.ConnectionPoolStats {
+	return prp.connections.Stats()
+}
+
 // GetClient will return the only HTTP client instance for the given psp. That instance uses the credentials and endpoint associated with the given psp.
 func (prp *HTTPPushRequestProcessor) GetClient(psp *push.PushServiceProvider) (HTTPClient, error) {
 	pspName := psp.Name()
@@ -164,6 +171,12 @@ func (prp *HTTPPushRequestProcessor) sendRequests(request *common.PushRequest) {
 		// by setting bundleid to the bundle id of the app.
 		"apns-topic": []string{bundleid},
 	}
+	if request.CollapseID != "" {
+		header["apns-collapse-id"] = []string{request.CollapseID}
+	}
+	for name, value := range request.Headers {
+		header[name] = []string{value}
+	}
 
 	// TODO: Allow specifying http2 addr without string matching heuristics.
 	psp := request.PSP
@@ -192,6 +205,7 @@ func (prp *HTTPPushRequestProcessor) sendRequests(request *common.PushRequest) {
 			continue
 		}
 		httpRequest.Header = header
+		httpRequest = prp.connections.TraceRequest(httpRequest)
 
 		go prp.sendRequest(wg, client, httpRequest, msgID, request.ErrChan, request.ResChan)
 	}
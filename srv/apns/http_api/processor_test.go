@@ -302,3 +302,52 @@ func TestGetMaxPayloadSize(t *testing.T) {
 		t.Fatalf("Wrong max payload, expected `4096`, got `%d`", maxPayloadSize)
 	}
 }
+
+func TestAddRequestPushWithCollapseID(t *testing.T) {
+	requestProcessor := newHTTPRequestProcessor()
+
+	request, errChan, resChan := newPushRequest()
+	request.CollapseID = "score-update"
+	mockAPNSRequest(requestProcessor, func(r *http.Request) (*http.Response, *mockResponse, error) {
+		expectHeaderToHaveValue(t, r, "apns-collapse-id", "score-update")
+		body := newMockResponse([]byte{}, r)
+		response := &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       body,
+		}
+		return response, body, nil
+	})
+
+	requestProcessor.AddRequest(request)
+
+	handleAPNSResultOrEmitTestError(t, resChan, errChan, func(res *common.APNSResult) {
+		if res.MsgID == 0 {
+			t.Fatal("Expected non-zero message id, got zero")
+		}
+	})
+}
+
+func TestAddRequestPushWithHeaders(t *testing.T) {
+	requestProcessor := newHTTPRequestProcessor()
+
+	request, errChan, resChan := newPushRequest()
+	request.Headers = map[string]string{"apns-push-type": "background", "apns-priority": "5"}
+	mockAPNSRequest(requestProcessor, func(r *http.Request) (*http.Response, *mockResponse, error) {
+		expectHeaderToHaveValue(t, r, "apns-push-type", "background")
+		expectHeaderToHaveValue(t, r, "apns-priority", "5")
+		body := newMockResponse([]byte{}, r)
+		response := &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       body,
+		}
+		return response, body, nil
+	})
+
+	requestProcessor.AddRequest(request)
+
+	handleAPNSResultOrEmitTestError(t, resChan, errChan, func(res *common.APNSResult) {
+		if res.MsgID == 0 {
+			t.Fatal("Expected non-zero message id, got zero")
+		}
+	})
+}
@@ -28,6 +28,10 @@ import (
 	"github.com/uniqush/uniqush-push/util"
 )
 
+// maxThreadIDLength is the maximum length of a thread-id (from the uniqush.group parameter) in bytes.
+// APNs doesn't document a limit on thread-id, but payloads are limited to 4096 bytes, so this leaves room for the rest of the payload.
+const maxThreadIDLength = 256
+
 // validateRawAPNSPayload tests that the client-provided JSON payload can be sent to APNs.
 // It converts it to bytes if it is, otherwise it returns a push.Error.
 func validateRawAPNSPayload(payload string) ([]byte, push.Error) {
@@ -87,6 +91,11 @@ func toAPNSPayload(n *push.Notification) ([]byte, push.Error) {
 			alert["launch-image"] = v
 		case "id", "expiry", "ttl":
 			continue
+		case push.GroupKey:
+			if len(v) > maxThreadIDLength {
+				return nil, push.NewBadNotificationWithDetails(fmt.Sprintf("%s is longer than %d bytes", push.GroupKey, maxThreadIDLength))
+			}
+			aps["thread-id"] = v
 		default:
 			if strings.HasPrefix(k, "uniqush.") { // keys beginning with "uniqush." are reserved by uniqush.
 				continue
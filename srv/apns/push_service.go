@@ -48,8 +48,13 @@ import (
 
 const (
 	maxNrConn int = 13
+	// maxCollapseIDLength is the maximum length of the apns-collapse-id header, in bytes.
+	maxCollapseIDLength = 64
 )
 
+// forwardedHeaders are the headers of the HTTP/2 API which can be set with push.HeaderPrefix. They override the headers uniqush-push would send.
+var forwardedHeaders = []string{"apns-push-type", "apns-expiration", "apns-priority", "apns-collapse-id", "apns-id"}
+
 // pushService is the APNs push service. It implements the two network protocols for sending requests to APNs and getting the corresponding response.
 type pushService struct {
 	binaryRequestProcessor common.PushRequestProcessor
@@ -83,6 +88,19 @@ func (ps *pushService) Finalize() {
 	ps.httpRequestProcessor.Finalize()
 }
 
+// ConnectionPoolStats returns the combined connection pool stats of the binary and HTTP/2 APIs.
+func (ps *pushService) ConnectionPoolStats() push.ConnectionPoolStats {
+	var stats push.ConnectionPoolStats
+	for _, processor := range []common.PushRequestProcessor{ps.binaryRequestProcessor, ps.httpRequestProcessor} {
+		if reporter, ok := processor.(push.ConnectionPoolStatsReporter); ok {
+			processorStats := reporter.ConnectionPoolStats()
+			stats.Reused += processorStats.Reused
+			stats.Opened += processorStats.Opened
+		}
+	}
+	return stats
+}
+
 func (ps *pushService) SetErrorReportChan(errChan chan<- push.Error) {
 	ps.errChan = errChan
 	ps.binaryRequestProcessor.SetErrorReportChan(errChan)
@@ -228,6 +246,27 @@ func (ps *pushService) Preview(notif *push.Notification) ([]byte, push.Error) {
 
 // Push will read all of the delivery points to send to from dpQueue and send responses on resQueue before closing the channel. If the notification data is invalid,
 // it will send only one response.
+// usesHTTP2 returns true if notif is sent with the HTTP/2 API (uniqush.http2=1) instead of the binary API.
+func usesHTTP2(notif *push.Notification) bool {
+	return notif.Data["uniqush.http2"] == "1"
+}
+
+// ForwardedHeaders returns the headers which can be set with push.HeaderPrefix. Only the HTTP/2 API has headers.
+func (ps *pushService) ForwardedHeaders(notif *push.Notification) []string {
+	if !usesHTTP2(notif) {
+		return nil
+	}
+	return forwardedHeaders
+}
+
+// FieldLimits returns the maximum length of the collapse key, which is sent as the apns-collapse-id header of the HTTP/2 API. The binary API ignores the collapse key.
+func (ps *pushService) FieldLimits(notif *push.Notification) map[string]int {
+	if !usesHTTP2(notif) {
+		return nil
+	}
+	return map[string]int{push.CollapseKey: maxCollapseIDLength}
+}
+
 func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
 	defer close(resQueue)
 	// Profiling
@@ -238,7 +277,7 @@ func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.
 	req.Payload, err = toAPNSPayload(notif)
 
 	var requestProcessor common.PushRequestProcessor
-	if http2, ok := notif.Data["uniqush.http2"]; ok && http2 == "1" {
+	if usesHTTP2(notif) {
 		requestProcessor = ps.httpRequestProcessor
 	} else {
 		requestProcessor = ps.binaryRequestProcessor
@@ -257,6 +296,13 @@ func (ps *pushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.
 	if err == nil && len(req.Payload) > maxPayloadSize {
 		err = push.NewBadNotificationWithDetails(fmt.Sprintf("payload is too large: %d > %d", len(req.Payload), maxPayloadSize))
 	}
+	if requestProcessor == ps.httpRequestProcessor {
+		// APNs rejects a longer apns-collapse-id, so the push is sent without collapsing instead. The backend logs the fields which exceed FieldLimits.
+		if collapseID := notif.Data[push.CollapseKey]; len(collapseID) <= maxCollapseIDLength {
+			req.CollapseID = collapseID
+		}
+		req.Headers = notif.Headers()
+	}
 
 	if err != nil {
 		// Drain the list of delivery points to send to, until the channel is closed. This allows the caller to proceed past the first step.
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
 
@@ -19,6 +20,8 @@ type MockPushRequestProcessor struct {
 	status      uint8
 	didFinalize bool
 	errChan     chan<- push.Error
+	lock        sync.Mutex
+	requests    []*common.PushRequest
 }
 
 func newMockRequestProcessor(status uint8) *MockPushRequestProcessor {
@@ -31,6 +34,9 @@ func newMockRequestProcessor(status uint8) *MockPushRequestProcessor {
 var _ common.PushRequestProcessor = &MockPushRequestProcessor{}
 
 func (mockPRP *MockPushRequestProcessor) AddRequest(request *common.PushRequest) {
+	mockPRP.lock.Lock()
+	mockPRP.requests = append(mockPRP.requests, request)
+	mockPRP.lock.Unlock()
 	close(request.ErrChan) // Would have contents only for an invalid request. Send nothing.
 	go func() {
 		for i := range request.DPList {
@@ -203,6 +209,37 @@ func TestPushMultiple(t *testing.T) {
 	service.Finalize()
 }
 
+// TestPushLongCollapseID tests that a msggroup which is too long for apns-collapse-id is sent without collapsing, instead of failing the push.
+func TestPushLongCollapseID(t *testing.T) {
+	psp, mockRequestProcessor, service, _ := commonAPNSMocks(APNSSuccess)
+	for _, collapseID := range []string{"score-update", strings.Repeat("x", maxCollapseIDLength+1)} {
+		notif := createNotification("Hello World")
+		notif.Data["uniqush.http2"] = "1"
+		notif.Data[push.CollapseKey] = collapseID
+		resQueue := make(chan *push.Result)
+		wg := new(sync.WaitGroup)
+		wg.Add(2)
+		dpQueue := make(chan *push.DeliveryPoint)
+		go asyncCreateDPQueue(wg, dpQueue, hex.EncodeToString([]byte("FakeDevToken")), "unusedsubscriber")
+		go asyncPush(wg, service, psp, dpQueue, resQueue, notif)
+		for res := range resQueue {
+			if res.Err != nil {
+				t.Fatalf("Encountered error %v\n", res.Err)
+			}
+		}
+		wg.Wait()
+	}
+	service.Finalize()
+
+	mockRequestProcessor.lock.Lock()
+	defer mockRequestProcessor.lock.Unlock()
+	if len(mockRequestProcessor.requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(mockRequestProcessor.requests))
+	}
+	testutil.ExpectEquals(t, "score-update", mockRequestProcessor.requests[0].CollapseID, "expected the collapse id to be sent")
+	testutil.ExpectEquals(t, "", mockRequestProcessor.requests[1].CollapseID, "expected a collapse id which is too long to be omitted")
+}
+
 // TODO: Add tests of uniqush generating expected errors for the various payload size limits. (2048 for binary, 4096 for HTTP2, 5120 for VoIP + HTTP2
 
 // TestPushUnsubscribe tests that an UnsubscribeUpdate should be generated from the corresponding apns status code.
@@ -470,3 +507,20 @@ func TestBuildPushServiceProviderFromMapExtraData(t *testing.T) {
 	expectMapEquals(t, expectedFixedData, dp.FixedData, "dp.FixedData")
 	expectMapEquals(t, expectedVolatileData, dp.VolatileData, "dp.VolatileData")
 }
+
+func TestToAPNSPayloadWithGroup(t *testing.T) {
+	notification := &push.Notification{
+		Data: map[string]string{"msg": "hello world", push.GroupKey: "chat-1"},
+	}
+	payload, err := toAPNSPayload(notification)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testutil.ExpectJSONIsEquivalent(t, []byte(`{"aps":{"alert":{"body":"hello world"},"thread-id":"chat-1"}}`), payload)
+
+	notification.Data[push.GroupKey] = strings.Repeat("x", maxThreadIDLength+1)
+	_, err = toAPNSPayload(notification)
+	if _, ok := err.(*push.BadNotification); !ok {
+		t.Errorf("Expected a BadNotification for a group which is too long, got %#v", err)
+	}
+}
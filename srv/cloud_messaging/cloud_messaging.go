@@ -32,6 +32,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/uniqush/uniqush-push/push"
@@ -61,6 +62,10 @@ type PushServiceBase struct {
 	serviceURL string
 	// const: "gcm" or "fcm", for API requests to uniqush and API responses, as well as logging.
 	pushServiceName string
+	// connections counts how often requests reused a connection from the client's pool.
+	connections *push.ConnectionPoolCounter
+	// recordRawResponses is 1 if the results of pushes should include the raw responses of GCM/FCM (accessed atomically).
+	recordRawResponses *int32
 }
 
 // Finalize will close all open HTTPS connections to GCM/FCM.
@@ -72,6 +77,20 @@ func (psb *PushServiceBase) Finalize() {
 	}
 }
 
+// ConnectionPoolStats returns how many requests to GCM/FCM reused a connection from the client's pool.
+func (psb *PushServiceBase) ConnectionPoolStats() push.ConnectionPoolStats {
+	return psb.connections.Stats()
+}
+
+// SetRecordRawResponses enables or disables including the status and body of the responses of GCM/FCM in the results of pushes, for debugging.
+func (psb *PushServiceBase) SetRecordRawResponses(record bool) {
+	var value int32
+	if record {
+		value = 1
+	}
+	atomic.StoreInt32(psb.recordRawResponses, value)
+}
+
 // OverrideClient will override the client interface. It is used only for unit testing.
 func (psb *PushServiceBase) OverrideClient(client HTTPClient) {
 	psb.client = client
@@ -101,6 +120,8 @@ func MakePushServiceBase(initialism string, rawPayloadKey string, rawNotificatio
 		rawNotificationKey: rawNotificationKey,
 		serviceURL:         serviceURL,
 		pushServiceName:    pushServiceName,
+		connections:        new(push.ConnectionPoolCounter),
+		recordRawResponses: new(int32),
 	}
 }
 
@@ -122,6 +143,10 @@ func (psb *PushServiceBase) BuildDeliveryPointFromMap(kv map[string]string, dp *
 	return nil
 }
 
+// maxTagLength is the maximum length of the tag (from the uniqush.group parameter) of a notification in bytes.
+// GCM/FCM don't document a limit on tags, but messages are limited to 4096 bytes, so this leaves room for the rest of the message.
+const maxTagLength = 256
+
 // CMCommonData contains common fields of HTTP API requests to GCM or FCM
 type CMCommonData struct {
 	RegIDs         []string `json:"registration_ids"`
@@ -226,6 +251,15 @@ func (psb *PushServiceBase) ToCMPayload(notif *push.Notification, regIds []strin
 		if err != nil {
 			return nil, err
 		}
+		if group, ok := postData[push.GroupKey]; ok {
+			if len(group) > maxTagLength {
+				return nil, push.NewBadNotificationWithDetails(fmt.Sprintf("%s is longer than %d bytes", push.GroupKey, maxTagLength))
+			}
+			// A tag in the raw notification takes precedence.
+			if _, hasTag := notification["tag"]; !hasTag {
+				notification["tag"] = group
+			}
+		}
 		payload.Notification = notification
 	}
 	if rawData, ok := postData[psb.rawPayloadKey]; ok {
@@ -307,7 +341,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 	req.Header.Set("Content-Type", "application/json")
 
 	// Perform a request, using a connection from the connection pool of a shared http.Client instance.
-	r, e2 := psb.client.Do(req)
+	r, e2 := psb.client.Do(psb.connections.TraceRequest(req))
 	if r != nil {
 		defer r.Body.Close()
 	}
@@ -337,6 +371,14 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		}
 		return
 	}
+	// With raw responses recorded, each result of this request includes the status and body of the response.
+	var raw *push.RawResponse
+	if atomic.LoadInt32(psb.recordRawResponses) != 0 {
+		body, _ := ioutil.ReadAll(r.Body)
+		raw = push.NewRawResponse(r.StatusCode, body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	send := withRawResponse(resQueue, raw)
 	// TODO: How does this work if there are multiple delivery points in one request to GCM/FCM?
 	newAuthToken := r.Header.Get("Update-Client-Auth")
 	if newAuthToken != "" && apikey != newAuthToken {
@@ -345,7 +387,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		res.Provider = psp
 		res.Content = notif
 		res.Err = push.NewPushServiceProviderUpdate(psp)
-		resQueue <- res
+		send(res)
 	}
 
 	switch r.StatusCode {
@@ -357,9 +399,9 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 			res.Provider = psp
 			res.Content = notif
 			res.Destination = dp
-			err := push.NewRetryError(psp, dp, notif, after)
+			err := push.NewRetryErrorWithCategory(psp, dp, notif, after, push.RetryCategoryProvider)
 			res.Err = err
-			resQueue <- res
+			send(res)
 		}
 		return
 	case 401:
@@ -368,7 +410,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		res.Provider = psp
 		res.Content = notif
 		res.Err = err
-		resQueue <- res
+		send(res)
 		return
 	case 400:
 		err := push.NewBadNotificationWithDetails(fmt.Sprintf("push notification payload rejected by %s", psb.initialism))
@@ -376,7 +418,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		res.Provider = psp
 		res.Content = notif
 		res.Err = err
-		resQueue <- res
+		send(res)
 		return
 	}
 
@@ -386,7 +428,7 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		res.Provider = psp
 		res.Content = notif
 		res.Err = push.NewErrorf("Failed to read %s response: %v", psb.initialism, err)
-		resQueue <- res
+		send(res)
 		return
 	}
 
@@ -398,14 +440,15 @@ func (psb *PushServiceBase) multicast(psp *push.PushServiceProvider, dpList []*p
 		res.Provider = psp
 		res.Content = notif
 		res.Err = push.NewErrorf("Failed to decode %s response: %v", psb.initialism, err)
-		resQueue <- res
+		send(res)
 		return
 	}
 
-	psb.handleCMMulticastResults(psp, dpList, resQueue, notif, result.Results)
+	psb.handleCMMulticastResults(psp, dpList, resQueue, notif, result.Results, raw)
 }
 
-func (psb *PushServiceBase) handleCMMulticastResults(psp *push.PushServiceProvider, dpList []*push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification, results []map[string]string) {
+func (psb *PushServiceBase) handleCMMulticastResults(psp *push.PushServiceProvider, dpList []*push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification, results []map[string]string, raw *push.RawResponse) {
+	send := withRawResponse(resQueue, raw)
 	for i, r := range results {
 		if i >= len(dpList) {
 			break
@@ -419,28 +462,28 @@ func (psb *PushServiceBase) handleCMMulticastResults(psp *push.PushServiceProvid
 				res.Provider = psp
 				res.Content = notif
 				res.Destination = dp
-				res.Err = push.NewRetryError(psp, dp, notif, after)
-				resQueue <- res
+				res.Err = push.NewRetryErrorWithCategory(psp, dp, notif, after, push.RetryCategoryProvider)
+				send(res)
 			case "NotRegistered":
 				res := new(push.Result)
 				res.Provider = psp
 				res.Err = push.NewUnsubscribeUpdate(psp, dp)
 				res.Content = notif
 				res.Destination = dp
-				resQueue <- res
+				send(res)
 			case "InvalidRegistration":
 				res := new(push.Result)
 				res.Err = push.NewInvalidRegistrationUpdate(psp, dp)
 				res.Content = notif
 				res.Destination = dp
-				resQueue <- res
+				send(res)
 			default:
 				res := new(push.Result)
 				res.Err = push.NewErrorf("FCMError: %v", errmsg)
 				res.Provider = psp
 				res.Content = notif
 				res.Destination = dp
-				resQueue <- res
+				send(res)
 			}
 		}
 		if newregid, ok := r["registration_id"]; ok {
@@ -450,7 +493,7 @@ func (psb *PushServiceBase) handleCMMulticastResults(psp *push.PushServiceProvid
 			res.Provider = psp
 			res.Content = notif
 			res.Destination = dp
-			resQueue <- res
+			send(res)
 		}
 		if msgid, ok := r["message_id"]; ok {
 			res := new(push.Result)
@@ -458,11 +501,19 @@ func (psb *PushServiceBase) handleCMMulticastResults(psp *push.PushServiceProvid
 			res.Content = notif
 			res.Destination = dp
 			res.MsgID = fmt.Sprintf("%v:%v", psp.Name(), msgid)
-			resQueue <- res
+			send(res)
 		}
 	}
 }
 
+// withRawResponse returns a function which sends results to resQueue with their RawResponse set to raw.
+func withRawResponse(resQueue chan<- *push.Result, raw *push.RawResponse) func(*push.Result) {
+	return func(res *push.Result) {
+		res.RawResponse = raw
+		resQueue <- res
+	}
+}
+
 // Push sends a push notification to 1 or more delivery points in dpQueue asynchronously, and sends results on resQueue.
 func (psb *PushServiceBase) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
 
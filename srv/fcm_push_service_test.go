@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 	"testing"
 
@@ -121,6 +122,45 @@ func TestFCMPushSingle(t *testing.T) {
 	assertExpectedFCMRequest(t, fcmMockResponse.request, expectedRegID, expectedPayload)
 }
 
+// TestFCMRecordRawResponses tests that results include the raw response of FCM only when recording raw responses is enabled.
+func TestFCMRecordRawResponses(t *testing.T) {
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello"}
+	mockHTTPResponse := []byte(`{"multicast_id":777,"canonical_ids":0,"success":1,"failure":0,"results":[{"message_id":"UID12345"}]}`)
+	for _, record := range []bool{false, true} {
+		psp, _, service, _ := commonFCMMocks(200, mockHTTPResponse, map[string]string{}, nil)
+		service.SetRecordRawResponses(record)
+		dpQueue := make(chan *push.DeliveryPoint)
+		resQueue := make(chan *push.Result)
+		wg := new(sync.WaitGroup)
+		wg.Add(2)
+		go fcmAsyncCreateDPQueue(wg, dpQueue, "mockregid", "unusedsubscriber1")
+		go fcmAsyncPush(wg, service, psp, dpQueue, resQueue, notif)
+		for res := range resQueue {
+			if res.Err != nil {
+				t.Fatalf("Encountered error %v\n", res.Err)
+			}
+			if !record {
+				if res.RawResponse != nil {
+					t.Errorf("Expected no raw response when not recording, got %#v", res.RawResponse)
+				}
+				continue
+			}
+			if res.RawResponse == nil {
+				t.Fatal("Expected a raw response when recording")
+			}
+			if res.RawResponse.StatusCode != 200 || res.RawResponse.Body != string(mockHTTPResponse) {
+				t.Errorf("Unexpected raw response %#v", res.RawResponse)
+			}
+			if !strings.HasSuffix(res.MsgID, ":UID12345") {
+				t.Errorf("Expected the response to still be parsed, got message id %q", res.MsgID)
+			}
+		}
+		wg.Wait()
+		service.Finalize()
+	}
+}
+
 // TestFCMPushSingleError tests the ability to send a single push with an error error, and shut down cleanly.
 func TestFCMPushSingleError(t *testing.T) {
 	expectedRegID := "mockregid"
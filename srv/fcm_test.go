@@ -123,3 +123,13 @@ func TestFCMPushServiceName(t *testing.T) {
 		t.Errorf("Expected %s, got %s", "fcm", name)
 	}
 }
+
+func TestToFCMPayloadUsesGroupForTag(t *testing.T) {
+	postData := map[string]string{
+		push.GroupKey:              "chat-1",
+		"uniqush.notification.fcm": `{"body":"text"}`,
+	}
+	regIds := []string{"CAFE1-FF"}
+	expectedPayload := `{"registration_ids":["CAFE1-FF"],"time_to_live":3600,"notification":{"body":"text","tag":"chat-1"}}`
+	testToFCMPayload(t, postData, regIds, expectedPayload)
+}
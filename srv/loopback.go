@@ -0,0 +1,170 @@
+/*
+ * Copyright 2011 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package srv
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/uniqush/uniqush-push/push"
+)
+
+// LoopbackPushServiceName is the name of the loopback push service type, which records pushes in memory instead of sending them to an external push service.
+const LoopbackPushServiceName = "loopback"
+
+// defaultLoopbackMaxPushes is the number of recorded pushes kept by default (see max_pushes in the [loopback] section).
+const defaultLoopbackMaxPushes = 1000
+
+// LoopbackPush is a push to a delivery point recorded by the loopback push service type.
+type LoopbackPush struct {
+	Service             string `json:"service"`
+	Subscriber          string `json:"subscriber"`
+	PushServiceProvider string `json:"pushServiceProvider"`
+	DeliveryPoint       string `json:"deliveryPoint"`
+	// PushServiceType is the push service type of the delivery point, which isn't "loopback" for the pushes of services routed to the loopback push service type.
+	PushServiceType string            `json:"pushServiceType"`
+	MsgID           string            `json:"msgId"`
+	Data            map[string]string `json:"data"`
+}
+
+// loopbackPushService is a push service type for end-to-end tests. Every push to it succeeds, and is recorded until ClearLoopbackPushes is called.
+// Only the most recent maxPushes pushes are kept, so that a loopback push service which is never cleared doesn't keep growing.
+type loopbackPushService struct {
+	lock      sync.Mutex
+	pushes    []LoopbackPush
+	nextID    int
+	maxPushes int
+	// endpoint is true if /loopbackpushes is served even if no service is routed to the loopback push service type (see LoopbackEndpointEnabled).
+	endpoint bool
+}
+
+var _ push.PushServiceType = &loopbackPushService{}
+
+var loopback = &loopbackPushService{maxPushes: defaultLoopbackMaxPushes}
+
+// InstallLoopback registers the only instance of the loopback push service. It is called only once.
+func InstallLoopback() {
+	psm := push.GetPushServiceManager()
+	err := psm.RegisterPushServiceType(loopback)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to install loopback module: %v", err))
+	}
+}
+
+// LoopbackPushes returns the pushes recorded by the loopback push service type, oldest first.
+func LoopbackPushes() []LoopbackPush {
+	loopback.lock.Lock()
+	defer loopback.lock.Unlock()
+	return append([]LoopbackPush(nil), loopback.pushes...)
+}
+
+// LoopbackEndpointEnabled returns true if the [loopback] section of the config file has endpoint=on, so that /loopbackpushes is served for push service providers with pushservicetype=loopback.
+func LoopbackEndpointEnabled() bool {
+	loopback.lock.Lock()
+	defer loopback.lock.Unlock()
+	return loopback.endpoint
+}
+
+// ClearLoopbackPushes forgets the pushes recorded by the loopback push service type (e.g. between tests), and returns them.
+func ClearLoopbackPushes() []LoopbackPush {
+	loopback.lock.Lock()
+	defer loopback.lock.Unlock()
+	pushes := loopback.pushes
+	loopback.pushes = nil
+	return pushes
+}
+
+func (p *loopbackPushService) Finalize() {}
+func (p *loopbackPushService) Name() string {
+	return LoopbackPushServiceName
+}
+func (p *loopbackPushService) SetErrorReportChan(errChan chan<- push.Error) {
+}
+
+// SetPushServiceConfig reads max_pushes and endpoint from the "loopback" section of the config file.
+func (p *loopbackPushService) SetPushServiceConfig(c *push.PushServiceConfig) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if maxPushes, err := c.GetInt("max_pushes"); err == nil && maxPushes > 0 {
+		p.maxPushes = maxPushes
+	}
+	if endpoint, err := c.GetString("endpoint"); err == nil {
+		p.endpoint = endpoint == "on"
+	}
+}
+
+func (p *loopbackPushService) BuildPushServiceProviderFromMap(kv map[string]string, psp *push.PushServiceProvider) error {
+	if service, ok := kv["service"]; ok && len(service) > 0 {
+		psp.FixedData["service"] = service
+	} else {
+		return errors.New("NoService")
+	}
+	// The name distinguishes several loopback push service providers of a service.
+	if name, ok := kv["name"]; ok && len(name) > 0 {
+		psp.FixedData["name"] = name
+	}
+	return nil
+}
+
+func (p *loopbackPushService) BuildDeliveryPointFromMap(kv map[string]string, dp *push.DeliveryPoint) error {
+	err := dp.AddCommonData(kv)
+	if err != nil {
+		return err
+	}
+	if devtoken, ok := kv["devtoken"]; ok && len(devtoken) > 0 {
+		dp.FixedData["devtoken"] = devtoken
+	} else {
+		return errors.New("NoDevToken")
+	}
+	return nil
+}
+
+func (p *loopbackPushService) Preview(notif *push.Notification) ([]byte, push.Error) {
+	return []byte(notif.String()), nil
+}
+
+// Push records a push to each delivery point in dpQueue, and reports it as successful.
+func (p *loopbackPushService) Push(psp *push.PushServiceProvider, dpQueue <-chan *push.DeliveryPoint, resQueue chan<- *push.Result, notif *push.Notification) {
+	for dp := range dpQueue {
+		data := make(map[string]string, len(notif.Data))
+		for k, v := range notif.Data {
+			data[k] = v
+		}
+		p.lock.Lock()
+		p.nextID++
+		msgID := fmt.Sprintf("%s:%d", LoopbackPushServiceName, p.nextID)
+		if len(p.pushes) >= p.maxPushes {
+			// Forget the oldest push, reusing the same backing array.
+			n := copy(p.pushes, p.pushes[len(p.pushes)-p.maxPushes+1:])
+			p.pushes = p.pushes[:n]
+		}
+		p.pushes = append(p.pushes, LoopbackPush{
+			Service:             psp.FixedData["service"],
+			Subscriber:          dp.FixedData["subscriber"],
+			PushServiceProvider: psp.Name(),
+			DeliveryPoint:       dp.Name(),
+			PushServiceType:     dp.PushServiceName(),
+			MsgID:               msgID,
+			Data:                data,
+		})
+		p.lock.Unlock()
+		resQueue <- &push.Result{Provider: psp, Destination: dp, Content: notif, MsgID: msgID}
+	}
+	close(resQueue)
+}
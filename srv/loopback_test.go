@@ -0,0 +1,84 @@
+package srv
+
+import (
+	"testing"
+
+	"github.com/uniqush/uniqush-push/push"
+	"github.com/uniqush/uniqush-push/testutil"
+)
+
+// TestLoopbackPush tests that the loopback push service records each push as successful, until the pushes are cleared.
+func TestLoopbackPush(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(loopback)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": LoopbackPushServiceName, "service": "myservice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": LoopbackPushServiceName, "service": "myservice", "subscriber": "sub1", "devtoken": "token1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ClearLoopbackPushes()
+	notif := push.NewEmptyNotification()
+	notif.Data = map[string]string{"msg": "hello"}
+	dpQueue := make(chan *push.DeliveryPoint, 1)
+	dpQueue <- dp
+	close(dpQueue)
+	resQueue := make(chan *push.Result, 1)
+	psm.Push(psp, dpQueue, resQueue, notif)
+
+	res := <-resQueue
+	if res.Err != nil {
+		t.Fatalf("Encountered error %v\n", res.Err)
+	}
+	pushes := LoopbackPushes()
+	if len(pushes) != 1 {
+		t.Fatalf("Expected 1 recorded push, got %v", pushes)
+	}
+	testutil.ExpectEquals(t, "sub1", pushes[0].Subscriber, "unexpected subscriber")
+	testutil.ExpectEquals(t, dp.Name(), pushes[0].DeliveryPoint, "unexpected delivery point")
+	testutil.ExpectEquals(t, res.MsgID, pushes[0].MsgID, "expected the recorded push to have the message id of the result")
+	testutil.ExpectEquals(t, "hello", pushes[0].Data["msg"], "unexpected data")
+	testutil.ExpectEquals(t, 1, len(ClearLoopbackPushes()), "expected clearing to return the recorded pushes")
+	testutil.ExpectEquals(t, 0, len(LoopbackPushes()), "expected the pushes to be cleared")
+}
+
+// TestLoopbackMaxPushes tests that the loopback push service only keeps the most recent max_pushes pushes.
+func TestLoopbackMaxPushes(t *testing.T) {
+	psm := push.GetPushServiceManager()
+	psm.RegisterPushServiceType(loopback)
+	psp, err := psm.BuildPushServiceProviderFromMap(map[string]string{"pushservicetype": LoopbackPushServiceName, "service": "myservice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loopback.lock.Lock()
+	loopback.maxPushes = 2
+	loopback.lock.Unlock()
+	defer func() {
+		loopback.lock.Lock()
+		loopback.maxPushes = defaultLoopbackMaxPushes
+		loopback.lock.Unlock()
+	}()
+	ClearLoopbackPushes()
+	for _, token := range []string{"token1", "token2", "token3"} {
+		dp, err := psm.BuildDeliveryPointFromMap(map[string]string{"pushservicetype": LoopbackPushServiceName, "service": "myservice", "subscriber": "sub1", "devtoken": token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		notif := push.NewEmptyNotification()
+		notif.Data = map[string]string{"msg": token}
+		dpQueue := make(chan *push.DeliveryPoint, 1)
+		dpQueue <- dp
+		close(dpQueue)
+		resQueue := make(chan *push.Result, 1)
+		psm.Push(psp, dpQueue, resQueue, notif)
+		<-resQueue
+	}
+	pushes := ClearLoopbackPushes()
+	if len(pushes) != 2 {
+		t.Fatalf("Expected 2 recorded pushes, got %v", pushes)
+	}
+	testutil.ExpectEquals(t, "token2", pushes[0].Data["msg"], "expected the oldest push to be forgotten")
+	testutil.ExpectEquals(t, "token3", pushes[1].Data["msg"], "expected the newest push to be kept")
+}